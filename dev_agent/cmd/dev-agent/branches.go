@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// branchPageSize is the page size requested while listing branches.
+const branchPageSize = 100
+
+// printBranches writes every branch of project as a table, following the
+// server's pagination.
+func printBranches(ctx context.Context, w io.Writer, client *t.MCPClient, project string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BRANCH ID\tPARENT\tAGENT\tSTATUS\tCREATED")
+	cursor := ""
+	for {
+		branches, next, err := client.ListBranches(ctx, project, cursor, branchPageSize)
+		if err != nil {
+			return err
+		}
+		for _, br := range branches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", br.ID, dash(br.ParentID), dash(br.Agent), dash(br.Status), dash(br.CreatedAt))
+		}
+		if next == "" || next == cursor {
+			break
+		}
+		cursor = next
+	}
+	return tw.Flush()
+}
+
+func printProjects(ctx context.Context, w io.Writer, client *t.MCPClient) error {
+	projects, err := client.ListProjects(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tDESCRIPTION")
+	for _, p := range projects {
+		fmt.Fprintf(tw, "%s\t%s\n", p.Name, dash(p.Description))
+	}
+	return tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runAncestry is the lineage of latest for the final report, starting at
+// the run's start branch when it is part of the chain. It is best effort:
+// a broken chain yields what was resolved, a failed lookup nothing.
+func runAncestry(client *t.MCPClient, latest, start string) []map[string]any {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	chain, err := client.GetBranchAncestry(ctx, latest)
+	var broken *t.AncestryError
+	if errors.As(err, &broken) {
+		chain = broken.Chain
+	}
+	if err != nil {
+		logx.Warningf("Could not resolve the ancestry of branch %s: %v", latest, err)
+	}
+	for i, b := range chain {
+		if b.ID == start {
+			chain = chain[i:]
+			break
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return t.AncestrySummary(chain)
+}
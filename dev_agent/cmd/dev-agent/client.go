@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	cfg "dev_agent/internal/config"
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// newMCPClient builds the MCP client from configuration, registering its
+// credentials for redaction first.
+func newMCPClient(conf cfg.AgentConfig) (*t.MCPClient, error) {
+	logx.RegisterSecret(conf.MCPAPIToken)
+	opts := t.MCPClientOptions{
+		APIToken:              conf.MCPAPIToken,
+		Proxy:                 conf.MCPProxyURL,
+		GzipRequests:          conf.MCPGzip,
+		MaxResponseBytes:      conf.MCPMaxResponseBytes,
+		SpillDir:              conf.MCPSpillDir,
+		SkipArgValidation:     conf.MCPSkipArgValidation,
+		UserAgent:             conf.MCPUserAgent,
+		DialTimeout:           conf.MCPConnectTimeout,
+		TLSHandshakeTimeout:   conf.MCPTLSHandshakeTimeout,
+		ResponseHeaderTimeout: conf.MCPResponseHeaderTimeout,
+		MaxRPS:                conf.MCPMaxRPS,
+		MethodRPS:             conf.MCPMethodRPS,
+		BreakerThreshold:      conf.MCPBreakerThreshold,
+		BreakerCooldown:       conf.MCPBreakerCooldown,
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = "dev-agent-go/" + version
+	}
+	if conf.MCPProxyURL != nil {
+		if pass, ok := conf.MCPProxyURL.User.Password(); ok {
+			logx.RegisterSecret(pass)
+		}
+	}
+	if files := conf.MCPTLS; !files.IsZero() {
+		tlsConf, err := t.LoadTLSConfig(files.CACertFile, files.ClientCertFile, files.ClientKeyFile, files.InsecureSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("MCP TLS configuration: %w", err)
+		}
+		if files.InsecureSkipVerify {
+			logx.Warningf("MCP_INSECURE_SKIP_VERIFY is set; the MCP server certificate is not verified.")
+		}
+		opts.TLS = tlsConf
+	}
+	if conf.MCPWireLogFile != "" {
+		wl, err := t.NewWireLog(conf.MCPWireLogFile, t.DefaultWireLogMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("MCP_WIRE_LOG_FILE: %w", err)
+		}
+		opts.WireLog = wl
+	}
+	if len(conf.MCPCommand) > 0 {
+		stdio, err := t.NewStdioTransport(conf.MCPCommand)
+		if err != nil {
+			return nil, fmt.Errorf("MCP_COMMAND: %w", err)
+		}
+		opts.Transport = stdio
+	}
+	return t.NewMCPClientWithOptions(conf.MCPBaseURL, opts), nil
+}
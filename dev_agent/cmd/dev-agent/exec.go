@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+
+	cfg "dev_agent/internal/config"
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// runExec implements `dev-agent exec <tool> --args '<json>'`: a single tool
+// call through the same ToolHandler the orchestrator uses.
+func runExec(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	var envFiles stringList
+	fs.Var(&envFiles, "env-file", "Load KEY=VALUE pairs from this file before validation (repeatable)")
+	noEnvFile := fs.Bool("no-env-file", false, "Do not load the implicit ./.env file")
+	rawArgs := fs.String("args", "{}", "Tool arguments as a JSON object")
+	project := fs.String("project-name", "", "Optional project name override")
+	parent := fs.String("parent-branch-id", "", "Starting branch for lineage tracking")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		logx.Eprintln("usage: dev-agent exec <tool> [--args '<json>']")
+		return 2
+	}
+	tool := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return 2
+	}
+	var probe map[string]any
+	if err := json.Unmarshal([]byte(*rawArgs), &probe); err != nil {
+		logx.Eprintf("--args must be a JSON object: %v\n", err)
+		return 2
+	}
+
+	conf, err := cfg.Load(cfg.LoadOptions{EnvFiles: envFiles, NoDefaultEnvFile: *noEnvFile, MCPOnly: true})
+	if err != nil {
+		logx.Eprintf("Configuration error: %v\n", err)
+		return 1
+	}
+	logx.RegisterSecret(conf.GitHubToken)
+	if *project != "" {
+		conf.ProjectName = *project
+	}
+
+	mcp, err := newMCPClient(conf)
+	if err != nil {
+		logx.Eprintf("Configuration error: %v\n", err)
+		return 1
+	}
+	defer mcp.Close()
+	handler := t.NewToolHandler(mcp, conf.ProjectName, *parent)
+	handler.SetDiffMaxBytes(conf.DiffMaxBytes)
+	handler.SetArtifactMaxBytes(conf.ArtifactMaxBytes)
+	handler.SetOutputMaxChars(conf.OutputMaxChars)
+	handler.SetResultBudget(conf.ResultMaxBytes, conf.ResultDir)
+	handler.SetToolTimeouts(t.ToolTimeouts{ExecuteAgent: conf.ExecuteAgentTimeout, CheckStatus: conf.CheckStatusTimeout, ReadArtifact: conf.ReadArtifactTimeout})
+	handler.SetPollPolicy(t.PollPolicy{Initial: conf.PollInitial, Max: conf.PollMax, Timeout: conf.PollTimeout})
+	handler.SetPollBackoffFactor(conf.PollBackoffFactor)
+	handler.SetMaxConcurrentBranches(conf.MaxConcurrentBranches)
+	handler.SetAllowedAgents(conf.AllowedAgents)
+	handler.SetLegacyErrorPayloads(conf.LegacyErrorPayloads)
+	audit, err := t.NewAuditLog(conf.AuditLogFile, "")
+	if err != nil {
+		logx.Eprintf("AUDIT_LOG_FILE: %v\n", err)
+		return 1
+	}
+	defer audit.Close()
+	handler.SetAuditLog(audit)
+	call := t.ToolCall{ID: "exec", Type: "function"}
+	call.Function.Name = tool
+	call.Function.Arguments = *rawArgs
+	result := handler.Handle(context.Background(), call)
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	logx.Println(string(out))
+	if status, _ := result["status"].(string); status != "success" {
+		return 1
+	}
+	return 0
+}
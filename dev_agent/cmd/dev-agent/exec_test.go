@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/logx"
+	"dev_agent/internal/tools/mcptest"
+)
+
+// execEnv points the config at a fake MCP server and a scratch directory
+// and captures what runExec prints.
+func execEnv(t *testing.T) (*mcptest.FakeServer, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	srv.SetDefaultScript("succeed")
+	t.Setenv("MCP_BASE_URL", srv.URL)
+	t.Setenv("PROJECT_NAME", "demo")
+	t.Setenv("WORKSPACE_DIR", "/home/dev/workspace")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	var stdout, stderr bytes.Buffer
+	logx.SetOutput(&stdout, &stderr)
+	t.Cleanup(func() { logx.SetOutput(os.Stdout, os.Stderr) })
+	return srv, &stdout, &stderr
+}
+
+// execResult decodes the result JSON runExec printed last.
+func execResult(t *testing.T, stdout string) map[string]any {
+	t.Helper()
+	i := strings.LastIndex("\n"+stdout, "\n{\n")
+	if i < 0 {
+		t.Fatalf("no result printed:\n%s", stdout)
+	}
+	var result map[string]any
+	if err := json.Unmarshal([]byte(stdout[i:]), &result); err != nil {
+		t.Fatalf("result does not decode: %v\n%s", err, stdout[i:])
+	}
+	return result
+}
+
+func TestExecUsage(t *testing.T) {
+	_, _, stderr := execEnv(t)
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{nil, "usage: dev-agent exec <tool>"},
+		{[]string{"check_status", "--args", "[1, 2]"}, "--args must be a JSON object"},
+		{[]string{"check_status", "--args", "{"}, "--args must be a JSON object"},
+	}
+	for _, c := range cases {
+		stderr.Reset()
+		if code := runExec(c.args); code != 2 {
+			t.Errorf("runExec(%q) = %d, want 2", c.args, code)
+		}
+		if !strings.Contains(stderr.String(), c.want) {
+			t.Errorf("runExec(%q) stderr = %q, want %q", c.args, stderr.String(), c.want)
+		}
+	}
+}
+
+func TestExecCheckStatus(t *testing.T) {
+	srv, stdout, stderr := execEnv(t)
+	srv.ScriptBranch("b-1", "succeed")
+	// Flags may follow the tool name.
+	code := runExec([]string{"--no-env-file", "check_status", "--args", `{"branch_id": "b-1"}`})
+	if code != 0 {
+		t.Fatalf("exit %d\nstdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+	result := execResult(t, stdout.String())
+	data, _ := result["data"].(map[string]any)
+	if result["status"] != "success" || data["terminal_status"] != "succeeded" {
+		t.Errorf("result = %v", result)
+	}
+	if len(srv.CallsTo("get_branch")) == 0 {
+		t.Error("check_status did not reach the MCP server")
+	}
+}
+
+func TestExecReadArtifact(t *testing.T) {
+	srv, stdout, stderr := execEnv(t)
+	srv.PutArtifact("b-1", "/home/dev/workspace/worklog.md", "all tests pass\n")
+	code := runExec([]string{"read_artifact", "--no-env-file", "--args", `{"branch_id": "b-1", "path": "/home/dev/workspace/worklog.md"}`})
+	if code != 0 {
+		t.Fatalf("exit %d\nstdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+	if !strings.Contains(stdout.String(), "all tests pass") {
+		t.Errorf("artifact content not printed:\n%s", stdout)
+	}
+
+	// Tools added to the registry later are reachable the same way.
+	stdout.Reset()
+	if code := runExec([]string{"list_artifacts", "--no-env-file", "--args", `{"branch_id": "b-1"}`}); code != 0 {
+		t.Fatalf("list_artifacts: exit %d\n%s", code, stdout)
+	}
+	if !strings.Contains(stdout.String(), "/home/dev/workspace/worklog.md") {
+		t.Errorf("listing lacks the artifact:\n%s", stdout)
+	}
+}
+
+// TestExecRemovesSpills checks a reply spilled to disk for being over
+// MCP_MAX_RESPONSE_BYTES is relayed as excerpts and gone once exec exits.
+func TestExecRemovesSpills(t *testing.T) {
+	srv, stdout, stderr := execEnv(t)
+	spillDir := t.TempDir()
+	t.Setenv("MCP_MAX_RESPONSE_BYTES", "1024")
+	t.Setenv("MCP_SPILL_DIR", spillDir)
+	srv.PutArtifact("b-1", "/home/dev/workspace/build.log", "build started\n"+strings.Repeat("compiling\n", 1000)+"build finished\n")
+
+	code := runExec([]string{"read_artifact", "--no-env-file", "--args", `{"branch_id": "b-1", "path": "/home/dev/workspace/build.log"}`})
+	if code != 0 {
+		t.Fatalf("exit %d\nstdout:\n%s\nstderr:\n%s", code, stdout, stderr)
+	}
+	data, _ := execResult(t, stdout.String())["data"].(map[string]any)
+	head, _ := data["head"].(string)
+	tail, _ := data["tail"].(string)
+	if data["local_path"] == nil || !strings.HasPrefix(head, "build started") || !strings.HasSuffix(tail, "build finished\n") {
+		t.Errorf("result data = %v, want the spill path with head and tail excerpts", data)
+	}
+	if entries, _ := os.ReadDir(spillDir); len(entries) != 0 {
+		t.Errorf("spill files left after exit: %v", entries)
+	}
+}
+
+func TestExecErrorResultExitsNonZero(t *testing.T) {
+	srv, stdout, _ := execEnv(t)
+	if code := runExec([]string{"read_artifact", "--no-env-file", "--args", `{"branch_id": "b-1"}`}); code != 1 {
+		t.Errorf("missing path: exit %d, want 1", code)
+	}
+	if result := execResult(t, stdout.String()); result["status"] != "error" {
+		t.Errorf("result = %v", result)
+	}
+	if len(srv.Calls()) != 0 {
+		t.Errorf("invalid arguments reached the MCP server: %v", srv.Calls())
+	}
+
+	stdout.Reset()
+	if code := runExec([]string{"no_such_tool", "--no-env-file"}); code != 1 {
+		t.Errorf("unknown tool: exit %d, want 1", code)
+	}
+	if !strings.Contains(stdout.String(), "UNKNOWN_TOOL") {
+		t.Errorf("unknown tool not reported:\n%s", stdout)
+	}
+}
+
+func TestExecUserAgent(t *testing.T) {
+	srv, stdout, _ := execEnv(t)
+	srv.ScriptBranch("b-1", "succeed")
+	for _, c := range []struct{ env, want string }{
+		{"", "dev-agent-go/" + version},
+		{"acme-ci/7", "acme-ci/7"},
+	} {
+		t.Setenv("MCP_USER_AGENT", c.env)
+		before := len(srv.Calls())
+		if code := runExec([]string{"check_status", "--no-env-file", "--args", `{"branch_id": "b-1"}`}); code != 0 {
+			t.Fatalf("exit %d\n%s", code, stdout)
+		}
+		for _, call := range srv.Calls()[before:] {
+			if got := call.Header.Get("User-Agent"); got != c.want {
+				t.Errorf("MCP_USER_AGENT=%q: %s sent User-Agent %q, want %q", c.env, call.Method, got, c.want)
+			}
+		}
+	}
+}
@@ -2,81 +2,318 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"time"
 
 	b "dev_agent/internal/brain"
 	cfg "dev_agent/internal/config"
+	"dev_agent/internal/logx"
 	o "dev_agent/internal/orchestrator"
 	t "dev_agent/internal/tools"
 )
 
+// version is stamped at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// exitInterrupted is the conventional exit status for a SIGINT-terminated run.
+const exitInterrupted = 130
+
+// exitPublishFailed signals that the workflow ran but its result was not
+// pushed, so callers can tell "nothing to show" from a crashed run.
+const exitPublishFailed = 3
+
+// watchInterrupts implements the double Ctrl+C pattern: the first signal
+// cancels the workflow context so the loop can stop and publish, a second
+// signal received while that shutdown is in progress calls force.
+func watchInterrupts(sigs <-chan os.Signal, cancel context.CancelFunc, force func()) {
+	if _, ok := <-sigs; !ok {
+		return
+	}
+	logx.Eprintln("info: interrupt received; stopping after the current step and publishing (press Ctrl+C again to force exit)")
+	cancel()
+	if _, ok := <-sigs; !ok {
+		return
+	}
+	force()
+}
+
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRunID returns a short identifier that sorts by start time.
+func newRunID() string {
+	var buf [3]byte
+	_, _ = rand.Read(buf[:])
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(buf[:])
+}
+
+// stringList collects the values of a repeatable flag in order.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "exec":
+			os.Exit(runExec(os.Args[2:]))
+		}
+	}
+
+	var envFiles stringList
+	flag.Var(&envFiles, "env-file", "Load KEY=VALUE pairs from this file before validation (repeatable, applied in order; never overrides variables already set)")
+	noEnvFile := flag.Bool("no-env-file", false, "Do not load the implicit ./.env file")
 	task := flag.String("task", "", "User task description")
 	parent := flag.String("parent-branch-id", "", "Parent branch UUID (required)")
 	project := flag.String("project-name", "", "Optional project name override")
 	headless := flag.Bool("headless", false, "Run in headless mode (no chat prints)")
+	reportFD := flag.Int("report-fd", -1, "In headless mode, also write the final JSON report to this open file descriptor and close it")
+	runIDFlag := flag.String("run-id", "", "Run identifier for cross-system correlation (generated when empty)")
+	skipPreflight := flag.Bool("skip-preflight", false, "Skip startup checks (project and parent branch probes, MCP tool discovery, GitHub token check)")
+	skipHealthCheck := flag.Bool("skip-health-check", false, "Do not ping the MCP server at startup (e.g. for air-gapped test runs)")
+	transcriptPath := flag.String("transcript", "", "Append a JSONL transcript of the run to this file, with {run_id} replaced by the run id (view with `dev-agent replay`)")
+	listBranches := flag.Bool("list-branches", false, "Print the project's branches as a table and exit (needs only MCP settings)")
+	listProjects := flag.Bool("list-projects", false, "Print the MCP server's projects and exit (needs only MCP settings)")
+	dryRun := flag.Bool("dry-run", false, "Simulate the MCP server: launches succeed at once with synthetic branch ids and artifacts are read from --fixtures; nothing is pushed")
+	fixtures := flag.String("fixtures", t.DefaultDryRunFixtures, "With --dry-run, serve read_artifact from this directory, keyed by workspace path")
+	resume := flag.Bool("resume", false, "Continue an interrupted run from its state file (pass the run's --run-id, or STATE_FILE); without it an existing state file is an error")
 	flag.Parse()
 
-	conf, err := cfg.FromEnv()
+	runID := *runIDFlag
+	if runID == "" {
+		runID = newRunID()
+	} else if !runIDPattern.MatchString(runID) {
+		logx.Eprintln("--run-id may only contain letters, digits, '.', '_' and '-' (max 64 chars)")
+		os.Exit(1)
+	}
+	logx.Eprintf("run_id: %s\n", runID)
+	logx.SetRunID(runID)
+
+	var reportOut *os.File
+	if *reportFD >= 0 {
+		if !*headless {
+			logx.Eprintln("--report-fd requires --headless")
+			os.Exit(1)
+		}
+		f, err := openReportFD(*reportFD)
+		if err != nil {
+			logx.Eprintf("--report-fd: %v\n", err)
+			os.Exit(1)
+		}
+		reportOut = f
+	}
+
+	conf, err := cfg.Load(cfg.LoadOptions{EnvFiles: envFiles, NoDefaultEnvFile: *noEnvFile, MCPOnly: *listBranches || *listProjects, RunID: runID})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		logx.Eprintf("Configuration error: %v\n", err)
 		os.Exit(1)
 	}
 
+	logx.RegisterSecret(conf.GitHubToken)
+	logx.RegisterSecret(conf.AzureAPIKey)
+
 	if *project != "" {
 		conf.ProjectName = *project
 	}
+	if *listProjects {
+		client, err := newMCPClient(conf)
+		if err == nil {
+			client.SetRunID(runID)
+			err = printProjects(context.Background(), logx.Stdout(), client)
+			client.Close()
+		}
+		if err != nil {
+			logx.Eprintf("--list-projects: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if conf.ProjectName == "" {
-		fmt.Fprintln(os.Stderr, "Project name must be provided via PROJECT_NAME or --project-name")
+		logx.Eprintln("Project name must be provided via PROJECT_NAME or --project-name")
 		os.Exit(1)
 	}
+	if *listBranches {
+		client, err := newMCPClient(conf)
+		if err == nil {
+			client.SetRunID(runID)
+			err = printBranches(context.Background(), logx.Stdout(), client, conf.ProjectName)
+			client.Close()
+		}
+		if err != nil {
+			logx.Eprintf("--list-branches: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if *parent == "" {
-		fmt.Fprintln(os.Stderr, "--parent-branch-id is required")
+		logx.Eprintln("--parent-branch-id is required")
+		os.Exit(1)
+	}
+
+	var mcp *t.MCPClient
+	if *dryRun {
+		mcp = t.NewDryRunClient(*fixtures, conf.WorkspaceDir)
+	} else if mcp, err = newMCPClient(conf); err != nil {
+		logx.Eprintf("Configuration error: %v\n", err)
+		os.Exit(1)
+	}
+	mcp.SetRunID(runID)
+	if conf.MetricsAddr != "" {
+		serveMetrics(conf.MetricsAddr, mcp)
+	}
+	if !*skipHealthCheck {
+		if err := mcp.Ping(context.Background()); err != nil {
+			logx.Eprintf("MCP health check failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	handler := t.NewToolHandler(mcp, conf.ProjectName, *parent)
+	handler.SetDiffMaxBytes(conf.DiffMaxBytes)
+	handler.SetArtifactMaxBytes(conf.ArtifactMaxBytes)
+	handler.SetOutputMaxChars(conf.OutputMaxChars)
+	handler.SetResultBudget(conf.ResultMaxBytes, conf.ResultDir)
+	handler.SetToolTimeouts(t.ToolTimeouts{ExecuteAgent: conf.ExecuteAgentTimeout, CheckStatus: conf.CheckStatusTimeout, ReadArtifact: conf.ReadArtifactTimeout})
+	handler.SetPollPolicy(t.PollPolicy{Initial: conf.PollInitial, Max: conf.PollMax, Timeout: conf.PollTimeout})
+	handler.SetPollBackoffFactor(conf.PollBackoffFactor)
+	handler.SetMaxConcurrentBranches(conf.MaxConcurrentBranches)
+	handler.SetAllowedAgents(conf.AllowedAgents)
+	handler.SetLegacyErrorPayloads(conf.LegacyErrorPayloads)
+	audit, err := t.NewAuditLog(conf.AuditLogFile, runID)
+	if err != nil {
+		logx.Eprintf("AUDIT_LOG_FILE: %v\n", err)
+		os.Exit(1)
+	}
+	defer audit.Close()
+	handler.SetAuditLog(audit)
+	handler.SetStateFile(conf.StateFile, runID)
+	if *resume {
+		if _, err := handler.LoadState(conf.StateFile); errors.Is(err, fs.ErrNotExist) {
+			logx.Eprintf("--resume: no state file %s; pass the --run-id of the run to resume\n", conf.StateFile)
+			os.Exit(1)
+		} else if err != nil {
+			logx.Eprintf("--resume: %v\n", err)
+			os.Exit(1)
+		}
+	} else if _, err := os.Stat(conf.StateFile); err == nil {
+		logx.Eprintf("State file %s already exists; pass --resume to continue that run, or remove the file\n", conf.StateFile)
 		os.Exit(1)
 	}
+	if !*headless {
+		handler.OnProgress(func(label string, pct float64, message string) {
+			logx.Printf("progress> %s %.0f%%: %s\n", label, pct, message)
+		})
+	}
+	if !*skipPreflight {
+		if err := checkProject(context.Background(), mcp, conf.ProjectName); err != nil {
+			logx.Eprintf("Preflight failed: %v\n", err)
+			os.Exit(1)
+		}
+		if err := checkParentBranch(mcp, conf, *parent); err != nil {
+			logx.Eprintf("Preflight failed: %v\n", err)
+			os.Exit(1)
+		}
+		if err := handler.ValidateServerTools(context.Background()); err != nil {
+			logx.Eprintf("Preflight failed: %v\n", err)
+			os.Exit(1)
+		}
+		// A dry run never pushes, so the token is not checked.
+		if !*dryRun {
+			if err := checkGitHubToken(conf.GitHubToken); err != nil {
+				logx.Eprintf("Preflight failed: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
 
 	tsk := *task
 	if tsk == "" {
-		fmt.Printf("you> Enter task description: ")
+		logx.Printf("you> Enter task description: ")
 		reader := bufio.NewReader(os.Stdin)
 		line, _ := reader.ReadString('\n')
 		tsk = strings.TrimSpace(line)
 		if tsk == "" {
-			fmt.Fprintln(os.Stderr, "error: task is required")
+			logx.Eprintln("error: task is required")
 			os.Exit(1)
 		}
 	}
 
 	brain := b.NewLLMBrain(conf.AzureAPIKey, conf.AzureEndpoint, conf.AzureDeployment, conf.AzureAPIVersion, 3)
-	mcp := t.NewMCPClient(conf.MCPBaseURL)
-	handler := t.NewToolHandler(mcp, conf.ProjectName, *parent)
 
-	msgs := o.BuildInitialMessages(tsk, conf.ProjectName, conf.WorkspaceDir, *parent)
+	msgs := o.BuildInitialMessages(tsk, conf.ProjectName, conf.WorkspaceDir, *parent, conf.Artifacts())
 	publish := o.PublishOptions{
-		GitHubToken:    conf.GitHubToken,
-		WorkspaceDir:   conf.WorkspaceDir,
-		ParentBranchID: *parent,
-		ProjectName:    conf.ProjectName,
-		Task:           tsk,
+		GitHubToken:     conf.GitHubToken,
+		WorkspaceDir:    conf.WorkspaceDir,
+		ParentBranchID:  *parent,
+		ProjectName:     conf.ProjectName,
+		Task:            tsk,
+		RunID:           runID,
+		Artifacts:       conf.Artifacts(),
+		CleanupBranches: conf.CleanupBranches,
+	}
+
+	var rec *o.Transcript
+	if *transcriptPath != "" {
+		rec, err = o.NewTranscript(strings.ReplaceAll(*transcriptPath, "{run_id}", runID), runID)
+		if err != nil {
+			logx.Eprintf("Failed to open transcript: %v\n", err)
+			os.Exit(1)
+		}
+		defer rec.Close()
 	}
 
-	var report map[string]any
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt)
+	go watchInterrupts(sigs, cancel, func() {
+		latest := handler.BranchRange()["latest_branch_id"]
+		if latest == "" {
+			latest = "none created"
+		}
+		logx.Eprintf("error: forced exit; work may be unpublished (latest branch: %s)\n", latest)
+		os.Exit(exitInterrupted)
+	})
+
+	var res o.RunResult
 	if *headless {
-		report, err = o.Orchestrate(brain, handler, msgs, publish)
+		res, err = o.Orchestrate(ctx, brain, handler, msgs, publish, rec)
 	} else {
-		report, err = o.ChatLoop(brain, handler, msgs, 0, publish)
-	}
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		res, err = o.ChatLoop(ctx, brain, handler, msgs, 0, publish, rec)
 	}
+	signal.Stop(sigs)
 
 	// Attach observed branch range
 	br := handler.BranchRange()
+	report := res.Report
+	if err != nil {
+		// Failed runs still emit a machine-readable object with everything
+		// known so far; the model's report, if any, is kept as partial.
+		report = map[string]any{"error": err.Error(), "iterations": res.Iterations, "stats": res.Stats}
+		if res.Report != nil {
+			report["partial_report"] = res.Report
+		}
+		var perr *o.PublishError
+		if errors.As(err, &perr) {
+			report["publish_failure"] = map[string]any{"reason": perr.Reason, "branch_id": perr.BranchID, "evidence": perr.Evidence}
+		}
+	}
 	if report == nil {
 		report = map[string]any{}
 	}
@@ -85,11 +322,73 @@ func main() {
 	}
 	if br["latest_branch_id"] != "" {
 		report["latest_branch_id"] = br["latest_branch_id"]
+		if ancestry := runAncestry(mcp, br["latest_branch_id"], br["start_branch_id"]); ancestry != nil {
+			report["ancestry"] = ancestry
+		}
+	}
+	report["branches_created"] = handler.BranchesCreated()
+	report["branch_lineage"] = handler.BranchLineage()
+	if res.PublishedBranchID != "" {
+		report["published_branch_id"] = res.PublishedBranchID
 	}
 	if _, ok := report["task"]; !ok {
 		report["task"] = tsk
 	}
+	report["run_id"] = runID
+	report["audit_log"] = audit.Path()
+	if *dryRun {
+		report["dry_run"] = true
+	}
+	stats, _ := report["stats"].(map[string]any)
+	if stats == nil {
+		stats = map[string]any{}
+		report["stats"] = stats
+	}
+	stats["mcp"] = mcp.Metrics()
+
+	mcp.Close()
 
 	out, _ := json.MarshalIndent(report, "", "  ")
-	fmt.Println(string(out))
+	out = []byte(logx.Redact(string(out)))
+	logx.Println(string(out))
+	if reportOut != nil {
+		if werr := writeReport(reportOut, out); werr != nil {
+			logx.Eprintf("failed to write report to fd %d: %v\n", *reportFD, werr)
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		logx.Eprintln(err.Error())
+		if errors.Is(err, o.ErrInterrupted) {
+			os.Exit(exitInterrupted)
+		}
+		var perr *o.PublishError
+		if errors.As(err, &perr) {
+			os.Exit(exitPublishFailed)
+		}
+		os.Exit(1)
+	}
+}
+
+// openReportFD wraps an inherited descriptor, failing if it is not open.
+func openReportFD(fd int) (*os.File, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("file descriptor %d is not valid", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not open: %v", fd, err)
+	}
+	return f, nil
+}
+
+// writeReport writes the report followed by a newline and closes f so the
+// reader sees EOF without waiting for the process to exit.
+func writeReport(f *os.File, report []byte) error {
+	_, werr := f.Write(append(report, '\n'))
+	cerr := f.Close()
+	if werr != nil {
+		return werr
+	}
+	return cerr
 }
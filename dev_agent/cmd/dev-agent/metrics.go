@@ -0,0 +1,24 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// serveMetrics publishes the MCP client counters as the expvar "mcp" and
+// serves them on addr under /debug/vars for the lifetime of the process.
+// A listen failure is logged but does not stop the run.
+func serveMetrics(addr string, client *t.MCPClient) {
+	expvar.Publish("mcp", expvar.Func(func() any { return client.Metrics() }))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logx.Warningf("METRICS_ADDR: %v; metrics are only included in the report", err)
+		return
+	}
+	logx.Infof("Serving metrics on http://%s/debug/vars", ln.Addr())
+	go http.Serve(ln, nil)
+}
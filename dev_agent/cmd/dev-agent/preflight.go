@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cfg "dev_agent/internal/config"
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// checkParentBranch validates the parent branch id format and then asks the
+// server about it, so a typo fails before the first LLM completion instead
+// of surfacing later as an opaque parallel_explore error.
+func checkParentBranch(client *t.MCPClient, conf cfg.AgentConfig, parentID string) error {
+	if conf.BranchIDPattern != nil && !conf.BranchIDPattern.MatchString(parentID) {
+		return fmt.Errorf("--parent-branch-id %q does not match the expected format %s (override with BRANCH_ID_PATTERN)", parentID, conf.BranchIDPattern)
+	}
+	branch, err := client.GetBranch(context.Background(), parentID, 0)
+	var (
+		failed    t.MCPToolError
+		schemaErr *t.ResponseSchemaError
+	)
+	switch {
+	case errors.As(err, &failed):
+		resp := failed.Result
+		return fmt.Errorf("parent branch %s was not found: %s", parentID, logx.Truncate(fmt.Sprint(firstNonNil(resp["error"], resp["text"], resp)), 300))
+	case errors.As(err, &schemaErr):
+		return fmt.Errorf("parent branch %s was not found (server returned no branch): %s", parentID, schemaErr.Raw)
+	case err != nil:
+		return fmt.Errorf("parent branch %s could not be fetched: %v", parentID, err)
+	}
+	if branch.Raw["error"] != nil {
+		return fmt.Errorf("parent branch %s was not found: %s", parentID, logx.Truncate(fmt.Sprint(branch.Raw["error"]), 300))
+	}
+	if branch.Project != "" && conf.ProjectName != "" && branch.Project != conf.ProjectName {
+		return fmt.Errorf("parent branch %s belongs to project %q, not %q", parentID, branch.Project, conf.ProjectName)
+	}
+	switch branch.Status {
+	case "pending", "running", "created", "queued":
+		logx.Warningf("Parent branch %s is still %s; branching from an unfinished branch is usually a mistake.", parentID, branch.Status)
+	}
+	return nil
+}
+
+// gitHubUserURL is a cheap authenticated endpoint used to validate the token.
+const gitHubUserURL = "https://api.github.com/user"
+
+// checkGitHubToken rejects a token GitHub refuses, so an expired credential
+// fails now instead of after a full run when the publish push is denied.
+// Network trouble only warns: the publish agent may reach GitHub even when
+// this process cannot.
+func checkGitHubToken(token string) error {
+	req, err := http.NewRequest(http.MethodGet, gitHubUserURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		logx.Warningf("Could not validate GITHUB_ACCESS_TOKEN: %v", err)
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("GITHUB_ACCESS_TOKEN was rejected by GitHub (401); the publish step would fail to push")
+	}
+	return nil
+}
+
+// checkProject confirms the configured project exists. On a miss the
+// server's project list supplies "did you mean" suggestions; when the list
+// itself is unavailable the check only warns.
+func checkProject(ctx context.Context, client *t.MCPClient, name string) error {
+	resp, err := client.GetProject(ctx, name)
+	if err == nil {
+		if isErr, _ := resp["isError"].(bool); !isErr && resp["error"] == nil {
+			return nil
+		}
+	}
+	projects, lerr := client.ListProjects(ctx)
+	if lerr != nil {
+		logx.Warningf("Could not verify project %q (get_project: %v; list_projects: %v)", name, err, lerr)
+		return nil
+	}
+	names := make([]string, 0, len(projects))
+	for _, p := range projects {
+		if p.Name == name {
+			return nil
+		}
+		names = append(names, p.Name)
+	}
+	msg := fmt.Sprintf("project %q was not found on the MCP server", name)
+	if matches := t.ClosestMatches(name, names, 3); len(matches) > 0 {
+		msg += fmt.Sprintf("; did you mean %s?", strings.Join(matches, ", "))
+	}
+	return fmt.Errorf("%s (see --list-projects)", msg)
+}
+
+func firstNonNil(vals ...any) any {
+	for _, v := range vals {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "dev_agent/internal/config"
+	"dev_agent/internal/logx"
+	"dev_agent/internal/tools"
+	"dev_agent/internal/tools/mcptest"
+)
+
+// parentCheckEnv returns a client of a fresh fake server, a config for
+// project demo and the captured warnings.
+func parentCheckEnv(t *testing.T) (*mcptest.FakeServer, *tools.MCPClient, cfg.AgentConfig, *bytes.Buffer) {
+	t.Helper()
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	client := tools.NewMCPClientWithOptions(srv.URL, tools.MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, SpillDir: t.TempDir()})
+	t.Cleanup(func() { client.Close() })
+	var logs bytes.Buffer
+	logx.SetOutput(&logs, &logs)
+	t.Cleanup(func() { logx.SetOutput(os.Stdout, os.Stderr) })
+	conf := cfg.AgentConfig{ProjectName: "demo", BranchIDPattern: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)}
+	return srv, client, conf, &logs
+}
+
+func TestCheckParentBranch(t *testing.T) {
+	t.Run("found", func(t *testing.T) {
+		srv, client, conf, logs := parentCheckEnv(t)
+		srv.ScriptBranch(testParentBranch, "succeed")
+		if err := checkParentBranch(client, conf, testParentBranch); err != nil {
+			t.Fatal(err)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("unexpected output:\n%s", logs.String())
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, client, conf, _ := parentCheckEnv(t)
+		err := checkParentBranch(client, conf, testParentBranch)
+		if err == nil || !strings.Contains(err.Error(), "parent branch "+testParentBranch+" was not found: branch "+testParentBranch+" not found") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("running", func(t *testing.T) {
+		srv, client, conf, logs := parentCheckEnv(t)
+		srv.ScriptBranch(testParentBranch, "running")
+		if err := checkParentBranch(client, conf, testParentBranch); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(logs.String(), "Parent branch "+testParentBranch+" is still running") {
+			t.Errorf("no warning about the running parent:\n%s", logs.String())
+		}
+	})
+
+	t.Run("other project", func(t *testing.T) {
+		srv, client, conf, _ := parentCheckEnv(t)
+		srv.Respond("get_branch", map[string]any{"id": testParentBranch, "status": "succeed", "project_name": "other"})
+		err := checkParentBranch(client, conf, testParentBranch)
+		if err == nil || !strings.Contains(err.Error(), `belongs to project "other", not "demo"`) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("bad format", func(t *testing.T) {
+		srv, client, conf, _ := parentCheckEnv(t)
+		err := checkParentBranch(client, conf, "1111-typo")
+		if err == nil || !strings.Contains(err.Error(), "does not match the expected format") {
+			t.Fatalf("err = %v", err)
+		}
+		if n := len(srv.Calls()); n != 0 {
+			t.Errorf("a malformed id reached the server (%d requests)", n)
+		}
+	})
+}
+
+func TestParentBranchProbeSkippable(t *testing.T) {
+	a := newAgentEnv(t, implementReply("call_1"), finalReply())
+	res := a.run(t, "--skip-preflight=false")
+	if res.code != 1 || !strings.Contains(res.stderr, "parent branch "+testParentBranch+" was not found") {
+		t.Fatalf("exit %d, stderr:\n%s", res.code, res.stderr)
+	}
+	if n := len(a.llm.Requests()); n != 0 {
+		t.Errorf("the run asked the model %d times despite the missing parent", n)
+	}
+	if res := a.run(t); res.code != 0 {
+		t.Errorf("with --skip-preflight: exit %d, stderr:\n%s", res.code, res.stderr)
+	}
+}
+
+func TestCheckProject(t *testing.T) {
+	projects := map[string]any{"projects": []any{"dev-agent", map[string]any{"name": "tidb", "description": "TiDB"}, "tikv"}}
+	cases := []struct {
+		name     string
+		project  string
+		found    bool
+		listErr  bool
+		wantErr  string
+		wantWarn bool
+	}{
+		{"found", "tidb", true, false, "", false},
+		{"typo with suggestions", "tidv", false, false, `project "tidv" was not found on the MCP server; did you mean tidb, tikv? (see --list-projects)`, false},
+		{"no plausible match", "kubernetes", false, false, `project "kubernetes" was not found on the MCP server (see --list-projects)`, false},
+		{"listed but get_project failed", "dev-agent", false, false, "", false},
+		{"list unavailable", "tidv", false, true, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, client, _, logs := parentCheckEnv(t)
+			srv.Handle("get_project", func(args map[string]any) (map[string]any, error) {
+				if !c.found {
+					return nil, fmt.Errorf("project %v not found", args["project_name"])
+				}
+				return map[string]any{"name": args["project_name"]}, nil
+			})
+			srv.Handle("list_projects", func(map[string]any) (map[string]any, error) {
+				if c.listErr {
+					return nil, errors.New("list_projects unavailable")
+				}
+				return projects, nil
+			})
+
+			err := checkProject(context.Background(), client, c.project)
+			if got := fmt.Sprint(err); (c.wantErr == "" && err != nil) || (c.wantErr != "" && got != c.wantErr) {
+				t.Errorf("err = %v, want %q", err, c.wantErr)
+			}
+			if warned := strings.Contains(logs.String(), "Could not verify project"); warned != c.wantWarn {
+				t.Errorf("warned = %t, want %t; logs:\n%s", warned, c.wantWarn, logs.String())
+			}
+			if calls := srv.CallsTo("get_project"); len(calls) != 1 || calls[0].Arguments["project_name"] != c.project {
+				t.Errorf("get_project calls = %v", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"dev_agent/internal/logx"
+	o "dev_agent/internal/orchestrator"
+)
+
+// runReplay implements `dev-agent replay <transcript-file> [--only ...] [--speed N]`.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	only := fs.String("only", "", "Only show tools, assistant or errors")
+	speed := fs.Float64("speed", 0, "Animate using recorded timing divided by this factor (0 prints immediately)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		logx.Eprintln("usage: dev-agent replay <transcript-file> [--only tools|assistant|errors] [--speed N]")
+		return 2
+	}
+	path := fs.Arg(0)
+	// Allow flags after the positional file argument.
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return 2
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		logx.Eprintf("replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	if err := o.RenderTranscript(logx.Stdout(), f, o.ReplayOptions{Only: *only, Speed: *speed}); err != nil {
+		logx.Eprintf("replay: %v\n", err)
+		return 1
+	}
+	return 0
+}
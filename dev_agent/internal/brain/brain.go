@@ -2,6 +2,7 @@ package brain
 
 import (
 	"bytes"
+	"context"
 	"dev_agent/internal/logx"
 	"encoding/json"
 	"errors"
@@ -58,6 +59,7 @@ type chatCompletionRequest struct {
 	MaxCompletionTokens int              `json:"max_completion_tokens,omitempty"`
 	Tools               []map[string]any `json:"tools,omitempty"`
 	ToolChoice          any              `json:"tool_choice,omitempty"`
+	ResponseFormat      any              `json:"response_format,omitempty"`
 }
 
 type chatCompletionResponse struct {
@@ -66,7 +68,17 @@ type chatCompletionResponse struct {
 	} `json:"choices"`
 }
 
-func (b *LLMBrain) Complete(messages []ChatMessage, tools []map[string]any) (*chatCompletionResponse, error) {
+func (b *LLMBrain) Complete(ctx context.Context, messages []ChatMessage, tools []map[string]any) (*chatCompletionResponse, error) {
+	return b.complete(ctx, messages, tools, nil)
+}
+
+// CompleteJSON is Complete with response_format json_object, forcing the
+// model to reply with a syntactically valid JSON object.
+func (b *LLMBrain) CompleteJSON(ctx context.Context, messages []ChatMessage, tools []map[string]any) (*chatCompletionResponse, error) {
+	return b.complete(ctx, messages, tools, map[string]any{"type": "json_object"})
+}
+
+func (b *LLMBrain) complete(ctx context.Context, messages []ChatMessage, tools []map[string]any, responseFormat any) (*chatCompletionResponse, error) {
 	var lastErr error
 	url := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", b.endpoint, b.deployment, b.apiVersion)
 
@@ -74,6 +86,7 @@ func (b *LLMBrain) Complete(messages []ChatMessage, tools []map[string]any) (*ch
 		Model:               b.deployment,
 		Messages:            messages,
 		MaxCompletionTokens: 4000,
+		ResponseFormat:      responseFormat,
 	}
 	if len(tools) > 0 {
 		body.Tools = tools
@@ -82,12 +95,15 @@ func (b *LLMBrain) Complete(messages []ChatMessage, tools []map[string]any) (*ch
 	payload, _ := json.Marshal(body)
 
 	for attempt := 0; attempt < b.maxRetries; attempt++ {
-		req, _ := http.NewRequest("POST", url, bytes.NewReader(payload))
+		req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("api-key", b.apiKey)
 
 		resp, err := b.client.Do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			lastErr = err
 		} else {
 			defer resp.Body.Close()
@@ -107,7 +123,11 @@ func (b *LLMBrain) Complete(messages []ChatMessage, tools []map[string]any) (*ch
 		if attempt < b.maxRetries-1 {
 			wait := time.Duration(1<<attempt) * time.Second
 			logx.Warningf("Azure OpenAI call failed (attempt %d/%d): %v. Retrying in %ds...", attempt+1, b.maxRetries, lastErr, int(wait.Seconds()))
-			time.Sleep(wait)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
 		}
 	}
 	if lastErr == nil {
@@ -4,49 +4,179 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"dev_agent/internal/logx"
 )
 
 type AgentConfig struct {
-	AzureAPIKey       string
-	AzureEndpoint     string
-	AzureDeployment   string
-	AzureAPIVersion   string
-	MCPBaseURL        string
+	AzureAPIKey     string
+	AzureEndpoint   string
+	AzureDeployment string
+	AzureAPIVersion string
+	MCPBaseURL      string
+	// MCPCommand, when set, launches the MCP server as a subprocess and
+	// talks to it over stdio instead of MCPBaseURL.
+	MCPCommand []string
+	// MCPAPIToken is sent as a bearer token to MCP gateways that require it.
+	MCPAPIToken string
+	// MCPTLS holds custom TLS material for the MCP connection.
+	MCPTLS MCPTLSFiles
+	// MCPBreakerThreshold consecutive MCP transport failures open the
+	// circuit for MCPBreakerCooldown; 0 keeps the client defaults.
+	MCPBreakerThreshold int
+	MCPBreakerCooldown  time.Duration
+	// MCPMaxRPS caps MCP requests per second (MCP_MAX_RPS); MCPMethodRPS
+	// holds per-tool overrides (MCP_METHOD_RPS="get_branch=0.5,..."). Zero
+	// means unlimited.
+	MCPMaxRPS    float64
+	MCPMethodRPS map[string]float64
+	// MCPGzip compresses large MCP request bodies (MCP_GZIP).
+	MCPGzip bool
+	// MCPUserAgent replaces the default "dev-agent-go/<version>" User-Agent
+	// of MCP requests (MCP_USER_AGENT).
+	MCPUserAgent string
+	// MCPSkipArgValidation disables the client-side check of tool arguments
+	// against the server's schemas (MCP_SKIP_ARG_VALIDATION).
+	MCPSkipArgValidation bool
+	// MCPMaxResponseBytes bounds an MCP reply held in memory; bigger ones
+	// are spilled to files under MCPSpillDir. 0 keeps the client defaults.
+	MCPMaxResponseBytes int64
+	MCPSpillDir         string
+	// MCPConnectTimeout, MCPTLSHandshakeTimeout and MCPResponseHeaderTimeout
+	// split the MCP transport timeouts by phase; 0 keeps the client
+	// defaults (30s, 10s, none).
+	MCPConnectTimeout        time.Duration
+	MCPTLSHandshakeTimeout   time.Duration
+	MCPResponseHeaderTimeout time.Duration
+	// MCPProxyURL, when set, replaces the HTTP_PROXY/HTTPS_PROXY settings
+	// for MCP traffic.
+	MCPProxyURL *url.URL
+	// MCPWireLogFile, when set, receives a JSONL log of all MCP traffic.
+	MCPWireLogFile    string
 	PollInitial       time.Duration
 	PollMax           time.Duration
 	PollTimeout       time.Duration
 	PollBackoffFactor float64
 	WorklogFilename   string
+	ReviewLogFilename string
 	ProjectName       string
 	WorkspaceDir      string
 	GitHubToken       string
+	// MetricsAddr, when set, serves expvar metrics (/debug/vars) there.
+	MetricsAddr string
+	// ArtifactMaxBytes is the default max_bytes of read_artifact.
+	ArtifactMaxBytes int
+	// DiffMaxBytes bounds the diff text returned by branch_diff.
+	DiffMaxBytes int
+	// OutputMaxChars bounds each text field returned by branch_output.
+	OutputMaxChars int
+	// ExecuteAgentTimeout, CheckStatusTimeout and ReadArtifactTimeout bound
+	// those tool calls; zero means no limit of their own.
+	ExecuteAgentTimeout time.Duration
+	CheckStatusTimeout  time.Duration
+	ReadArtifactTimeout time.Duration
+	// ResultMaxBytes bounds every tool result sent to the model; bigger
+	// ones are saved under ResultDir and replaced by a stub.
+	ResultMaxBytes int
+	ResultDir      string
+	// AuditLogFile receives one JSON line per tool call; it defaults to
+	// dev-agent-audit-<run id>.jsonl in the working directory, next to the
+	// saved results.
+	AuditLogFile string
+	// StateFile is rewritten after every tool call with the run's progress,
+	// for resuming it with --resume; the calls themselves are appended to a
+	// .calls.jsonl journal next to it. It defaults to
+	// .dev-agent-state-<run id>.json in the working directory.
+	StateFile string
+	// AllowedAgents are the agents execute_agent may launch.
+	AllowedAgents []string
+	// MaxConcurrentBranches bounds the launched branches not yet seen
+	// terminal; zero means no limit.
+	MaxConcurrentBranches int
+	// CleanupBranches deletes intermediate branches after a successful
+	// publish.
+	CleanupBranches bool
+	// LegacyErrorPayloads keeps tool error payloads in the flat shape with
+	// "error" as the message.
+	LegacyErrorPayloads bool
+	// BranchIDPattern validates --parent-branch-id before any network call.
+	BranchIDPattern *regexp.Regexp
 }
 
-func FromEnv() (AgentConfig, error) {
-	// Load .env if present (non-destructive)
-	_ = loadDotenv(".env")
+// MCPTLSFiles are PEM paths for a private-CA or mutual-TLS MCP server.
+type MCPTLSFiles struct {
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+}
 
-	apiKey := os.Getenv("AZURE_OPENAI_API_KEY")
-	if apiKey == "" {
-		return AgentConfig{}, errors.New("AZURE_OPENAI_API_KEY must be set")
-	}
+// IsZero reports whether no TLS customization was requested.
+func (f MCPTLSFiles) IsZero() bool { return f == MCPTLSFiles{} }
+
+// defaultBranchIDPattern matches a canonical UUID.
+const defaultBranchIDPattern = `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`
+
+// LoadOptions controls which env files are consulted before the
+// environment is validated.
+type LoadOptions struct {
+	// EnvFiles are loaded in order before the implicit ./.env. Values never
+	// override variables that are already set, so the real environment wins
+	// over every file and earlier files win over later ones.
+	EnvFiles []string
+	// NoDefaultEnvFile disables the implicit ./.env only; EnvFiles are still
+	// loaded.
+	NoDefaultEnvFile bool
+	// MCPOnly skips validation of the Azure OpenAI and GitHub settings for
+	// commands that only talk to the MCP server.
+	MCPOnly bool
+	// RunID names the default audit log and state file, and replaces
+	// {run_id} in AUDIT_LOG_FILE and STATE_FILE, so runs sharing a working
+	// directory do not share those files. Without it the names carry no id.
+	RunID string
+}
+
+func FromEnv() (AgentConfig, error) {
+	return Load(LoadOptions{})
+}
 
-	endpoint := os.Getenv("AZURE_OPENAI_ENDPOINT")
-	if endpoint == "" {
-		return AgentConfig{}, errors.New("AZURE_OPENAI_ENDPOINT must be set")
+func Load(opts LoadOptions) (AgentConfig, error) {
+	for _, path := range opts.EnvFiles {
+		if err := loadDotenv(path); err != nil {
+			return AgentConfig{}, fmt.Errorf("failed to load env file %s: %w", path, err)
+		}
+		logx.Infof("Loaded env file %s", path)
 	}
-	if !strings.HasPrefix(endpoint, "https://") {
-		return AgentConfig{}, errors.New("AZURE_OPENAI_ENDPOINT must start with 'https://'")
+	if !opts.NoDefaultEnvFile {
+		// Load .env if present (non-destructive)
+		if err := loadDotenv(".env"); err == nil {
+			logx.Infof("Loaded env file .env")
+		}
 	}
-	endpoint = strings.TrimRight(endpoint, "/")
 
+	apiKey := os.Getenv("AZURE_OPENAI_API_KEY")
+	endpoint := strings.TrimRight(os.Getenv("AZURE_OPENAI_ENDPOINT"), "/")
 	deployment := os.Getenv("AZURE_OPENAI_DEPLOYMENT")
-	if deployment == "" {
-		return AgentConfig{}, errors.New("AZURE_OPENAI_DEPLOYMENT must be set")
+	if !opts.MCPOnly {
+		if apiKey == "" {
+			return AgentConfig{}, errors.New("AZURE_OPENAI_API_KEY must be set")
+		}
+		if endpoint == "" {
+			return AgentConfig{}, errors.New("AZURE_OPENAI_ENDPOINT must be set")
+		}
+		if !strings.HasPrefix(endpoint, "https://") {
+			return AgentConfig{}, errors.New("AZURE_OPENAI_ENDPOINT must start with 'https://'")
+		}
+		if deployment == "" {
+			return AgentConfig{}, errors.New("AZURE_OPENAI_DEPLOYMENT must be set")
+		}
 	}
 
 	apiVersion := os.Getenv("AZURE_OPENAI_API_VERSION")
@@ -58,13 +188,14 @@ func FromEnv() (AgentConfig, error) {
 	if baseURL == "" {
 		baseURL = "http://localhost:8000/mcp/sse"
 	}
-	if !(strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://")) {
+	mcpCommand := strings.Fields(os.Getenv("MCP_COMMAND"))
+	if len(mcpCommand) == 0 && !(strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://")) {
 		return AgentConfig{}, errors.New("MCP_BASE_URL must be a valid HTTP/HTTPS URL")
 	}
 
-	pollInitial := envSeconds("MCP_POLL_INITIAL_SECONDS", 2)
+	pollInitial := envSeconds("MCP_POLL_INITIAL_SECONDS", 3)
 	pollMax := envSeconds("MCP_POLL_MAX_SECONDS", 30)
-	pollTimeout := envSeconds("MCP_POLL_TIMEOUT_SECONDS", 600)
+	pollTimeout := envSeconds("MCP_POLL_TIMEOUT_SECONDS", 1800)
 	if pollInitial >= pollMax {
 		return AgentConfig{}, errors.New("MCP_POLL_INITIAL_SECONDS must be less than MCP_POLL_MAX_SECONDS")
 	}
@@ -87,28 +218,271 @@ func FromEnv() (AgentConfig, error) {
 		backoff = f
 	}
 
+	branchPattern := defaultBranchIDPattern
+	if v := os.Getenv("BRANCH_ID_PATTERN"); v != "" {
+		branchPattern = v
+	}
+	branchRe, err := regexp.Compile(branchPattern)
+	if err != nil {
+		return AgentConfig{}, fmt.Errorf("BRANCH_ID_PATTERN is not a valid regular expression: %v", err)
+	}
+
+	mcpTLS := MCPTLSFiles{
+		CACertFile:     os.Getenv("MCP_CA_CERT_FILE"),
+		ClientCertFile: os.Getenv("MCP_CLIENT_CERT_FILE"),
+		ClientKeyFile:  os.Getenv("MCP_CLIENT_KEY_FILE"),
+	}
+	if (mcpTLS.ClientCertFile == "") != (mcpTLS.ClientKeyFile == "") {
+		return AgentConfig{}, errors.New("MCP_CLIENT_CERT_FILE and MCP_CLIENT_KEY_FILE must be set together")
+	}
+	if v := os.Getenv("MCP_INSECURE_SKIP_VERIFY"); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return AgentConfig{}, errors.New("MCP_INSECURE_SKIP_VERIFY must be a boolean")
+		}
+		mcpTLS.InsecureSkipVerify = skip
+	}
+
+	breakerThreshold := 0
+	if v := os.Getenv("MCP_BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return AgentConfig{}, errors.New("MCP_BREAKER_THRESHOLD must be an integer (negative disables the breaker)")
+		}
+		breakerThreshold = n
+	}
+	breakerCooldown := envSeconds("MCP_BREAKER_COOLDOWN_SECONDS", 30)
+
+	maxRPS := 0.0
+	if v := os.Getenv("MCP_MAX_RPS"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return AgentConfig{}, errors.New("MCP_MAX_RPS must be a non-negative number")
+		}
+		maxRPS = f
+	}
+	var methodRPS map[string]float64
+	if v := os.Getenv("MCP_METHOD_RPS"); v != "" {
+		methodRPS = map[string]float64{}
+		for _, pair := range strings.Split(v, ",") {
+			name, rate, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			f, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+			if !ok || strings.TrimSpace(name) == "" || err != nil || f < 0 {
+				return AgentConfig{}, fmt.Errorf("MCP_METHOD_RPS entry %q must look like get_branch=0.5", pair)
+			}
+			methodRPS[strings.TrimSpace(name)] = f
+		}
+	}
+
+	mcpGzip := false
+	if v := os.Getenv("MCP_GZIP"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return AgentConfig{}, errors.New("MCP_GZIP must be a boolean")
+		}
+		mcpGzip = b
+	}
+
+	skipArgValidation := false
+	if v := os.Getenv("MCP_SKIP_ARG_VALIDATION"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return AgentConfig{}, errors.New("MCP_SKIP_ARG_VALIDATION must be a boolean")
+		}
+		skipArgValidation = b
+	}
+
+	connectTimeout := envSeconds("MCP_CONNECT_TIMEOUT_SECONDS", 0)
+	tlsTimeout := envSeconds("MCP_TLS_HANDSHAKE_TIMEOUT_SECONDS", 0)
+	headerTimeout := envSeconds("MCP_RESPONSE_HEADER_TIMEOUT_SECONDS", 0)
+	if connectTimeout < 0 || tlsTimeout < 0 || headerTimeout < 0 {
+		return AgentConfig{}, errors.New("MCP_CONNECT_TIMEOUT_SECONDS, MCP_TLS_HANDSHAKE_TIMEOUT_SECONDS and MCP_RESPONSE_HEADER_TIMEOUT_SECONDS must not be negative")
+	}
+
+	var maxResponse int64
+	if v := os.Getenv("MCP_MAX_RESPONSE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n == 0 {
+			return AgentConfig{}, errors.New("MCP_MAX_RESPONSE_BYTES must be a non-zero integer (negative disables the limit)")
+		}
+		maxResponse = n
+	}
+
+	var proxyURL *url.URL
+	if v := os.Getenv("MCP_PROXY_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return AgentConfig{}, errors.New("MCP_PROXY_URL must be an http, https or socks5 URL with a host")
+		}
+		proxyURL = u
+	}
+
+	diffMax := 64 * 1024
+	if v := os.Getenv("BRANCH_DIFF_MAX_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return AgentConfig{}, errors.New("BRANCH_DIFF_MAX_BYTES must be a positive integer")
+		}
+		diffMax = n
+	}
+
+	artifactMax := 64 * 1024
+	if v := os.Getenv("ARTIFACT_MAX_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return AgentConfig{}, errors.New("ARTIFACT_MAX_BYTES must be a positive integer")
+		}
+		artifactMax = n
+	}
+
+	outputMax := 20000
+	if v := os.Getenv("BRANCH_OUTPUT_MAX_CHARS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return AgentConfig{}, errors.New("BRANCH_OUTPUT_MAX_CHARS must be a positive integer")
+		}
+		outputMax = n
+	}
+
+	executeTimeout := envSeconds("TOOL_TIMEOUT_EXECUTE_AGENT", 0)
+	statusTimeout := envSeconds("TOOL_TIMEOUT_CHECK_STATUS", 0)
+	readTimeout := envSeconds("TOOL_TIMEOUT_READ_ARTIFACT", 0)
+	if executeTimeout < 0 || statusTimeout < 0 || readTimeout < 0 {
+		return AgentConfig{}, errors.New("TOOL_TIMEOUT_EXECUTE_AGENT, TOOL_TIMEOUT_CHECK_STATUS and TOOL_TIMEOUT_READ_ARTIFACT must not be negative")
+	}
+
+	resultMax := 16 * 1024
+	if v := os.Getenv("TOOL_RESULT_MAX_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return AgentConfig{}, errors.New("TOOL_RESULT_MAX_BYTES must be a positive integer")
+		}
+		resultMax = n
+	}
+
+	allowedAgents := []string{"claude_code", "codex"}
+	if v := os.Getenv("ALLOWED_AGENTS"); v != "" {
+		allowedAgents = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				allowedAgents = append(allowedAgents, name)
+			}
+		}
+		if len(allowedAgents) == 0 {
+			return AgentConfig{}, errors.New("ALLOWED_AGENTS must list at least one agent")
+		}
+	}
+
+	maxBranches := 2
+	if v := os.Getenv("MAX_CONCURRENT_BRANCHES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return AgentConfig{}, errors.New("MAX_CONCURRENT_BRANCHES must be a non-negative integer")
+		}
+		maxBranches = n
+	}
+
+	cleanup := false
+	if v := os.Getenv("CLEANUP_BRANCHES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return AgentConfig{}, errors.New("CLEANUP_BRANCHES must be a boolean")
+		}
+		cleanup = b
+	}
+
+	legacyErrors := false
+	if v := os.Getenv("LEGACY_ERROR_PAYLOADS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return AgentConfig{}, errors.New("LEGACY_ERROR_PAYLOADS must be a boolean")
+		}
+		legacyErrors = b
+	}
+
+	idSuffix := ""
+	if opts.RunID != "" {
+		idSuffix = "-" + opts.RunID
+	}
+	auditLog := strings.ReplaceAll(os.Getenv("AUDIT_LOG_FILE"), "{run_id}", opts.RunID)
+	if auditLog == "" {
+		auditLog = "dev-agent-audit" + idSuffix + ".jsonl"
+	}
+	stateFile := strings.ReplaceAll(os.Getenv("STATE_FILE"), "{run_id}", opts.RunID)
+	if stateFile == "" {
+		stateFile = ".dev-agent-state" + idSuffix + ".json"
+	}
+
 	githubToken := os.Getenv("GITHUB_ACCESS_TOKEN")
-	if githubToken == "" {
+	if githubToken == "" && !opts.MCPOnly {
 		return AgentConfig{}, errors.New("GITHUB_ACCESS_TOKEN must be set")
 	}
 
 	return AgentConfig{
-		AzureAPIKey:       apiKey,
-		AzureEndpoint:     endpoint,
-		AzureDeployment:   deployment,
-		AzureAPIVersion:   apiVersion,
-		MCPBaseURL:        baseURL,
-		PollInitial:       pollInitial,
-		PollMax:           pollMax,
-		PollTimeout:       pollTimeout,
-		PollBackoffFactor: backoff,
-		WorklogFilename:   "worklog.md",
-		ProjectName:       project,
-		WorkspaceDir:      workspace,
-		GitHubToken:       githubToken,
+		AzureAPIKey:              apiKey,
+		AzureEndpoint:            endpoint,
+		AzureDeployment:          deployment,
+		AzureAPIVersion:          apiVersion,
+		MCPBaseURL:               baseURL,
+		MCPCommand:               mcpCommand,
+		MCPAPIToken:              strings.TrimSpace(os.Getenv("MCP_API_TOKEN")),
+		MCPTLS:                   mcpTLS,
+		MCPProxyURL:              proxyURL,
+		MCPMaxRPS:                maxRPS,
+		MCPMethodRPS:             methodRPS,
+		MCPGzip:                  mcpGzip,
+		MCPMaxResponseBytes:      maxResponse,
+		MCPSkipArgValidation:     skipArgValidation,
+		MCPUserAgent:             strings.TrimSpace(os.Getenv("MCP_USER_AGENT")),
+		MCPConnectTimeout:        connectTimeout,
+		MCPTLSHandshakeTimeout:   tlsTimeout,
+		MCPResponseHeaderTimeout: headerTimeout,
+		MCPSpillDir:              os.Getenv("MCP_SPILL_DIR"),
+		MCPBreakerThreshold:      breakerThreshold,
+		MCPBreakerCooldown:       breakerCooldown,
+		MCPWireLogFile:           os.Getenv("MCP_WIRE_LOG_FILE"),
+		PollInitial:              pollInitial,
+		PollMax:                  pollMax,
+		PollTimeout:              pollTimeout,
+		PollBackoffFactor:        backoff,
+		WorklogFilename:          "worklog.md",
+		ReviewLogFilename:        "codex_review.log",
+		ProjectName:              project,
+		WorkspaceDir:             workspace,
+		GitHubToken:              githubToken,
+		MetricsAddr:              os.Getenv("METRICS_ADDR"),
+		ArtifactMaxBytes:         artifactMax,
+		DiffMaxBytes:             diffMax,
+		OutputMaxChars:           outputMax,
+		ExecuteAgentTimeout:      executeTimeout,
+		CheckStatusTimeout:       statusTimeout,
+		ReadArtifactTimeout:      readTimeout,
+		ResultMaxBytes:           resultMax,
+		ResultDir:                os.Getenv("TOOL_RESULT_DIR"),
+		AuditLogFile:             auditLog,
+		StateFile:                stateFile,
+		AllowedAgents:            allowedAgents,
+		MaxConcurrentBranches:    maxBranches,
+		CleanupBranches:          cleanup,
+		LegacyErrorPayloads:      legacyErrors,
+		BranchIDPattern:          branchRe,
 	}, nil
 }
 
+// ArtifactPaths are the workspace files the agents use to hand work between
+// phases. Every prompt and every orchestrator-side read must use these.
+type ArtifactPaths struct {
+	Worklog   string
+	ReviewLog string
+}
+
+func (c AgentConfig) Artifacts() ArtifactPaths {
+	return ArtifactPaths{
+		Worklog:   path.Join(c.WorkspaceDir, c.WorklogFilename),
+		ReviewLog: path.Join(c.WorkspaceDir, c.ReviewLogFilename),
+	}
+}
+
 func envSeconds(name string, def int) time.Duration {
 	v := os.Getenv(name)
 	if v == "" {
@@ -2,6 +2,7 @@ package logx
 
 import (
     "fmt"
+    "io"
     "os"
     "time"
 )
@@ -17,36 +18,60 @@ const (
 
 var current Level = Info
 var loggerName = "dev_agent"
+var runID string
+
+var (
+    stdout io.Writer = os.Stdout
+    stderr io.Writer = os.Stderr
+)
 
 func SetLevel(l Level) { current = l }
 
+// SetRunID tags every subsequent log line with the run identifier.
+func SetRunID(id string) { runID = id }
+
+// SetOutput redirects log lines and user-facing prints. Nil keeps the
+// current writer.
+func SetOutput(out, errOut io.Writer) {
+    if out != nil {
+        stdout = out
+    }
+    if errOut != nil {
+        stderr = errOut
+    }
+}
+
 func ts() string { return time.Now().Format("15:04:05") }
 
+func logf(w io.Writer, level, format string, args ...any) {
+    name := loggerName
+    if runID != "" {
+        name += " run=" + runID
+    }
+    line := fmt.Sprintf("[%s] %s %s: ", ts(), level, name) + fmt.Sprintf(format, args...)
+    fmt.Fprintln(w, Redact(line))
+}
+
 func Infof(format string, args ...any) {
     if current <= Info {
-        fmt.Fprintf(os.Stdout, "[%s] INFO %s: ", ts(), loggerName)
-        fmt.Fprintf(os.Stdout, format+"\n", args...)
+        logf(stdout, "INFO", format, args...)
     }
 }
 
 func Warningf(format string, args ...any) {
     if current <= Warning {
-        fmt.Fprintf(os.Stdout, "[%s] WARNING %s: ", ts(), loggerName)
-        fmt.Fprintf(os.Stdout, format+"\n", args...)
+        logf(stdout, "WARNING", format, args...)
     }
 }
 
 func Errorf(format string, args ...any) {
     if current <= Error {
-        fmt.Fprintf(os.Stderr, "[%s] ERROR %s: ", ts(), loggerName)
-        fmt.Fprintf(os.Stderr, format+"\n", args...)
+        logf(stderr, "ERROR", format, args...)
     }
 }
 
 func Debugf(format string, args ...any) {
     if current <= Debug {
-        fmt.Fprintf(os.Stdout, "[%s] DEBUG %s: ", ts(), loggerName)
-        fmt.Fprintf(os.Stdout, format+"\n", args...)
+        logf(stdout, "DEBUG", format, args...)
     }
 }
-
@@ -0,0 +1,95 @@
+package logx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// redactedMarker replaces every registered secret in emitted text.
+const redactedMarker = "[REDACTED]"
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// RegisterSecret adds a value that must never be written by this package.
+// Every log line and every Print/Eprint call is passed through Redact, so
+// user-facing output should always go through these helpers rather than fmt.
+func RegisterSecret(secret string) {
+	if strings.TrimSpace(secret) == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// Redact replaces all registered secrets in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redactedMarker)
+	}
+	return s
+}
+
+// Printf writes redacted user-facing output to stdout.
+func Printf(format string, args ...any) {
+	fmt.Fprint(stdout, Redact(fmt.Sprintf(format, args...)))
+}
+
+// Println writes a redacted line to stdout.
+func Println(args ...any) {
+	fmt.Fprint(stdout, Redact(fmt.Sprintln(args...)))
+}
+
+// Eprintf writes redacted user-facing output to stderr.
+func Eprintf(format string, args ...any) {
+	fmt.Fprint(stderr, Redact(fmt.Sprintf(format, args...)))
+}
+
+// Eprintln writes a redacted line to stderr.
+func Eprintln(args ...any) {
+	fmt.Fprint(stderr, Redact(fmt.Sprintln(args...)))
+}
+
+// Stdout returns a writer that redacts what is written to it before passing
+// it to stdout, for output composed by writer-based helpers such as
+// text/tabwriter.
+func Stdout() io.Writer { return redactingWriter{} }
+
+type redactingWriter struct{}
+
+// Write redacts p as a whole, so a secret split across two writes would get
+// through; tabwriter writes each cell in one call.
+func (redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(stdout, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Truncate shortens s to at most max bytes on a rune boundary and appends a
+// marker with the original size so a preview is never mistaken for the whole
+// payload. Invalid UTF-8 in s is replaced, so the result is always valid.
+func Truncate(s string, max int) string {
+	s = strings.ToValidUTF8(s, "�")
+	if max < 0 || len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s…[truncated, %d bytes total]", s[:cut], len(s))
+}
@@ -0,0 +1,80 @@
+package logx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+func TestStdoutRedactsTables(t *testing.T) {
+	var out bytes.Buffer
+	SetOutput(&out, nil)
+	t.Cleanup(func() { SetOutput(os.Stdout, nil) })
+	RegisterSecret("s3cret-value")
+
+	tw := tabwriter.NewWriter(Stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDESCRIPTION")
+	fmt.Fprintln(tw, "demo\ttoken s3cret-value")
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cret-value") || !strings.Contains(out.String(), "token [REDACTED]") {
+		t.Errorf("table not redacted:\n%s", out.String())
+	}
+}
+
+func TestTruncateRuneBoundary(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		max  int
+		want string
+	}{
+		{"fits", "héllo", 6, "héllo"},
+		{"ascii", "abcdef", 3, "abc…[truncated, 6 bytes total]"},
+		// "日" is three bytes: a cut inside it backs off to the rune start.
+		{"cjk mid-rune", "ab日本", 4, "ab…[truncated, 8 bytes total]"},
+		{"cjk on boundary", "ab日本", 5, "ab日…[truncated, 8 bytes total]"},
+		// "🚀" is four bytes.
+		{"emoji mid-rune", `{"k":"🚀🚀"}`, 9, `{"k":"…[truncated, 16 bytes total]`},
+		{"emoji on boundary", `{"k":"🚀🚀"}`, 10, `{"k":"🚀…[truncated, 16 bytes total]`},
+		{"zero", "日本", 0, "…[truncated, 6 bytes total]"},
+		{"no limit", "日本", -1, "日本"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := Truncate(c.in, c.max)
+			if got != c.want {
+				t.Errorf("Truncate(%q, %d) = %q, want %q", c.in, c.max, got, c.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("Truncate(%q, %d) is not valid UTF-8", c.in, c.max)
+			}
+		})
+	}
+}
+
+func TestTruncateEveryCutIsValid(t *testing.T) {
+	s := strings.Repeat("a日🚀é", 20)
+	for max := 0; max <= len(s); max++ {
+		got := Truncate(s, max)
+		if !utf8.ValidString(got) {
+			t.Fatalf("Truncate at %d is not valid UTF-8: %q", max, got)
+		}
+		body, _, cut := strings.Cut(got, "…[truncated")
+		if max < len(s) && (!cut || len(body) > max || !strings.HasPrefix(s, body)) {
+			t.Fatalf("Truncate at %d = %q", max, got)
+		}
+	}
+}
+
+func TestTruncateInvalidInput(t *testing.T) {
+	got := Truncate("ok\xff\xfe tail", 100)
+	if !utf8.ValidString(got) || !strings.HasPrefix(got, "ok") || !strings.HasSuffix(got, " tail") {
+		t.Errorf("Truncate of invalid UTF-8 = %q", got)
+	}
+}
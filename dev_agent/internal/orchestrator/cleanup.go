@@ -0,0 +1,27 @@
+package orchestrator
+
+import (
+	"context"
+
+	"dev_agent/internal/logx"
+)
+
+// cleanupBranches deletes the branches the run created except the published
+// one; the original parent is never in the tracked list. Failures are logged
+// and otherwise ignored: a leftover branch is clutter, not a failed run.
+func (e *engine) cleanupBranches(ctx context.Context, published string) {
+	if !e.publish.CleanupBranches || published == "" {
+		return
+	}
+	for _, id := range e.handler.CreatedBranchIDs() {
+		if id == published || id == e.publish.ParentBranchID {
+			continue
+		}
+		if err := e.handler.DeleteBranch(ctx, id); err != nil {
+			logx.Warningf("Failed to delete intermediate branch %s: %v", id, err)
+			continue
+		}
+		e.stats.BranchesDeleted++
+		logx.Infof("Deleted intermediate branch %s.", id)
+	}
+}
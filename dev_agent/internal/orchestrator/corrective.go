@@ -0,0 +1,76 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	b "dev_agent/internal/brain"
+)
+
+// maxCorrectivePrompts bounds how many corrective user messages one run may
+// add; after that, non-productive turns are simply retried as before.
+const maxCorrectivePrompts = 3
+
+const finalReportSchema = `{"is_finished": true, "task": "<original user task description>", "summary": "<concise outcome>"}`
+
+// runStats are counters reported under "stats" in the final report.
+type runStats struct {
+	Iterations        int `json:"iterations"`
+	ToolCalls         int `json:"tool_calls"`
+	ReviewsCompleted  int `json:"reviews_completed"`
+	CorrectivePrompts int `json:"corrective_prompts"`
+	ReportRepairs     int `json:"report_repairs"`
+	BranchesDeleted   int `json:"branches_deleted,omitempty"`
+}
+
+// reportParseError explains why content that looks like a final report
+// attempt could not be used, or returns "" when it does not look like one.
+func reportParseError(content string) string {
+	trimmed := strings.TrimSpace(content)
+	if !strings.Contains(trimmed, "is_finished") && !strings.HasPrefix(trimmed, "{") {
+		return ""
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(trimmed), &m); err != nil {
+		return err.Error()
+	}
+	if m["is_finished"] != true {
+		return `"is_finished" must be the boolean true`
+	}
+	return ""
+}
+
+// reportRepairPrompt asks the model to resend a final report that failed to
+// parse, quoting the exact decode error.
+func reportRepairPrompt(parseErr string) b.ChatMessage {
+	return b.ChatMessage{Role: "user", Content: fmt.Sprintf("Your final report could not be parsed (%s). Resend it as a single JSON object only, with no other text, matching: %s", parseErr, finalReportSchema)}
+}
+
+// nextPhaseHint names the tool call expected after the last agent run.
+func nextPhaseHint(lastAgent string) string {
+	switch lastAgent {
+	case "":
+		return "call execute_agent with agent \"claude_code\" to start the Implement phase"
+	case "claude_code":
+		return "call execute_agent with agent \"codex\" for the Review phase"
+	default:
+		return "if the review reported P0/P1 issues, call read_artifact on the review log and then execute_agent with agent \"claude_code\" for the Fix phase; otherwise send the final report"
+	}
+}
+
+// correctivePrompt builds the user message sent after a turn that had no
+// tool calls and no usable final report.
+func correctivePrompt(content, lastAgent string) b.ChatMessage {
+	var sb strings.Builder
+	if perr := reportParseError(content); perr != "" {
+		fmt.Fprintf(&sb, "Your last reply looks like a final report but could not be used: %s.\n", perr)
+		fmt.Fprintf(&sb, "If the workflow is complete, reply with JSON only (no other text) matching: %s\n", finalReportSchema)
+		fmt.Fprintf(&sb, "Otherwise, %s.", nextPhaseHint(lastAgent))
+	} else {
+		sb.WriteString("Your last reply contained neither a tool call nor the final report, so the workflow did not advance.\n")
+		fmt.Fprintf(&sb, "Next, %s.\n", nextPhaseHint(lastAgent))
+		fmt.Fprintf(&sb, "When codex reports no P0/P1 issues, reply with JSON only matching: %s", finalReportSchema)
+	}
+	return b.ChatMessage{Role: "user", Content: sb.String()}
+}
@@ -0,0 +1,174 @@
+package orchestrator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	b "dev_agent/internal/brain"
+)
+
+// lastMessage is the newest message of a request.
+func lastMessage(req llmRequest) b.ChatMessage { return req.Messages[len(req.Messages)-1] }
+
+// runCounter reads one of the run counters embedded in a report.
+func runCounter(report map[string]any, name string) any {
+	stats, _ := report["stats"].(map[string]any)
+	run, _ := stats["run"].(map[string]any)
+	return run[name]
+}
+
+func TestCorrectivePromptAfterProseTurn(t *testing.T) {
+	r := newTestRun(t,
+		toolCallReply(implementCall("call_1")),
+		b.ChatMessage{Role: "assistant", Content: "The implementation looks good to me."},
+		finalReply(),
+	)
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := r.llm.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("model was asked %d times, want 3", len(reqs))
+	}
+	msg := lastMessage(reqs[2])
+	if msg.Role != "user" {
+		t.Fatalf("last message = %+v, want a corrective user message", msg)
+	}
+	for _, want := range []string{"neither a tool call nor the final report", `call execute_agent with agent "codex" for the Review phase`, finalReportSchema} {
+		if !strings.Contains(msg.Content, want) {
+			t.Errorf("corrective prompt lacks %q:\n%s", want, msg.Content)
+		}
+	}
+	if got := runCounter(res.Report, "corrective_prompts"); got != 1.0 {
+		t.Errorf("corrective_prompts = %v, want 1", got)
+	}
+}
+
+func TestCorrectivePromptAfterBrokenJSONTurn(t *testing.T) {
+	r := newTestRun(t,
+		b.ChatMessage{Role: "assistant", Content: `{"task": "task", "summary": "done"`},
+		finalReply(),
+	)
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := lastMessage(r.llm.Requests()[1])
+	for _, want := range []string{"looks like a final report but could not be used: unexpected end of JSON input", "reply with JSON only", `agent "claude_code" to start the Implement phase`} {
+		if !strings.Contains(msg.Content, want) {
+			t.Errorf("corrective prompt lacks %q:\n%s", want, msg.Content)
+		}
+	}
+	if got := runCounter(res.Report, "corrective_prompts"); got != 1.0 {
+		t.Errorf("corrective_prompts = %v, want 1", got)
+	}
+}
+
+func TestCorrectivePromptsAreCapped(t *testing.T) {
+	replies := []b.ChatMessage{toolCallReply(implementCall("call_1"))}
+	for i := 0; i < maxCorrectivePrompts+2; i++ {
+		replies = append(replies, b.ChatMessage{Role: "assistant", Content: "Thinking about it."})
+	}
+	r := newTestRun(t, append(replies, finalReply())...)
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runCounter(res.Report, "corrective_prompts"); got != float64(maxCorrectivePrompts) {
+		t.Errorf("corrective_prompts = %v, want %d", got, maxCorrectivePrompts)
+	}
+	reqs := r.llm.Requests()
+	if msg := lastMessage(reqs[len(reqs)-1]); msg.Role != "assistant" {
+		t.Errorf("after the cap the turn was retried with %s message %q, want no new prompt", msg.Role, msg.Content)
+	}
+}
+
+func TestReportParseError(t *testing.T) {
+	cases := map[string]string{
+		"Working on it.":                    "",
+		`{"is_finished": true, "task": ""}`: "",
+		`{"is_finished": "yes"}`:            `"is_finished" must be the boolean true`,
+		`is_finished: true`:                 "invalid character 'i' looking for beginning of value",
+		`{"summary": "done",}`:              "invalid character '}' looking for beginning of object key string",
+	}
+	for content, want := range cases {
+		if got := reportParseError(content); got != want {
+			t.Errorf("reportParseError(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
+
+// brokenReport is a final report attempt with a trailing comma.
+func brokenReport() b.ChatMessage {
+	return b.ChatMessage{Role: "assistant", Content: `{"is_finished": true, "task": "task", "summary": "done",}`}
+}
+
+func TestReportRepairRecovers(t *testing.T) {
+	r := newTestRun(t, toolCallReply(implementCall("call_1")), brokenReport(), finalReply())
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := r.llm.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("model was asked %d times, want 3", len(reqs))
+	}
+	msg := lastMessage(reqs[2])
+	if msg.Role != "user" || !strings.Contains(msg.Content, "could not be parsed (invalid character '}'") || !strings.Contains(msg.Content, finalReportSchema) {
+		t.Errorf("repair prompt = %+v", msg)
+	}
+	if !reflect.DeepEqual(reqs[2].ResponseFormat, map[string]any{"type": "json_object"}) || reqs[1].ResponseFormat != nil {
+		t.Errorf("response_format: turn 2 %v, turn 3 %v; want json_object on the retry only", reqs[1].ResponseFormat, reqs[2].ResponseFormat)
+	}
+	if res.Report["summary"] != "Implemented and reviewed." {
+		t.Errorf("report = %v", res.Report)
+	}
+	if got := runCounter(res.Report, "report_repairs"); got != 1.0 {
+		t.Errorf("report_repairs = %v, want 1", got)
+	}
+}
+
+func TestReportRepairTriedOnce(t *testing.T) {
+	r := newTestRun(t, toolCallReply(implementCall("call_1")), brokenReport(), brokenReport(), brokenReport(), finalReply())
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := r.llm.Requests()
+	if len(reqs) != 5 {
+		t.Fatalf("model was asked %d times, want 5", len(reqs))
+	}
+	// The failed retry falls through to the corrective prompt, and so does
+	// the next broken report: no tool call happened in between.
+	for _, i := range []int{3, 4} {
+		if msg := lastMessage(reqs[i]); !strings.Contains(msg.Content, "looks like a final report but could not be used") {
+			t.Errorf("request %d ends with %q, want the corrective prompt", i+1, msg.Content)
+		}
+		if reqs[i].ResponseFormat != nil {
+			t.Errorf("request %d forced response_format %v", i+1, reqs[i].ResponseFormat)
+		}
+	}
+	if got := runCounter(res.Report, "report_repairs"); got != 1.0 {
+		t.Errorf("report_repairs = %v, want 1", got)
+	}
+	if got := runCounter(res.Report, "corrective_prompts"); got != 2.0 {
+		t.Errorf("corrective_prompts = %v, want 2", got)
+	}
+}
+
+func TestReportRepairRearmsAfterToolCalls(t *testing.T) {
+	r := newTestRun(t, brokenReport(), brokenReport(), toolCallReply(implementCall("call_1")), brokenReport(), finalReply())
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := r.llm.Requests()
+	if len(reqs) != 5 || reqs[4].ResponseFormat == nil {
+		t.Fatalf("after a tool-call turn the broken report was not repaired again (%d requests)", len(reqs))
+	}
+	if got := runCounter(res.Report, "report_repairs"); got != 2.0 {
+		t.Errorf("report_repairs = %v, want 2", got)
+	}
+}
@@ -0,0 +1,339 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	b "dev_agent/internal/brain"
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// engine is the single orchestration loop behind Orchestrate and ChatLoop.
+// The two modes differ only in how progress is displayed.
+type engine struct {
+	brain    *b.LLMBrain
+	handler  *t.ToolHandler
+	publish  PublishOptions
+	rec      *Transcript
+	ui       display
+	maxIters int
+	stats    runStats
+}
+
+// RunResult is everything a run produced. It is returned alongside errors so
+// callers can still report lineage and progress for failed runs.
+type RunResult struct {
+	// Report is the model's final report, or nil when none was produced.
+	Report            map[string]any
+	Iterations        int
+	Stats             map[string]any
+	PublishedBranchID string
+}
+
+func (e *engine) result(report map[string]any, published string) RunResult {
+	return RunResult{Report: report, Iterations: e.stats.Iterations, Stats: e.statsMap(), PublishedBranchID: published}
+}
+
+func (e *engine) run(ctx context.Context, messages []b.ChatMessage) (RunResult, error) {
+	tools := e.handler.ToolDefinitions()
+	e.handler.OnPoll(e.ui.Poll)
+	defer e.handler.OnPoll(nil)
+	var (
+		finalReport map[string]any
+		finished    bool
+		interrupted bool
+		reviewCount int
+		lastAgent   string
+		// forceJSON requests response_format json_object for the next turn,
+		// set after a malformed final report; repairTried limits that to one
+		// retry until a turn makes progress with tool calls.
+		forceJSON   bool
+		repairTried bool
+	)
+
+	for i := 1; ; i++ {
+		if ctx.Err() != nil {
+			interrupted = true
+			break
+		}
+		e.stats.Iterations = i
+		e.ui.Iteration(i)
+		e.rec.Record(TranscriptEvent{Kind: EventIteration, Iteration: i})
+		complete := e.brain.Complete
+		if forceJSON {
+			complete = e.brain.CompleteJSON
+			forceJSON = false
+		}
+		resp, err := complete(ctx, messages, tools)
+		if err != nil {
+			if ctx.Err() != nil {
+				interrupted = true
+				break
+			}
+			e.rec.Record(TranscriptEvent{Kind: EventError, Iteration: i, Content: err.Error()})
+			return e.result(nil, ""), err
+		}
+		choice := resp.Choices[0].Message
+		choice.ToolCalls = dedupeToolCalls(choice.ToolCalls)
+		if choice.Content != "" {
+			rationale := len(choice.ToolCalls) > 0
+			e.ui.Assistant(choice.Content, rationale)
+			kind := EventAssistant
+			if rationale {
+				kind = EventRationale
+			}
+			e.rec.Record(TranscriptEvent{Kind: kind, Iteration: i, Content: choice.Content})
+		}
+		messages = append(messages, assistantMessageToDict(choice))
+
+		if len(choice.ToolCalls) > 0 {
+			repairTried = false
+			reviewCompleted := false
+			turnStart := len(messages)
+			calls := make([]t.ToolCall, len(choice.ToolCalls))
+			for j, tc := range choice.ToolCalls {
+				calls[j] = handlerCall(tc, e.publish.Task)
+			}
+			e.handler.Prefetch(ctx, calls)
+			for j, tc := range choice.ToolCalls {
+				e.ui.ToolCall(tc)
+				e.stats.ToolCalls++
+				var args map[string]any
+				if tc.Function.Arguments != "" {
+					_ = json.Unmarshal([]byte(tc.Function.Arguments), &args)
+				}
+				htc := calls[j]
+				e.rec.Record(TranscriptEvent{Kind: EventToolCall, Iteration: i, Tool: tc.Function.Name, ToolCallID: tc.ID, Arguments: tc.Function.Arguments})
+				result := safeHandle(ctx, e.handler, htc)
+				e.rec.Record(TranscriptEvent{Kind: EventToolResult, Iteration: i, Tool: tc.Function.Name, ToolCallID: tc.ID, Result: result})
+				e.ui.ToolResult(tc, result)
+				messages = append(messages, b.ChatMessage{Role: "tool", ToolCallID: tc.ID, Content: toJSON(result)})
+				if code, msg, details, failed := t.ErrorInfo(result); failed && (code == t.CodeMCPUnavailable || details["error_kind"] == t.KindAuth) {
+					e.rec.Record(TranscriptEvent{Kind: EventError, Iteration: i, Content: msg})
+					return e.result(nil, ""), fmt.Errorf("%w: %v", ErrMCPUnavailable, msg)
+				}
+
+				if tc.Function.Name == "execute_agent" {
+					agent, _ := args["agent"].(string)
+					if status, _ := result["status"].(string); status == "success" {
+						lastAgent = agent
+						if agent == "codex" {
+							reviewCompleted = true
+						}
+					}
+				}
+			}
+			messages = ensureToolResponses(e.handler, messages, turnStart, choice.ToolCalls)
+			if reviewCompleted {
+				reviewCount++
+				e.stats.ReviewsCompleted = reviewCount
+				e.ui.Review(reviewCount, e.maxIters)
+				e.rec.Record(TranscriptEvent{Kind: EventReview, Iteration: i, Content: fmt.Sprintf("note: completed review iteration %d/%d", reviewCount, e.maxIters)})
+				if reviewCount >= e.maxIters {
+					logx.Errorf("Reached review iteration limit without final report.")
+					break
+				}
+			}
+			continue
+		}
+
+		if fr, ok := ParseFinalReport(choice); ok {
+			finalReport = fr
+			finished = true
+			e.ui.FinalReport()
+			e.rec.Record(TranscriptEvent{Kind: EventFinalReport, Iteration: i, Report: fr})
+			break
+		}
+		e.ui.NotFinal()
+		e.rec.Record(TranscriptEvent{Kind: EventNotFinal, Iteration: i, Content: "assistant< not final yet, continuing..."})
+		if perr := reportParseError(choice.Content); perr != "" && strings.Contains(choice.Content, "is_finished") && !repairTried {
+			repairTried = true
+			forceJSON = true
+			e.stats.ReportRepairs++
+			msg := reportRepairPrompt(perr)
+			messages = append(messages, msg)
+			e.rec.Record(TranscriptEvent{Kind: EventCorrective, Iteration: i, Content: msg.Content})
+			continue
+		}
+		if e.stats.CorrectivePrompts < maxCorrectivePrompts {
+			e.stats.CorrectivePrompts++
+			msg := correctivePrompt(choice.Content, lastAgent)
+			messages = append(messages, msg)
+			e.rec.Record(TranscriptEvent{Kind: EventCorrective, Iteration: i, Content: msg.Content})
+		}
+	}
+
+	// Publishing must still run after an interrupt cancelled ctx.
+	publishCtx := context.WithoutCancel(ctx)
+	if finished {
+		finalReport["stats"] = e.statsMap()
+		branchID, err := finalizeBranchPush(publishCtx, e.handler, e.publish, successOutcome(finalReport))
+		if err != nil {
+			return e.result(finalReport, ""), err
+		}
+		e.cleanupBranches(publishCtx, branchID)
+		finalReport["stats"] = e.statsMap()
+		return e.result(finalReport, branchID), nil
+	}
+
+	if interrupted {
+		e.ui.Interrupted()
+		branchID, err := finalizeBranchPush(publishCtx, e.handler, e.publish, outcomeInterrupted)
+		if err != nil {
+			return e.result(nil, ""), fmt.Errorf("%w: publish failed: %w", ErrInterrupted, err)
+		}
+		e.ui.Published(branchID, "interruption")
+		e.cleanupBranches(publishCtx, branchID)
+		return e.result(nil, branchID), ErrInterrupted
+	}
+
+	branchID, err := finalizeBranchPush(publishCtx, e.handler, e.publish, outcomeIterationLimit)
+	if err != nil {
+		return e.result(nil, ""), fmt.Errorf("%w; publish failed: %w", ErrIterationLimit, err)
+	}
+	if branchID != "" {
+		e.ui.Published(branchID, "iteration limit")
+		e.cleanupBranches(publishCtx, branchID)
+	}
+	return e.result(nil, branchID), ErrIterationLimit
+}
+
+// statsMap returns the run counters and the handler's per-tool metrics in
+// the shape embedded in reports.
+func (e *engine) statsMap() map[string]any {
+	var m map[string]any
+	raw, _ := json.Marshal(e.stats)
+	_ = json.Unmarshal(raw, &m)
+	return map[string]any{"run": m, "tools": e.handler.Stats().Tools}
+}
+
+// display renders loop progress for one run mode.
+type display interface {
+	Iteration(i int)
+	Assistant(content string, rationale bool)
+	ToolCall(tc b.ToolCall)
+	ToolResult(tc b.ToolCall, result map[string]any)
+	Review(count, max int)
+	FinalReport()
+	NotFinal()
+	Interrupted()
+	Published(branchID, reason string)
+	// Poll is called after each status poll while a tool waits on a branch.
+	Poll(branchID, status string, attempt int, elapsed time.Duration)
+}
+
+// headlessDisplay logs through logx for unattended runs.
+type headlessDisplay struct {
+	polls *pollThrottle
+}
+
+// pollLogInterval spaces the headless lines of a branch whose status has
+// not changed.
+const pollLogInterval = time.Minute
+
+// pollThrottle decides which status polls are worth a headless log line:
+// the first of a branch, a status change, or one per pollLogInterval and
+// branch, so sibling branches polled together do not silence each other.
+type pollThrottle struct {
+	mu     sync.Mutex
+	last   map[string]time.Time
+	status map[string]string
+}
+
+func (p *pollThrottle) due(branchID, status string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status == nil {
+		p.status = map[string]string{}
+		p.last = map[string]time.Time{}
+	}
+	prev, seen := p.status[branchID]
+	p.status[branchID] = status
+	if seen && prev == status && time.Since(p.last[branchID]) < pollLogInterval {
+		return false
+	}
+	p.last[branchID] = time.Now()
+	return true
+}
+
+func (headlessDisplay) Iteration(i int) { logx.Infof("LLM iteration %d", i) }
+
+func (headlessDisplay) Assistant(content string, rationale bool) {
+	if rationale {
+		logx.Infof("Tool-call rationale: %s", content)
+	}
+}
+
+func (headlessDisplay) ToolCall(b.ToolCall) {}
+
+func (headlessDisplay) ToolResult(b.ToolCall, map[string]any) {}
+
+func (headlessDisplay) Review(count, max int) {
+	logx.Infof("Completed review iteration %d/%d", count, max)
+}
+
+func (headlessDisplay) FinalReport() {}
+
+func (headlessDisplay) NotFinal() {
+	logx.Infof("Assistant response was not a final report; continuing.")
+}
+
+func (headlessDisplay) Interrupted() {
+	logx.Warningf("Interrupted; attempting to publish the current workspace before exiting.")
+}
+
+func (headlessDisplay) Published(branchID, reason string) {
+	logx.Infof("Workspace published to branch (branch_id=%s) after %s.", branchID, reason)
+}
+
+func (d headlessDisplay) Poll(branchID, status string, attempt int, elapsed time.Duration) {
+	if d.polls == nil || d.polls.due(branchID, status) {
+		logx.Infof("Waiting on branch %s: status=%s after %s (%d polls)", branchID, status, elapsed.Round(time.Second), attempt)
+	}
+}
+
+// consoleDisplay prints the interactive chat transcript.
+type consoleDisplay struct{}
+
+func (consoleDisplay) Iteration(i int) { logx.Printf("[iter %d] requesting completion...\n", i) }
+
+func (consoleDisplay) Assistant(content string, rationale bool) {
+	if rationale {
+		logx.Printf("assistant (tool-call rationale)> %s\n", content)
+		return
+	}
+	logx.Printf("assistant> %s\n", content)
+}
+
+func (consoleDisplay) ToolCall(tc b.ToolCall) {
+	logx.Printf("tool> %s %s\n", tc.Function.Name, tc.Function.Arguments)
+}
+
+// ToolResult prints the result exactly as the model receives it; the
+// handler's result budget already bounds it.
+func (consoleDisplay) ToolResult(_ b.ToolCall, result map[string]any) {
+	logx.Printf("tool< %s\n", toJSON(result))
+}
+
+func (consoleDisplay) Review(count, max int) {
+	logx.Printf("note: completed review iteration %d/%d\n", count, max)
+}
+
+func (consoleDisplay) FinalReport() { logx.Println("assistant< final_report") }
+
+func (consoleDisplay) NotFinal() { logx.Println("assistant< not final yet, continuing...") }
+
+func (consoleDisplay) Interrupted() { logx.Eprintln("info: interrupted; publishing current workspace") }
+
+func (consoleDisplay) Published(branchID, _ string) {
+	logx.Eprintf("info: workspace pushed (branch_id=%s)\n", branchID)
+}
+
+func (consoleDisplay) Poll(branchID, status string, attempt int, elapsed time.Duration) {
+	logx.Printf("status> branch %s %s (poll %d, %s elapsed)\n", branchID, status, attempt, elapsed.Round(time.Second))
+}
@@ -0,0 +1,587 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	b "dev_agent/internal/brain"
+	cfg "dev_agent/internal/config"
+	"dev_agent/internal/logx"
+	"dev_agent/internal/tools"
+	"dev_agent/internal/tools/mcptest"
+)
+
+const testParent = "11111111-1111-4111-8111-111111111111"
+
+var testArtifactPaths = cfg.ArtifactPaths{Worklog: "/work/worklog.md", ReviewLog: "/work/code_review.log"}
+
+// scriptedLLM is a chat completions endpoint answering with scripted
+// assistant messages in order. Once the script is used up it holds every
+// request until the client gives up.
+type scriptedLLM struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	replies  []b.ChatMessage
+	requests []llmRequest
+}
+
+// llmRequest is the part of a chat completions request the tests look at.
+type llmRequest struct {
+	Messages       []b.ChatMessage `json:"messages"`
+	ResponseFormat any             `json:"response_format"`
+}
+
+func newScriptedLLM(t *testing.T, replies ...b.ChatMessage) *scriptedLLM {
+	t.Helper()
+	l := &scriptedLLM{replies: replies}
+	l.Server = httptest.NewServer(http.HandlerFunc(l.serve))
+	t.Cleanup(l.Close)
+	return l
+}
+
+func (l *scriptedLLM) serve(w http.ResponseWriter, r *http.Request) {
+	raw, _ := io.ReadAll(r.Body)
+	var req llmRequest
+	_ = json.Unmarshal(raw, &req)
+	l.mu.Lock()
+	l.requests = append(l.requests, req)
+	var reply *b.ChatMessage
+	if len(l.replies) > 0 {
+		reply = &l.replies[0]
+		l.replies = l.replies[1:]
+	}
+	l.mu.Unlock()
+	if reply == nil {
+		<-r.Context().Done()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": reply}}})
+}
+
+// Requests returns the requests received so far.
+func (l *scriptedLLM) Requests() []llmRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]llmRequest(nil), l.requests...)
+}
+
+// toolCall is one model tool call.
+func toolCall(id, name string, args map[string]any) b.ToolCall {
+	raw, _ := json.Marshal(args)
+	return b.ToolCall{ID: id, Type: "function", Function: b.ToolFunction{Name: name, Arguments: string(raw)}}
+}
+
+// toolCallReply is an assistant turn making the given tool calls.
+func toolCallReply(calls ...b.ToolCall) b.ChatMessage {
+	return b.ChatMessage{Role: "assistant", ToolCalls: calls}
+}
+
+// implementCall launches the Implement phase on the run's parent branch.
+func implementCall(id string) b.ToolCall {
+	return toolCall(id, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent})
+}
+
+// finalReply is an assistant turn carrying the final report.
+func finalReply() b.ChatMessage {
+	return b.ChatMessage{Role: "assistant", Content: `{"is_finished": true, "task": "task", "summary": "Implemented and reviewed."}`}
+}
+
+// testRun is an engine wired to a scripted model and a fake MCP server.
+type testRun struct {
+	llm     *scriptedLLM
+	mcp     *mcptest.FakeServer
+	handler *tools.ToolHandler
+	logs    *syncBuffer
+}
+
+func newTestRun(t *testing.T, replies ...b.ChatMessage) *testRun {
+	t.Helper()
+	llm := newScriptedLLM(t, replies...)
+	mcp := mcptest.NewFakeServer()
+	t.Cleanup(mcp.Close)
+	mcp.SetDefaultScript("succeed")
+	client := tools.NewMCPClientWithOptions(mcp.URL, tools.MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, SpillDir: t.TempDir()})
+	t.Cleanup(func() { client.Close() })
+	h := tools.NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	h.SetPollPolicy(tools.PollPolicy{Initial: time.Millisecond, Max: 2 * time.Millisecond})
+	return &testRun{llm: llm, mcp: mcp, handler: h, logs: captureLogs(t)}
+}
+
+func (r *testRun) brain() *b.LLMBrain {
+	return b.NewLLMBrain("test-key", r.llm.URL, "gpt-test", "2024-10-21", 1)
+}
+
+// orchestrate runs the headless loop to completion.
+func (r *testRun) orchestrate(t *testing.T) (RunResult, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return Orchestrate(ctx, r.brain(), r.handler, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), testPublishOptions(), nil)
+}
+
+// chat runs the console loop to completion.
+func (r *testRun) chat(t *testing.T, maxIters int) (RunResult, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return ChatLoop(ctx, r.brain(), r.handler, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), maxIters, testPublishOptions(), nil)
+}
+
+// toolMessages counts the tool messages of a request by tool_call id.
+func toolMessages(req llmRequest) map[string]int {
+	n := map[string]int{}
+	for _, m := range req.Messages {
+		if m.Role == "tool" {
+			n[m.ToolCallID]++
+		}
+	}
+	return n
+}
+
+// captureLogs sends logx output to a buffer for the rest of the test.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	var buf syncBuffer
+	logx.SetOutput(&buf, &buf)
+	t.Cleanup(func() { logx.SetOutput(os.Stdout, os.Stderr) })
+	return &buf
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestOrchestrateCompletes(t *testing.T) {
+	r := newTestRun(t, toolCallReply(implementCall("call_1")), finalReply())
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatalf("Orchestrate: %v\n%s", err, r.logs.String())
+	}
+	if res.Report == nil || res.PublishedBranchID == "" {
+		t.Errorf("result = %+v, want a report and a published branch", res)
+	}
+	if n := len(r.llm.Requests()); n != 2 {
+		t.Errorf("model was asked %d times, want 2", n)
+	}
+}
+
+// TestOrchestrateAbortsWhenMCPUnavailable checks that a run stops at the
+// first tool result refused by the open circuit instead of asking the model
+// again.
+func TestOrchestrateAbortsWhenMCPUnavailable(t *testing.T) {
+	var calls []b.ToolCall
+	for i := 1; i <= 8; i++ {
+		calls = append(calls, toolCall(fmt.Sprintf("call_%d", i), "branch_output", map[string]any{"branch_id": "b1"}))
+	}
+	r := newTestRun(t, toolCallReply(calls...), finalReply())
+	r.mcp.Close() // every call now fails to connect
+
+	_, err := r.orchestrate(t)
+	if !errors.Is(err, ErrMCPUnavailable) {
+		t.Fatalf("err = %v, want ErrMCPUnavailable", err)
+	}
+	if n := len(r.llm.Requests()); n != 1 {
+		t.Errorf("model was asked %d times, want 1", n)
+	}
+}
+
+// TestHeadlessAndConsoleShareTheLoop runs one script through both modes:
+// the model sees the same conversation and the run the same result; only
+// the progress output differs.
+func TestHeadlessAndConsoleShareTheLoop(t *testing.T) {
+	script := func() []b.ChatMessage {
+		return []b.ChatMessage{
+			toolCallReply(implementCall("call_1")),
+			{Role: "assistant", Content: "Still working on it."},
+			finalReply(),
+		}
+	}
+	headless := newTestRun(t, script()...)
+	hres, herr := headless.orchestrate(t)
+	console := newTestRun(t, script()...)
+	cres, cerr := console.chat(t, 0)
+	if herr != nil || cerr != nil {
+		t.Fatalf("errors: headless %v, console %v", herr, cerr)
+	}
+	if hres.Iterations != 3 || cres.Iterations != 3 {
+		t.Errorf("iterations: headless %d, console %d, want 3", hres.Iterations, cres.Iterations)
+	}
+	if hres.PublishedBranchID != cres.PublishedBranchID || hres.Report["summary"] != cres.Report["summary"] {
+		t.Errorf("results differ:\nheadless %+v\nconsole  %+v", hres, cres)
+	}
+	hreqs, creqs := headless.llm.Requests(), console.llm.Requests()
+	if len(hreqs) != len(creqs) {
+		t.Fatalf("model asked %d times headless, %d times console", len(hreqs), len(creqs))
+	}
+	for i := range hreqs {
+		if got, want := toJSON(creqs[i].Messages), toJSON(hreqs[i].Messages); got != want {
+			t.Errorf("request %d differs:\nconsole  %s\nheadless %s", i+1, got, want)
+		}
+	}
+
+	hlogs, clogs := headless.logs.String(), console.logs.String()
+	for _, want := range []string{"LLM iteration 1", "Assistant response was not a final report; continuing."} {
+		if !strings.Contains(hlogs, want) {
+			t.Errorf("headless output lacks %q:\n%s", want, hlogs)
+		}
+	}
+	for _, want := range []string{"[iter 1] requesting completion...", "tool> execute_agent ", "tool< {", "assistant> Still working on it.", "assistant< not final yet, continuing...", "assistant< final_report"} {
+		if !strings.Contains(clogs, want) {
+			t.Errorf("console output lacks %q:\n%s", want, clogs)
+		}
+	}
+	if strings.Contains(hlogs, "[iter ") || strings.Contains(clogs, "LLM iteration") {
+		t.Error("a mode printed the other mode's progress lines")
+	}
+}
+
+func TestChatLoopStopsAtReviewLimit(t *testing.T) {
+	review := toolCall("call_2", "execute_agent", map[string]any{"agent": "codex", "prompt": "Review the change.", "parent_branch_id": testParent})
+	r := newTestRun(t, toolCallReply(implementCall("call_1")), toolCallReply(review), finalReply())
+	res, err := r.chat(t, 1)
+	if !errors.Is(err, ErrIterationLimit) {
+		t.Fatalf("err = %v, want ErrIterationLimit", err)
+	}
+	if res.Iterations != 2 || res.Report != nil {
+		t.Errorf("result = %+v, want a stop after the first review", res)
+	}
+	if !strings.Contains(r.logs.String(), "note: completed review iteration 1/1") {
+		t.Errorf("no review note:\n%s", r.logs.String())
+	}
+}
+
+// TestToolCallRationaleSurfaced scripts a turn carrying both content and a
+// tool call: the content is logged and recorded as rationale ahead of the
+// call, and the call still runs.
+func TestToolCallRationaleSurfaced(t *testing.T) {
+	turn := toolCallReply(implementCall("call_1"))
+	turn.Content = "Implementing first so the review has a branch."
+	for _, tc := range []struct {
+		mode, wantLog string
+		run           func(r *testRun, ctx context.Context, rec *Transcript) (RunResult, error)
+	}{
+		{"headless", "Tool-call rationale: Implementing first", func(r *testRun, ctx context.Context, rec *Transcript) (RunResult, error) {
+			return Orchestrate(ctx, r.brain(), r.handler, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), testPublishOptions(), rec)
+		}},
+		{"console", "assistant (tool-call rationale)> Implementing first", func(r *testRun, ctx context.Context, rec *Transcript) (RunResult, error) {
+			return ChatLoop(ctx, r.brain(), r.handler, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), 0, testPublishOptions(), rec)
+		}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			r := newTestRun(t, turn, finalReply())
+			path := filepath.Join(t.TempDir(), "run.jsonl")
+			rec, err := NewTranscript(path, "run-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if _, err := tc.run(r, ctx, rec); err != nil {
+				t.Fatalf("run: %v\n%s", err, r.logs.String())
+			}
+			rec.Close()
+
+			if calls := r.mcp.CallsTo("parallel_explore"); len(calls) == 0 || calls[0].Arguments["parent_branch_id"] != testParent {
+				t.Errorf("the turn's execute_agent did not run: %+v", calls)
+			}
+			logs := r.logs.String()
+			if !strings.Contains(logs, tc.wantLog) {
+				t.Errorf("output lacks %q:\n%s", tc.wantLog, logs)
+			}
+			if tc.mode == "console" {
+				if strings.Index(logs, tc.wantLog) > strings.Index(logs, "tool> execute_agent") {
+					t.Errorf("rationale printed after the tool line:\n%s", logs)
+				}
+				if strings.Contains(logs, "assistant> Implementing") {
+					t.Errorf("rationale also printed as a plain assistant line:\n%s", logs)
+				}
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kinds []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var ev TranscriptEvent
+				if err := json.Unmarshal([]byte(line), &ev); err != nil {
+					t.Fatalf("transcript line %q: %v", line, err)
+				}
+				if ev.Kind == EventRationale && ev.Content != turn.Content {
+					t.Errorf("rationale content = %q, want %q", ev.Content, turn.Content)
+				}
+				if ev.Iteration == 1 {
+					kinds = append(kinds, ev.Kind)
+				}
+			}
+			if want := []string{EventIteration, EventRationale, EventToolCall, EventToolResult}; strings.Join(kinds, ",") != strings.Join(want, ",") {
+				t.Errorf("iteration 1 events = %v, want %v", kinds, want)
+			}
+		})
+	}
+}
+
+// TestCleanupDeletesIntermediateBranches runs with zero, one and several
+// implement phases: every branch the run created is deleted except the
+// published one, and the parent never is.
+func TestCleanupDeletesIntermediateBranches(t *testing.T) {
+	for _, phases := range []int{0, 1, 3} {
+		t.Run(fmt.Sprintf("%d phases", phases), func(t *testing.T) {
+			var replies []b.ChatMessage
+			for i := 0; i < phases; i++ {
+				replies = append(replies, toolCallReply(implementCall(fmt.Sprintf("call_%d", i))))
+			}
+			r := newTestRun(t, append(replies, finalReply())...)
+			r.mcp.Respond("delete_branch", map[string]any{"deleted": true})
+			opts := testPublishOptions()
+			opts.ParentBranchID = testParent
+			opts.CleanupBranches = true
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			res, err := Orchestrate(ctx, r.brain(), r.handler, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), opts, nil)
+			if err != nil {
+				t.Fatalf("Orchestrate: %v\n%s", err, r.logs.String())
+			}
+
+			created := r.handler.CreatedBranchIDs()
+			if len(created) != phases+1 || r.handler.BranchesCreated() != phases+1 {
+				t.Fatalf("created %v, want %d phase branches and the publish branch", created, phases)
+			}
+			if latest := r.handler.BranchRange()["latest_branch_id"]; latest != res.PublishedBranchID || latest != created[phases] {
+				t.Errorf("latest %s, published %s, want the last created %s", latest, res.PublishedBranchID, created[phases])
+			}
+			var deleted []string
+			for _, c := range r.mcp.CallsTo("delete_branch") {
+				id, _ := c.Arguments["branch_id"].(string)
+				deleted = append(deleted, id)
+			}
+			if strings.Join(deleted, ",") != strings.Join(created[:phases], ",") {
+				t.Errorf("deleted %v, want %v", deleted, created[:phases])
+			}
+			want := any(nil)
+			if phases > 0 {
+				want = float64(phases)
+			}
+			if got := runCounter(res.Report, "branches_deleted"); got != want {
+				t.Errorf("branches_deleted = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestOrchestrateDryRun drives a whole run, phases, artifact reads and the
+// publish step, against the dry-run client, and checks every call went
+// through validation and the audit log without reaching an MCP server.
+func TestOrchestrateDryRun(t *testing.T) {
+	fixtures := t.TempDir()
+	if err := os.WriteFile(filepath.Join(fixtures, "worklog.md"), []byte("## Implement\ndone\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const firstBranch = "00000000-0000-4000-8000-dry000000001"
+	llm := newScriptedLLM(t,
+		toolCallReply(implementCall("call_1")),
+		toolCallReply(toolCall("call_2", "read_artifact", map[string]any{"branch_id": firstBranch, "path": testArtifactPaths.Worklog})),
+		toolCallReply(toolCall("call_3", "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Review the work.", "num_branches": "1", "parent_branch_id": firstBranch})),
+		toolCallReply(toolCall("call_4", "execute_agent", map[string]any{"agent": "claude_code", "parent_branch_id": firstBranch})),
+		finalReply(),
+	)
+	logs := captureLogs(t)
+	client := tools.NewDryRunClient(fixtures, "/work")
+	t.Cleanup(func() { client.Close() })
+	h := tools.NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := tools.NewAuditLog(auditPath, "dry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetAuditLog(audit)
+
+	opts := testPublishOptions()
+	opts.ParentBranchID = testParent
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := Orchestrate(ctx, b.NewLLMBrain("test-key", llm.URL, "gpt-test", "2024-10-21", 1), h, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), opts, nil)
+	audit.Close()
+	if err != nil {
+		t.Fatalf("Orchestrate: %v\n%s", err, logs.String())
+	}
+	if res.Report == nil || !strings.Contains(res.PublishedBranchID, "-dry") {
+		t.Errorf("result = %+v, want a report and a synthetic published branch", res)
+	}
+	for _, id := range h.CreatedBranchIDs() {
+		if !strings.Contains(id, "-dry") {
+			t.Errorf("created branch %s is not synthetic", id)
+		}
+	}
+
+	// The model saw the fixture and the validation error of call_4.
+	reqs := llm.Requests()
+	if len(reqs) != 5 {
+		t.Fatalf("model was asked %d times, want 5", len(reqs))
+	}
+	if read := lastMessage(reqs[2]).Content; !strings.Contains(read, "## Implement") {
+		t.Errorf("read_artifact result = %s, want the fixture", read)
+	}
+	if invalid := lastMessage(reqs[4]).Content; !strings.Contains(invalid, "INVALID_ARGS") {
+		t.Errorf("execute_agent without a prompt answered %s, want a validation error", invalid)
+	}
+
+	var audited []string
+	f, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(f)), "\n") {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		audited = append(audited, fmt.Sprintf("%v:%v", e["tool"], e["status"]))
+	}
+	want := []string{"execute_agent:success", "read_artifact:success", "execute_agent:success", "execute_agent:error", "execute_agent:success"}
+	if strings.Join(audited, " ") != strings.Join(want, " ") {
+		t.Errorf("audited calls %v, want %v", audited, want)
+	}
+}
+
+func TestPollThrottle(t *testing.T) {
+	var p pollThrottle
+	steps := []struct {
+		branch, status string
+		want           bool
+	}{
+		{"b1", "running", true},  // first poll of b1
+		{"b2", "running", true},  // first poll of b2, right after b1's line
+		{"b1", "running", false}, // unchanged within the interval
+		{"b2", "running", false},
+		{"b1", "succeed", true}, // status change
+		{"b2", "running", false},
+	}
+	for i, s := range steps {
+		if got := p.due(s.branch, s.status); got != s.want {
+			t.Errorf("step %d: due(%s, %s) = %v, want %v", i, s.branch, s.status, got, s.want)
+		}
+	}
+	// Once b2's interval has passed it is due again, however recently b1
+	// was logged.
+	p.mu.Lock()
+	p.last["b2"] = time.Now().Add(-pollLogInterval)
+	p.mu.Unlock()
+	p.due("b1", "failed")
+	if !p.due("b2", "running") {
+		t.Error("b2 was not logged after its interval because b1 was logged")
+	}
+	if p.due("b1", "failed") {
+		t.Error("b1 was logged again within its interval")
+	}
+}
+
+// TestPollProgressLines runs a phase whose branch takes 10 polls and checks
+// the console prints every poll while headless mode logs only the first
+// and the status change.
+func TestPollProgressLines(t *testing.T) {
+	script := []string{"running", "running", "running", "running", "running", "running", "running", "running", "running", "succeed"}
+	for _, tc := range []struct {
+		name  string
+		run   func(r *testRun, t *testing.T) (RunResult, error)
+		line  string
+		lines int
+	}{
+		{"headless", func(r *testRun, t *testing.T) (RunResult, error) { return r.orchestrate(t) }, "INFO dev_agent: Waiting on branch 00000000-0000-4000-8000-000000000001", 2},
+		{"console", func(r *testRun, t *testing.T) (RunResult, error) { return r.chat(t, 0) }, "status> branch 00000000-0000-4000-8000-000000000001", len(script)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRun(t, toolCallReply(implementCall("call_1")), finalReply())
+			r.mcp.ScriptBranch("00000000-0000-4000-8000-000000000001", script...)
+			if _, err := tc.run(r, t); err != nil {
+				t.Fatalf("run: %v\n%s", err, r.logs.String())
+			}
+			if n := strings.Count(r.logs.String(), tc.line); n != tc.lines {
+				t.Errorf("%d poll lines for the phase branch, want %d:\n%s", n, tc.lines, r.logs.String())
+			}
+		})
+	}
+}
+
+// TestOrchestrateRefusesFailedPublishParent finishes a run whose only phase
+// failed and checks the publish step is refused rather than launched from
+// the failed branch.
+func TestOrchestrateRefusesFailedPublishParent(t *testing.T) {
+	r := newTestRun(t, toolCallReply(implementCall("call_1")), finalReply())
+	r.mcp.ScriptBranch("00000000-0000-4000-8000-000000000001", "failed")
+	opts := testPublishOptions()
+	opts.ParentBranchID = testParent
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := Orchestrate(ctx, r.brain(), r.handler, BuildInitialMessages("task", "demo", "/work", testParent, testArtifactPaths), opts, nil)
+	if err == nil || !strings.Contains(err.Error(), "refusing to publish from branch 00000000-0000-4000-8000-000000000001") {
+		t.Fatalf("err = %v, want the publish refused", err)
+	}
+	if res.PublishedBranchID != "" {
+		t.Errorf("published %s from a failed branch", res.PublishedBranchID)
+	}
+	if n := len(r.mcp.CallsTo("parallel_explore")); n != 1 {
+		t.Errorf("%d launches, want only the failed phase", n)
+	}
+}
+
+// TestReportToolStats checks the report embeds the handler's per-tool
+// metrics under stats.tools.
+func TestReportToolStats(t *testing.T) {
+	const implement, review = "00000000-0000-4000-8000-000000000001", "00000000-0000-4000-8000-000000000002"
+	r := newTestRun(t,
+		toolCallReply(implementCall("call_1")),
+		toolCallReply(toolCall("call_2", "execute_agent", map[string]any{"agent": "codex", "prompt": "Review the change.", "parent_branch_id": implement}),
+			toolCall("call_3", "check_status", map[string]any{"branch_id": review})),
+		toolCallReply(toolCall("call_4", "check_status", map[string]any{})),
+		finalReply(),
+	)
+	res, err := r.orchestrate(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := res.Report["stats"].(map[string]any)
+	byTool, _ := stats["tools"].(map[string]tools.ToolStat)
+	exec, status := byTool["execute_agent"], byTool["check_status"]
+	// The publish step is a third, claude_code, launch.
+	if exec.Calls != 3 || exec.Errors != 0 || status.Calls != 2 || status.Errors != 1 {
+		t.Errorf("stats.tools = %+v, want 3 launches and 2 status checks, one failed", byTool)
+	}
+	if exec.ByAgent["claude_code"].Calls != 2 || exec.ByAgent["codex"].Calls != 1 {
+		t.Errorf("execute_agent by agent = %+v, want two claude_code runs and one codex run", exec.ByAgent)
+	}
+	if !reflect.DeepEqual(res.Stats["tools"], stats["tools"]) {
+		t.Errorf("RunResult.Stats tools = %v, want the report's", res.Stats["tools"])
+	}
+}
@@ -0,0 +1,119 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	cfg "dev_agent/internal/config"
+)
+
+// quotedPath matches the single-quoted absolute paths prompts name.
+var quotedPath = regexp.MustCompile(`'(/[^']+)'`)
+
+// promptPaths returns the distinct quoted paths of a prompt in sorted order.
+func promptPaths(prompt string) []string {
+	var paths []string
+	for _, m := range quotedPath.FindAllStringSubmatch(prompt, -1) {
+		if !slices.Contains(paths, m[1]) {
+			paths = append(paths, m[1])
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// TestPromptsShareArtifactPaths renders every prompt, the system prompt with
+// its phase templates and the publish prompt, and checks they all name the
+// configured worklog and review log and nothing else.
+func TestPromptsShareArtifactPaths(t *testing.T) {
+	paths := cfg.AgentConfig{WorkspaceDir: "/srv/ws", WorklogFilename: "notes.md", ReviewLogFilename: "review.txt"}.Artifacts()
+	want := []string{paths.ReviewLog, paths.Worklog}
+	slices.Sort(want)
+
+	system := BuildInitialMessages("task", "demo", "/srv/ws", testParent, paths)[0].Content
+	// The system prompt and each phase template it carries, with the
+	// artifacts each must name.
+	prompts := map[string]string{"system": system}
+	wantPaths := map[string][]string{"system": want, "Implement": {paths.Worklog}, "Review": {paths.Worklog}, "Fix": want, "publish": want}
+	for _, section := range strings.Split(system, "\n---\n") {
+		heading := strings.Index(section, "####")
+		if heading < 0 {
+			continue
+		}
+		section = section[heading:]
+		if phase := strings.Fields(section)[1]; wantPaths[phase] != nil {
+			prompts[phase] = section
+		}
+	}
+	for _, phase := range []string{"Implement", "Review", "Fix"} {
+		if prompts[phase] == "" {
+			t.Fatalf("system prompt has no %s section", phase)
+		}
+	}
+
+	h := &fakePublishHandler{latest: "b2", results: map[string]map[string]any{
+		"execute_agent": publishResult(map[string]any{"branch_id": "b3", "terminal_status": "succeeded"}),
+	}}
+	opts := testPublishOptions()
+	opts.Artifacts = paths
+	if _, err := finalizeBranchPush(context.Background(), h, opts, "done"); err != nil {
+		t.Fatal(err)
+	}
+	var reads []string
+	for _, call := range h.calls {
+		var args map[string]any
+		_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
+		switch call.Function.Name {
+		case "execute_agent":
+			prompts["publish"], _ = args["prompt"].(string)
+		default:
+			if p, ok := args["path"].(string); ok {
+				reads = append(reads, p)
+			}
+		}
+	}
+
+	for name, prompt := range prompts {
+		if strings.Contains(prompt, "{{") {
+			t.Errorf("%s prompt has an unrendered placeholder:\n%s", name, prompt)
+		}
+		if got := promptPaths(prompt); !slices.Equal(got, wantPaths[name]) {
+			t.Errorf("%s prompt names %v, want %v", name, got, wantPaths[name])
+		}
+	}
+	if !slices.Equal(reads, []string{paths.Worklog}) {
+		t.Errorf("publish read %v, want the worklog %s", reads, paths.Worklog)
+	}
+}
+
+// TestSystemPromptInspectsRuns checks the system prompt steers review
+// verdicts to branch_output and its summary before the full transcript.
+func TestSystemPromptInspectsRuns(t *testing.T) {
+	paths := cfg.AgentConfig{WorkspaceDir: "/srv/ws"}.Artifacts()
+	system := BuildInitialMessages("task", "demo", "/srv/ws", testParent, paths)[0].Content
+	for _, want := range []string{"call 'branch_output' on the review branch", "the default summary is usually enough", "full_output=true"} {
+		if !strings.Contains(system, want) {
+			t.Errorf("system prompt does not say %q", want)
+		}
+	}
+}
+
+// TestSystemPromptVerifiesTests checks the workflow calls run_tests between
+// Fix and Review once a review doubted the tests.
+func TestSystemPromptVerifiesTests(t *testing.T) {
+	paths := cfg.AgentConfig{WorkspaceDir: "/srv/ws"}.Artifacts()
+	system := BuildInitialMessages("task", "demo", "/srv/ws", testParent, paths)[0].Content
+	verify := strings.Index(system, "**Verify (run_tests)**")
+	if verify < 0 || verify < strings.Index(system, "**Fix (claude_code)**") {
+		t.Fatalf("system prompt has no Verify step after Fix:\n%s", system)
+	}
+	for _, want := range []string{"fabricated, skipped or unrun tests", "call 'run_tests' on the **Fix** branch before the next **Review**", "keep building on the Fix branch"} {
+		if !strings.Contains(system, want) {
+			t.Errorf("system prompt does not say %q", want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// PublishReasonAuth marks a publish whose branch finished but whose git
+// push was rejected for credentials.
+const PublishReasonAuth = "auth"
+
+// PublishError is returned when the publish branch completed but the push
+// evidently did not happen. Evidence is a short excerpt of the log line that
+// gave it away.
+type PublishError struct {
+	Reason   string
+	BranchID string
+	Evidence string
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("publish branch %s failed (%s): %s", e.BranchID, e.Reason, e.Evidence)
+}
+
+// authFailurePattern matches the messages git and GitHub print when a push is
+// refused for credentials.
+var authFailurePattern = regexp.MustCompile(`(?i)(authentication failed|permission denied \(publickey\)|invalid username or password|bad credentials|could not read username|the requested url returned error: 40[13]|\b403 forbidden\b|remote: permission to \S+ denied)`)
+
+// maxWorklogScanBytes is how much of the publish worklog is scanned; the
+// push is the last step, so the default artifact page could miss it.
+const maxWorklogScanBytes = 4 << 20
+
+// maxEvidenceBytes bounds the excerpt stored in the report.
+const maxEvidenceBytes = 300
+
+// authFailureEvidence returns the first line in texts that looks like a git
+// authentication failure, or "" when none does.
+func authFailureEvidence(texts ...string) string {
+	for _, text := range texts {
+		for _, line := range strings.Split(text, "\n") {
+			if authFailurePattern.MatchString(line) {
+				return logx.Truncate(strings.TrimSpace(line), maxEvidenceBytes)
+			}
+		}
+	}
+	return ""
+}
+
+// checkPublishAuth scans the publish branch's status and worklog for auth
+// failures. A "succeeded" branch with one of these is a push that never
+// landed.
+func checkPublishAuth(ctx context.Context, handler publishHandler, branchID string, status map[string]any, worklog string) error {
+	texts := []string{flattenText(status)}
+	if worklog != "" {
+		argsBytes, _ := json.Marshal(map[string]any{"branch_id": branchID, "path": worklog, "max_bytes": maxWorklogScanBytes})
+		call := t.ToolCall{Type: "function"}
+		call.Function.Name = "read_artifact"
+		call.Function.Arguments = string(argsBytes)
+		if resp := handler.HandleFull(ctx, call); resp["status"] == "success" {
+			texts = append(texts, flattenText(resp["data"]))
+		} else {
+			_, msg, _, _ := t.ErrorInfo(resp)
+			logx.Warningf("Could not read %s from publish branch %s to verify the push: %s", worklog, branchID, msg)
+		}
+	}
+	if evidence := authFailureEvidence(texts...); evidence != "" {
+		return &PublishError{Reason: PublishReasonAuth, BranchID: branchID, Evidence: evidence}
+	}
+	return nil
+}
+
+// flattenText collects every string inside v, one per line, so escaped
+// newlines in JSON payloads do not hide matches.
+func flattenText(v any) string {
+	var sb strings.Builder
+	var walk func(any)
+	walk = func(v any) {
+		switch x := v.(type) {
+		case string:
+			sb.WriteString(x)
+			sb.WriteByte('\n')
+		case map[string]any:
+			for _, item := range x {
+				walk(item)
+			}
+		case []any:
+			for _, item := range x {
+				walk(item)
+			}
+		}
+	}
+	walk(v)
+	return sb.String()
+}
@@ -0,0 +1,171 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/tools"
+)
+
+// fakePublishHandler answers the publish step's tool calls from a table.
+type fakePublishHandler struct {
+	latest  string
+	lineage []tools.BranchRecord
+	results map[string]map[string]any
+	calls   []tools.ToolCall
+}
+
+func (f *fakePublishHandler) BranchRange() map[string]string {
+	return map[string]string{"start_branch_id": "start", "latest_branch_id": f.latest}
+}
+
+func (f *fakePublishHandler) BranchLineage() []tools.BranchRecord { return f.lineage }
+
+func (f *fakePublishHandler) HandleFull(_ context.Context, call tools.ToolCall) map[string]any {
+	f.calls = append(f.calls, call)
+	if res, ok := f.results[call.Function.Name]; ok {
+		return res
+	}
+	return map[string]any{"status": "error", "error": map[string]any{"code": "NOT_FOUND", "message": "no such file"}}
+}
+
+func publishResult(data map[string]any) map[string]any {
+	return map[string]any{"status": "success", "data": data}
+}
+
+func testPublishOptions() PublishOptions {
+	return PublishOptions{GitHubToken: "ghp_test", ParentBranchID: "parent", Task: "task"}
+}
+
+func TestFinalizeBranchPushTerminalStatus(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    map[string]any
+		wantErr string
+	}{
+		{"succeeded", map[string]any{"branch_id": "pub", "terminal_status": "succeeded"}, ""},
+		{"failed", map[string]any{"branch_id": "pub", "terminal_status": "failed", "log_tail": "push\nerror: failed to push\n"}, "last log line: error: failed to push"},
+		{"cancelled", map[string]any{"branch_id": "pub", "terminal_status": "cancelled"}, "completed with cancelled status"},
+		// A raw status that merely looks successful is not enough.
+		{"untyped", map[string]any{"branch_id": "pub", "status": "succeed"}, "finished without a terminal status"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &fakePublishHandler{latest: "fix", results: map[string]map[string]any{"execute_agent": publishResult(c.data)}}
+			branchID, err := finalizeBranchPush(context.Background(), h, testPublishOptions(), "done")
+			if c.wantErr == "" {
+				if err != nil || branchID != "pub" {
+					t.Fatalf("got %q, %v", branchID, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestFinalizeBranchPushRefusesFailedParent(t *testing.T) {
+	h := &fakePublishHandler{latest: "fix", lineage: []tools.BranchRecord{{BranchID: "fix", Terminal: tools.TerminalFailed}}}
+	_, err := finalizeBranchPush(context.Background(), h, testPublishOptions(), "done")
+	if err == nil || !strings.Contains(err.Error(), "refusing to publish from branch fix") {
+		t.Fatalf("err = %v", err)
+	}
+	if len(h.calls) != 0 {
+		t.Errorf("publish launched from a failed branch: %v", h.calls)
+	}
+}
+
+// TestPublishAuthFailureFixtures scans captured publish logs, served either
+// as the worklog or as the branch's log tail, for push auth failures.
+func TestPublishAuthFailureFixtures(t *testing.T) {
+	cases := []struct {
+		fixture  string
+		evidence string // "" when the push went through
+	}{
+		{"https_auth_failed.log", "remote: Invalid username or password."},
+		{"ssh_publickey.log", "git@github.com: Permission denied (publickey)."},
+		{"https_403.log", "remote: Permission to acme/widgets.git denied to dev-bot."},
+		{"pushed.log", ""},
+	}
+	for _, c := range cases {
+		log, err := os.ReadFile(filepath.Join("testdata", "publish", c.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, source := range []string{"worklog", "log_tail"} {
+			t.Run(c.fixture+"/"+source, func(t *testing.T) {
+				captureLogs(t)
+				data := map[string]any{"branch_id": "pub", "terminal_status": "succeeded"}
+				results := map[string]map[string]any{"execute_agent": publishResult(data)}
+				if source == "worklog" {
+					results["read_artifact"] = publishResult(map[string]any{"path": testArtifactPaths.Worklog, "content": string(log)})
+				} else {
+					data["log_tail"] = string(log)
+				}
+				opts := testPublishOptions()
+				opts.Artifacts = testArtifactPaths
+				branchID, err := finalizeBranchPush(context.Background(), &fakePublishHandler{latest: "fix", results: results}, opts, "done")
+
+				if c.evidence == "" {
+					if err != nil || branchID != "pub" {
+						t.Fatalf("got %q, %v; want the published branch", branchID, err)
+					}
+					return
+				}
+				var perr *PublishError
+				if !errors.As(err, &perr) {
+					t.Fatalf("err = %v, want a PublishError", err)
+				}
+				if perr.Reason != PublishReasonAuth || perr.BranchID != "pub" || perr.Evidence != c.evidence {
+					t.Errorf("PublishError = %+v, want reason %s and evidence %q", perr, PublishReasonAuth, c.evidence)
+				}
+			})
+		}
+	}
+}
+
+// TestFinalizeBranchPushLargeResults publishes through a real handler whose
+// results exceed the result budget: the publish step must still see the
+// whole worklog and the branch id.
+func TestFinalizeBranchPushLargeResults(t *testing.T) {
+	const pub = "00000000-0000-4000-8000-000000000001"
+	opts := testPublishOptions()
+	opts.ParentBranchID = testParent
+
+	t.Run("worklog", func(t *testing.T) {
+		r := newTestRun(t)
+		worklog := strings.Repeat("pushing the change\n", 2000) + "remote: Invalid username or password.\n"
+		r.mcp.PutArtifact(pub, testArtifactPaths.Worklog, worklog)
+		read := tools.ToolCall{Type: "function"}
+		read.Function.Name = "read_artifact"
+		read.Function.Arguments = `{"branch_id": "` + pub + `", "path": "` + testArtifactPaths.Worklog + `"}`
+		if res := r.handler.Handle(context.Background(), read); res["data"] != nil {
+			t.Fatalf("a %d-byte worklog fit the result budget; the test needs it spilled", len(worklog))
+		}
+
+		opts := opts
+		opts.Artifacts = testArtifactPaths
+		_, err := finalizeBranchPush(context.Background(), r.handler, opts, "done")
+		var perr *PublishError
+		if !errors.As(err, &perr) || perr.Reason != PublishReasonAuth || perr.Evidence != "remote: Invalid username or password." {
+			t.Errorf("err = %v, want an auth PublishError from the end of the worklog", err)
+		}
+	})
+
+	t.Run("branch payload", func(t *testing.T) {
+		r := newTestRun(t)
+		r.mcp.Handle("get_branch", func(args map[string]any) (map[string]any, error) {
+			return map[string]any{"id": args["branch_id"], "status": "succeed", "description": strings.Repeat("pushed ", 4000)}, nil
+		})
+		branchID, err := finalizeBranchPush(context.Background(), r.handler, opts, "done")
+		if err != nil || branchID != pub {
+			t.Errorf("got %q, %v; want the published branch", branchID, err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package orchestrator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+const (
+	taskBeginMarker = "<<<BEGIN USER TASK"
+	taskEndMarker   = "<<<END USER TASK"
+)
+
+// EncapsulateTask wraps the user task in explicit BEGIN/END markers so
+// headings, code fences or "Final Step:" lines inside it cannot be mistaken
+// for the surrounding template. When the task already contains a marker, a
+// nonce derived from the task is added so the closing marker stays unique;
+// the result is deterministic, letting the orchestrator recognise the block
+// in prompts the model builds.
+func EncapsulateTask(task string) string {
+	begin, end := taskBeginMarker+">>>", taskEndMarker+">>>"
+	if strings.Contains(task, taskBeginMarker) || strings.Contains(task, taskEndMarker) {
+		sum := sha256.Sum256([]byte(task))
+		nonce := hex.EncodeToString(sum[:4])
+		begin = taskBeginMarker + " " + nonce + ">>>"
+		end = taskEndMarker + " " + nonce + ">>>"
+	}
+	return begin + "\n" + task + "\n" + end
+}
+
+// enforceTaskBlock makes sure execute_agent prompts (the shared prompt or
+// each per-branch entry of prompts) carry the task in its encapsulated form.
+// A prompt that pasted the raw task gets it replaced by the block; the call
+// is returned unchanged otherwise.
+func enforceTaskBlock(call t.ToolCall, task string) t.ToolCall {
+	if call.Function.Name != "execute_agent" || strings.TrimSpace(task) == "" {
+		return call
+	}
+	var args map[string]any
+	if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+		return call
+	}
+	block := EncapsulateTask(task)
+	changed := false
+	if prompt, _ := args["prompt"].(string); prompt != "" {
+		if wrapped, ok := wrapTask(prompt, task, block); ok {
+			args["prompt"], changed = wrapped, true
+		}
+	}
+	if list, ok := args["prompts"].([]any); ok {
+		for i, v := range list {
+			if prompt, _ := v.(string); prompt != "" {
+				if wrapped, ok := wrapTask(prompt, task, block); ok {
+					list[i], changed = wrapped, true
+				}
+			}
+		}
+	}
+	if !changed {
+		return call
+	}
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return call
+	}
+	call.Function.Arguments = string(raw)
+	return call
+}
+
+// wrapTask replaces the raw task in prompt with its block, reporting whether
+// the prompt changed.
+func wrapTask(prompt, task, block string) (string, bool) {
+	if strings.Contains(prompt, block) {
+		return prompt, false
+	}
+	if !strings.Contains(prompt, task) {
+		logx.Warningf("execute_agent prompt does not contain the encapsulated user task.")
+		return prompt, false
+	}
+	logx.Infof("Wrapping raw user task in execute_agent prompt with task markers.")
+	return strings.Replace(prompt, task, block, 1), true
+}
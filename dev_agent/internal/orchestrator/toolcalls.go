@@ -0,0 +1,82 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+
+	b "dev_agent/internal/brain"
+	"dev_agent/internal/logx"
+	t "dev_agent/internal/tools"
+)
+
+// dedupeToolCalls drops repeated tool_call ids. The chat API requires exactly
+// one tool message per id, so a duplicate would either go unanswered or be
+// answered twice.
+func dedupeToolCalls(calls []b.ToolCall) []b.ToolCall {
+	seen := make(map[string]bool, len(calls))
+	out := make([]b.ToolCall, 0, len(calls))
+	for _, tc := range calls {
+		if seen[tc.ID] {
+			logx.Warningf("Dropping duplicate tool_call id %s (%s) from assistant message.", tc.ID, tc.Function.Name)
+			continue
+		}
+		seen[tc.ID] = true
+		out = append(out, tc)
+	}
+	return out
+}
+
+// handlerCall converts a model tool call for the handler, enforcing the
+// task block on agent prompts.
+func handlerCall(tc b.ToolCall, task string) t.ToolCall {
+	htc := t.ToolCall{ID: tc.ID, Type: tc.Type}
+	htc.Function.Name = tc.Function.Name
+	htc.Function.Arguments = tc.Function.Arguments
+	return enforceTaskBlock(htc, task)
+}
+
+// safeHandle runs a tool call and converts a panic into an error payload so
+// the call still gets its tool response.
+func safeHandle(ctx context.Context, handler *t.ToolHandler, call t.ToolCall) (result map[string]any) {
+	defer func() {
+		if r := recover(); r != nil {
+			logx.Errorf("Tool %s panicked: %v", call.Function.Name, r)
+			result = handler.ErrorResult(call.Function.Name, t.ToolExecutionError{
+				Code:    t.CodeToolFailed,
+				Msg:     fmt.Sprintf("internal error while running %s: %v", call.Function.Name, r),
+				Details: map[string]any{"retryable": false},
+			})
+		}
+	}()
+	return handler.Handle(ctx, call)
+}
+
+// ensureToolResponses checks that messages[turnStart:] holds exactly one tool
+// message for every call and appends a synthesized error response, built by
+// handler, for any call that is missing one.
+func ensureToolResponses(handler *t.ToolHandler, messages []b.ChatMessage, turnStart int, calls []b.ToolCall) []b.ChatMessage {
+	answered := map[string]int{}
+	for _, m := range messages[turnStart:] {
+		if m.Role == "tool" {
+			answered[m.ToolCallID]++
+		}
+	}
+	for _, tc := range calls {
+		switch n := answered[tc.ID]; {
+		case n == 0:
+			logx.Errorf("Tool call %s (%s) has no tool response; synthesizing an error response.", tc.ID, tc.Function.Name)
+			payload := handler.ErrorResult(tc.Function.Name, t.ToolExecutionError{
+				Code: t.CodeResultUnknown,
+				Msg:  fmt.Sprintf("no result was recorded for tool call %s; retry the call if still needed", tc.Function.Name),
+				Details: map[string]any{
+					"retryable": true,
+					"hint":      "The call may or may not have run. Check with check_status or the branch listing before relaunching an agent.",
+				},
+			})
+			messages = append(messages, b.ChatMessage{Role: "tool", ToolCallID: tc.ID, Content: toJSON(payload)})
+		case n > 1:
+			logx.Errorf("Tool call %s (%s) has %d tool responses.", tc.ID, tc.Function.Name, n)
+		}
+	}
+	return messages
+}
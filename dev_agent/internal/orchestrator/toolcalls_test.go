@@ -0,0 +1,109 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	b "dev_agent/internal/brain"
+	"dev_agent/internal/tools"
+)
+
+func TestDedupeToolCalls(t *testing.T) {
+	logs := captureLogs(t)
+	calls := []b.ToolCall{
+		toolCall("call_1", "check_status", nil),
+		toolCall("call_2", "read_artifact", nil),
+		toolCall("call_1", "execute_agent", nil),
+	}
+	got := dedupeToolCalls(calls)
+	if len(got) != 2 || got[0].ID != "call_1" || got[0].Function.Name != "check_status" || got[1].ID != "call_2" {
+		t.Errorf("deduped = %+v, want the first call_1 and call_2", got)
+	}
+	if !strings.Contains(logs.String(), "Dropping duplicate tool_call id call_1 (execute_agent)") {
+		t.Errorf("no warning for the duplicate:\n%s", logs.String())
+	}
+}
+
+// TestEnsureToolResponsesFillsGaps breaks the pairing on purpose: one call
+// is answered, one is not and one is answered twice.
+func TestEnsureToolResponsesFillsGaps(t *testing.T) {
+	logs := captureLogs(t)
+	calls := []b.ToolCall{toolCall("call_1", "check_status", nil), toolCall("call_2", "read_artifact", nil), toolCall("call_3", "list_artifacts", nil)}
+	messages := []b.ChatMessage{
+		{Role: "tool", ToolCallID: "call_2", Content: "stale answer from an earlier turn"},
+		{Role: "assistant", ToolCalls: calls},
+		{Role: "tool", ToolCallID: "call_1", Content: `{"status":"success"}`},
+		{Role: "tool", ToolCallID: "call_3", Content: `{"status":"success"}`},
+		{Role: "tool", ToolCallID: "call_3", Content: `{"status":"success"}`},
+	}
+	h := tools.NewToolHandler(nil, "demo", testParent)
+	got := ensureToolResponses(h, messages, 2, calls)
+	if len(got) != len(messages)+1 {
+		t.Fatalf("got %d messages, want one synthesized response appended", len(got))
+	}
+	last := got[len(got)-1]
+	if last.Role != "tool" || last.ToolCallID != "call_2" {
+		t.Fatalf("synthesized message = %+v, want a tool response to call_2", last)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(last.Content), &payload); err != nil {
+		t.Fatalf("synthesized content = %s: %v", last.Content, err)
+	}
+	e, _ := payload["error"].(map[string]any)
+	if payload["status"] != "error" || e["code"] != tools.ErrorCodeResultUnknown || e["retryable"] != true || !strings.Contains(fmt.Sprint(e["message"]), "no result was recorded for tool call read_artifact") {
+		t.Errorf("synthesized content = %s, want a retryable %s error", last.Content, tools.ErrorCodeResultUnknown)
+	}
+	for _, want := range []string{"Tool call call_2 (read_artifact) has no tool response", "Tool call call_3 (list_artifacts) has 2 tool responses"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs.String())
+		}
+	}
+	if again := ensureToolResponses(h, got, 2, calls); len(again) != len(got) {
+		t.Errorf("a complete turn gained %d messages", len(again)-len(got))
+	}
+}
+
+func TestSafeHandleRecoversPanic(t *testing.T) {
+	captureLogs(t)
+	// A handler without a client panics on the first MCP call.
+	h := tools.NewToolHandler(nil, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	var call tools.ToolCall
+	call.ID = "call_1"
+	call.Function.Name = "read_artifact"
+	call.Function.Arguments = `{"branch_id": "` + testParent + `", "path": "worklog.md"}`
+	result := safeHandle(context.Background(), h, call)
+	e, _ := result["error"].(map[string]any)
+	if result["status"] != "error" || e["code"] != tools.ErrorCodeToolFailed || e["retryable"] != false || !strings.Contains(fmt.Sprint(e["message"]), "internal error while running read_artifact") {
+		t.Errorf("result = %v, want a non-retryable %s error", result, tools.ErrorCodeToolFailed)
+	}
+}
+
+func TestDuplicateToolCallAnsweredOnce(t *testing.T) {
+	readCall := toolCall("call_1", "read_artifact", map[string]any{"branch_id": testParent, "path": "worklog.md"})
+	dup := toolCall("call_1", "check_status", map[string]any{"branch_id": testParent})
+	r := newTestRun(t, toolCallReply(readCall, dup, toolCall("call_2", "read_artifact", map[string]any{"branch_id": testParent, "path": "review.log"})), finalReply())
+	if _, err := r.orchestrate(t); err != nil {
+		t.Fatalf("Orchestrate: %v", err)
+	}
+	reqs := r.llm.Requests()
+	if len(reqs) < 2 {
+		t.Fatalf("model was asked %d times", len(reqs))
+	}
+	got := toolMessages(reqs[1])
+	if got["call_1"] != 1 || got["call_2"] != 1 || len(got) != 2 {
+		t.Errorf("tool messages by id = %v, want exactly one each", got)
+	}
+	assistant := reqs[1].Messages[len(reqs[1].Messages)-3]
+	if assistant.Role != "assistant" || len(assistant.ToolCalls) != 2 {
+		t.Errorf("assistant message sent back = %+v, want the two distinct calls", assistant)
+	}
+	for _, c := range r.mcp.CallsTo("get_branch") {
+		if c.Arguments["branch_id"] == testParent {
+			t.Errorf("the dropped duplicate still ran: %v", c)
+		}
+	}
+}
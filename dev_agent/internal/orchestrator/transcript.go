@@ -0,0 +1,179 @@
+package orchestrator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// Transcript event kinds.
+const (
+	EventIteration   = "iteration"
+	EventAssistant   = "assistant"
+	EventRationale   = "tool_call_rationale"
+	EventToolCall    = "tool_call"
+	EventToolResult  = "tool_result"
+	EventReview      = "review"
+	EventNotFinal    = "not_final"
+	EventCorrective  = "corrective_prompt"
+	EventFinalReport = "final_report"
+	EventError       = "error"
+)
+
+// TranscriptEvent is one line of a run transcript (JSONL).
+type TranscriptEvent struct {
+	Time       time.Time      `json:"ts"`
+	RunID      string         `json:"run_id,omitempty"`
+	Kind       string         `json:"kind"`
+	Iteration  int            `json:"iteration,omitempty"`
+	Content    string         `json:"content,omitempty"`
+	Tool       string         `json:"tool,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+	Arguments  string         `json:"arguments,omitempty"`
+	Result     map[string]any `json:"result,omitempty"`
+	Report     map[string]any `json:"report,omitempty"`
+}
+
+// Transcript appends events to a JSONL file as they happen so a crashed run
+// still leaves everything up to the crash on disk. A nil *Transcript is a
+// valid no-op recorder.
+type Transcript struct {
+	mu    sync.Mutex
+	f     *os.File
+	runID string
+}
+
+func NewTranscript(path, runID string) (*Transcript, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Transcript{f: f, runID: runID}, nil
+}
+
+func (t *Transcript) Record(ev TranscriptEvent) {
+	if t == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.RunID = t.runID
+	line, err := json.Marshal(ev)
+	if err != nil {
+		logx.Warningf("Failed to encode transcript event %s: %v", ev.Kind, err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.f.Write(append([]byte(logx.Redact(string(line))), '\n')); err != nil {
+		logx.Warningf("Failed to write transcript: %v", err)
+	}
+}
+
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
+
+// ReplayOptions controls RenderTranscript.
+type ReplayOptions struct {
+	// Only restricts output to "tools", "assistant" or "errors"; empty shows all.
+	Only string
+	// Speed > 0 sleeps between events for the recorded gap divided by Speed.
+	Speed float64
+}
+
+// maxReplayGap caps the delay between two animated events.
+const maxReplayGap = 3 * time.Second
+
+// RenderTranscript prints a saved transcript in the ChatLoop console format.
+// A trailing partial line (a run killed mid-write) is reported and skipped.
+func RenderTranscript(w io.Writer, r io.Reader, opts ReplayOptions) error {
+	switch opts.Only {
+	case "", "tools", "assistant", "errors":
+	default:
+		return fmt.Errorf("unknown --only filter %q (want tools, assistant or errors)", opts.Only)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var prev time.Time
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		var ev TranscriptEvent
+		if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+			fmt.Fprintf(w, "note: skipping unreadable transcript line %d (%v)\n", lineNo, err)
+			continue
+		}
+		if !replayIncludes(opts.Only, ev) {
+			continue
+		}
+		if opts.Speed > 0 && !prev.IsZero() && ev.Time.After(prev) {
+			gap := time.Duration(float64(ev.Time.Sub(prev)) / opts.Speed)
+			if gap > maxReplayGap {
+				gap = maxReplayGap
+			}
+			time.Sleep(gap)
+		}
+		prev = ev.Time
+		renderEvent(w, ev)
+	}
+	return scanner.Err()
+}
+
+func replayIncludes(only string, ev TranscriptEvent) bool {
+	switch only {
+	case "tools":
+		return ev.Kind == EventToolCall || ev.Kind == EventToolResult
+	case "assistant":
+		return ev.Kind == EventAssistant || ev.Kind == EventRationale || ev.Kind == EventFinalReport
+	case "errors":
+		if ev.Kind == EventError {
+			return true
+		}
+		status, _ := ev.Result["status"].(string)
+		return ev.Kind == EventToolResult && status == "error"
+	}
+	return true
+}
+
+func renderEvent(w io.Writer, ev TranscriptEvent) {
+	switch ev.Kind {
+	case EventIteration:
+		fmt.Fprintf(w, "[iter %d] requesting completion...\n", ev.Iteration)
+	case EventAssistant:
+		fmt.Fprintf(w, "assistant> %s\n", ev.Content)
+	case EventRationale:
+		fmt.Fprintf(w, "assistant (tool-call rationale)> %s\n", ev.Content)
+	case EventToolCall:
+		fmt.Fprintf(w, "tool> %s %s\n", ev.Tool, ev.Arguments)
+	case EventToolResult:
+		fmt.Fprintf(w, "tool< %s\n", toJSON(ev.Result))
+	case EventReview, EventNotFinal:
+		fmt.Fprintf(w, "%s\n", ev.Content)
+	case EventCorrective:
+		fmt.Fprintf(w, "you (corrective)> %s\n", ev.Content)
+	case EventFinalReport:
+		fmt.Fprintln(w, "assistant< final_report")
+		out, _ := json.MarshalIndent(ev.Report, "", "  ")
+		fmt.Fprintln(w, string(out))
+	case EventError:
+		fmt.Fprintf(w, "error: %s\n", ev.Content)
+	default:
+		fmt.Fprintf(w, "%s: %s\n", ev.Kind, ev.Content)
+	}
+}
@@ -0,0 +1,118 @@
+package orchestrator
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, rewriting it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (rerun with -update to accept):\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func TestRenderTranscriptGolden(t *testing.T) {
+	for _, only := range []string{"", "tools", "assistant", "errors"} {
+		name := "transcript.golden"
+		if only != "" {
+			name = "transcript." + only + ".golden"
+		}
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "transcript.jsonl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var out bytes.Buffer
+			if err := RenderTranscript(&out, f, ReplayOptions{Only: only}); err != nil {
+				t.Fatalf("RenderTranscript: %v", err)
+			}
+			checkGolden(t, name, out.Bytes())
+		})
+	}
+}
+
+func TestRenderTranscriptUnknownFilter(t *testing.T) {
+	err := RenderTranscript(&bytes.Buffer{}, strings.NewReader(""), ReplayOptions{Only: "everything"})
+	if err == nil || !strings.Contains(err.Error(), "unknown --only filter") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// TestRenderTranscriptFullResult checks replay prints a tool result as the
+// model received it; the handler's result budget is the only cut.
+func TestRenderTranscriptFullResult(t *testing.T) {
+	content := strings.Repeat("r", 5000)
+	line := `{"ts":"2026-10-01T09:00:00Z","kind":"tool_result","tool":"read_artifact","result":{"status":"success","data":{"content":"` + content + `"}}}`
+	var out bytes.Buffer
+	if err := RenderTranscript(&out, strings.NewReader(line+"\n"), ReplayOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), content) {
+		t.Errorf("replayed result was cut to %d bytes", out.Len())
+	}
+}
+
+func TestRenderTranscriptSpeed(t *testing.T) {
+	var sb strings.Builder
+	for _, ts := range []string{"2026-10-01T09:00:00Z", "2026-10-01T09:00:01Z", "2026-10-01T09:00:02Z"} {
+		sb.WriteString(`{"ts":"` + ts + `","kind":"iteration","iteration":1}` + "\n")
+	}
+	start := time.Now()
+	if err := RenderTranscript(&bytes.Buffer{}, strings.NewReader(sb.String()), ReplayOptions{Speed: 20}); err != nil {
+		t.Fatal(err)
+	}
+	// Two recorded one-second gaps at 20x speed.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > maxReplayGap {
+		t.Errorf("replay took %s", elapsed)
+	}
+}
+
+func TestTranscriptRecordsAndReplays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.jsonl")
+	rec, err := NewTranscript(path, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Record(TranscriptEvent{Kind: EventIteration, Iteration: 1})
+	rec.Record(TranscriptEvent{Kind: EventToolCall, Iteration: 1, Tool: "check_status", Arguments: `{"branch_id":"b1"}`})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var nilRec *Transcript
+	nilRec.Record(TranscriptEvent{Kind: EventIteration})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), `"run_id":"run-1"`); n != 2 {
+		t.Errorf("%d of 2 events carry the run id:\n%s", n, data)
+	}
+	var out bytes.Buffer
+	if err := RenderTranscript(&out, bytes.NewReader(data), ReplayOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[iter 1] requesting completion...\ntool> check_status {\"branch_id\":\"b1\"}\n"; out.String() != want {
+		t.Errorf("replay = %q, want %q", out.String(), want)
+	}
+}
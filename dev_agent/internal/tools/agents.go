@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultAllowedAgents are the agents execute_agent launches unless
+// SetAllowedAgents says otherwise.
+var DefaultAllowedAgents = []string{"claude_code", "codex"}
+
+// SetAllowedAgents replaces the agents execute_agent accepts and the list
+// shown in its schema; an empty list keeps the current one.
+func (h *ToolHandler) SetAllowedAgents(names []string) {
+	var clean []string
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" {
+			clean = append(clean, n)
+		}
+	}
+	if len(clean) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.allowedAgents = clean
+	h.describeAgents()
+}
+
+// describeAgents puts the allowlist into the description of execute_agent's
+// agent argument, so the model sees it before its first call. The schema is
+// copied, not edited, since ToolDefinitions hands it out. h.mu must be held.
+func (h *ToolHandler) describeAgents() {
+	tool, ok := h.tools["execute_agent"]
+	if !ok {
+		return
+	}
+	props, _ := tool.Schema["properties"].(map[string]any)
+	agent, _ := props["agent"].(map[string]any)
+	if agent == nil {
+		return
+	}
+	schema := make(map[string]any, len(tool.Schema))
+	for k, v := range tool.Schema {
+		schema[k] = v
+	}
+	newProps := make(map[string]any, len(props))
+	for k, v := range props {
+		newProps[k] = v
+	}
+	newAgent := make(map[string]any, len(agent))
+	for k, v := range agent {
+		newAgent[k] = v
+	}
+	newAgent["description"] = "Target specialist agent: one of " + strings.Join(h.allowedAgents, ", ") + "."
+	newProps["agent"] = newAgent
+	schema["properties"] = newProps
+	tool.Schema = schema
+	h.tools["execute_agent"] = tool
+}
+
+// checkAgent rejects an agent outside the allowlist before anything is
+// sent to the server, naming the allowed agents and the closest one.
+func (h *ToolHandler) checkAgent(agent string) error {
+	h.mu.Lock()
+	allowed := h.allowedAgents
+	h.mu.Unlock()
+	best, bestDist := "", 0
+	for _, a := range allowed {
+		if a == agent {
+			return nil
+		}
+		if d := editDistance(strings.ToLower(agent), a); best == "" || d < bestDist {
+			best, bestDist = a, d
+		}
+	}
+	msg := fmt.Sprintf("Agent %q is not available; use one of: %s.", agent, strings.Join(allowed, ", "))
+	details := map[string]any{"allowed_agents": allowed, "retryable": false}
+	if best != "" && bestDist <= max(len(agent), len(best))/2 {
+		msg += fmt.Sprintf(" Did you mean %s?", best)
+		details["did_you_mean"] = best
+	}
+	return ToolExecutionError{Code: CodeInvalidArguments, Msg: msg, Details: details}
+}
@@ -0,0 +1,85 @@
+package tools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecuteAgentAllowlist(t *testing.T) {
+	cases := []struct {
+		agent   string
+		allowed bool
+		suggest string
+	}{
+		{"claude_code", true, ""},
+		{"codex", true, ""},
+		{"claude-code", false, "claude_code"},
+		{"Codex", false, "codex"},
+		{"gpt_reviewer", false, ""},
+		{"tester", false, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.agent, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			res := callTool(h, "execute_agent", map[string]any{"agent": c.agent, "prompt": "Implement the task.", "parent_branch_id": testParent})
+			if c.allowed {
+				mustSucceed(t, res)
+				return
+			}
+			code, details := mustFail(t, res)
+			if code != CodeInvalidArguments || !reflect.DeepEqual(details["allowed_agents"], DefaultAllowedAgents) {
+				t.Errorf("code %s, details %v; want %s listing %v", code, details, CodeInvalidArguments, DefaultAllowedAgents)
+			}
+			if _, msg, _, _ := ErrorInfo(res); !strings.Contains(msg, "use one of: claude_code, codex.") {
+				t.Errorf("message %q does not list the allowed agents", msg)
+			}
+			if got, _ := details["did_you_mean"].(string); got != c.suggest {
+				t.Errorf("did_you_mean = %q, want %q", got, c.suggest)
+			}
+			if n := len(srv.Calls()); n != 0 {
+				t.Errorf("%d server requests for a denied agent, want none", n)
+			}
+		})
+	}
+}
+
+// agentDescription is the description of execute_agent's agent argument.
+func agentDescription(defs []map[string]any) string {
+	for _, def := range defs {
+		fn, _ := def["function"].(map[string]any)
+		if fn["name"] != "execute_agent" {
+			continue
+		}
+		props, _ := fn["parameters"].(map[string]any)["properties"].(map[string]any)
+		desc, _ := props["agent"].(map[string]any)["description"].(string)
+		return desc
+	}
+	return ""
+}
+
+func TestSetAllowedAgents(t *testing.T) {
+	if desc := agentDescription(GetToolDefinitions()); desc != "Target specialist agent: one of claude_code, codex." {
+		t.Errorf("default description = %q", desc)
+	}
+
+	h, _ := newTestHandler(t)
+	h.SetAllowedAgents([]string{" codex ", "", "aider"})
+	if desc := agentDescription(h.ToolDefinitions()); desc != "Target specialist agent: one of codex, aider." {
+		t.Errorf("description = %q, want the new allowlist", desc)
+	}
+	mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "aider", "prompt": "Implement the task.", "parent_branch_id": testParent}))
+	_, details := mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent}))
+	if !reflect.DeepEqual(details["allowed_agents"], []string{"codex", "aider"}) {
+		t.Errorf("allowed_agents = %v, want codex and aider", details["allowed_agents"])
+	}
+
+	// An empty list keeps the current one; other handlers are unaffected.
+	h.SetAllowedAgents([]string{" ", ""})
+	if err := h.checkAgent("aider"); err != nil {
+		t.Errorf("aider after an empty SetAllowedAgents: %v", err)
+	}
+	if desc := agentDescription(GetToolDefinitions()); !strings.Contains(desc, "claude_code, codex") {
+		t.Errorf("GetToolDefinitions description changed to %q", desc)
+	}
+}
@@ -0,0 +1,104 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+// maxAncestryDepth bounds the get_branch walk of GetBranchAncestry.
+const maxAncestryDepth = 100
+
+// AncestryError reports a lineage that could not be followed to its root:
+// a parent that does not exist, a cycle, or a chain deeper than
+// maxAncestryDepth. Chain holds the branches resolved so far, oldest first.
+type AncestryError struct {
+	BranchID string
+	Problem  string
+	Chain    []BranchInfo
+	Err      error
+}
+
+func (e *AncestryError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("ancestry of branch %s: %s: %v", e.BranchID, e.Problem, e.Err)
+	}
+	return fmt.Sprintf("ancestry of branch %s: %s", e.BranchID, e.Problem)
+}
+
+func (e *AncestryError) Unwrap() error { return e.Err }
+
+// GetBranchAncestry returns the chain of branches from the root to
+// branchID, oldest first, by following get_branch parent pointers.
+func (c *MCPClient) GetBranchAncestry(ctx context.Context, branchID string) ([]BranchInfo, error) {
+	var chain []BranchInfo
+	seen := map[string]bool{}
+	id := branchID
+	for id != "" {
+		if seen[id] {
+			ids := make([]string, 0, len(chain)+1)
+			for _, b := range chain {
+				ids = append(ids, b.ID)
+			}
+			return nil, &AncestryError{BranchID: branchID, Problem: fmt.Sprintf("parent pointers form a cycle (%s)", strings.Join(append(ids, id), " -> ")), Chain: reverseBranches(chain)}
+		}
+		if len(chain) == maxAncestryDepth {
+			return nil, &AncestryError{BranchID: branchID, Problem: fmt.Sprintf("deeper than %d branches", maxAncestryDepth), Chain: reverseBranches(chain)}
+		}
+		seen[id] = true
+		b, err := c.GetBranch(ctx, id, 0)
+		// A missing branch is an isError reply or one without a branch.
+		var failed MCPToolError
+		var empty *ResponseSchemaError
+		if (errors.As(err, &failed) || errors.As(err, &empty)) && len(chain) > 0 {
+			return nil, &AncestryError{BranchID: branchID, Problem: fmt.Sprintf("parent %s of branch %s was not found", id, chain[len(chain)-1].ID), Chain: reverseBranches(chain), Err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, b)
+		id = b.ParentID
+	}
+	return reverseBranches(chain), nil
+}
+
+func reverseBranches(chain []BranchInfo) []BranchInfo {
+	out := make([]BranchInfo, len(chain))
+	for i, b := range chain {
+		out[len(chain)-1-i] = b
+	}
+	return out
+}
+
+// AncestrySummary reduces a chain to the fields the model and the final
+// report need.
+func AncestrySummary(chain []BranchInfo) []map[string]any {
+	out := make([]map[string]any, len(chain))
+	for i, b := range chain {
+		entry := map[string]any{"branch_id": b.ID}
+		for k, v := range map[string]string{"parent_branch_id": b.ParentID, "agent": b.Agent, "status": b.Status, "created_at": b.CreatedAt} {
+			if v != "" {
+				entry[k] = v
+			}
+		}
+		out[i] = entry
+	}
+	return out
+}
+
+func (h *ToolHandler) branchAncestry(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	logx.Infof("Resolving ancestry of branch %s", branchID)
+	chain, err := h.client.GetBranchAncestry(ctx, branchID)
+	var broken *AncestryError
+	if errors.As(err, &broken) {
+		return nil, ToolExecutionError{Code: CodeToolFailed, Msg: err.Error(), Details: map[string]any{"partial_ancestry": AncestrySummary(broken.Chain)}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"branch_id": branchID, "depth": len(chain), "ancestry": AncestrySummary(chain)}, nil
+}
@@ -0,0 +1,136 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// lineageServer answers get_branch from parents, which maps each existing
+// branch to its parent ("" for a root); other ids are not found.
+func lineageServer(t *testing.T, parents map[string]string) *mcptest.FakeServer {
+	t.Helper()
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	srv.Handle("get_branch", func(args map[string]any) (map[string]any, error) {
+		id, _ := args["branch_id"].(string)
+		parent, ok := parents[id]
+		if !ok {
+			return nil, fmt.Errorf("branch %s not found", id)
+		}
+		return map[string]any{"id": id, "parent_id": parent, "status": "succeed", "agent": "claude_code"}, nil
+	})
+	return srv
+}
+
+// chainParents describes b1 <- b2 <- ... <- bn.
+func chainParents(n int) map[string]string {
+	parents := map[string]string{"b1": ""}
+	for i := 2; i <= n; i++ {
+		parents[fmt.Sprintf("b%d", i)] = fmt.Sprintf("b%d", i-1)
+	}
+	return parents
+}
+
+func branchIDs(chain []BranchInfo) []string {
+	ids := make([]string, len(chain))
+	for i, b := range chain {
+		ids[i] = b.ID
+	}
+	return ids
+}
+
+func TestGetBranchAncestry(t *testing.T) {
+	srv := lineageServer(t, chainParents(5))
+	client := newTestClient(t, srv)
+	chain, err := client.GetBranchAncestry(context.Background(), "b5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := branchIDs(chain), []string{"b1", "b2", "b3", "b4", "b5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ancestry = %v, want %v", got, want)
+	}
+	if chain[4].ParentID != "b4" || chain[0].ParentID != "" {
+		t.Errorf("parents = %q ... %q, want b4 and none", chain[4].ParentID, chain[0].ParentID)
+	}
+	if n := len(srv.CallsTo("get_branch")); n != 5 {
+		t.Errorf("%d get_branch calls, want 5", n)
+	}
+}
+
+func TestGetBranchAncestryBroken(t *testing.T) {
+	cycle := chainParents(5)
+	cycle["b1"] = "b3"
+	missing := chainParents(5)
+	missing["b3"] = "ghost"
+	cases := []struct {
+		name    string
+		parents map[string]string
+		problem string
+		partial []string
+	}{
+		{"missing parent", missing, "parent ghost of branch b3 was not found", []string{"b3", "b4", "b5"}},
+		{"cycle", cycle, "parent pointers form a cycle (b5 -> b4 -> b3 -> b2 -> b1 -> b3)", []string{"b1", "b2", "b3", "b4", "b5"}},
+		{"too deep", chainParents(maxAncestryDepth + 1), fmt.Sprintf("deeper than %d branches", maxAncestryDepth), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := newTestClient(t, lineageServer(t, c.parents))
+			start := "b5"
+			if c.partial == nil {
+				start = fmt.Sprintf("b%d", maxAncestryDepth+1)
+			}
+			_, err := client.GetBranchAncestry(context.Background(), start)
+			var broken *AncestryError
+			if !errors.As(err, &broken) || broken.Problem != c.problem {
+				t.Fatalf("err = %v, want an AncestryError: %s", err, c.problem)
+			}
+			if c.partial != nil && !reflect.DeepEqual(branchIDs(broken.Chain), c.partial) {
+				t.Errorf("partial chain = %v, want %v", branchIDs(broken.Chain), c.partial)
+			}
+			if c.partial == nil && len(broken.Chain) != maxAncestryDepth {
+				t.Errorf("partial chain has %d branches, want %d", len(broken.Chain), maxAncestryDepth)
+			}
+		})
+	}
+
+	t.Run("missing start", func(t *testing.T) {
+		client := newTestClient(t, lineageServer(t, chainParents(2)))
+		_, err := client.GetBranchAncestry(context.Background(), "nope")
+		var broken *AncestryError
+		if err == nil || errors.As(err, &broken) {
+			t.Errorf("err = %v, want the lookup failure itself", err)
+		}
+	})
+}
+
+func TestBranchAncestryTool(t *testing.T) {
+	parents := chainParents(5)
+	parents["b7"] = "b6"
+	srv := lineageServer(t, parents)
+	h := NewToolHandler(newTestClient(t, srv), "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+
+	data := mustSucceed(t, callTool(h, "branch_ancestry", map[string]any{"branch_id": "b5"}))
+	ancestry, _ := data["ancestry"].([]map[string]any)
+	if data["depth"] != 5 || len(ancestry) != 5 {
+		t.Fatalf("data = %v, want 5 branches", data)
+	}
+	if want := map[string]any{"branch_id": "b2", "parent_branch_id": "b1", "agent": "claude_code", "status": "succeed"}; !reflect.DeepEqual(ancestry[1], want) {
+		t.Errorf("ancestry[1] = %v, want %v", ancestry[1], want)
+	}
+
+	code, details := mustFail(t, callTool(h, "branch_ancestry", map[string]any{"branch_id": "b7"}))
+	partial, _ := details["partial_ancestry"].([]map[string]any)
+	if code != CodeToolFailed || len(partial) != 1 || partial[0]["branch_id"] != "b7" {
+		t.Errorf("code %s, details %v; want TOOL_FAILED with b7 resolved", code, details)
+	}
+	if _, msg, _, _ := ErrorInfo(callTool(h, "branch_ancestry", map[string]any{"branch_id": "b7"})); !strings.Contains(msg, "parent b6 of branch b7 was not found") {
+		t.Errorf("message %q does not name the missing parent", msg)
+	}
+}
@@ -0,0 +1,59 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+// numberArg reads a numeric tool argument. The model regularly sends numbers
+// as strings ("2"), so numeric strings and json.Number are accepted alongside
+// float64 and logged when coerced. ok is false when the argument is absent.
+func numberArg(args map[string]any, name string) (value float64, ok bool, err error) {
+	raw, present := args[name]
+	if !present || raw == nil {
+		return 0, false, nil
+	}
+	switch v := raw.(type) {
+	case float64:
+		return v, true, nil
+	case int:
+		return float64(v), true, nil
+	case int64:
+		return float64(v), true, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, false, invalidNumber(name, raw)
+		}
+		return f, true, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false, invalidNumber(name, raw)
+		}
+		logx.Infof("Coerced argument %s from string %q to %v", name, v, f)
+		return f, true, nil
+	}
+	return 0, false, invalidNumber(name, raw)
+}
+
+// intArg is numberArg for integer-valued arguments.
+func intArg(args map[string]any, name string) (int, bool, error) {
+	f, ok, err := numberArg(args, name)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	if f != math.Trunc(f) {
+		return 0, false, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`%s` must be an integer, got %v", name, f)}
+	}
+	return int(f), true, nil
+}
+
+func invalidNumber(name string, v any) error {
+	return ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`%s` must be a number, got %s", name, toJSON(v))}
+}
@@ -0,0 +1,80 @@
+package tools
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNumberArg(t *testing.T) {
+	cases := []struct {
+		name    string
+		v       any
+		want    float64
+		ok      bool
+		wantErr bool
+	}{
+		{"float64", 2.5, 2.5, true, false},
+		{"int", 3, 3, true, false},
+		{"int64", int64(4), 4, true, false},
+		{"json.Number", json.Number("5"), 5, true, false},
+		{"bad json.Number", json.Number("five"), 0, false, true},
+		{"numeric string", "2", 2, true, false},
+		{"padded string", " 7.5 ", 7.5, true, false},
+		{"word", "two", 0, false, true},
+		{"empty string", "", 0, false, true},
+		{"NaN", "NaN", 0, false, true},
+		{"Inf", "Inf", 0, false, true},
+		{"bool", true, 0, false, true},
+		{"null", nil, 0, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok, err := numberArg(map[string]any{"timeout_seconds": c.v}, "timeout_seconds")
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, want error %t", err, c.wantErr)
+			}
+			if got != c.want || ok != c.ok {
+				t.Errorf("numberArg = %v, %t; want %v, %t", got, ok, c.want, c.ok)
+			}
+			if err != nil {
+				te, isTE := err.(ToolExecutionError)
+				if !isTE || te.Code != CodeInvalidArguments || !strings.Contains(te.Msg, "`timeout_seconds` must be a number") {
+					t.Errorf("err = %#v", err)
+				}
+			}
+		})
+	}
+	if _, ok, err := numberArg(map[string]any{}, "timeout_seconds"); ok || err != nil {
+		t.Errorf("absent argument: ok %t err %v", ok, err)
+	}
+}
+
+func TestIntArg(t *testing.T) {
+	if n, ok, err := intArg(map[string]any{"num_branches": "2"}, "num_branches"); n != 2 || !ok || err != nil {
+		t.Errorf(`intArg("2") = %d, %t, %v`, n, ok, err)
+	}
+	if _, _, err := intArg(map[string]any{"num_branches": 1.5}, "num_branches"); err == nil || !strings.Contains(err.Error(), "must be an integer") {
+		t.Errorf("intArg(1.5) err = %v", err)
+	}
+}
+
+func TestNumericStringArgumentsAreCoerced(t *testing.T) {
+	logs := captureLogs(t)
+	h, srv := newTestHandler(t)
+	data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore", "parent_branch_id": testParent, "num_branches": "2"}))
+	if ids, _ := data["branch_ids"].([]string); len(ids) != 2 {
+		t.Errorf("branch_ids = %v, want two branches", data["branch_ids"])
+	}
+	if launches := srv.CallsTo("parallel_explore"); len(launches) == 0 {
+		t.Fatal("nothing launched")
+	}
+	if !strings.Contains(logs.String(), `Coerced execute_agent argument num_branches from string "2" to 2`) {
+		t.Errorf("coercion not logged:\n%s", logs)
+	}
+
+	code, _ := mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore", "parent_branch_id": testParent, "num_branches": "two"}))
+	if code != CodeInvalidArguments {
+		t.Errorf("code = %s, want %s", code, CodeInvalidArguments)
+	}
+}
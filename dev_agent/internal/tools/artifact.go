@@ -0,0 +1,215 @@
+package tools
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Artifact read encodings accepted by branch_read_file.
+const (
+	EncodingText   = "text"
+	EncodingBase64 = "base64"
+)
+
+// maxInlineBase64Bytes is the largest base64 payload returned inline to the
+// model; bigger binaries are saved locally and only their path is returned.
+const maxInlineBase64Bytes = 16 * 1024
+
+// binaryExtensions are artifact types that do not survive a text round trip.
+var binaryExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".ico": true, ".bmp": true,
+	".pdf": true, ".zip": true, ".gz": true, ".tgz": true, ".tar": true, ".bz2": true, ".xz": true, ".7z": true,
+	".so": true, ".dylib": true, ".dll": true, ".exe": true, ".bin": true, ".o": true, ".a": true,
+	".jar": true, ".class": true, ".wasm": true, ".pyc": true, ".sqlite": true, ".db": true,
+}
+
+// artifactEncoding picks the read encoding: the explicit argument when
+// given, otherwise base64 for paths that look binary.
+func artifactEncoding(path, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if binaryExtensions[strings.ToLower(filepath.Ext(path))] {
+		return EncodingBase64
+	}
+	return EncodingText
+}
+
+// binaryArtifactResult reshapes a base64 read into content_base64, mime_type
+// and size, spilling payloads over maxInlineBase64Bytes to a local file.
+func binaryArtifactResult(branchID, path string, a ArtifactContent) (map[string]any, error) {
+	if a.File != "" {
+		return spilledBinaryArtifact(branchID, path, a)
+	}
+	encoded := firstNonEmpty(a.Base64, a.Content)
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("branch_read_file returned invalid base64 for %s: %v", path, err)}
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	out := map[string]any{"branch_id": branchID, "path": path, "mime_type": mimeType, "size": len(raw)}
+	if len(encoded) <= maxInlineBase64Bytes {
+		out["content_base64"] = encoded
+		return out, nil
+	}
+	dir := filepath.Join(os.TempDir(), "dev_agent_artifacts", branchID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	local := filepath.Join(dir, filepath.Base(path))
+	if err := os.WriteFile(local, raw, 0o600); err != nil {
+		return nil, err
+	}
+	out["local_path"] = local
+	out["note"] = "Binary artifact too large to inline; saved to local_path."
+	return out, nil
+}
+
+// spilledTextArtifact relays a text artifact whose reply was spilled to disk:
+// its local path and size plus head and tail excerpts within maxBytes.
+func spilledTextArtifact(branchID, path string, a ArtifactContent, maxBytes int) (map[string]any, error) {
+	head, tail, err := spillExcerpt(a.File, a.FileSize, min(max(maxBytes/2, 1), spillExcerptBytes))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"branch_id":  branchID,
+		"path":       path,
+		"local_path": a.File,
+		"total_size": a.FileSize,
+		"head":       head,
+		"tail":       tail,
+		"truncated":  true,
+		"note":       "Artifact too large to return inline; head and tail are its first and last bytes, the full text is in local_path.",
+	}, nil
+}
+
+// spilledBinaryArtifact decodes a spilled base64 reply straight into the
+// local artifact file.
+func spilledBinaryArtifact(branchID, path string, a ArtifactContent) (map[string]any, error) {
+	in, err := os.Open(a.File)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	dir := filepath.Join(os.TempDir(), "dev_agent_artifacts", branchID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	local := filepath.Join(dir, filepath.Base(path))
+	out, err := os.OpenFile(local, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(out, base64.NewDecoder(base64.StdEncoding, in))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("branch_read_file returned invalid base64 for %s: %v", path, err)}
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return map[string]any{
+		"branch_id":  branchID,
+		"path":       path,
+		"mime_type":  mimeType,
+		"size":       size,
+		"local_path": local,
+		"note":       "Binary artifact too large to inline; saved to local_path.",
+	}, nil
+}
+
+// defaultArtifactMaxBytes is read_artifact's max_bytes unless configured.
+const defaultArtifactMaxBytes = 64 * 1024
+
+// readTextArtifact reads a byte range of a text artifact. The range is sent
+// to the server; when the reply shows the server ignored it (no size or
+// offset fields), the full content is sliced here instead. The result
+// carries total_size, returned_bytes and truncated so the model can page.
+func (h *ToolHandler) readTextArtifact(ctx context.Context, branchID, path string, arguments map[string]any) (map[string]any, error) {
+	offset, maxBytes, err := h.textReadRange(arguments)
+	if err != nil {
+		return nil, err
+	}
+	opts := ReadFileOptions{Offset: offset, MaxBytes: maxBytes}
+	var a ArtifactContent
+	if res, ok := h.takePrefetched(branchID, path, opts); ok {
+		a, err = decodeArtifact(res)
+	} else {
+		a, err = h.client.BranchReadFile(ctx, branchID, path, opts)
+	}
+	// A failed read goes back to the model as the server phrased it.
+	var failed MCPToolError
+	if errors.As(err, &failed) {
+		return failed.Result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.File != "" {
+		return spilledTextArtifact(branchID, path, a, maxBytes)
+	}
+	if a.Field == "" {
+		return a.Raw, nil
+	}
+
+	content, total, serverRanged := a.Content, a.TotalSize, a.Ranged
+	if !serverRanged {
+		total = len(content)
+		start := min(offset, len(content))
+		end := min(start+maxBytes, len(content))
+		for end > start && end < len(content) && !utf8.RuneStart(content[end]) {
+			end--
+		}
+		content = content[start:end]
+	} else if len(content) > maxBytes {
+		content = content[:maxBytes]
+	}
+
+	resp := a.Raw
+	resp[a.Field] = content
+	resp["offset"] = offset
+	resp["returned_bytes"] = len(content)
+	resp["total_size"] = total
+	resp["truncated"] = offset+len(content) < total
+	return resp, nil
+}
+
+// textReadRange returns read_artifact's offset and max_bytes, defaulted.
+func (h *ToolHandler) textReadRange(arguments map[string]any) (offset, maxBytes int, err error) {
+	offset, _, err = intArg(arguments, "offset")
+	if err != nil {
+		return 0, 0, err
+	}
+	maxBytes, ok, err := intArg(arguments, "max_bytes")
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok || maxBytes <= 0 {
+		maxBytes, _, _ = h.budgets()
+	}
+	return offset, maxBytes, nil
+}
+
+func sizeField(m map[string]any) (int, bool) {
+	for _, k := range []string{"total_size", "size"} {
+		if v, ok := m[k].(float64); ok {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
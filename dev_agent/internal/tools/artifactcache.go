@@ -0,0 +1,198 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// ArtifactEntry is one file of a branch_list_files listing. Size is -1, and
+// ModTime and SHA256 are empty, when the server did not report them.
+type ArtifactEntry struct {
+	Path    string
+	Size    int64
+	ModTime string
+	SHA256  string
+}
+
+// BranchListArtifacts lists a directory of a branch workspace ("" for the
+// root) with the size, modification time and sha256 of each file, as far
+// as the server reports them. Paths are relative to the workspace root.
+func (c *MCPClient) BranchListArtifacts(ctx context.Context, branchID, dir string) ([]ArtifactEntry, error) {
+	res, err := c.BranchListFiles(ctx, branchID, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := toolFailed("branch_list_files", res); err != nil {
+		return nil, err
+	}
+	return decodeArtifactEntries(dir, res), nil
+}
+
+// listedFiles returns the entries of a branch_list_files reply, under
+// files, entries or items.
+func listedFiles(res map[string]any) []any {
+	for _, k := range []string{"files", "entries", "items"} {
+		if v, ok := res[k].([]any); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// decodeArtifactEntries accepts plain path strings and objects naming the
+// path as path, name or file_path. Directories are skipped and names
+// relative to dir are joined to it.
+func decodeArtifactEntries(dir string, res map[string]any) []ArtifactEntry {
+	items := listedFiles(res)
+	dir = strings.Trim(dir, "/")
+	out := make([]ArtifactEntry, 0, len(items))
+	for _, item := range items {
+		e := ArtifactEntry{Size: -1}
+		switch v := item.(type) {
+		case string:
+			e.Path = v
+		case map[string]any:
+			if kind, _ := v["type"].(string); kind == "dir" || kind == "directory" {
+				continue
+			}
+			e.Path = firstString(v, "path", "name", "file_path")
+			if size, ok := v["size"].(float64); ok {
+				e.Size = int64(size)
+			}
+			e.ModTime = modTime(v)
+			e.SHA256 = sha256Field(v)
+		}
+		if e.Path == "" {
+			continue
+		}
+		if dir != "" && !strings.HasPrefix(strings.TrimPrefix(e.Path, "/"), dir+"/") {
+			e.Path = path.Join(dir, e.Path)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// modTime reads the modification time as sent, or as RFC 3339 when it is
+// epoch seconds.
+func modTime(entry map[string]any) string {
+	for _, k := range []string{"mtime", "modified", "modified_at", "updated_at"} {
+		switch v := entry[k].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return time.Unix(int64(v), 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return ""
+}
+
+// sha256Field reads a sha256 digest from sha256, or from checksum or hash
+// when the value is one (optionally prefixed "sha256:").
+func sha256Field(entry map[string]any) string {
+	for _, k := range []string{"sha256", "checksum", "hash"} {
+		v, _ := entry[k].(string)
+		v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "sha256:")
+		if len(v) == 64 && strings.Trim(v, "0123456789abcdef") == "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func samePath(a, b string) bool {
+	return path.Clean("/"+a) == path.Clean("/"+b)
+}
+
+// artifactKey names a workspace file. cachedArtifact holds the results of
+// reads of one version of it, keyed by readKey, so a new checksum drops
+// every earlier read.
+type artifactKey struct{ branchID, path string }
+
+type cachedArtifact struct {
+	sha256 string
+	reads  map[string]map[string]any
+}
+
+// readKey identifies the arguments of a read within one file version.
+func readKey(encoding string, offset, maxBytes int) string {
+	return fmt.Sprintf("%s:%d:%d", encoding, offset, maxBytes)
+}
+
+// artifactChecksum looks up the current sha256 of a workspace file by
+// listing its directory. It returns "" when the file is not listed or the
+// listing fails; a server that lists files without checksums is remembered
+// so later reads skip the listing.
+func (h *ToolHandler) artifactChecksum(ctx context.Context, branchID, name string) string {
+	h.mu.Lock()
+	skip := h.noChecksums
+	h.mu.Unlock()
+	if skip {
+		return ""
+	}
+	dir := path.Dir(strings.TrimPrefix(name, "/"))
+	if dir == "." {
+		dir = ""
+	}
+	entries, err := h.client.BranchListArtifacts(ctx, branchID, dir)
+	if err != nil {
+		logx.Debugf("Could not list %q of branch %s for its checksum: %v", dir, branchID, err)
+		return ""
+	}
+	for _, e := range entries {
+		if !samePath(e.Path, name) {
+			continue
+		}
+		if e.SHA256 == "" {
+			logx.Infof("The MCP server does not report artifact checksums; read_artifact results will not be cached.")
+			h.mu.Lock()
+			h.noChecksums = true
+			h.mu.Unlock()
+		}
+		return e.SHA256
+	}
+	return ""
+}
+
+// cachedRead returns a copy of an earlier read of the same file version with
+// the same arguments, marked cached.
+func (h *ToolHandler) cachedRead(key artifactKey, sum, read string) (map[string]any, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry := h.artifactCache[key]
+	if entry == nil || entry.sha256 != sum {
+		return nil, false
+	}
+	res, ok := entry.reads[read]
+	if !ok {
+		return nil, false
+	}
+	out := make(map[string]any, len(res)+1)
+	for k, v := range res {
+		out[k] = v
+	}
+	out["cached"] = true
+	return out, true
+}
+
+// cacheRead records a successful read of the file version sum.
+func (h *ToolHandler) cacheRead(key artifactKey, sum, read string, res map[string]any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.artifactCache == nil {
+		h.artifactCache = map[artifactKey]*cachedArtifact{}
+	}
+	entry := h.artifactCache[key]
+	if entry == nil || entry.sha256 != sum {
+		entry = &cachedArtifact{sha256: sum, reads: map[string]map[string]any{}}
+		h.artifactCache[key] = entry
+	}
+	entry.reads[read] = res
+}
@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBranchListArtifacts(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b-1", "/home/dev/workspace/worklog.md", "done\n")
+	srv.PutArtifact("b-1", "/home/dev/workspace/docs/notes.md", "notes")
+	srv.PutArtifact("b-1", "/etc/hosts", "localhost")
+	entries, err := h.client.BranchListArtifacts(context.Background(), "b-1", "home/dev/workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ArtifactEntry{
+		{Path: "/home/dev/workspace/docs/notes.md", Size: 5, SHA256: sha256Hex("notes")},
+		{Path: "/home/dev/workspace/worklog.md", Size: 5, SHA256: sha256Hex("done\n")},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+}
+
+func TestDecodeArtifactEntries(t *testing.T) {
+	sum := sha256Hex("x")
+	res := map[string]any{"entries": []any{
+		"plain.txt",
+		map[string]any{"name": "sub", "type": "dir"},
+		map[string]any{"name": "a.md", "size": float64(3), "mtime": float64(1700000000), "checksum": "sha256:" + strings.ToUpper(sum)},
+		map[string]any{"file_path": "ws/b.md", "modified_at": "2026-01-02T03:04:05Z", "hash": "md5:abc"},
+		map[string]any{"size": float64(1)},
+	}}
+	want := []ArtifactEntry{
+		{Path: "ws/plain.txt", Size: -1},
+		{Path: "ws/a.md", Size: 3, ModTime: "2023-11-14T22:13:20Z", SHA256: sum},
+		{Path: "ws/b.md", Size: -1, ModTime: "2026-01-02T03:04:05Z"},
+	}
+	if got := decodeArtifactEntries("/ws/", res); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestReadArtifactCache(t *testing.T) {
+	const worklog = "/home/dev/workspace/worklog.md"
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b-1", worklog, "step 1\n")
+	srv.PutArtifact("b-2", worklog, "step 1\n")
+	read := func(branchID string, extra map[string]any) map[string]any {
+		args := map[string]any{"branch_id": branchID, "path": worklog}
+		for k, v := range extra {
+			args[k] = v
+		}
+		return mustSucceed(t, callTool(h, "read_artifact", args))
+	}
+	reads := func() int { return len(srv.CallsTo("branch_read_file")) }
+
+	first := read("b-1", nil)
+	if first["cached"] != nil || first["sha256"] != sha256Hex("step 1\n") || reads() != 1 {
+		t.Fatalf("first read = %v after %d reads, want a fresh read with its sha256", first, reads())
+	}
+
+	// Hit: same branch, path, arguments and checksum.
+	if again := read("b-1", nil); again["cached"] != true || again["content"] != "step 1\n" || reads() != 1 {
+		t.Errorf("repeat read = %v after %d reads, want the cached result", again, reads())
+	}
+
+	// Misses: other read arguments and another branch with the same file.
+	if ranged := read("b-1", map[string]any{"max_bytes": 4}); ranged["cached"] != nil || reads() != 2 {
+		t.Errorf("read with max_bytes = %v after %d reads, want a fresh read", ranged, reads())
+	}
+	if other := read("b-2", nil); other["cached"] != nil || reads() != 3 {
+		t.Errorf("read of b-2 = %v after %d reads, want a fresh read", other, reads())
+	}
+
+	// A changed checksum drops the cached version.
+	srv.PutArtifact("b-1", worklog, "step 1\nstep 2\n")
+	changed := read("b-1", nil)
+	if changed["cached"] != nil || changed["content"] != "step 1\nstep 2\n" || changed["sha256"] != sha256Hex("step 1\nstep 2\n") || reads() != 4 {
+		t.Errorf("read after a change = %v after %d reads, want the new content", changed, reads())
+	}
+	if again := read("b-1", nil); again["cached"] != true || again["content"] != "step 1\nstep 2\n" || reads() != 4 {
+		t.Errorf("repeat read after a change = %v after %d reads, want the new version cached", again, reads())
+	}
+}
+
+func TestReadArtifactWithoutChecksums(t *testing.T) {
+	const worklog = "/home/dev/workspace/worklog.md"
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b-1", worklog, "step 1\n")
+	srv.Respond("branch_list_files", map[string]any{"files": []any{map[string]any{"path": worklog, "size": float64(7)}}})
+	for i := 0; i < 3; i++ {
+		data := mustSucceed(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b-1", "path": worklog}))
+		if data["cached"] != nil {
+			t.Errorf("read %d = %v, want no caching without checksums", i+1, data)
+		}
+	}
+	if n := len(srv.CallsTo("branch_read_file")); n != 3 {
+		t.Errorf("%d reads, want 3", n)
+	}
+	if n := len(srv.CallsTo("branch_list_files")); n != 1 {
+		t.Errorf("%d listings, want 1: a server without checksums is not asked again", n)
+	}
+}
@@ -0,0 +1,224 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"dev_agent/internal/logx"
+)
+
+// tailRead reports whether read_artifact was asked for incremental text:
+// the last tail_lines lines, or what was appended since since_offset.
+func tailRead(arguments map[string]any) bool {
+	_, tail := arguments["tail_lines"]
+	_, since := arguments["since_offset"]
+	return tail || since
+}
+
+// readArtifactTail serves read_artifact's tail_lines and since_offset. The
+// range is sent to the server and sliced here when the server ignores it.
+// since_offset -1 continues from where the last incremental read of the
+// same branch and path ended. The result's next_offset is the offset to
+// pass next; a file that shrank below since_offset was rewritten, so it is
+// read again from the start and flagged reset.
+func (h *ToolHandler) readArtifactTail(ctx context.Context, branchID, path string, arguments map[string]any) (map[string]any, error) {
+	tailLines, hasTail, err := intArg(arguments, "tail_lines")
+	if err != nil {
+		return nil, err
+	}
+	since, hasSince, err := intArg(arguments, "since_offset")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case hasTail && hasSince:
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "pass either `tail_lines` or `since_offset`, not both"}
+	case hasTail && tailLines < 1:
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`tail_lines` must be at least 1, got %d", tailLines)}
+	case hasSince && since < -1:
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`since_offset` must be -1 or a byte offset, got %d", since)}
+	}
+	_, maxBytes, err := h.textReadRange(arguments)
+	if err != nil {
+		return nil, err
+	}
+	key := artifactKey{branchID, path}
+
+	var out map[string]any
+	if hasTail {
+		logx.Infof("Reading the last %d lines of artifact %s from branch %s", tailLines, path, branchID)
+		out, err = h.readLastLines(ctx, branchID, path, tailLines, maxBytes)
+	} else {
+		if since == -1 {
+			since = h.tailOffset(key)
+		}
+		logx.Infof("Reading artifact %s from branch %s since offset %d", path, branchID, since)
+		out, err = h.readSince(ctx, branchID, path, since, maxBytes)
+	}
+	if err != nil || out == nil || out["isError"] == true {
+		return out, err
+	}
+	if next, ok := out["next_offset"].(int); ok {
+		h.setTailOffset(key, next)
+	}
+	return out, nil
+}
+
+// readSince returns up to maxBytes of text from offset on.
+func (h *ToolHandler) readSince(ctx context.Context, branchID, path string, offset, maxBytes int) (map[string]any, error) {
+	content, total, res, err := h.readTextRange(ctx, branchID, path, offset, maxBytes)
+	if res != nil || err != nil {
+		return res, err
+	}
+	reset := false
+	if offset > total {
+		logx.Infof("Artifact %s of branch %s shrank to %d bytes below offset %d; reading it from the start", path, branchID, total, offset)
+		reset, offset = true, 0
+		if content, total, res, err = h.readTextRange(ctx, branchID, path, 0, maxBytes); res != nil || err != nil {
+			return res, err
+		}
+	}
+	next := offset + len(content)
+	out := map[string]any{
+		"branch_id":      branchID,
+		"path":           path,
+		"content":        content,
+		"offset":         offset,
+		"next_offset":    next,
+		"returned_bytes": len(content),
+		"total_size":     total,
+		"truncated":      next < total,
+	}
+	if reset {
+		out["reset"] = true
+	}
+	return out, nil
+}
+
+// readLastLines returns the last n lines of a text artifact, keeping at
+// most maxBytes from its end. Its offset shows where the excerpt starts.
+func (h *ToolHandler) readLastLines(ctx context.Context, branchID, path string, n, maxBytes int) (map[string]any, error) {
+	content, total, res, err := h.readTextRange(ctx, branchID, path, 0, 0)
+	if res != nil || err != nil {
+		return res, err
+	}
+	start := 0
+	if len(content) < total {
+		// The server capped the read; fetch the end of the file instead.
+		start = max(total-maxBytes, 0)
+		if content, total, res, err = h.readTextRange(ctx, branchID, path, start, maxBytes); res != nil || err != nil {
+			return res, err
+		}
+	}
+	body := strings.TrimSuffix(content, "\n")
+	from := 0
+	for i, cut := 0, len(body); i < n; i++ {
+		j := strings.LastIndexByte(body[:cut], '\n')
+		if j < 0 {
+			from = 0
+			break
+		}
+		from, cut = j+1, j
+	}
+	if len(content)-from > maxBytes {
+		from = len(content) - maxBytes
+		for from < len(content) && !utf8.RuneStart(content[from]) {
+			from++
+		}
+	}
+	text := content[from:]
+	return map[string]any{
+		"branch_id":      branchID,
+		"path":           path,
+		"content":        text,
+		"offset":         start + from,
+		"next_offset":    start + len(content),
+		"returned_bytes": len(text),
+		"total_size":     total,
+	}, nil
+}
+
+// readTextRange reads maxBytes of text from offset (the rest of the file for
+// maxBytes 0), slicing locally when the server returned the whole file. A
+// non-nil res is a failed read to hand back to the model as-is.
+func (h *ToolHandler) readTextRange(ctx context.Context, branchID, path string, offset, maxBytes int) (content string, total int, res map[string]any, err error) {
+	a, err := h.client.BranchReadFile(ctx, branchID, path, ReadFileOptions{Offset: offset, MaxBytes: maxBytes})
+	var failed MCPToolError
+	if errors.As(err, &failed) {
+		return "", 0, failed.Result, nil
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if a.File != "" {
+		content, err = readSpillRange(a.File, a.FileSize, offset, maxBytes)
+		return content, int(a.FileSize), nil, err
+	}
+	if a.Field == "" {
+		return "", 0, nil, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("branch_read_file returned no text for %s", path)}
+	}
+	if a.Ranged {
+		content = a.Content
+		if maxBytes > 0 && len(content) > maxBytes {
+			content = content[:maxBytes]
+		}
+		return content, a.TotalSize, nil, nil
+	}
+	return sliceText(a.Content, offset, maxBytes), len(a.Content), nil, nil
+}
+
+// sliceText is text[offset:offset+maxBytes], without splitting a rune at the
+// end; maxBytes 0 means to the end.
+func sliceText(text string, offset, maxBytes int) string {
+	start := min(offset, len(text))
+	end := len(text)
+	if maxBytes > 0 {
+		end = min(start+maxBytes, len(text))
+	}
+	for end > start && end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[start:end]
+}
+
+// readSpillRange reads a byte range of a spilled artifact reply.
+func readSpillRange(path string, size int64, offset, maxBytes int) (string, error) {
+	if int64(offset) >= size {
+		return "", nil
+	}
+	n := size - int64(offset)
+	if maxBytes > 0 {
+		n = min(n, int64(maxBytes))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	k, err := f.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf[:k]), nil
+}
+
+func (h *ToolHandler) tailOffset(key artifactKey) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tailOffsets[key]
+}
+
+func (h *ToolHandler) setTailOffset(key artifactKey, offset int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tailOffsets == nil {
+		h.tailOffsets = map[artifactKey]int{}
+	}
+	h.tailOffsets[key] = offset
+}
@@ -0,0 +1,163 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+const reviewLog = "/home/dev/workspace/codex_review.log"
+
+// readTail calls read_artifact for reviewLog of branchID with extra
+// arguments.
+func readTail(t *testing.T, h *ToolHandler, branchID string, extra map[string]any) map[string]any {
+	t.Helper()
+	args := map[string]any{"branch_id": branchID, "path": reviewLog}
+	for k, v := range extra {
+		args[k] = v
+	}
+	return mustSucceed(t, callTool(h, "read_artifact", args))
+}
+
+func TestReadArtifactTailLines(t *testing.T) {
+	const log = "one\ntwo\nthree\nfour\nfive\n"
+	cases := []struct {
+		name    string
+		lines   int
+		content string
+	}{
+		{"last two", 2, "four\nfive\n"},
+		{"exactly all", 5, log},
+		{"more than the file", 50, log},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			srv.PutArtifact("b-1", reviewLog, log)
+			data := readTail(t, h, "b-1", map[string]any{"tail_lines": c.lines})
+			if data["content"] != c.content {
+				t.Errorf("content = %q, want %q", data["content"], c.content)
+			}
+			if data["offset"] != len(log)-len(c.content) || data["next_offset"] != len(log) || data["total_size"] != len(log) {
+				t.Errorf("offset %v, next_offset %v, total_size %v; want %d, %d, %d", data["offset"], data["next_offset"], data["total_size"], len(log)-len(c.content), len(log), len(log))
+			}
+		})
+	}
+
+	t.Run("no trailing newline", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		srv.PutArtifact("b-1", reviewLog, "a\nb\nc")
+		if data := readTail(t, h, "b-1", map[string]any{"tail_lines": 2}); data["content"] != "b\nc" {
+			t.Errorf("content = %q, want the last two lines", data["content"])
+		}
+	})
+}
+
+// TestReadArtifactSinceOffset follows a growing log: each read returns only
+// what was appended, whether the offset is passed back or remembered.
+func TestReadArtifactSinceOffset(t *testing.T) {
+	h, srv := newTestHandler(t)
+	first := "finding 1\n"
+	srv.PutArtifact("b-1", reviewLog, first)
+	srv.PutArtifact("b-2", reviewLog, "other branch\n")
+
+	data := readTail(t, h, "b-1", map[string]any{"tail_lines": 10})
+	if data["content"] != first || data["next_offset"] != len(first) {
+		t.Fatalf("first read = %v, want the whole log and next_offset %d", data, len(first))
+	}
+
+	second := first + "finding 2\n"
+	srv.PutArtifact("b-1", reviewLog, second)
+	data = readTail(t, h, "b-1", map[string]any{"since_offset": len(first)})
+	if data["content"] != "finding 2\n" || data["offset"] != len(first) || data["next_offset"] != len(second) || data["truncated"] != false {
+		t.Fatalf("explicit continuation = %v, want only finding 2", data)
+	}
+
+	// -1 continues from the remembered offset of this branch and path.
+	third := second + "finding 3\n"
+	srv.PutArtifact("b-1", reviewLog, third)
+	if data = readTail(t, h, "b-1", map[string]any{"since_offset": -1}); data["content"] != "finding 3\n" || data["next_offset"] != len(third) {
+		t.Errorf("remembered continuation = %v, want only finding 3", data)
+	}
+	if data = readTail(t, h, "b-1", map[string]any{"since_offset": -1}); data["content"] != "" || data["next_offset"] != len(third) {
+		t.Errorf("read with nothing appended = %v, want no content", data)
+	}
+	if data = readTail(t, h, "b-2", map[string]any{"since_offset": -1}); data["content"] != "other branch\n" {
+		t.Errorf("first -1 read of b-2 = %v, want it from the start", data)
+	}
+
+	// A small max_bytes pages through the rest.
+	srv.PutArtifact("b-1", reviewLog, third+"finding 4\n")
+	data = readTail(t, h, "b-1", map[string]any{"since_offset": -1, "max_bytes": 4})
+	if data["content"] != "find" || data["truncated"] != true || data["next_offset"] != len(third)+4 {
+		t.Errorf("capped read = %v, want 4 bytes and truncated", data)
+	}
+	if data = readTail(t, h, "b-1", map[string]any{"since_offset": -1}); data["content"] != "ing 4\n" {
+		t.Errorf("read after the capped one = %v, want the rest", data)
+	}
+}
+
+// TestReadArtifactTailTruncated checks a log rewritten shorter than the
+// offset between reads is read again from the start.
+func TestReadArtifactTailTruncated(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b-1", reviewLog, "round 1: finding a\nround 1: finding b\n")
+	data := readTail(t, h, "b-1", map[string]any{"since_offset": 0})
+	if data["reset"] != nil {
+		t.Fatalf("first read = %v, want no reset", data)
+	}
+
+	srv.PutArtifact("b-1", reviewLog, "round 2\n")
+	data = readTail(t, h, "b-1", map[string]any{"since_offset": -1})
+	if data["reset"] != true || data["content"] != "round 2\n" || data["offset"] != 0 || data["next_offset"] != len("round 2\n") {
+		t.Fatalf("read after the rewrite = %v, want the new log from the start, flagged reset", data)
+	}
+	srv.PutArtifact("b-1", reviewLog, "round 2\nfinding c\n")
+	if data = readTail(t, h, "b-1", map[string]any{"since_offset": -1}); data["reset"] != nil || data["content"] != "finding c\n" {
+		t.Errorf("read after the reset = %v, want only the appended line", data)
+	}
+}
+
+// TestReadArtifactTailRangedServer checks the range is sent to the server
+// and a ranged reply is used as-is.
+func TestReadArtifactTailRangedServer(t *testing.T) {
+	log := "line 1\nline 2\nline 3\n"
+	h, srv := newTestHandler(t)
+	srv.Handle("branch_read_file", func(args map[string]any) (map[string]any, error) {
+		offset, _ := args["offset"].(float64)
+		return map[string]any{"content": sliceText(log, int(offset), 0), "offset": offset, "total_size": float64(len(log))}, nil
+	})
+	data := readTail(t, h, "b-1", map[string]any{"since_offset": 7})
+	if data["content"] != "line 2\nline 3\n" || data["next_offset"] != len(log) {
+		t.Errorf("data = %v, want the text after offset 7", data)
+	}
+	calls := srv.CallsTo("branch_read_file")
+	if got := calls[len(calls)-1].Arguments["offset"]; got != 7.0 {
+		t.Errorf("offset sent = %v, want 7", got)
+	}
+}
+
+func TestReadArtifactTailInvalid(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b-1", reviewLog, "x\n")
+	cases := []struct {
+		name  string
+		extra map[string]any
+		msg   string
+	}{
+		{"both", map[string]any{"tail_lines": 1, "since_offset": 0}, "not both"},
+		{"negative offset", map[string]any{"since_offset": -2}, "since_offset"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := map[string]any{"branch_id": "b-1", "path": reviewLog}
+			for k, v := range c.extra {
+				args[k] = v
+			}
+			res := callTool(h, "read_artifact", args)
+			code, msg, _, _ := ErrorInfo(res)
+			if code != CodeInvalidArguments || !strings.Contains(msg, c.msg) {
+				t.Errorf("code %s, message %q; want %s mentioning %q", code, msg, CodeInvalidArguments, c.msg)
+			}
+		})
+	}
+}
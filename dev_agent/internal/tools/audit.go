@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// maxAuditResultBytes is the largest result kept inline in an audit entry;
+// bigger ones are recorded by hash and size.
+const maxAuditResultBytes = 4 * 1024
+
+// auditEntry is one Handle invocation in the audit log.
+type auditEntry struct {
+	Time         time.Time `json:"ts"`
+	RunID        string    `json:"run_id,omitempty"`
+	Tool         string    `json:"tool"`
+	CallID       string    `json:"call_id,omitempty"`
+	Arguments    any       `json:"arguments,omitempty"`
+	Status       string    `json:"status"`
+	Code         string    `json:"code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	BranchIDs    []string  `json:"branch_ids,omitempty"`
+	DurationMS   int64     `json:"duration_ms"`
+	Retried      bool      `json:"retried,omitempty"`
+	Result       any       `json:"result,omitempty"`
+	ResultBytes  int       `json:"result_bytes"`
+	ResultSHA256 string    `json:"result_sha256,omitempty"`
+}
+
+// AuditLog appends one JSON line per tool call: what was called with which
+// arguments, how it ended, the branches involved and how long it took.
+// Unlike WireLog it writes synchronously and never drops an entry, since it
+// is the record postmortems rely on. Registered secrets are redacted. A nil
+// *AuditLog records nothing.
+type AuditLog struct {
+	path  string
+	runID string
+	mu    sync.Mutex
+	f     *os.File
+}
+
+// NewAuditLog opens path for appending; runID is stamped on every entry.
+func NewAuditLog(path, runID string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, runID: runID, f: f}, nil
+}
+
+// Path is the file the log appends to.
+func (a *AuditLog) Path() string {
+	if a == nil {
+		return ""
+	}
+	return a.path
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func (a *AuditLog) record(call ToolCall, result map[string]any, started time.Time) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		Time:       started.UTC(),
+		RunID:      a.runID,
+		Tool:       call.Function.Name,
+		CallID:     call.ID,
+		DurationMS: time.Since(started).Milliseconds(),
+	}
+	var args map[string]any
+	if json.Unmarshal([]byte(call.Function.Arguments), &args) == nil {
+		e.Arguments = args
+	} else if call.Function.Arguments != "" {
+		e.Arguments = call.Function.Arguments
+	}
+	e.Status, _ = result["status"].(string)
+	var details map[string]any
+	e.Code, e.Error, details, _ = ErrorInfo(result)
+	e.BranchIDs = auditBranchIDs(args, result, details)
+	data, _ := result["data"].(map[string]any)
+	e.Retried = details["retried"] == true || data["retried"] == true
+	raw := toJSON(result)
+	e.ResultBytes = len(raw)
+	if len(raw) <= maxAuditResultBytes {
+		e.Result = result
+	} else {
+		sum := sha256.Sum256([]byte(raw))
+		e.ResultSHA256 = hex.EncodeToString(sum[:])
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append([]byte(logx.Redact(string(line))), '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if _, err := a.f.Write(line); err != nil {
+		logx.Warningf("Audit log write to %s failed: %v", a.path, err)
+	}
+}
+
+// auditBranchIDs collects the branch ids a call named or produced, or its
+// error details name.
+func auditBranchIDs(args, result, details map[string]any) []string {
+	seen := map[string]bool{}
+	add := func(v any) {
+		switch id := v.(type) {
+		case string:
+			if id != "" {
+				seen[id] = true
+			}
+		case []any:
+			for _, x := range id {
+				if s, ok := x.(string); ok && s != "" {
+					seen[s] = true
+				}
+			}
+		case []string:
+			for _, s := range id {
+				if s != "" {
+					seen[s] = true
+				}
+			}
+		}
+	}
+	data, _ := result["data"].(map[string]any)
+	for _, m := range []map[string]any{args, data, result, details} {
+		for _, k := range []string{"branch_id", "parent_branch_id", "branch_ids", "launched_branch_ids"} {
+			add(m[k])
+		}
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SetAuditLog makes Handle record every call in a; nil stops recording.
+func (h *ToolHandler) SetAuditLog(a *AuditLog) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.audit = a
+}
+
+func (h *ToolHandler) auditLog() *AuditLog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.audit
+}
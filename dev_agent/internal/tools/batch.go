@@ -0,0 +1,227 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// Request is one call of a CallBatch.
+type Request struct {
+	Method string
+	Params map[string]any
+}
+
+// Response is the outcome of one batched Request; Err carries JSON-RPC
+// errors for that request alone.
+type Response struct {
+	Result map[string]any
+	Err    error
+}
+
+// ToolRequest builds a tools/call Request.
+func ToolRequest(ctx context.Context, name string, arguments map[string]any) Request {
+	return Request{Method: "tools/call", Params: toolCallParams(ctx, name, arguments)}
+}
+
+// CallBatch sends reqs as one JSON-RPC batch and returns their responses in
+// request order. Servers that answer a batch with a single object, an HTTP
+// error or a malformed reply are remembered as not supporting batches, and
+// the requests are sent one at a time instead; non-HTTP transports always
+// take that path. Only use it for calls that are safe to repeat.
+func (c *MCPClient) CallBatch(ctx context.Context, reqs []Request) ([]Response, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+	c.mu.Lock()
+	unsupported := c.batchUnsupported
+	c.mu.Unlock()
+	if _, isHTTP := c.transport.(httpTransport); isHTTP && !unsupported && len(reqs) > 1 {
+		if err := c.ensureInitialized(ctx); err != nil {
+			return nil, err
+		}
+		out, err := c.sendBatch(ctx, reqs)
+		if err == nil {
+			return out, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logx.Warningf("MCP batch of %d requests failed (%v); falling back to sequential calls.", len(reqs), err)
+		c.mu.Lock()
+		c.batchUnsupported = true
+		c.mu.Unlock()
+	}
+	out := make([]Response, len(reqs))
+	for i, req := range reqs {
+		out[i].Result, out[i].Err = c.call(ctx, req.Method, req.Params, c.timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return out, nil
+}
+
+func (c *MCPClient) sendBatch(ctx context.Context, reqs []Request) (out []Response, err error) {
+	start := time.Now()
+	ctx = withRequestID(ctx, newUUID())
+	payload := make([]any, len(reqs))
+	index := make(map[string]int, len(reqs))
+	for i, req := range reqs {
+		id := c.nextRequestID()
+		payload[i] = map[string]any{"jsonrpc": "2.0", "id": id, "method": req.Method, "params": req.Params}
+		index[fmt.Sprint(id)] = i
+	}
+	entry := wireEntry{Time: start, Method: "batch", Params: payload, Headers: c.wireHeaders(ctx, "batch")}
+	var body []byte
+	defer func() {
+		if err == nil {
+			for i, req := range reqs {
+				c.metrics.observe(metricKey(req.Method, req.Params), time.Since(start), out[i].Err)
+			}
+		}
+		if c.wireLog == nil {
+			return
+		}
+		entry.DurationMS = time.Since(start).Milliseconds()
+		entry.Body = string(body)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		c.wireLog.record(entry)
+	}()
+
+	if err = c.limiter.wait(ctx, "batch"); err != nil {
+		return nil, err
+	}
+	resp, cancel, err := c.rpcPost(ctx, c.rpcURL, payload, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	entry.Status = resp.StatusCode
+	defer cancel()
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ = io.ReadAll(resp.Body)
+		return nil, MCPHTTPError{Status: resp.StatusCode, Body: string(body)}
+	}
+
+	var messages []json.RawMessage
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		messages, body, err = sseMessages(resp.Body)
+	} else {
+		body, err = io.ReadAll(resp.Body)
+		if err == nil {
+			messages, err = splitBatch(body)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out = make([]Response, len(reqs))
+	seen := make([]bool, len(reqs))
+	for _, raw := range messages {
+		var msg struct {
+			ID     json.RawMessage `json:"id"`
+			Result map[string]any  `json:"result"`
+			Error  any             `json:"error"`
+		}
+		if json.Unmarshal(raw, &msg) != nil {
+			continue
+		}
+		if len(msg.ID) == 0 {
+			c.handleNotification(raw)
+			continue
+		}
+		var id any
+		_ = json.Unmarshal(msg.ID, &id)
+		i, ok := index[fmt.Sprint(id)]
+		if !ok {
+			continue
+		}
+		seen[i] = true
+		if rpcErr, isErr := parseRPCError(msg.Error); isErr {
+			out[i].Err = rpcErr
+		} else {
+			out[i].Result = normalizeToolResult(msg.Result)
+		}
+	}
+	for i, ok := range seen {
+		if !ok {
+			return nil, fmt.Errorf("batch reply has no response for request %d of %d", i+1, len(reqs))
+		}
+	}
+	return out, nil
+}
+
+// splitBatch splits a JSON batch reply. A lone object means the server did
+// not process the batch.
+func splitBatch(data []byte) ([]json.RawMessage, error) {
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("batch reply is not a JSON array: %s", logx.Truncate(string(data), 200))
+	}
+	return messages, nil
+}
+
+// sseMessages collects every JSON-RPC message of an SSE body, flattening
+// events that carry arrays.
+func sseMessages(r io.Reader) ([]json.RawMessage, []byte, error) {
+	var (
+		all      bytes.Buffer
+		data     strings.Builder
+		messages []json.RawMessage
+	)
+	flush := func() error {
+		text := strings.TrimSpace(data.String())
+		data.Reset()
+		if text == "" {
+			return nil
+		}
+		if strings.HasPrefix(text, "[") {
+			batch, err := splitBatch([]byte(text))
+			messages = append(messages, batch...)
+			return err
+		}
+		if !json.Valid([]byte(text)) {
+			return fmt.Errorf("invalid JSON in SSE event: %s", logx.Truncate(text, 200))
+		}
+		messages = append(messages, json.RawMessage(text))
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		all.WriteString(line)
+		all.WriteByte('\n')
+		if line == "" {
+			if err := flush(); err != nil {
+				return nil, all.Bytes(), err
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimSpace(value))
+			data.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, all.Bytes(), err
+	}
+	if err := flush(); err != nil {
+		return nil, all.Bytes(), err
+	}
+	return messages, all.Bytes(), nil
+}
@@ -0,0 +1,218 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// batchServer serves branch_read_file, and no other tool, singly and in
+// JSON-RPC batches; singles counts the single branch_read_file calls.
+// Paths starting with "missing" get a JSON-RPC error and "denied" an isError
+// result; batch replies come in reverse order. rejectBatches answers a
+// batch with a lone error object, sse with an event stream.
+type batchServer struct {
+	*httptest.Server
+	rejectBatches, sse bool
+
+	mu               sync.Mutex
+	batches, singles int
+}
+
+func newBatchServer(t *testing.T) *batchServer {
+	s := &batchServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+type batchRPC struct {
+	ID     any    `json:"id"`
+	Method string `json:"method"`
+	Params struct {
+		Name      string         `json:"name"`
+		Arguments map[string]any `json:"arguments"`
+	} `json:"params"`
+}
+
+func (s *batchServer) answer(req batchRPC) map[string]any {
+	path, _ := req.Params.Arguments["file_path"].(string)
+	switch {
+	case req.Method != "tools/call":
+		return map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{}}
+	case req.Params.Name != "branch_read_file":
+		return map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": RPCInvalidParams, "message": "Unknown tool: " + req.Params.Name}}
+	case strings.HasPrefix(path, "missing"):
+		return map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": RPCInvalidParams, "message": "no such file " + path}}
+	case strings.HasPrefix(path, "denied"):
+		return map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"isError": true, "content": []any{map[string]any{"type": "text", "text": "permission denied"}}}}
+	}
+	return map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"content": "content of " + path}}}
+}
+
+func (s *batchServer) serve(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	json.NewDecoder(r.Body).Decode(&raw)
+	var reply any
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "[") {
+		s.mu.Lock()
+		s.batches++
+		s.mu.Unlock()
+		var reqs []batchRPC
+		json.Unmarshal(raw, &reqs)
+		if s.rejectBatches {
+			reply = map[string]any{"jsonrpc": "2.0", "id": nil, "error": map[string]any{"code": RPCInvalidRequest, "message": "batches are not supported"}}
+		} else {
+			var out []any
+			for i := len(reqs) - 1; i >= 0; i-- {
+				out = append(out, s.answer(reqs[i]))
+			}
+			reply = out
+		}
+	} else {
+		var req batchRPC
+		json.Unmarshal(raw, &req)
+		if req.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if req.Params.Name == "branch_read_file" {
+			s.mu.Lock()
+			s.singles++
+			s.mu.Unlock()
+		}
+		reply = s.answer(req)
+	}
+	body, _ := json.Marshal(reply)
+	if s.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{\"progress\":1}}\n\ndata: %s\n\n", body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (s *batchServer) counts() (batches, singles int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches, s.singles
+}
+
+// readRequests builds branch_read_file requests for paths of branch b1.
+func readRequests(paths ...string) []Request {
+	reqs := make([]Request, len(paths))
+	for i, p := range paths {
+		reqs[i] = ToolRequest(context.Background(), "branch_read_file", map[string]any{"branch_id": "b1", "file_path": p})
+	}
+	return reqs
+}
+
+// checkBatchResponses checks responses to readRequests("a.md", "missing.md",
+// "denied.md", "b.md").
+func checkBatchResponses(t *testing.T, resps []Response) {
+	t.Helper()
+	if len(resps) != 4 {
+		t.Fatalf("%d responses, want 4", len(resps))
+	}
+	for i, want := range []string{"content of a.md", "", "", "content of b.md"} {
+		if want != "" && (resps[i].Err != nil || resps[i].Result["content"] != want) {
+			t.Errorf("response %d = %+v, want %q", i, resps[i], want)
+		}
+	}
+	var rpcErr MCPRPCError
+	if !errors.As(resps[1].Err, &rpcErr) || !strings.Contains(rpcErr.Message, "missing.md") {
+		t.Errorf("response 1 err = %v, want the RPC error for missing.md", resps[1].Err)
+	}
+	if resps[2].Err != nil || resps[2].Result["isError"] != true {
+		t.Errorf("response 2 = %+v, want an isError result", resps[2])
+	}
+}
+
+func TestCallBatchMixedResults(t *testing.T) {
+	for _, sse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sse=%t", sse), func(t *testing.T) {
+			srv := newBatchServer(t)
+			srv.sse = sse
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+			defer client.Close()
+
+			resps, err := client.CallBatch(context.Background(), readRequests("a.md", "missing.md", "denied.md", "b.md"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBatchResponses(t, resps)
+			if batches, singles := srv.counts(); batches != 1 || singles != 0 {
+				t.Errorf("%d batches and %d single calls, want one batch", batches, singles)
+			}
+			if m := client.Metrics()["tools/call:branch_read_file"]; m.Calls != 4 || m.Errors != 1 {
+				t.Errorf("metrics = %+v, want 4 calls and 1 error", m)
+			}
+		})
+	}
+}
+
+func TestCallBatchFallsBackToSequential(t *testing.T) {
+	srv := newBatchServer(t)
+	srv.rejectBatches = true
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	captureLogs(t)
+
+	for round := 1; round <= 2; round++ {
+		resps, err := client.CallBatch(context.Background(), readRequests("a.md", "missing.md", "denied.md", "b.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBatchResponses(t, resps)
+		// The rejection is remembered: the second round never tries a batch.
+		if batches, singles := srv.counts(); batches != 1 || singles != 4*round {
+			t.Errorf("round %d: %d batches and %d single calls, want 1 and %d", round, batches, singles, 4*round)
+		}
+	}
+}
+
+func TestPrefetchBatchesArtifactReads(t *testing.T) {
+	srv := newBatchServer(t)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	captureLogs(t)
+
+	paths := []string{"worklog.md", "review.log", "missing.md"}
+	var calls []ToolCall
+	for _, path := range paths {
+		call := ToolCall{ID: "call_" + path, Type: "function"}
+		call.Function.Name = "read_artifact"
+		call.Function.Arguments = fmt.Sprintf(`{"branch_id": "b1", "path": %q}`, path)
+		calls = append(calls, call)
+	}
+	h.Prefetch(context.Background(), calls)
+	if batches, singles := srv.counts(); batches != 1 || singles != 0 {
+		t.Fatalf("prefetch made %d batches and %d single calls, want one batch", batches, singles)
+	}
+
+	for _, path := range paths[:2] {
+		data := mustSucceed(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b1", "path": path}))
+		if !strings.Contains(toJSON(data), "content of "+path) {
+			t.Errorf("read_artifact %s = %s", path, toJSON(data))
+		}
+	}
+	if _, singles := srv.counts(); singles != 0 {
+		t.Errorf("prefetched reads made %d calls, want none", singles)
+	}
+	// A failed batch member is not kept; Handle makes that call itself, and
+	// a prefetched result is used only once.
+	mustFail(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b1", "path": "missing.md"}))
+	mustSucceed(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b1", "path": "worklog.md"}))
+	if _, singles := srv.counts(); singles != 2 {
+		t.Errorf("%d single calls after the prefetched results ran out, want 2", singles)
+	}
+}
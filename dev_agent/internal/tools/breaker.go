@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// ErrMCPUnavailable is matched by errors.Is when a call was refused because
+// the circuit breaker is open.
+var ErrMCPUnavailable = errors.New("MCP server unavailable")
+
+// CodeMCPUnavailable marks a tool result refused by the open circuit.
+const CodeMCPUnavailable = "mcp_unavailable"
+
+// MCPUnavailableError is returned without contacting the server while the
+// circuit is open. RetryAfter is the remaining cooldown.
+type MCPUnavailableError struct {
+	RetryAfter time.Duration
+	Cause      error
+}
+
+func (e MCPUnavailableError) Error() string {
+	return fmt.Sprintf("MCP server unavailable (circuit open, retry in %.0fs); last error: %v", e.RetryAfter.Seconds(), e.Cause)
+}
+
+func (e MCPUnavailableError) Is(target error) bool { return target == ErrMCPUnavailable }
+
+func (e MCPUnavailableError) Unwrap() error { return e.Cause }
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// breaker is a consecutive-failure circuit breaker. After threshold
+// transport failures in a row it opens for cooldown; the first call after
+// that is let through as a probe (half-open) and closes the circuit on
+// success or reopens it on failure. A threshold <= 0 disables it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	lastErr   error
+}
+
+// allow reports whether a call may proceed.
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+		return MCPUnavailableError{RetryAfter: max(wait, 0), Cause: b.lastErr}
+	}
+	b.probing = true
+	return nil
+}
+
+// record feeds back the outcome of an allowed call.
+func (b *breaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasProbe := b.probing
+	b.probing = false
+	if !transportFailure(err) {
+		// Any answer, even an error for this request, shows the server is up.
+		if wasProbe {
+			logx.Infof("MCP circuit closed: the server answered again.")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		logx.Warningf("MCP circuit open for %.0fs after %d consecutive failures: %v", b.cooldown.Seconds(), b.failures, err)
+	}
+}
+
+// transportFailure reports whether err means the server could not be
+// reached or is failing as a whole, as opposed to rejecting one request.
+func transportFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var re MCPRPCError
+	if errors.As(err, &re) {
+		return false
+	}
+	var he MCPHTTPError
+	if errors.As(err, &he) {
+		return he.Status >= 500 || he.Status == http.StatusTooManyRequests
+	}
+	var se *ResponseSchemaError
+	return !errors.As(err, &se)
+}
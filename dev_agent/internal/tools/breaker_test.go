@@ -0,0 +1,142 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errRefused = errors.New("dial tcp 127.0.0.1:1: connection refused")
+
+// expireCooldown ends the open period as if the cooldown had passed.
+func expireCooldown(b *breaker) {
+	b.mu.Lock()
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	b.mu.Unlock()
+}
+
+func mustRefuse(t *testing.T, b *breaker) MCPUnavailableError {
+	t.Helper()
+	var unavailable MCPUnavailableError
+	err := b.allow()
+	if !errors.As(err, &unavailable) || !errors.Is(err, ErrMCPUnavailable) {
+		t.Fatalf("allow() = %v, want ErrMCPUnavailable", err)
+	}
+	return unavailable
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := &breaker{threshold: 3, cooldown: time.Minute}
+	captureLogs(t)
+
+	// Closed: failures below the threshold, and answers of any kind, let
+	// calls through.
+	for _, err := range []error{errRefused, errRefused, MCPRPCError{Code: RPCInvalidParams}, errRefused, errRefused} {
+		if got := b.allow(); got != nil {
+			t.Fatalf("closed breaker refused a call: %v", got)
+		}
+		b.record(err)
+	}
+	if got := b.allow(); got != nil {
+		t.Fatalf("breaker opened after an RPC error reset the count: %v", got)
+	}
+
+	// Open: the third consecutive failure refuses calls for the cooldown.
+	b.record(MCPHTTPError{Status: http.StatusServiceUnavailable})
+	unavailable := mustRefuse(t, b)
+	if unavailable.RetryAfter <= 50*time.Second || unavailable.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %v, want about the one-minute cooldown", unavailable.RetryAfter)
+	}
+	var httpErr MCPHTTPError
+	if !errors.As(unavailable, &httpErr) || httpErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("cause = %v, want the last failure", unavailable.Cause)
+	}
+
+	// Half-open: one probe goes through once the cooldown is over; a failed
+	// probe reopens the circuit.
+	expireCooldown(b)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe refused after the cooldown: %v", err)
+	}
+	mustRefuse(t, b) // only one probe at a time
+	b.record(errRefused)
+	if mustRefuse(t, b).RetryAfter <= 50*time.Second {
+		t.Error("a failed probe did not restart the cooldown")
+	}
+
+	// A successful probe closes the circuit again.
+	expireCooldown(b)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe refused after the cooldown: %v", err)
+	}
+	b.record(nil)
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("closed breaker refused call %d: %v", i, err)
+		}
+		b.record(errRefused)
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("breaker reopened before the threshold: %v", err)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := &breaker{threshold: 0, cooldown: time.Minute}
+	for i := 0; i < 10; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("disabled breaker refused call %d: %v", i, err)
+		}
+		b.record(errRefused)
+	}
+}
+
+func TestTransportFailure(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"connection refused", errRefused, true},
+		{"canceled", context.Canceled, false},
+		{"HTTP 503", MCPHTTPError{Status: http.StatusServiceUnavailable}, true},
+		{"HTTP 429", MCPHTTPError{Status: http.StatusTooManyRequests}, true},
+		{"HTTP 404", MCPHTTPError{Status: http.StatusNotFound}, false},
+		{"RPC error", MCPRPCError{Code: RPCInternalError}, false},
+		{"schema error", &ResponseSchemaError{Tool: "get_branch"}, false},
+	} {
+		if got := transportFailure(c.err); got != c.want {
+			t.Errorf("%s: transportFailure = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
+
+// TestBreakerFailsFast checks that an open circuit refuses calls without
+// contacting the server and that the handler flags them as retryable later.
+func TestBreakerFailsFast(t *testing.T) {
+	srv, attempts := scriptedStatusServer(t, "", http.StatusBadGateway, http.StatusBadGateway)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	defer client.Close()
+	captureLogs(t)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); errors.Is(err, ErrMCPUnavailable) {
+			t.Fatalf("call %d refused before the threshold", i)
+		}
+	}
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	code, details := mustFail(t, callTool(h, "branch_output", map[string]any{"branch_id": "b1"}))
+	if code != CodeMCPUnavailable {
+		t.Errorf("code = %q, want %q", code, CodeMCPUnavailable)
+	}
+	if after, _ := details["retryable_after_seconds"].(int); after < 55 || after > 60 {
+		t.Errorf("retryable_after_seconds = %v, want the remaining minute", details["retryable_after_seconds"])
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("server saw %d tool calls, want 2: the open circuit must not contact it", n)
+	}
+}
@@ -0,0 +1,80 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+
+	"dev_agent/internal/logx"
+)
+
+// defaultMaxConcurrentBranches is how many launched branches may be running
+// at once unless SetMaxConcurrentBranches overrides it.
+const defaultMaxConcurrentBranches = 2
+
+// CodeConcurrencyLimit marks an execute_agent refused because too many of
+// the run's branches are still running.
+const CodeConcurrencyLimit = "concurrency_limit"
+
+// SetMaxConcurrentBranches bounds the branches launched by execute_agent
+// that no check_status has yet seen terminal; n <= 0 removes the limit.
+func (h *ToolHandler) SetMaxConcurrentBranches(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxInflight = max(n, 0)
+}
+
+// reserveBranches claims n launch slots, or explains which branches to wait
+// for first. The caller hands the slots back with launched.
+func (h *ToolHandler) reserveBranches(n int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limit := h.maxInflight
+	if limit == 0 || len(h.inflight)+h.launching+n <= limit {
+		h.launching += n
+		return nil
+	}
+	running := make([]string, 0, len(h.inflight))
+	for id := range h.inflight {
+		running = append(running, id)
+	}
+	sort.Strings(running)
+	details := map[string]any{
+		"limit":              limit,
+		"running_branch_ids": running,
+		"requested":          n,
+		"retryable":          false,
+	}
+	if n > limit {
+		details["hint"] = fmt.Sprintf("At most %d branches may run at once; launch fewer branches per execute_agent.", limit)
+		return ToolExecutionError{Code: CodeConcurrencyLimit, Msg: fmt.Sprintf("execute_agent asked for %d branches but at most %d may run at once", n, limit), Details: details}
+	}
+	details["hint"] = "Wait for a running branch with check_status (or stop it with cancel_agent) before launching another."
+	return ToolExecutionError{
+		Code:    CodeConcurrencyLimit,
+		Msg:     fmt.Sprintf("%d of at most %d branches are still running (%v); wait for one to finish before launching more", len(h.inflight), limit, running),
+		Details: details,
+	}
+}
+
+// launched returns n reserved slots and marks ids as running.
+func (h *ToolHandler) launched(n int, ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.launching -= n
+	if h.inflight == nil {
+		h.inflight = map[string]bool{}
+	}
+	for _, id := range ids {
+		h.inflight[id] = true
+	}
+}
+
+// branchDone frees the slot of a branch seen terminal or cancelled.
+func (h *ToolHandler) branchDone(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.inflight[id] {
+		delete(h.inflight, id)
+		logx.Debugf("Branch %s no longer counts against the concurrency limit (%d running)", id, len(h.inflight))
+	}
+}
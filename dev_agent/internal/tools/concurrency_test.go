@@ -0,0 +1,81 @@
+package tools
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestConcurrencyLimit launches up to the limit, is refused while the
+// branches run, and may launch again once check_status saw one finish.
+func TestConcurrencyLimit(t *testing.T) {
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	h.SetMaxConcurrentBranches(2)
+	srv.SetDefaultScript("running")
+	launch := func() map[string]any {
+		return callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent, "timeout_seconds": 0.05})
+	}
+	launches := func() int { return len(srv.CallsTo("parallel_explore")) }
+
+	// Both launches time out waiting, so their branches keep running.
+	for i := 1; i <= 2; i++ {
+		if code, _ := mustFail(t, launch()); code != CodeTimeout {
+			t.Fatalf("launch %d: code %s, want %s", i, code, CodeTimeout)
+		}
+	}
+
+	code, details := mustFail(t, launch())
+	running := []string{fakeBranchID(1), fakeBranchID(2)}
+	if code != CodeConcurrencyLimit || !reflect.DeepEqual(details["running_branch_ids"], running) || details["limit"] != 2 {
+		t.Fatalf("code %s, details %v; want %s listing %v", code, details, CodeConcurrencyLimit, running)
+	}
+	if details["hint"] == nil || launches() != 2 {
+		t.Errorf("hint %v after %d launches, want a hint and no third launch", details["hint"], launches())
+	}
+
+	// A check_status that sees a branch finish frees its slot.
+	srv.ScriptBranch(fakeBranchID(1), "succeed")
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": fakeBranchID(1)}))
+	srv.SetDefaultScript("succeed")
+	if data := mustSucceed(t, launch()); data["branch_id"] != fakeBranchID(3) {
+		t.Errorf("launch after a completion = %v, want branch 3", data)
+	}
+
+	// Branch 3 finished within execute_agent; cancelling branch 2 frees
+	// the last slot.
+	srv.Respond("cancel_branch", map[string]any{"status": "cancelled"})
+	mustSucceed(t, callTool(h, "cancel_agent", map[string]any{"branch_id": fakeBranchID(2)}))
+	mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Review.", "parent_branch_id": testParent, "num_branches": 2}))
+}
+
+func TestConcurrencyLimitPerLaunch(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetMaxConcurrentBranches(2)
+	code, details := mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore.", "parent_branch_id": testParent, "num_branches": 3}))
+	if code != CodeConcurrencyLimit || details["requested"] != 3 || len(details["running_branch_ids"].([]string)) != 0 {
+		t.Errorf("code %s, details %v; want %s for 3 branches with none running", code, details, CodeConcurrencyLimit)
+	}
+	if n := len(srv.CallsTo("parallel_explore")); n != 0 {
+		t.Errorf("%d launches, want none", n)
+	}
+
+	// A failed launch hands its slots back.
+	srv.Handle("parallel_explore", func(map[string]any) (map[string]any, error) { return nil, errors.New("project demo is archived") })
+	mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore.", "parent_branch_id": testParent, "num_branches": 2}))
+	if err := h.reserveBranches(2); err != nil {
+		t.Errorf("slots still held after a failed launch: %v", err)
+	}
+}
+
+func TestConcurrencyUnlimited(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetMaxConcurrentBranches(0)
+	srv.SetDefaultScript("running")
+	for i := 0; i < 4; i++ {
+		mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore.", "parent_branch_id": testParent, "timeout_seconds": 0.01}))
+	}
+	if n := len(srv.CallsTo("parallel_explore")); n != 4 {
+		t.Errorf("%d launches, want 4 without a limit", n)
+	}
+}
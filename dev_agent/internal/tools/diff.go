@@ -0,0 +1,65 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+// defaultDiffMaxBytes bounds branch_diff output unless SetDiffMaxBytes
+// overrides it.
+const defaultDiffMaxBytes = 64 * 1024
+
+func (h *ToolHandler) branchDiff(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	logx.Infof("Fetching diff of branch %s", branchID)
+	resp, err := h.client.BranchDiff(ctx, branchID)
+	if err != nil {
+		return nil, err
+	}
+	if isErr, _ := resp["isError"].(bool); isErr {
+		return nil, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("branch_diff %s failed", branchID), Details: map[string]any{"mcp_error": resp}}
+	}
+	diff := firstString(resp, "diff", "patch", "text")
+	if strings.TrimSpace(diff) == "" {
+		return map[string]any{"branch_id": branchID, "diff": "", "empty": true, "note": "The branch has no changes against its parent."}, nil
+	}
+	diff = collapseBinaryPatches(diff)
+	out := map[string]any{"branch_id": branchID, "total_bytes": len(diff)}
+	if _, _, diffMax := h.budgets(); len(diff) > diffMax {
+		diff = logx.Truncate(diff, diffMax)
+		out["truncated"] = true
+		out["note"] = fmt.Sprintf("Diff truncated to %d bytes; use read_artifact on specific files for the rest.", diffMax)
+	}
+	out["diff"] = diff
+	return out, nil
+}
+
+// collapseBinaryPatches replaces every "GIT binary patch" body with a
+// one-line marker; the encoded data is useless to a reviewer and eats
+// context.
+func collapseBinaryPatches(diff string) string {
+	if !strings.Contains(diff, "GIT binary patch") {
+		return diff
+	}
+	lines := strings.Split(diff, "\n")
+	out := make([]string, 0, len(lines))
+	skipping := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "diff --git ") {
+			skipping = false
+		}
+		if skipping {
+			continue
+		}
+		if line == "GIT binary patch" {
+			out = append(out, "[binary patch omitted]")
+			skipping = true
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
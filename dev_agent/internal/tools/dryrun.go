@@ -0,0 +1,259 @@
+package tools
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"dev_agent/internal/logx"
+)
+
+// DefaultDryRunFixtures is the directory NewDryRunClient serves artifacts
+// from when none is given.
+const DefaultDryRunFixtures = "dry-run-fixtures"
+
+// dryRunTools are the server tools dryRunTransport answers.
+var dryRunTools = []string{
+	"parallel_explore", "get_branch", "branch_read_file", "branch_list_files",
+	"branch_write_file", "branch_output", "branch_diff", "branch_logs",
+	"cancel_branch", "delete_branch", "get_project", "list_projects", "list_branches",
+}
+
+// NewDryRunClient returns a client whose MCP server is simulated in-process,
+// for rehearsing a run without launching agents. parallel_explore hands out
+// synthetic branch ids, every branch reports "succeed" at once, and
+// branch_read_file serves <fixturesDir>/<path> whatever the branch, with
+// paths under workspaceDir taken relative to it. Writes are kept in memory
+// so later reads see them; nothing leaves the process.
+// A ToolHandler built on it validates, times out and audits calls exactly
+// as it would against a real server.
+func NewDryRunClient(fixturesDir, workspaceDir string) *MCPClient {
+	if fixturesDir == "" {
+		fixturesDir = DefaultDryRunFixtures
+	}
+	logx.Infof("Dry run: MCP calls are simulated and artifacts are served from %s", fixturesDir)
+	return NewMCPClientWithOptions("dry-run", MCPClientOptions{Transport: &dryRunTransport{
+		fixtures:  fixturesDir,
+		workspace: cleanFixturePath(workspaceDir),
+		branches:  map[string]map[string]any{},
+		written:   map[string]string{},
+	}})
+}
+
+// dryRunTransport is the MCPTransport of NewDryRunClient.
+type dryRunTransport struct {
+	fixtures  string
+	workspace string
+
+	mu       sync.Mutex
+	next     int
+	branches map[string]map[string]any
+	order    []string
+	written  map[string]string
+}
+
+func (t *dryRunTransport) Call(ctx context.Context, method string, params map[string]any) (map[string]any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch method {
+	case "tools/list":
+		tools := make([]any, len(dryRunTools))
+		for i, name := range dryRunTools {
+			tools[i] = map[string]any{"name": name, "inputSchema": map[string]any{"type": "object"}}
+		}
+		return map[string]any{"tools": tools}, nil
+	case "tools/call":
+		name, _ := params["name"].(string)
+		args, _ := params["arguments"].(map[string]any)
+		res, err := t.tool(name, args)
+		if err != nil {
+			return map[string]any{"error": err.Error(), "isError": true}, nil
+		}
+		res["dry_run"] = true
+		return res, nil
+	}
+	return nil, MCPRPCError{Code: RPCMethodNotFound, Message: "Method not found: " + method}
+}
+
+func (t *dryRunTransport) tool(name string, args map[string]any) (map[string]any, error) {
+	branchID, _ := args["branch_id"].(string)
+	switch name {
+	case "parallel_explore":
+		return t.explore(args), nil
+	case "get_branch":
+		return t.branch(branchID), nil
+	case "branch_read_file":
+		file, _ := args["file_path"].(string)
+		content, err := t.read(file)
+		if err != nil {
+			return nil, err
+		}
+		if enc, _ := args["encoding"].(string); enc == EncodingBase64 {
+			return map[string]any{"content_base64": base64.StdEncoding.EncodeToString([]byte(content)), "size": len(content)}, nil
+		}
+		return map[string]any{"content": content}, nil
+	case "branch_list_files":
+		dir, _ := args["directory"].(string)
+		return map[string]any{"files": t.list(dir)}, nil
+	case "branch_write_file":
+		file, _ := args["file_path"].(string)
+		content, _ := args["content"].(string)
+		t.mu.Lock()
+		t.written[t.fixturePath(file)] = content
+		t.mu.Unlock()
+		return map[string]any{"branch_id": branchID, "file_path": file, "bytes_written": len(content)}, nil
+	case "branch_output":
+		return map[string]any{"branch_id": branchID, "output": "Dry run: no agent ran on this branch."}, nil
+	case "branch_diff":
+		return map[string]any{"branch_id": branchID, "diff": ""}, nil
+	case "branch_logs":
+		return map[string]any{"branch_id": branchID, "logs": ""}, nil
+	case "cancel_branch":
+		return map[string]any{"branch_id": branchID, "status": "cancelled"}, nil
+	case "delete_branch":
+		return map[string]any{"branch_id": branchID, "deleted": true}, nil
+	case "get_project":
+		return map[string]any{"name": args["project_name"]}, nil
+	case "list_projects":
+		return map[string]any{"projects": []any{}}, nil
+	case "list_branches":
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		items := make([]any, len(t.order))
+		for i, id := range t.order {
+			items[i] = t.branches[id]
+		}
+		return map[string]any{"branches": items}, nil
+	}
+	return nil, fmt.Errorf("dry run does not simulate tool %s", name)
+}
+
+// explore records num_branches synthetic branches of the parent.
+func (t *dryRunTransport) explore(args map[string]any) map[string]any {
+	n := 1
+	switch v := args["num_branches"].(type) {
+	case int:
+		n = max(v, 1)
+	case float64:
+		n = max(int(v), 1)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	branches := make([]any, n)
+	for i := range branches {
+		t.next++
+		id := fmt.Sprintf("00000000-0000-4000-8000-dry%09d", t.next)
+		t.branches[id] = map[string]any{
+			"branch_id":        id,
+			"status":           "succeed",
+			"parent_branch_id": args["parent_branch_id"],
+			"agent":            args["agent"],
+			"project_name":     args["project_name"],
+			"idempotency_key":  args["idempotency_key"],
+		}
+		t.order = append(t.order, id)
+		branches[i] = map[string]any{"branch_id": id, "status": "pending"}
+		logx.Infof("Dry run: %v branch %s from parent %v", args["agent"], id, args["parent_branch_id"])
+	}
+	return map[string]any{"branches": branches}
+}
+
+// branch returns a launched branch, or a finished one of unknown lineage
+// for ids the simulation did not create, such as the starting parent.
+func (t *dryRunTransport) branch(id string) map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b, ok := t.branches[id]; ok {
+		out := make(map[string]any, len(b))
+		for k, v := range b {
+			out[k] = v
+		}
+		return out
+	}
+	return map[string]any{"branch_id": id, "status": "succeed"}
+}
+
+// read returns a file written during the run or else its fixture.
+func (t *dryRunTransport) read(file string) (string, error) {
+	name := t.fixturePath(file)
+	t.mu.Lock()
+	content, ok := t.written[name]
+	t.mu.Unlock()
+	if ok {
+		return content, nil
+	}
+	b, err := os.ReadFile(filepath.Join(t.fixtures, filepath.FromSlash(name)))
+	if err != nil {
+		return "", fmt.Errorf("file %s not found: no dry-run fixture at %s", file, filepath.Join(t.fixtures, filepath.FromSlash(name)))
+	}
+	return string(b), nil
+}
+
+// list returns the fixtures and written files under dir with their size and
+// sha256.
+func (t *dryRunTransport) list(dir string) []any {
+	prefix := t.fixturePath(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	files := map[string]string{}
+	_ = filepath.WalkDir(t.fixtures, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(t.fixtures, p)
+		if err != nil {
+			return nil
+		}
+		if b, err := os.ReadFile(p); err == nil {
+			files[filepath.ToSlash(rel)] = string(b)
+		}
+		return nil
+	})
+	t.mu.Lock()
+	for name, content := range t.written {
+		files[name] = content
+	}
+	t.mu.Unlock()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := make([]any, len(names))
+	for i, name := range names {
+		sum := sha256.Sum256([]byte(files[name]))
+		out[i] = map[string]any{"path": name, "size": len(files[name]), "sha256": hex.EncodeToString(sum[:])}
+	}
+	return out
+}
+
+// fixturePath is the name of a workspace file below the fixtures root.
+func (t *dryRunTransport) fixturePath(p string) string {
+	name := cleanFixturePath(p)
+	if t.workspace != "" && name == t.workspace {
+		return ""
+	}
+	if rel, ok := strings.CutPrefix(name, t.workspace+"/"); ok && t.workspace != "" {
+		return rel
+	}
+	return name
+}
+
+// cleanFixturePath makes a workspace path relative to the fixtures root so
+// it cannot leave it.
+func cleanFixturePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newDryRunHandler returns a handler on a dry-run client serving fixtures
+// from a temp dir holding the given workspace-relative files.
+func newDryRunHandler(t *testing.T, files map[string]string) *ToolHandler {
+	t.Helper()
+	fixtures := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(fixtures, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := NewDryRunClient(fixtures, "/home/dev/workspace")
+	t.Cleanup(func() { client.Close() })
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	return h
+}
+
+func TestDryRunLaunches(t *testing.T) {
+	h := newDryRunHandler(t, nil)
+	data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore", "parent_branch_id": testParent, "num_branches": 2}))
+	ids, _ := data["branch_ids"].([]string)
+	if len(ids) != 2 || ids[0] == ids[1] || !strings.Contains(ids[0], "-dry") {
+		t.Fatalf("branch_ids = %v, want two synthetic ids", data["branch_ids"])
+	}
+	if data["terminal_status"] != TerminalSucceeded {
+		t.Errorf("terminal_status = %v, want succeeded", data["terminal_status"])
+	}
+	status := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": ids[1]}))
+	if status["terminal_status"] != TerminalSucceeded {
+		t.Errorf("check_status = %v, want an instant success", status)
+	}
+	chain, err := h.client.GetBranchAncestry(context.Background(), ids[0])
+	if err != nil || len(chain) != 2 || chain[0].ID != testParent {
+		t.Errorf("ancestry = %+v (%v), want the launch on the start branch", chain, err)
+	}
+}
+
+func TestDryRunArtifacts(t *testing.T) {
+	h := newDryRunHandler(t, map[string]string{"worklog.md": "step 1\n", "docs/notes.md": "notes"})
+	read := func(path string) map[string]any {
+		return callTool(h, "read_artifact", map[string]any{"branch_id": "b-1", "path": path})
+	}
+	if data := mustSucceed(t, read("/home/dev/workspace/worklog.md")); data["content"] != "step 1\n" {
+		t.Errorf("worklog = %v, want the fixture", data["content"])
+	}
+	if data := mustSucceed(t, read("docs/notes.md")); data["content"] != "notes" {
+		t.Errorf("relative path read %v, want the fixture", data["content"])
+	}
+	if data := mustSucceed(t, read("/home/dev/workspace/missing.md")); data["isError"] != true || !strings.Contains(toJSON(data), "no dry-run fixture") {
+		t.Errorf("missing fixture read = %v, want the server error naming it", data)
+	}
+	if res, err := h.client.CallTool(context.Background(), "branch_read_file", map[string]any{"branch_id": "b-1", "file_path": "/../../etc/passwd"}); err != nil || res["isError"] != true {
+		t.Errorf("read outside the fixtures = %v (%v), want it kept below them and not found", res, err)
+	}
+
+	mustSucceed(t, callTool(h, "write_artifact", map[string]any{"branch_id": "b-1", "path": "/home/dev/workspace/worklog.md", "content": "rewritten\n"}))
+	if data := mustSucceed(t, read("/home/dev/workspace/worklog.md")); data["content"] != "rewritten\n" {
+		t.Errorf("worklog after a write = %v, want the written content", data["content"])
+	}
+	entries, err := h.client.BranchListArtifacts(context.Background(), "b-1", "/home/dev/workspace/docs")
+	if err != nil || len(entries) != 1 || entries[0].SHA256 != sha256Hex("notes") {
+		t.Errorf("listing = %+v (%v), want docs/notes.md with its sha256", entries, err)
+	}
+}
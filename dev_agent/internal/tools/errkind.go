@@ -0,0 +1,159 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrorKind classifies an MCP failure by what the caller should do about it.
+type ErrorKind string
+
+const (
+	// KindTransport: the server could not be reached or the connection broke.
+	KindTransport ErrorKind = "transport"
+	// KindRateLimited: the server asked us to slow down.
+	KindRateLimited ErrorKind = "rate_limited"
+	// KindInvalidParams: the request itself is wrong (bad arguments, unknown
+	// tool, prompt too long); sending it unchanged fails again.
+	KindInvalidParams ErrorKind = "invalid_params"
+	// KindNotFound: the branch, file or project does not exist.
+	KindNotFound ErrorKind = "not_found"
+	// KindServerInternal: the server failed while handling a valid request.
+	KindServerInternal ErrorKind = "server_internal"
+	// KindSessionExpired: the server no longer knows our session.
+	KindSessionExpired ErrorKind = "session_expired"
+	// KindAuth: the server rejected our credentials.
+	KindAuth ErrorKind = "auth"
+)
+
+// Retryable reports whether a failure of this kind may go away by itself.
+func (k ErrorKind) Retryable() bool {
+	switch k {
+	case KindTransport, KindRateLimited, KindServerInternal, KindSessionExpired:
+		return true
+	}
+	return false
+}
+
+// KindOf classifies err; it returns "" for errors that are not MCP failures,
+// such as a cancelled context.
+func KindOf(err error) ErrorKind {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return ""
+	}
+	var me MCPError
+	if errors.As(err, &me) && me.Kind != "" {
+		return me.Kind
+	}
+	var he MCPHTTPError
+	if errors.As(err, &he) {
+		switch {
+		case he.Status == http.StatusTooManyRequests:
+			return KindRateLimited
+		case he.Status == http.StatusUnauthorized || he.Status == http.StatusForbidden:
+			return KindAuth
+		case he.Status == http.StatusNotFound || he.Status == http.StatusGone:
+			return KindNotFound
+		case he.Status >= 500:
+			return KindServerInternal
+		}
+		return KindInvalidParams
+	}
+	var re MCPRPCError
+	if errors.As(err, &re) {
+		switch {
+		case re.malformed():
+			return KindInvalidParams
+		case mentionsNotFound(re.Message):
+			return KindNotFound
+		}
+		return KindServerInternal
+	}
+	var te MCPToolError
+	if errors.As(err, &te) {
+		return toolErrorKind(te.Result)
+	}
+	var xe ToolExecutionError
+	var ae ArgumentError
+	if (errors.As(err, &xe) && xe.Code == CodeInvalidArguments) || errors.As(err, &ae) {
+		return KindInvalidParams
+	}
+	var ne net.Error
+	var disc *sseDisconnectError
+	switch {
+	case errors.Is(err, ErrMCPUnavailable), errors.Is(err, ErrResultUnknown), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &ne), errors.As(err, &disc):
+		return KindTransport
+	}
+	return ""
+}
+
+// isRetryable reports whether another attempt could succeed: the error's
+// own verdict when it has one, otherwise that of its kind. Unclassified
+// errors are retried, as they always were.
+func isRetryable(err error) bool {
+	var me MCPError
+	if errors.As(err, &me) && me.Kind != "" {
+		return me.IsRetryable()
+	}
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+	kind := KindOf(err)
+	return kind == "" || kind.Retryable()
+}
+
+// classify wraps a failure of call in an MCPError carrying its kind and
+// request id. Errors that already say what to do (open circuit, unknown
+// result, bad reply) and context errors pass through unchanged.
+func classify(err error, requestID string) error {
+	if err == nil || errors.Is(err, ErrMCPUnavailable) || errors.Is(err, ErrResultUnknown) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if me, ok := err.(MCPError); ok {
+		if me.RequestID == "" {
+			me.RequestID = requestID
+			me.Msg = fmt.Sprintf("%s (request_id=%s)", me.Msg, requestID)
+		}
+		return me
+	}
+	var se *ResponseSchemaError
+	if errors.As(err, &se) {
+		return err
+	}
+	kind := KindOf(err)
+	if kind == "" {
+		return err
+	}
+	return MCPError{Kind: kind, Msg: fmt.Sprintf("%v (request_id=%s)", err, requestID), Err: err, RequestID: requestID}
+}
+
+// toolErrorKind reads the kind of an isError tool result from its message.
+func toolErrorKind(res map[string]any) ErrorKind {
+	msg := strings.ToLower(firstString(res, "error", "message", "text"))
+	if e, ok := res["error"].(map[string]any); ok {
+		msg = strings.ToLower(firstString(e, "message", "code"))
+	}
+	switch {
+	case mentionsNotFound(msg):
+		return KindNotFound
+	case strings.Contains(msg, "rate limit"), strings.Contains(msg, "too many requests"):
+		return KindRateLimited
+	case strings.Contains(msg, "invalid"), strings.Contains(msg, "too long"), strings.Contains(msg, "exceeds"),
+		strings.Contains(msg, "required"), strings.Contains(msg, "must "):
+		return KindInvalidParams
+	}
+	return KindServerInternal
+}
+
+func mentionsNotFound(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist") || strings.Contains(msg, "no such")
+}
@@ -0,0 +1,223 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKindOf(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		want      ErrorKind
+		retryable bool
+	}{
+		{"429", MCPHTTPError{Status: 429}, KindRateLimited, true},
+		{"401", MCPHTTPError{Status: 401}, KindAuth, false},
+		{"403", MCPHTTPError{Status: 403}, KindAuth, false},
+		{"404", MCPHTTPError{Status: 404}, KindNotFound, false},
+		{"400", MCPHTTPError{Status: 400}, KindInvalidParams, false},
+		{"500", MCPHTTPError{Status: 500}, KindServerInternal, true},
+		{"503", MCPHTTPError{Status: 503}, KindServerInternal, true},
+		{"rpc invalid params", MCPRPCError{Code: RPCInvalidParams, Message: "bad branch_id"}, KindInvalidParams, false},
+		{"rpc method not found", MCPRPCError{Code: RPCMethodNotFound}, KindInvalidParams, false},
+		{"rpc internal", MCPRPCError{Code: -32603, Message: "boom"}, KindServerInternal, true},
+		{"rpc internal not found", MCPRPCError{Code: -32603, Message: "Branch not found"}, KindNotFound, false},
+		{"tool not found", MCPToolError{Result: map[string]any{"isError": true, "error": "no such file"}}, KindNotFound, false},
+		{"tool rate limited", MCPToolError{Result: map[string]any{"isError": true, "error": "Rate limit exceeded"}}, KindRateLimited, true},
+		{"tool invalid", MCPToolError{Result: map[string]any{"isError": true, "error": "prompt too long"}}, KindInvalidParams, false},
+		{"tool failed", MCPToolError{Result: map[string]any{"isError": true, "error": "agent crashed"}}, KindServerInternal, true},
+		{"argument error", ArgumentError{Tool: "get_branch", Property: "branch_id"}, KindInvalidParams, false},
+		{"EOF", io.ErrUnexpectedEOF, KindTransport, true},
+		{"net error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, KindTransport, true},
+		{"unavailable", ErrMCPUnavailable, KindTransport, true},
+		{"deadline", context.DeadlineExceeded, KindTransport, true},
+		{"session expired", MCPError{Kind: KindSessionExpired}, KindSessionExpired, true},
+		{"wrapped", fmt.Errorf("get_branch: %w", MCPError{Kind: KindAuth}), KindAuth, false},
+		{"cancelled", context.Canceled, "", true},
+		{"unclassified", errors.New("odd"), "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := KindOf(c.err); got != c.want {
+				t.Errorf("KindOf = %q, want %q", got, c.want)
+			}
+			if got := isRetryable(c.err); got != c.retryable {
+				t.Errorf("isRetryable = %v, want %v", got, c.retryable)
+			}
+		})
+	}
+}
+
+func TestErrorKindRetryable(t *testing.T) {
+	want := map[ErrorKind]bool{
+		KindTransport:      true,
+		KindRateLimited:    true,
+		KindServerInternal: true,
+		KindSessionExpired: true,
+		KindInvalidParams:  false,
+		KindNotFound:       false,
+		KindAuth:           false,
+	}
+	for kind, retryable := range want {
+		if kind.Retryable() != retryable || (MCPError{Kind: kind}).IsRetryable() != retryable {
+			t.Errorf("%s: retryable = %v, want %v", kind, kind.Retryable(), retryable)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	err := classify(MCPHTTPError{Status: 404, Body: "gone"}, "req-1")
+	var me MCPError
+	if !errors.As(err, &me) || me.Kind != KindNotFound || me.RequestID != "req-1" {
+		t.Fatalf("classify = %#v, want a not_found MCPError for req-1", err)
+	}
+	var he MCPHTTPError
+	if !errors.As(err, &he) || he.Status != 404 {
+		t.Errorf("the classified error no longer unwraps to the HTTP error: %v", err)
+	}
+	for _, passthrough := range []error{nil, context.Canceled, ErrMCPUnavailable, errors.New("odd")} {
+		if got := classify(passthrough, "req-2"); got != passthrough {
+			t.Errorf("classify(%v) = %v, want it unchanged", passthrough, got)
+		}
+	}
+}
+
+// expiringSessionServer assigns a session on initialize and then rejects
+// every tool call with 404, as a server that keeps losing its sessions.
+func expiringSessionServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method == "tools/call" {
+			calls.Add(1)
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Mcp-Session-Id", "s1")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+// TestRetryByKind checks each kind reaches the caller from CallTool and
+// that the retry loop repeats only the retryable ones.
+func TestRetryByKind(t *testing.T) {
+	status := func(code int) func(t *testing.T) (*httptest.Server, *atomic.Int32) {
+		return func(t *testing.T) (*httptest.Server, *atomic.Int32) {
+			return scriptedStatusServer(t, "", code, code, code)
+		}
+	}
+	rpc := func(code int, msg string) func(t *testing.T) (*httptest.Server, *atomic.Int32) {
+		return func(t *testing.T) (*httptest.Server, *atomic.Int32) {
+			return rpcErrorServer(t, map[string]any{"code": code, "message": msg})
+		}
+	}
+	cases := []struct {
+		name   string
+		server func(t *testing.T) (*httptest.Server, *atomic.Int32)
+		kind   ErrorKind
+		calls  int32
+	}{
+		{"rate limited", status(http.StatusTooManyRequests), KindRateLimited, 3},
+		{"server internal", status(http.StatusInternalServerError), KindServerInternal, 3},
+		{"auth", status(http.StatusUnauthorized), KindAuth, 1},
+		{"not found", status(http.StatusNotFound), KindNotFound, 1},
+		{"invalid params", status(http.StatusBadRequest), KindInvalidParams, 1},
+		{"rpc invalid params", rpc(RPCInvalidParams, "bad branch_id"), KindInvalidParams, 1},
+		{"rpc not found", rpc(-32603, "branch does not exist"), KindNotFound, 1},
+		{"rpc internal", rpc(-32603, "boom"), KindServerInternal, 3},
+		// Each rejection is answered by a new handshake, not a retry.
+		{"session expired", expiringSessionServer, KindSessionExpired, maxSessionReinits + 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, calls := c.server(t)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+			defer client.Close()
+			_, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+			var me MCPError
+			if !errors.As(err, &me) || me.Kind != c.kind {
+				t.Fatalf("err = %v, want an MCPError of kind %s", err, c.kind)
+			}
+			if me.IsRetryable() != c.kind.Retryable() {
+				t.Errorf("IsRetryable = %v, want %v", me.IsRetryable(), c.kind.Retryable())
+			}
+			if got := calls.Load(); got != c.calls {
+				t.Errorf("%d tool calls, want %d", got, c.calls)
+			}
+		})
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		srv, _ := scriptedStatusServer(t, "")
+		srv.Close()
+		client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+		defer client.Close()
+		_, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+		if kind := KindOf(err); kind != KindTransport || !isRetryable(err) {
+			t.Errorf("err = %v (kind %q), want a retryable transport failure", err, kind)
+		}
+	})
+}
+
+func TestErrorPayloadKind(t *testing.T) {
+	cases := []struct {
+		name      string
+		server    func(t *testing.T) *httptest.Server
+		kind      ErrorKind
+		retryable bool
+	}{
+		{"invalid params", func(t *testing.T) *httptest.Server {
+			srv, _ := rpcErrorServer(t, map[string]any{"code": RPCInvalidParams, "message": "bad branch_id"})
+			return srv
+		}, KindInvalidParams, false},
+		{"rpc not found", func(t *testing.T) *httptest.Server {
+			srv, _ := rpcErrorServer(t, map[string]any{"code": -32603, "message": "branch does not exist"})
+			return srv
+		}, KindNotFound, false},
+		{"server internal", func(t *testing.T) *httptest.Server {
+			srv, _ := scriptedStatusServer(t, "", 500)
+			return srv
+		}, KindServerInternal, true},
+		{"not found", func(t *testing.T) *httptest.Server {
+			srv, _ := scriptedStatusServer(t, "", 404)
+			return srv
+		}, KindNotFound, false},
+		{"auth", func(t *testing.T) *httptest.Server {
+			srv, _ := scriptedStatusServer(t, "", 401)
+			return srv
+		}, KindAuth, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := NewMCPClientWithOptions(c.server(t).URL, MCPClientOptions{MaxRetries: 1})
+			defer client.Close()
+			h := NewToolHandler(client, "demo", testParent)
+			h.SetResultBudget(0, t.TempDir())
+			res := callTool(h, "branch_output", map[string]any{"branch_id": fakeBranchID(1)})
+			_, details := mustFail(t, res)
+			if details["error_kind"] != c.kind {
+				t.Errorf("error_kind = %v, want %s", details["error_kind"], c.kind)
+			}
+			if got := res["error"].(map[string]any)["retryable"]; got != c.retryable {
+				t.Errorf("retryable = %v, want %v", got, c.retryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Error payloads look like
+//
+//	{"status": "error", "error": {"code": "INVALID_ARGS", "message": "...",
+//	 "retryable": false, "details": {...}}}
+//
+// so the model can tell a call to fix from one to repeat without parsing
+// prose. With SetLegacyErrorPayloads the former flat shape is returned
+// instead: "error" is the message and the code, hints and details sit next
+// to it.
+
+// Wire error codes of the structured error payload.
+const (
+	ErrorCodeInvalidArgs      = "INVALID_ARGS"
+	ErrorCodeUnknownTool      = "UNKNOWN_TOOL"
+	ErrorCodeToolFailed       = "TOOL_FAILED"
+	ErrorCodeAgentFailed      = "AGENT_FAILED"
+	ErrorCodeTimeout          = "TIMEOUT"
+	ErrorCodeNoProgress       = "NO_PROGRESS"
+	ErrorCodeCancelled        = "CANCELLED"
+	ErrorCodeConcurrencyLimit = "CONCURRENCY_LIMIT"
+	ErrorCodeMCPTimeout       = "MCP_TIMEOUT"
+	ErrorCodeMCPTransport     = "MCP_TRANSPORT"
+	ErrorCodeMCPUnavailable   = "MCP_UNAVAILABLE"
+	ErrorCodeMCPServerError   = "MCP_SERVER_ERROR"
+	ErrorCodeInvalidResponse  = "INVALID_RESPONSE"
+	ErrorCodeResultUnknown    = "RESULT_UNKNOWN"
+	ErrorCodeRateLimited      = "RATE_LIMITED"
+	ErrorCodeNotFound         = "NOT_FOUND"
+	ErrorCodeSessionExpired   = "SESSION_EXPIRED"
+	ErrorCodeAuthFailed       = "AUTH_FAILED"
+)
+
+// wireCodes maps the Code of a ToolExecutionError (and the flat payload's
+// code) to its wire code.
+var wireCodes = map[string]string{
+	CodeInvalidArguments: ErrorCodeInvalidArgs,
+	CodeUnknownTool:      ErrorCodeUnknownTool,
+	CodeToolFailed:       ErrorCodeToolFailed,
+	CodeAgentFailed:      ErrorCodeAgentFailed,
+	CodeTimeout:          ErrorCodeTimeout,
+	CodeNoProgress:       ErrorCodeNoProgress,
+	CodeCancelled:        ErrorCodeCancelled,
+	CodeConcurrencyLimit: ErrorCodeConcurrencyLimit,
+	CodeMCPUnavailable:   ErrorCodeMCPUnavailable,
+	CodeInvalidResponse:  ErrorCodeInvalidResponse,
+	CodeResultUnknown:    ErrorCodeResultUnknown,
+}
+
+// kindCodes gives the wire code of an uncoded failure by its kind.
+var kindCodes = map[ErrorKind]string{
+	KindTransport:      ErrorCodeMCPTransport,
+	KindRateLimited:    ErrorCodeRateLimited,
+	KindInvalidParams:  ErrorCodeInvalidArgs,
+	KindNotFound:       ErrorCodeNotFound,
+	KindServerInternal: ErrorCodeMCPServerError,
+	KindSessionExpired: ErrorCodeSessionExpired,
+	KindAuth:           ErrorCodeAuthFailed,
+}
+
+// transientCodes are the wire codes retryable by default, for failures that
+// carry no verdict of their own.
+var transientCodes = map[string]bool{
+	ErrorCodeMCPTimeout:     true,
+	ErrorCodeMCPTransport:   true,
+	ErrorCodeMCPUnavailable: true,
+	ErrorCodeMCPServerError: true,
+	ErrorCodeRateLimited:    true,
+	ErrorCodeSessionExpired: true,
+}
+
+// SetLegacyErrorPayloads makes Handle return errors in the flat shape used
+// before structured error payloads, for consumers not yet updated. It will
+// be removed in the next release.
+func (h *ToolHandler) SetLegacyErrorPayloads(on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.legacyErrors = on
+}
+
+// wireCode is the wire code of a failure whose flat payload carries code.
+func wireCode(code string, err error) string {
+	if c, ok := wireCodes[code]; ok {
+		return c
+	}
+	if code != "" {
+		return strings.ToUpper(code)
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return ErrorCodeMCPTimeout
+	}
+	if c, ok := kindCodes[KindOf(err)]; ok {
+		return c
+	}
+	return ErrorCodeToolFailed
+}
+
+// shapeError turns the flat error payload built by errorResult into the
+// structured one, unless legacy payloads are on.
+func (h *ToolHandler) shapeError(flat map[string]any, err error) map[string]any {
+	h.mu.Lock()
+	legacy := h.legacyErrors
+	h.mu.Unlock()
+	if legacy {
+		return flat
+	}
+	code, _ := flat["code"].(string)
+	code = wireCode(code, err)
+	msg, _ := flat["error"].(string)
+	retryable, set := flat["retryable"].(bool)
+	if !set {
+		retryable = transientCodes[code]
+	}
+	details := map[string]any{}
+	for k, v := range flat {
+		switch k {
+		case "status", "error", "code", "retryable":
+		default:
+			details[k] = v
+		}
+	}
+	return map[string]any{
+		"status": "error",
+		"error": map[string]any{
+			"code":      code,
+			"message":   msg,
+			"retryable": retryable,
+			"details":   details,
+		},
+	}
+}
+
+// ErrorInfo reads an error payload of either shape: its code as one of the
+// Code constants (the wire code when none matches), its message and its
+// details. ok is false for other payloads.
+func ErrorInfo(payload map[string]any) (code, msg string, details map[string]any, ok bool) {
+	if payload["status"] != "error" {
+		return "", "", nil, false
+	}
+	e, structured := payload["error"].(map[string]any)
+	if !structured {
+		code, _ = payload["code"].(string)
+		msg, _ = payload["error"].(string)
+		return code, msg, payload, true
+	}
+	wire, _ := e["code"].(string)
+	code = wire
+	for c, w := range wireCodes {
+		if w == wire {
+			code = c
+			break
+		}
+	}
+	msg, _ = e["message"].(string)
+	details, _ = e["details"].(map[string]any)
+	if details == nil {
+		details = map[string]any{}
+	}
+	return code, msg, details, true
+}
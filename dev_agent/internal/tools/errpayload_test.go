@@ -0,0 +1,271 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWireCode(t *testing.T) {
+	cases := []struct {
+		name string
+		code string
+		err  error
+		want string
+	}{
+		{"invalid arguments", CodeInvalidArguments, nil, ErrorCodeInvalidArgs},
+		{"unknown tool", CodeUnknownTool, nil, ErrorCodeUnknownTool},
+		{"tool failed", CodeToolFailed, nil, ErrorCodeToolFailed},
+		{"agent failed", CodeAgentFailed, nil, ErrorCodeAgentFailed},
+		{"timeout", CodeTimeout, nil, ErrorCodeTimeout},
+		{"no progress", CodeNoProgress, nil, ErrorCodeNoProgress},
+		{"cancelled", CodeCancelled, nil, ErrorCodeCancelled},
+		{"concurrency limit", CodeConcurrencyLimit, nil, ErrorCodeConcurrencyLimit},
+		{"mcp unavailable", CodeMCPUnavailable, nil, ErrorCodeMCPUnavailable},
+		{"invalid response", CodeInvalidResponse, nil, ErrorCodeInvalidResponse},
+		{"result unknown", CodeResultUnknown, nil, ErrorCodeResultUnknown},
+		{"unmapped code", "quota_exceeded", nil, "QUOTA_EXCEEDED"},
+		{"code wins over the error", CodeToolFailed, context.DeadlineExceeded, ErrorCodeToolFailed},
+		{"deadline", "", fmt.Errorf("get_branch: %w", context.DeadlineExceeded), ErrorCodeMCPTimeout},
+		{"net timeout", "", &net.OpError{Op: "read", Err: timeoutErr{}}, ErrorCodeMCPTimeout},
+		{"transport", "", connRefused, ErrorCodeMCPTransport},
+		{"rate limited", "", MCPHTTPError{Status: http.StatusTooManyRequests}, ErrorCodeRateLimited},
+		{"invalid params", "", MCPHTTPError{Status: http.StatusBadRequest}, ErrorCodeInvalidArgs},
+		{"not found", "", MCPHTTPError{Status: http.StatusNotFound}, ErrorCodeNotFound},
+		{"server internal", "", MCPHTTPError{Status: http.StatusInternalServerError}, ErrorCodeMCPServerError},
+		{"session expired", "", MCPError{Kind: KindSessionExpired}, ErrorCodeSessionExpired},
+		{"auth", "", MCPHTTPError{Status: http.StatusUnauthorized}, ErrorCodeAuthFailed},
+		{"unclassified", "", errors.New("odd"), ErrorCodeToolFailed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := wireCode(c.code, c.err); got != c.want {
+				t.Errorf("wireCode(%q, %v) = %s, want %s", c.code, c.err, got, c.want)
+			}
+		})
+	}
+}
+
+// timeoutErr is a net.Error that timed out.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+var connRefused = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+func TestShapeError(t *testing.T) {
+	cases := []struct {
+		name string
+		flat map[string]any
+		err  error
+		want map[string]any
+	}{
+		{"details gathered",
+			map[string]any{"status": "error", "error": "bad input", "code": CodeInvalidArguments, "hint": "fix it", "property": "prompt"}, nil,
+			map[string]any{"code": ErrorCodeInvalidArgs, "message": "bad input", "retryable": false, "details": map[string]any{"hint": "fix it", "property": "prompt"}}},
+		{"transient by default",
+			map[string]any{"status": "error", "error": "read timed out"}, context.DeadlineExceeded,
+			map[string]any{"code": ErrorCodeMCPTimeout, "message": "read timed out", "retryable": true, "details": map[string]any{}}},
+		{"explicit retryable wins",
+			map[string]any{"status": "error", "error": "boom", "error_kind": KindServerInternal, "retryable": false}, MCPHTTPError{Status: 500},
+			map[string]any{"code": ErrorCodeMCPServerError, "message": "boom", "retryable": false, "details": map[string]any{"error_kind": KindServerInternal}}},
+		{"coded failure not retryable by default",
+			map[string]any{"status": "error", "error": "branch b-1 failed", "code": CodeAgentFailed, "branch_id": "b-1"}, nil,
+			map[string]any{"code": ErrorCodeAgentFailed, "message": "branch b-1 failed", "retryable": false, "details": map[string]any{"branch_id": "b-1"}}},
+	}
+	h, _ := newTestHandler(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := h.shapeError(c.flat, c.err)
+			if want := map[string]any{"status": "error", "error": c.want}; !reflect.DeepEqual(got, want) {
+				t.Errorf("shapeError =\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+
+	h.SetLegacyErrorPayloads(true)
+	flat := map[string]any{"status": "error", "error": "bad input", "code": CodeInvalidArguments}
+	if got := h.shapeError(flat, nil); !reflect.DeepEqual(got, flat) {
+		t.Errorf("legacy shapeError = %v, want the flat payload", got)
+	}
+}
+
+// TestErrorResultWrapped checks a ToolExecutionError keeps its code,
+// retryable flag and details when a helper wraps it.
+func TestErrorResultWrapped(t *testing.T) {
+	h, _ := newTestHandler(t)
+	te := ToolExecutionError{Msg: "branch b-1 timed out", Code: CodeTimeout, Details: map[string]any{"branch_id": "b-1", "retryable": true}}
+	got := h.ErrorResult("check_status", fmt.Errorf("await b-1: %w", te))
+	want := map[string]any{"status": "error", "error": map[string]any{
+		"code": ErrorCodeTimeout, "message": "await b-1: branch b-1 timed out", "retryable": true, "details": map[string]any{"branch_id": "b-1"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ErrorResult =\n%v\nwant\n%v", got, want)
+	}
+}
+
+// TestErrorSiteCodes calls each failure site through Handle and checks the
+// wire code, retryable flag and the details the model needs to react.
+func TestErrorSiteCodes(t *testing.T) {
+	launch := map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent}
+	with := func(extra map[string]any) map[string]any {
+		args := map[string]any{}
+		for k, v := range launch {
+			args[k] = v
+		}
+		for k, v := range extra {
+			args[k] = v
+		}
+		return args
+	}
+	cases := []struct {
+		name      string
+		call      func(t *testing.T) map[string]any
+		code      string
+		retryable bool
+		details   []string
+	}{
+		{"schema violation", func(t *testing.T) map[string]any {
+			h, _ := newTestHandler(t)
+			return callTool(h, "branch_logs", map[string]any{"branch_id": "b-1", "tail_lines": 0})
+		}, ErrorCodeInvalidArgs, false, []string{"validation_errors", "schema"}},
+		{"unknown tool", func(t *testing.T) map[string]any {
+			h, _ := newTestHandler(t)
+			return callTool(h, "exeute_agent", launch)
+		}, ErrorCodeUnknownTool, false, []string{"supported_tools", "did_you_mean"}},
+		{"agent not allowed", func(t *testing.T) map[string]any {
+			h, _ := newTestHandler(t)
+			return callTool(h, "execute_agent", with(map[string]any{"agent": "tester"}))
+		}, ErrorCodeInvalidArgs, false, []string{"allowed_agents"}},
+		{"launch rejected", func(t *testing.T) map[string]any {
+			h, srv := newTestHandler(t)
+			srv.Respond("parallel_explore", map[string]any{"isError": true, "error": "project demo is archived"})
+			return callTool(h, "execute_agent", launch)
+		}, ErrorCodeToolFailed, false, []string{"mcp_error", "request"}},
+		{"invalid launch response", func(t *testing.T) map[string]any {
+			h, srv := newTestHandler(t)
+			captureLogs(t)
+			srv.Respond("parallel_explore", map[string]any{"branches": []any{map[string]any{"state": "pending"}}})
+			return callTool(h, "execute_agent", launch)
+		}, ErrorCodeInvalidResponse, false, []string{"tool", "field", "raw_response"}},
+		{"concurrency limit", func(t *testing.T) map[string]any {
+			h, _ := newTestHandler(t)
+			h.SetMaxConcurrentBranches(1)
+			return callTool(h, "execute_agent", with(map[string]any{"num_branches": 2}))
+		}, ErrorCodeConcurrencyLimit, false, []string{"limit", "running_branch_ids", "hint"}},
+		{"agent failed", func(t *testing.T) map[string]any {
+			h, srv := newTestHandler(t)
+			srv.ScriptBranch("b-1", "failed")
+			return callTool(h, "check_status", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeAgentFailed, false, []string{"branch_id", "terminal_status"}},
+		{"timeout", func(t *testing.T) map[string]any {
+			h, srv := newTestHandler(t)
+			h.SetPollPolicy(PollPolicy{Initial: time.Millisecond, Max: 2 * time.Millisecond, Timeout: time.Minute})
+			srv.ScriptBranch("b-1", "running")
+			return callTool(h, "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": 0.05})
+		}, ErrorCodeTimeout, false, []string{"branch_id", "status_history"}},
+		{"no progress", func(t *testing.T) map[string]any {
+			h, srv := newTestHandler(t)
+			h.SetPollPolicy(PollPolicy{Initial: time.Millisecond, Max: 2 * time.Millisecond, Timeout: time.Minute})
+			srv.ScriptBranch("b-1", "pending")
+			return callTool(h, "check_status", map[string]any{"branch_id": "b-1", "no_progress_timeout_seconds": 0.05})
+		}, ErrorCodeNoProgress, false, []string{"branch_id", "status_history", "hint"}},
+		{"cancelled", func(t *testing.T) map[string]any {
+			h, srv := newTestHandler(t)
+			h.SetPollPolicy(PollPolicy{Initial: time.Second, Max: time.Second, Timeout: time.Minute})
+			srv.ScriptBranch("b-1", "running")
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return callToolCtx(ctx, h, "check_status", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeCancelled, false, []string{"branch_id", "last_status"}},
+		{"branch not found", func(t *testing.T) map[string]any {
+			h, _ := newTestHandler(t)
+			return callTool(h, "check_status", map[string]any{"branch_id": "ghost"})
+		}, ErrorCodeToolFailed, false, []string{"error_kind", "result"}},
+		{"rpc invalid params", func(t *testing.T) map[string]any {
+			srv, _ := rpcErrorServer(t, map[string]any{"code": RPCInvalidParams, "message": "bad branch_id"})
+			return callTool(rawHandler(t, srv.URL, MCPClientOptions{}), "branch_output", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeInvalidArgs, false, []string{"rpc_error", "hint", "error_kind"}},
+		{"rpc internal", func(t *testing.T) map[string]any {
+			srv, _ := rpcErrorServer(t, map[string]any{"code": -32603, "message": "boom"})
+			return callTool(rawHandler(t, srv.URL, MCPClientOptions{}), "branch_output", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeToolFailed, true, []string{"rpc_error", "hint"}},
+		{"rate limited", func(t *testing.T) map[string]any {
+			srv, _ := scriptedStatusServer(t, "", http.StatusTooManyRequests)
+			return callTool(rawHandler(t, srv.URL, MCPClientOptions{}), "branch_output", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeRateLimited, true, []string{"error_kind"}},
+		{"auth", func(t *testing.T) map[string]any {
+			srv, _ := scriptedStatusServer(t, "", http.StatusUnauthorized)
+			return callTool(rawHandler(t, srv.URL, MCPClientOptions{}), "branch_output", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeAuthFailed, false, []string{"error_kind"}},
+		{"transport", func(t *testing.T) map[string]any {
+			srv, _ := scriptedStatusServer(t, "")
+			srv.Close()
+			return callTool(rawHandler(t, srv.URL, MCPClientOptions{}), "branch_output", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeMCPTransport, true, []string{"error_kind"}},
+		{"circuit open", func(t *testing.T) map[string]any {
+			srv, _ := scriptedStatusServer(t, "", http.StatusBadGateway, http.StatusBadGateway)
+			h := rawHandler(t, srv.URL, MCPClientOptions{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+			captureLogs(t)
+			callTool(h, "branch_output", map[string]any{"branch_id": "b-1"})
+			return callTool(h, "branch_output", map[string]any{"branch_id": "b-1"})
+		}, ErrorCodeMCPUnavailable, true, []string{"retryable_after_seconds"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := c.call(t)
+			e, _ := res["error"].(map[string]any)
+			if res["status"] != "error" || e == nil {
+				t.Fatalf("result = %s, want a structured error", toJSON(res))
+			}
+			if e["code"] != c.code || e["retryable"] != c.retryable {
+				t.Errorf("code %v, retryable %v; want %s, %v\n%s", e["code"], e["retryable"], c.code, c.retryable, toJSON(res))
+			}
+			if msg, _ := e["message"].(string); msg == "" {
+				t.Errorf("no message: %s", toJSON(res))
+			}
+			details, _ := e["details"].(map[string]any)
+			for _, k := range c.details {
+				if _, ok := details[k]; !ok {
+					t.Errorf("details lack %s: %v", k, details)
+				}
+			}
+			for _, k := range []string{"status", "code", "retryable"} {
+				if _, ok := details[k]; ok {
+					t.Errorf("details repeat %s: %v", k, details)
+				}
+			}
+		})
+	}
+}
+
+// rawHandler is a handler on a client of url that does not retry.
+func rawHandler(t *testing.T, url string, opts MCPClientOptions) *ToolHandler {
+	t.Helper()
+	opts.MaxRetries, opts.BaseBackoff, opts.MaxBackoff = 1, time.Millisecond, time.Millisecond
+	client := NewMCPClientWithOptions(url, opts)
+	t.Cleanup(func() { client.Close() })
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	return h
+}
+
+func TestLegacyErrorPayloads(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetLegacyErrorPayloads(true)
+	srv.ScriptBranch("b-1", "failed")
+	res := callTool(h, "check_status", map[string]any{"branch_id": "b-1"})
+	if msg, _ := res["error"].(string); res["status"] != "error" || res["code"] != CodeAgentFailed || msg == "" || res["branch_id"] != "b-1" {
+		t.Errorf("legacy result = %s, want the flat shape", toJSON(res))
+	}
+	if code, _, details, _ := ErrorInfo(res); code != CodeAgentFailed || details["branch_id"] != "b-1" {
+		t.Errorf("ErrorInfo = %s, %v; want the flat payload read back", code, details)
+	}
+}
@@ -0,0 +1,53 @@
+package tools
+
+import (
+	"sort"
+	"strings"
+)
+
+// ClosestMatches returns up to limit candidates within a plausible typo
+// distance of name, closest first. Comparison ignores case.
+func ClosestMatches(name string, candidates []string, limit int) []string {
+	type scored struct {
+		name string
+		dist int
+	}
+	var hits []scored
+	lower := strings.ToLower(name)
+	for _, c := range candidates {
+		d := editDistance(lower, strings.ToLower(c))
+		if d <= max(len(name), len(c))/2 {
+			hits = append(hits, scored{c, d})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].dist < hits[j].dist })
+	out := make([]string, 0, min(limit, len(hits)))
+	for _, h := range hits {
+		if len(out) == limit {
+			break
+		}
+		out = append(out, h.name)
+	}
+	return out
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,49 @@
+package tools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClosestMatches(t *testing.T) {
+	projects := []string{"dev-agent", "dev_agent", "tidb", "tikv", "pd", "dashboard", "DevAgent-Legacy"}
+	cases := []struct {
+		name  string
+		typo  string
+		limit int
+		want  []string
+	}{
+		{"exact", "tidb", 3, []string{"tidb", "tikv"}},
+		{"one substitution", "dev-agnet", 3, []string{"dev-agent", "dev_agent"}},
+		{"case ignored", "TIKV", 1, []string{"tikv"}},
+		{"closest first", "tikb", 3, []string{"tidb", "tikv"}},
+		{"limit", "dev_agen", 1, []string{"dev_agent"}},
+		{"nothing plausible", "kubernetes", 3, []string{}},
+		{"short names need close typos", "px", 3, []string{"pd"}},
+		{"empty name", "", 3, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ClosestMatches(c.typo, projects, c.limit); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("ClosestMatches(%q) = %q, want %q", c.typo, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"dev-agent", "dev_agent", 1},
+		{"tidb", "tibd", 2},
+	} {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
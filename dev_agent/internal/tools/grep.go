@@ -0,0 +1,193 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+const (
+	// defaultGrepMatches and maxGrepMatches bound grep_artifact's
+	// max_matches; maxGrepContext bounds context_lines.
+	defaultGrepMatches = 50
+	maxGrepMatches     = 500
+	maxGrepContext     = 20
+	// maxGrepBytes bounds the line text of a grep_artifact result and
+	// maxGrepLineChars each line in it.
+	maxGrepBytes     = 12 * 1024
+	maxGrepLineChars = 400
+)
+
+// grepHunk is a run of consecutive lines around one or more matches, each
+// as "N:text" for a match and "N-text" for context, like grep -n.
+type grepHunk struct {
+	StartLine int      `json:"start_line"`
+	Lines     []string `json:"lines"`
+}
+
+// grepArtifact returns the lines of a branch file matching a regexp, with
+// context. A server-side branch_grep tool is used when the server lists
+// one; otherwise the file is read and filtered here.
+func (h *ToolHandler) grepArtifact(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	path, _ := arguments["path"].(string)
+	pattern, _ := arguments["pattern"].(string)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, ToolExecutionError{
+			Code: CodeInvalidArguments,
+			Msg:  fmt.Sprintf("`pattern` %q is not a valid regular expression: %v", pattern, err),
+			Details: map[string]any{
+				"pattern": pattern,
+				"hint":    "Patterns use RE2 syntax; escape literal metacharacters such as ( [ . * with a backslash, and prefix (?i) to ignore case.",
+			},
+		}
+	}
+	maxMatches, ok, err := intArg(arguments, "max_matches")
+	if err != nil {
+		return nil, err
+	}
+	if !ok || maxMatches <= 0 {
+		maxMatches = defaultGrepMatches
+	}
+	maxMatches = min(maxMatches, maxGrepMatches)
+	contextLines, _, err := intArg(arguments, "context_lines")
+	if err != nil {
+		return nil, err
+	}
+	contextLines = min(max(contextLines, 0), maxGrepContext)
+
+	if h.client.serverSchema("branch_grep") != nil {
+		res, err := h.client.CallTool(ctx, "branch_grep", map[string]any{
+			"branch_id": branchID, "file_path": path, "pattern": pattern,
+			"max_matches": maxMatches, "context_lines": contextLines,
+		})
+		if err == nil && res["isError"] != true {
+			res["server_side"] = true
+			return res, nil
+		}
+		logx.Debugf("Server-side branch_grep of %s failed (%v); filtering locally", path, err)
+	}
+
+	logx.Infof("Searching artifact %s of branch %s for %q", path, branchID, pattern)
+	a, err := h.client.BranchReadFile(ctx, branchID, path, ReadFileOptions{})
+	var failed MCPToolError
+	if errors.As(err, &failed) {
+		return failed.Result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = strings.NewReader(a.Content)
+	if a.File != "" {
+		f, err := os.Open(a.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	} else if a.Field == "" {
+		return nil, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("branch_read_file returned no text for %s", path)}
+	}
+	hunks, matches, lines, truncated, err := grepLines(r, re, maxMatches, contextLines)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{
+		"branch_id":     branchID,
+		"path":          path,
+		"pattern":       pattern,
+		"match_count":   matches,
+		"hunks":         hunks,
+		"lines_scanned": lines,
+		"truncated":     truncated,
+	}
+	if matches == 0 {
+		out["hunks"] = []grepHunk{}
+		out["note"] = "No line matches the pattern."
+	}
+	return out, nil
+}
+
+// grepLines scans r for lines matching re. Context windows that touch or
+// overlap are merged into one hunk. It stops after maxMatches matches or
+// maxGrepBytes of output, reporting truncated when a match was left out.
+func grepLines(r io.Reader, re *regexp.Regexp, maxMatches, contextLines int) (hunks []grepHunk, matches, lines int, truncated bool, err error) {
+	type numbered struct {
+		n    int
+		text string
+	}
+	var (
+		before  []numbered
+		cur     = -1 // index of the open hunk
+		last    int  // last line number emitted
+		after   int  // context lines still owed after the last match
+		written int
+	)
+	emit := func(n int, text string, match bool) bool {
+		if len(text) > maxGrepLineChars {
+			text = logx.Truncate(text, maxGrepLineChars)
+		}
+		sep := "-"
+		if match {
+			sep = ":"
+		}
+		line := fmt.Sprintf("%d%s%s", n, sep, text)
+		if written+len(line) > maxGrepBytes {
+			return false
+		}
+		if cur < 0 || n > last+1 {
+			hunks = append(hunks, grepHunk{StartLine: n})
+			cur = len(hunks) - 1
+		}
+		hunks[cur].Lines = append(hunks[cur].Lines, line)
+		written += len(line)
+		last = n
+		return true
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		lines++
+		text := strings.TrimRight(sc.Text(), "\r")
+		if re.MatchString(text) {
+			if matches == maxMatches {
+				truncated = true
+				break
+			}
+			for _, b := range before {
+				if b.n > last && !emit(b.n, b.text, false) {
+					return hunks, matches, lines, true, nil
+				}
+			}
+			if !emit(lines, text, true) {
+				return hunks, matches, lines, true, nil
+			}
+			matches++
+			after = contextLines
+		} else if after > 0 {
+			if !emit(lines, text, false) {
+				return hunks, matches, lines, true, nil
+			}
+			after--
+		}
+		if contextLines > 0 {
+			if len(before) == contextLines {
+				before = before[1:]
+			}
+			before = append(before, numbered{lines, text})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, 0, false, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("could not scan the file: %v", err)}
+	}
+	return hunks, matches, lines, truncated, nil
+}
@@ -0,0 +1,150 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGrepLines(t *testing.T) {
+	// Lines 1..12 read "line N"; P0 and P1 mark a few of them.
+	var text []string
+	for i := 1; i <= 12; i++ {
+		line := fmt.Sprintf("line %d", i)
+		switch i {
+		case 3, 5, 11:
+			line += " P0"
+		case 6:
+			line += " P1"
+		}
+		text = append(text, line)
+	}
+	file := strings.Join(text, "\n") + "\n"
+
+	cases := []struct {
+		name      string
+		pattern   string
+		max, ctx  int
+		hunks     []grepHunk
+		matches   int
+		truncated bool
+	}{
+		{"no context", "P1", 50, 0, []grepHunk{{6, []string{"6:line 6 P1"}}}, 1, false},
+		{"adjacent matches share a hunk", "P0|P1", 50, 0, []grepHunk{
+			{3, []string{"3:line 3 P0"}},
+			{5, []string{"5:line 5 P0", "6:line 6 P1"}},
+			{11, []string{"11:line 11 P0"}},
+		}, 4, false},
+		{"overlapping context merges", "P0", 50, 1, []grepHunk{
+			{2, []string{"2-line 2", "3:line 3 P0", "4-line 4", "5:line 5 P0", "6-line 6 P1"}},
+			{10, []string{"10-line 10", "11:line 11 P0", "12-line 12"}},
+		}, 3, false},
+		{"touching context merges", "^line (3|8)( |$)", 50, 2, []grepHunk{
+			{1, []string{"1-line 1", "2-line 2", "3:line 3 P0", "4-line 4", "5-line 5 P0", "6-line 6 P1", "7-line 7", "8:line 8", "9-line 9", "10-line 10"}},
+		}, 2, false},
+		{"context clipped at the file ends", "line (1|12)$", 50, 3, []grepHunk{
+			{1, []string{"1:line 1", "2-line 2", "3-line 3 P0", "4-line 4"}},
+			{9, []string{"9-line 9", "10-line 10", "11-line 11 P0", "12:line 12"}},
+		}, 2, false},
+		{"max matches", "P0", 2, 0, []grepHunk{{3, []string{"3:line 3 P0"}}, {5, []string{"5:line 5 P0"}}}, 2, true},
+		{"no matches", "P2", 50, 2, nil, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hunks, matches, lines, truncated, err := grepLines(strings.NewReader(file), regexp.MustCompile(c.pattern), c.max, c.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hunks, c.hunks) {
+				t.Errorf("hunks =\n%v\nwant\n%v", hunks, c.hunks)
+			}
+			if matches != c.matches || truncated != c.truncated {
+				t.Errorf("%d matches, truncated %v; want %d, %v", matches, truncated, c.matches, c.truncated)
+			}
+			if !c.truncated && lines != 12 {
+				t.Errorf("scanned %d lines, want 12", lines)
+			}
+		})
+	}
+}
+
+func TestGrepLinesOutputBound(t *testing.T) {
+	file := strings.Repeat("P0 "+strings.Repeat("x", 2*maxGrepLineChars)+"\n", 100)
+	hunks, matches, _, truncated, err := grepLines(strings.NewReader(file), regexp.MustCompile("P0"), maxGrepMatches, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := 0
+	for _, h := range hunks {
+		for _, line := range h.Lines {
+			if len(line) >= 2*maxGrepLineChars {
+				t.Fatalf("line of %d bytes, want it shortened to about %d", len(line), maxGrepLineChars)
+			}
+			written += len(line)
+		}
+	}
+	if !truncated || matches == 100 || written > maxGrepBytes {
+		t.Errorf("%d matches in %d bytes, truncated %v; want the output cut at %d bytes", matches, written, truncated, maxGrepBytes)
+	}
+}
+
+func TestGrepArtifact(t *testing.T) {
+	const worklog = "/home/dev/workspace/worklog.md"
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b-1", worklog, "# Review\nP1: missing test\nok\nok\nP0: data race\n")
+	grep := func(args map[string]any) map[string]any {
+		args["branch_id"], args["path"] = "b-1", worklog
+		return callTool(h, "grep_artifact", args)
+	}
+
+	data := mustSucceed(t, grep(map[string]any{"pattern": "P0|P1", "context_lines": 1}))
+	want := []grepHunk{{1, []string{"1-# Review", "2:P1: missing test", "3-ok", "4-ok", "5:P0: data race"}}}
+	if !reflect.DeepEqual(data["hunks"], want) || data["match_count"] != 2 || data["lines_scanned"] != 5 || data["truncated"] != false {
+		t.Errorf("data = %v, want one merged hunk with both findings", data)
+	}
+
+	data = mustSucceed(t, grep(map[string]any{"pattern": "P2"}))
+	if hunks, _ := data["hunks"].([]grepHunk); data["match_count"] != 0 || hunks == nil || len(hunks) != 0 || data["note"] == nil {
+		t.Errorf("no-match data = %v, want empty hunks and a note", data)
+	}
+
+	reads := len(srv.CallsTo("branch_read_file"))
+	res := grep(map[string]any{"pattern": "P0(|P1"})
+	code, msg, details, _ := ErrorInfo(res)
+	if code != CodeInvalidArguments || !strings.Contains(msg, "`pattern` \"P0(|P1\" is not a valid regular expression") || details["hint"] == nil {
+		t.Errorf("code %s, message %q, details %v; want a validation error with a hint", code, msg, details)
+	}
+	if n := len(srv.CallsTo("branch_read_file")); n != reads {
+		t.Errorf("an invalid pattern read the file")
+	}
+}
+
+func TestGrepArtifactServerSide(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.SetSchema("branch_grep", map[string]any{"type": "object"})
+	srv.Handle("branch_grep", func(args map[string]any) (map[string]any, error) {
+		return map[string]any{"hunks": []any{}, "match_count": 0.0, "sent": args}, nil
+	})
+	if _, err := h.client.ListTools(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data := mustSucceed(t, callTool(h, "grep_artifact", map[string]any{"branch_id": "b-1", "path": "a.log", "pattern": "P0", "max_matches": 5, "context_lines": 2}))
+	sent, _ := data["sent"].(map[string]any)
+	if data["server_side"] != true || sent["file_path"] != "a.log" || sent["max_matches"] != 5.0 || sent["context_lines"] != 2.0 {
+		t.Errorf("data = %v, want the server's result for the same arguments", data)
+	}
+	if n := len(srv.CallsTo("branch_read_file")); n != 0 {
+		t.Errorf("%d file reads, want the server-side grep only", n)
+	}
+
+	// A failing server-side grep falls back to filtering locally.
+	srv.Handle("branch_grep", func(map[string]any) (map[string]any, error) { return nil, fmt.Errorf("grep is unavailable") })
+	srv.PutArtifact("b-1", "a.log", "P0 here\n")
+	data = mustSucceed(t, callTool(h, "grep_artifact", map[string]any{"branch_id": "b-1", "path": "a.log", "pattern": "P0"}))
+	if data["server_side"] != nil || data["match_count"] != 1 {
+		t.Errorf("fallback data = %v, want a local match", data)
+	}
+}
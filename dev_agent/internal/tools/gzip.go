@@ -0,0 +1,71 @@
+package tools
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"dev_agent/internal/logx"
+)
+
+// gzipMinBytes is the smallest request body worth compressing.
+const gzipMinBytes = 1024
+
+// gzipRequestBody compresses payload, logging the saving at debug level.
+func gzipRequestBody(payload []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(payload)
+	zw.Close()
+	logx.Debugf("MCP request gzip: %d -> %d bytes", len(payload), buf.Len())
+	return buf.Bytes()
+}
+
+// decodeResponseBody undoes Content-Encoding: gzip. The transport leaves it
+// to us because we set Accept-Encoding ourselves.
+func decodeResponseBody(resp *http.Response) error {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+	raw := &countingReader{r: resp.Body}
+	zr, err := gzip.NewReader(raw)
+	if err != nil {
+		return err
+	}
+	resp.Body = &gzipBody{zr: zr, raw: raw, closer: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type gzipBody struct {
+	zr     *gzip.Reader
+	raw    *countingReader
+	closer io.Closer
+	n      int64
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	n, err := g.zr.Read(p)
+	g.n += int64(n)
+	return n, err
+}
+
+func (g *gzipBody) Close() error {
+	logx.Debugf("MCP response gzip: %d -> %d bytes", g.raw.n, g.n)
+	g.zr.Close()
+	return g.closer.Close()
+}
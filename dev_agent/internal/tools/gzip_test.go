@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"dev_agent/internal/logx"
+)
+
+// gzipRequest is what gzipServer saw of one tools/call.
+type gzipRequest struct {
+	acceptsGzip, compressed bool
+	args                    map[string]any
+}
+
+// gzipServer decodes gzipped request bodies and gzips every reply, as an
+// event stream when sse is set.
+func gzipServer(t *testing.T, sse bool) (*httptest.Server, func() []gzipRequest) {
+	var (
+		mu   sync.Mutex
+		seen []gzipRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		compressed := r.Header.Get("Content-Encoding") == "gzip"
+		if compressed {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+			Params struct {
+				Arguments map[string]any `json:"arguments"`
+			} `json:"params"`
+		}
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if req.Method == "tools/call" {
+			mu.Lock()
+			seen = append(seen, gzipRequest{strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"), compressed, req.Params.Arguments})
+			mu.Unlock()
+		}
+		reply, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"content": strings.Repeat("worklog line\n", 500)}}})
+		var out bytes.Buffer
+		zw := gzip.NewWriter(&out)
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(zw, "data: %s\n\n", reply)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			zw.Write(reply)
+		}
+		zw.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(out.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []gzipRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]gzipRequest(nil), seen...)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	small := map[string]any{"branch_id": "b1", "file_path": "worklog.md"}
+	large := map[string]any{"branch_id": "b1", "file_path": "worklog.md", "content": strings.Repeat("x", 2*gzipMinBytes)}
+	cases := []struct {
+		name     string
+		enabled  bool
+		sse      bool
+		args     map[string]any
+		compress bool
+	}{
+		{"large request", true, false, large, true},
+		{"small request", true, false, small, false},
+		{"disabled", false, false, large, false},
+		{"SSE reply", true, true, large, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, seen := gzipServer(t, c.sse)
+			logs := captureLogs(t)
+			logx.SetLevel(logx.Debug)
+			defer logx.SetLevel(logx.Info)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, GzipRequests: c.enabled})
+			defer client.Close()
+
+			res, err := client.CallTool(context.Background(), "branch_read_file", c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res["content"] != strings.Repeat("worklog line\n", 500) {
+				t.Errorf("gzipped reply not decoded: %.100v", res)
+			}
+			reqs := seen()
+			if len(reqs) != 1 {
+				t.Fatalf("server saw %d tool calls, want 1", len(reqs))
+			}
+			if !reqs[0].acceptsGzip || reqs[0].compressed != c.compress {
+				t.Errorf("request accepts gzip %t, compressed %t; want true, %t", reqs[0].acceptsGzip, reqs[0].compressed, c.compress)
+			}
+			if reqs[0].args["content"] != c.args["content"] {
+				t.Error("request arguments garbled")
+			}
+			if !strings.Contains(logs.String(), "MCP response gzip: ") {
+				t.Errorf("no response size log:\n%s", logs)
+			}
+			if got := strings.Contains(logs.String(), "MCP request gzip: "); got != c.compress {
+				t.Errorf("request size logged = %t, want %t", got, c.compress)
+			}
+		})
+	}
+}
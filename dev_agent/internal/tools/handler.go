@@ -1,56 +1,395 @@
 package tools
 
 import (
+	"context"
 	"dev_agent/internal/logx"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
-type ToolExecutionError struct{ Msg string }
+// Error codes attached to tool error payloads.
+const (
+	CodeInvalidArguments = "invalid_arguments"
+	CodeToolFailed       = "tool_failed"
+	CodeTimeout          = "timeout"
+	CodeNoProgress       = "no_progress"
+	CodeCancelled        = "cancelled"
+	// CodeAgentFailed marks a branch whose agent run ended "failed"; the
+	// payload's error_kind is the same.
+	CodeAgentFailed = "agent_failed"
+)
+
+type ToolExecutionError struct {
+	Msg  string
+	Code string
+	// Details are merged into the error payload returned to the model.
+	Details map[string]any
+}
 
 func (e ToolExecutionError) Error() string { return e.Msg }
 
+// BranchTracker records the branches produced during a run. Until the first
+// branch other than the starting one is recorded, no latest branch is
+// reported, so callers never mistake the parent for produced work. It is
+// safe for concurrent use; when branches are recorded concurrently, the
+// latest is the one recorded last.
 type BranchTracker struct {
-	start  string
-	latest string
+	mu      sync.Mutex
+	start   string
+	latest  string
+	created map[string]int // branch id -> index in records
+	records []BranchRecord
+}
+
+// BranchRecord is one branch of the run's lineage: the tool that first saw
+// it, the agent that ran on it, the phase its prompt named and its parent.
+type BranchRecord struct {
+	BranchID string    `json:"branch_id"`
+	Tool     string    `json:"tool,omitempty"`
+	Agent    string    `json:"agent,omitempty"`
+	Phase    string    `json:"phase,omitempty"`
+	Parent   string    `json:"parent_branch_id,omitempty"`
+	Time     time.Time `json:"timestamp"`
+	// Terminal is the last terminal status seen, "" while running.
+	Terminal string `json:"terminal_status,omitempty"`
 }
 
 func NewBranchTracker(start string) *BranchTracker {
-	return &BranchTracker{start: start, latest: start}
+	return &BranchTracker{start: start, created: map[string]int{}}
 }
 
 func (t *BranchTracker) Record(id string) {
-	if id == "" {
+	t.RecordBranch(BranchRecord{BranchID: id})
+}
+
+// RecordBranch records r.BranchID like Record. A branch seen again keeps
+// its first record; fields that record left empty are filled from r, and
+// Terminal is replaced by a newer one.
+func (t *BranchTracker) RecordBranch(r BranchRecord) {
+	if r.BranchID == "" {
 		return
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start == "" {
+		t.start = r.BranchID
+		return
+	}
+	if r.BranchID == t.start {
+		return
+	}
+	if i, ok := t.created[r.BranchID]; ok {
+		have := &t.records[i]
+		have.Tool = firstNonEmpty(have.Tool, r.Tool)
+		have.Agent = firstNonEmpty(have.Agent, r.Agent)
+		have.Phase = firstNonEmpty(have.Phase, r.Phase)
+		have.Parent = firstNonEmpty(have.Parent, r.Parent)
+		have.Terminal = firstNonEmpty(r.Terminal, have.Terminal)
+	} else {
+		if r.Time.IsZero() {
+			r.Time = time.Now().UTC()
+		}
+		t.created[r.BranchID] = len(t.records)
+		t.records = append(t.records, r)
+	}
+	t.latest = r.BranchID
+}
+
+// restore replaces the tracker's lineage with one saved by a state file. A
+// tracker started from another branch refuses it.
+func (t *BranchTracker) restore(start, latest string, records []BranchRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start != "" && start != "" && t.start != start {
+		return fmt.Errorf("the saved run started from branch %s, not %s", start, t.start)
+	}
 	if t.start == "" {
-		t.start = id
+		t.start = start
+	}
+	t.latest = latest
+	t.records = append([]BranchRecord(nil), records...)
+	t.created = make(map[string]int, len(records))
+	for i, r := range t.records {
+		t.created[r.BranchID] = i
+	}
+	return nil
+}
+
+// sideline makes latest the latest branch again ("" for none) if id, a side
+// branch that later phases must not build on, is the latest one now.
+func (t *BranchTracker) sideline(id, latest string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latest == id {
+		t.latest = latest
 	}
-	t.latest = id
 }
 
+// Range reports start_branch_id and latest_branch_id; latest_branch_id is ""
+// when no branch has been created yet.
 func (t *BranchTracker) Range() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return map[string]string{"start_branch_id": t.start, "latest_branch_id": t.latest}
 }
 
+// IDs returns the recorded branches besides the start, oldest first.
+func (t *BranchTracker) IDs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, len(t.records))
+	for i, r := range t.records {
+		ids[i] = r.BranchID
+	}
+	return ids
+}
+
+// Lineage returns the records of the branches besides the start, oldest
+// first.
+func (t *BranchTracker) Lineage() []BranchRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]BranchRecord(nil), t.records...)
+}
+
+// Created returns how many distinct branches were recorded besides the start.
+func (t *BranchTracker) Created() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.created)
+}
+
+// ToolHandler runs the model's tool calls against an MCP server. It is safe
+// for concurrent use: Handle may be called from several goroutines, and
+// every piece of state calls share (the branch lineage, the artifact cache,
+// read offsets, running branches, stats) is guarded by a mutex. The Set
+// methods may be called at any time but only affect calls started after
+// them; calls running concurrently see each other's effects in no fixed
+// order, e.g. which of two launches becomes the latest branch.
 type ToolHandler struct {
 	client        *MCPClient
 	defaultProj   string
 	branchTracker *BranchTracker
+
+	// mu guards agents (branch id -> agent name, for progress lines),
+	// progress, poll, prefetched (see Prefetch), timeouts, artifactCache,
+	// noChecksums, the result budget, the text budgets, noLongPoll, audit,
+	// state, pollBackoff, pollPolicy, tailOffsets, the tool registry, the
+	// concurrency limit, allowedAgents, stats and legacyErrors. It is never
+	// held across an MCP call.
+	mu     sync.Mutex
+	agents map[string]string
+	// diffMaxBytes, artifactMax and outputMax are the text budgets of
+	// branch_diff, read_artifact and branch_output; see budgets.
+	diffMaxBytes int
+	artifactMax  int
+	outputMax    int
+	progress     func(label string, pct float64, message string)
+	poll         func(branchID, status string, attempt int, elapsed time.Duration)
+	prefetched   map[string]map[string]any
+	// timeouts bounds whole tool calls; see withToolTimeout.
+	timeouts ToolTimeouts
+	// artifactCache keeps read_artifact results by file version; see
+	// artifactChecksum. noChecksums is set once listings are seen without
+	// checksums.
+	artifactCache map[artifactKey]*cachedArtifact
+	noChecksums   bool
+	// resultMax and resultDir are the budget of fitResult; resultSeq
+	// numbers the files it saves.
+	resultMax int
+	resultDir string
+	resultSeq int
+	// noLongPoll is set once the server is seen ignoring wait_seconds.
+	noLongPoll bool
+	// audit records every Handle call; see SetAuditLog.
+	audit *AuditLog
+	// state saves the run's progress after every Handle call; see
+	// SetStateFile.
+	state *stateFile
+	// pollBackoff grows the status poll interval; see pollSleep.
+	pollBackoff float64
+	// pollPolicy holds the status poll defaults; see SetPollPolicy.
+	pollPolicy PollPolicy
+	// tailOffsets is where the last incremental read_artifact of each file
+	// ended; see readArtifactTail.
+	tailOffsets map[artifactKey]int
+	// tools is the registry Handle dispatches on; toolOrder keeps the
+	// registration order for ToolDefinitions.
+	tools     map[string]Tool
+	toolOrder []string
+	// inflight holds the launched branches not yet seen terminal, launching
+	// the slots reserved for launches under way, and maxInflight bounds
+	// both together; see reserveBranches.
+	inflight    map[string]bool
+	launching   int
+	maxInflight int
+	// allowedAgents are the agents execute_agent accepts.
+	allowedAgents []string
+	// stats aggregates Handle calls by tool; see Stats.
+	stats map[string]ToolStat
+	// legacyErrors keeps error payloads flat; see SetLegacyErrorPayloads.
+	legacyErrors bool
+}
+
+const (
+	// longPollSeconds is the wait_seconds sent to get_branch.
+	longPollSeconds = 60
+	// instantReturn is how fast a long-poll reply with an unchanged status
+	// must come back to show the server did not wait.
+	instantReturn = time.Second
+)
+
+func (h *ToolHandler) longPollEnabled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.noLongPoll
+}
+
+func (h *ToolHandler) disableLongPoll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.noLongPoll = true
 }
 
 func NewToolHandler(client *MCPClient, defaultProject string, startBranch string) *ToolHandler {
-	return &ToolHandler{
+	h := &ToolHandler{
 		client:        client,
 		defaultProj:   defaultProject,
 		branchTracker: NewBranchTracker(startBranch),
+		diffMaxBytes:  defaultDiffMaxBytes,
+		artifactMax:   defaultArtifactMaxBytes,
+		outputMax:     defaultOutputMaxChars,
+		resultMax:     defaultResultMaxBytes,
+		resultDir:     defaultResultDir,
+		pollBackoff:   defaultPollBackoff,
+		pollPolicy:    defaultPollPolicy,
+		maxInflight:   defaultMaxConcurrentBranches,
+		allowedAgents: DefaultAllowedAgents,
+		agents:        map[string]string{},
+	}
+	h.registerBuiltins()
+	if client != nil {
+		client.OnProgress(h.reportProgress)
+	}
+	return h
+}
+
+// OnProgress replaces how server progress is shown; by default it is logged
+// as e.g. "claude_code 40%: running tests".
+func (h *ToolHandler) OnProgress(fn func(label string, pct float64, message string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.progress = fn
+}
+
+// OnPoll sets a function called after every status poll of check_status
+// and execute_agent with the branch, its status, the 1-based poll number and
+// the time waited so far, so callers can show that a long run is alive. It
+// only observes; nil removes it.
+func (h *ToolHandler) OnPoll(fn func(branchID, status string, attempt int, elapsed time.Duration)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.poll = fn
+}
+
+func (h *ToolHandler) reportPoll(branchID, status string, attempt int, elapsed time.Duration) {
+	h.mu.Lock()
+	fn := h.poll
+	h.mu.Unlock()
+	if fn != nil {
+		fn(branchID, status, attempt, elapsed)
+	}
+}
+
+func (h *ToolHandler) reportProgress(token string, pct float64, message string) {
+	label := ProgressLabel(token)
+	h.mu.Lock()
+	fn := h.progress
+	h.mu.Unlock()
+	if fn != nil {
+		fn(label, pct, message)
+		return
+	}
+	logx.Infof("%s %.0f%%: %s", label, pct, message)
+}
+
+// agentFor names branchID for progress lines: the agent that created it
+// when known, otherwise the id itself.
+func (h *ToolHandler) agentFor(branchID string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if agent := h.agents[branchID]; agent != "" {
+		return agent
+	}
+	return branchID
+}
+
+// SetArtifactMaxBytes sets the default max_bytes of read_artifact; n <= 0
+// keeps the default.
+func (h *ToolHandler) SetArtifactMaxBytes(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n > 0 {
+		h.artifactMax = n
+	}
+}
+
+// SetOutputMaxChars sets the character budget of each branch_output text
+// field; n <= 0 keeps the default.
+func (h *ToolHandler) SetOutputMaxChars(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n > 0 {
+		h.outputMax = n
+	}
+}
+
+// SetDiffMaxBytes bounds the diff text branch_diff returns; n <= 0 keeps
+// the default.
+func (h *ToolHandler) SetDiffMaxBytes(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n > 0 {
+		h.diffMaxBytes = n
 	}
 }
 
+// budgets returns the read_artifact, branch_output and branch_diff text
+// budgets.
+func (h *ToolHandler) budgets() (artifactMax, outputMax, diffMax int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.artifactMax, h.outputMax, h.diffMaxBytes
+}
+
 func (h *ToolHandler) BranchRange() map[string]string { return h.branchTracker.Range() }
 
+func (h *ToolHandler) BranchesCreated() int { return h.branchTracker.Created() }
+
+// CreatedBranchIDs lists every branch produced during the run, oldest first.
+func (h *ToolHandler) CreatedBranchIDs() []string { return h.branchTracker.IDs() }
+
+// BranchLineage describes every branch produced during the run, oldest first.
+func (h *ToolHandler) BranchLineage() []BranchRecord { return h.branchTracker.Lineage() }
+
+// DeleteBranch removes a branch on the server.
+func (h *ToolHandler) DeleteBranch(ctx context.Context, branchID string) error {
+	resp, err := h.client.DeleteBranch(ctx, branchID)
+	if err != nil {
+		return err
+	}
+	if isErr, _ := resp["isError"].(bool); isErr {
+		return fmt.Errorf("delete_branch %s failed: %s", branchID, logx.Truncate(toJSON(resp), 300))
+	}
+	return nil
+}
+
 // ToolCall mirrors brain.ToolCall, but we keep it generic here if needed.
 type ToolCall struct {
 	ID       string `json:"id"`
@@ -61,229 +400,1152 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
-func (h *ToolHandler) Handle(call ToolCall) map[string]any {
+// Handle runs one tool call. Cancelling ctx aborts in-flight MCP requests and
+// status polling. Every call is counted in Stats and recorded in the audit
+// log and the state file, if they are set. The result is bounded by the
+// result budget (see SetResultBudget), since it is meant for the model.
+func (h *ToolHandler) Handle(ctx context.Context, call ToolCall) map[string]any {
+	return h.handleCall(ctx, call, true)
+}
+
+// HandleFull is Handle without the result budget: the result is never
+// replaced by a spill stub. It is for callers that inspect the result
+// themselves, like the publish step, rather than pass it to the model.
+func (h *ToolHandler) HandleFull(ctx context.Context, call ToolCall) map[string]any {
+	return h.handleCall(ctx, call, false)
+}
+
+func (h *ToolHandler) handleCall(ctx context.Context, call ToolCall, budget bool) map[string]any {
+	started := time.Now()
+	result := h.handle(ctx, call, budget)
+	h.recordStats(call, result, started)
+	h.auditLog().record(call, result, started)
+	h.saveState(call, result, started)
+	return result
+}
+
+func (h *ToolHandler) handle(ctx context.Context, call ToolCall, budget bool) map[string]any {
 	name := call.Function.Name
 	if name == "" {
-		return h.errorPayload("Missing tool name in call.")
+		return h.errorResult(name, nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "Missing tool name in call."}, budget)
 	}
 	var args map[string]any
 	if call.Function.Arguments != "" {
 		if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
-			return h.errorPayload(fmt.Sprintf("Invalid JSON arguments: %v", err))
+			return h.errorResult(name, nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("Invalid JSON arguments: %v", err)}, budget)
 		}
 	} else {
 		args = map[string]any{}
 	}
 
+	// The configured project fills in for an omitted project_name, so apply
+	// it before the schema marks the field as missing.
+	if name == "execute_agent" && h.defaultProj != "" {
+		if v, _ := args["project_name"].(string); v == "" {
+			args["project_name"] = h.defaultProj
+		}
+	}
+
 	var res map[string]any
 	var err error
-	switch name {
-	case "execute_agent":
-		res, err = h.executeAgent(args)
-	case "check_status":
-		res, err = h.checkStatus(args)
-	case "read_artifact":
-		res, err = h.readArtifact(args)
-	default:
-		err = ToolExecutionError{Msg: fmt.Sprintf("Unsupported tool: %s", name)}
+	tool, ok := h.tool(name)
+	if ok {
+		coerceArgs(name, tool.Schema, args)
+		err = validateArgs(name, tool.Schema, args)
+	} else {
+		err = unknownToolError(name, h.ToolDefinitions())
+	}
+	if err == nil {
+		ctx, cancel, timedOut := h.withToolTimeout(ctx, name)
+		res, err = tool.Run(ctx, args)
+		err = timedOut(err)
+		cancel()
 	}
 	if err != nil {
-		return h.errorPayload(err.Error())
+		return h.errorResult(name, args, err, budget)
+	}
+	payload := map[string]any{"status": "success", "data": res}
+	if budget {
+		payload = h.fitResult(name, args, payload)
+	}
+	return payload
+}
+
+// ErrorResult is the error payload Handle returns for a call of tool that
+// failed with err, for callers answering a tool call without running it.
+// A ToolExecutionError sets the code; "retryable" among its Details sets
+// whether the model may repeat the call.
+func (h *ToolHandler) ErrorResult(tool string, err error) map[string]any {
+	return h.errorResult(tool, nil, err, true)
+}
+
+// errorResult is the payload of a call that failed with err: its message,
+// a code and whatever details the error carries, shaped by shapeError and,
+// with budget, bounded by fitResult.
+func (h *ToolHandler) errorResult(name string, args map[string]any, err error, budget bool) map[string]any {
+	var schemaErr *ResponseSchemaError
+	if errors.As(err, &schemaErr) {
+		err = schemaErr.toolError()
+	}
+	payload := h.errorPayload(err.Error())
+	var failed MCPToolError
+	if errors.As(err, &failed) {
+		payload["code"] = CodeToolFailed
+		payload["result"] = failed.Result
+	}
+	var rpcErr MCPRPCError
+	if errors.As(err, &rpcErr) {
+		payload["code"] = CodeToolFailed
+		hint := "The server failed internally; retrying the same call may succeed."
+		if rpcErr.Code == RPCInvalidParams || rpcErr.Code == RPCMethodNotFound {
+			payload["code"] = CodeInvalidArguments
+			hint = "The server rejected the request; fix the tool name or arguments instead of retrying unchanged."
+		}
+		payload["rpc_error"] = map[string]any{"code": rpcErr.Code, "message": rpcErr.Message, "data": rpcErr.Data}
+		payload["retryable"] = rpcErr.Retryable()
+		payload["hint"] = hint
+	}
+	var argErr ArgumentError
+	if errors.As(err, &argErr) {
+		payload["code"] = CodeInvalidArguments
+		payload["property"] = argErr.Property
+		payload["hint"] = "The MCP server's published schema for " + argErr.Tool + " rejects the arguments dev_agent sends; the client and server versions likely disagree. Retrying will not help."
+	}
+	var unknown ResultUnknownError
+	if errors.As(err, &unknown) {
+		payload["code"] = CodeResultUnknown
+		payload["hint"] = "The request may have taken effect. Check with check_status or the branch listing before sending it again."
+	}
+	var unavailable MCPUnavailableError
+	if errors.As(err, &unavailable) {
+		payload["code"] = CodeMCPUnavailable
+		payload["retryable_after_seconds"] = int(unavailable.RetryAfter.Seconds() + 0.5)
+	}
+	var te ToolExecutionError
+	if errors.As(err, &te) {
+		if te.Code != "" {
+			payload["code"] = te.Code
+		}
+		for k, v := range te.Details {
+			payload[k] = v
+		}
+	}
+	var retried retriedError
+	if errors.As(err, &retried) {
+		payload["retried"] = true
 	}
-	return map[string]any{"status": "success", "data": res}
+	var mcpErr MCPError
+	if errors.As(err, &mcpErr) && mcpErr.RequestID != "" {
+		payload["request_id"] = mcpErr.RequestID
+	}
+	if kind := KindOf(err); kind != "" {
+		payload["error_kind"] = kind
+		if _, set := payload["retryable"]; !set {
+			payload["retryable"] = isRetryable(err)
+		}
+	}
+	if budget {
+		payload = h.fitResult(name, args, payload)
+	}
+	return h.shapeError(payload, err)
 }
 
-func (h *ToolHandler) executeAgent(arguments map[string]any) (map[string]any, error) {
+func (h *ToolHandler) executeAgent(ctx context.Context, arguments map[string]any) (map[string]any, error) {
 	agent, _ := arguments["agent"].(string)
-	prompt, _ := arguments["prompt"].(string)
 	project := h.defaultProj
 	if v, ok := arguments["project_name"].(string); ok && v != "" {
 		project = v
 	}
 	parent, _ := arguments["parent_branch_id"].(string)
 
-	if agent == "" || prompt == "" || parent == "" || project == "" {
-		return nil, ToolExecutionError{Msg: "missing required arguments"}
+	if agent == "" || parent == "" || project == "" {
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "missing required arguments"}
+	}
+	if err := h.checkAgent(agent); err != nil {
+		return nil, err
+	}
+	numBranches, numSet, err := intArg(arguments, "num_branches")
+	if err != nil {
+		return nil, err
+	}
+	if numSet && numBranches < 1 {
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`num_branches` must be at least 1"}
+	}
+	prompts, err := explorePrompts(arguments)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(prompts) > 1 && numSet && numBranches != len(prompts):
+		return nil, ToolExecutionError{
+			Code: CodeInvalidArguments,
+			Msg:  fmt.Sprintf("`prompts` has %d entries but `num_branches` is %d; give one prompt per branch or omit num_branches", len(prompts), numBranches),
+		}
+	case len(prompts) > 1:
+		numBranches = len(prompts)
+	case !numSet:
+		numBranches = 1
 	}
 
-	logx.Infof("Executing agent %s on project %s from parent %s", agent, project, parent)
-	resp, err := h.client.ParallelExplore(project, parent, []string{prompt}, agent, 1)
+	if err := h.reserveBranches(numBranches); err != nil {
+		return nil, err
+	}
+	logx.Infof("Executing agent %s on project %s from parent %s (%d branches, %d prompts)", agent, project, parent, numBranches, len(prompts))
+	ctx = WithProgressLabel(ctx, agent)
+	explored, retried, err := h.launch(ctx, project, parent, prompts, agent, numBranches)
+	var rejected MCPToolError
+	if errors.As(err, &rejected) {
+		partial, _ := rejected.Result["launched_branch_ids"].([]string)
+		h.launched(numBranches, partial)
+		xe := exploreError(rejected.Result, arguments, numBranches)
+		if retried {
+			xe.Details["retried"] = true
+		}
+		return nil, xe
+	}
 	if err != nil {
+		h.launched(numBranches, nil)
 		return nil, err
 	}
-	if isErr, ok := resp["isError"].(bool); ok && isErr {
-		return nil, ToolExecutionError{Msg: fmt.Sprintf("%v", resp["error"])}
+	branchIDs := make([]string, len(explored.Branches))
+	h.mu.Lock()
+	for i, b := range explored.Branches {
+		branchIDs[i] = b.ID
+		h.agents[b.ID] = agent
 	}
-	branchID := ExtractBranchID(resp)
-	if branchID == "" {
-		return nil, ToolExecutionError{Msg: "Missing branch id in parallel_explore response."}
+	h.mu.Unlock()
+	h.launched(numBranches, branchIDs)
+	phase := phaseHint(prompts[0])
+	for _, id := range branchIDs {
+		h.branchTracker.RecordBranch(BranchRecord{BranchID: id, Tool: "execute_agent", Agent: agent, Phase: phase, Parent: parent})
 	}
-	h.branchTracker.Record(branchID)
+	branchID := branchIDs[0]
 
-	result := map[string]any{"parallel_explore": resp, "branch_id": branchID}
+	result := map[string]any{"parallel_explore": explored.Raw, "branch_id": branchID, "branch_ids": branchIDs}
+	if retried {
+		result["retried"] = true
+	}
 
 	logx.Infof("Waiting for branch %s to complete.", branchID)
 	statusArgs := map[string]any{"branch_id": branchID}
-	if v, ok := arguments["timeout_seconds"].(float64); ok && v > 0 {
-		statusArgs["timeout_seconds"] = v
-	}
-	if v, ok := arguments["poll_interval_seconds"].(float64); ok && v > 0 {
-		statusArgs["poll_interval_seconds"] = v
-	}
-	if v, ok := arguments["max_poll_interval_seconds"].(float64); ok && v > 0 {
-		statusArgs["max_poll_interval_seconds"] = v
+	for _, k := range []string{"timeout_seconds", "poll_interval_seconds", "max_poll_interval_seconds", "cancel_after_seconds"} {
+		v, ok, err := numberArg(arguments, k)
+		if err != nil {
+			return nil, err
+		}
+		if ok && v > 0 {
+			statusArgs[k] = v
+		}
 	}
 
-	statusResp, err := h.checkStatus(statusArgs)
+	final, statusResp, err := h.awaitBranch(ctx, statusArgs)
 	if err != nil {
 		return nil, err
 	}
 	result["branch"] = statusResp
-	if status, ok := statusResp["status"]; ok {
-		result["status"] = status
+	if final.Status != "" {
+		result["status"] = final.Status
+	}
+	for _, k := range terminalFields {
+		if v, ok := statusResp[k]; ok {
+			result[k] = v
+		}
+	}
+	if len(branchIDs) > 1 {
+		// Siblings are reported even when some failed, so the model can
+		// pick among the rest.
+		result["branch_results"] = h.awaitSiblings(ctx, branchIDs, summariseBranch(final, statusResp), statusArgs)
+	} else if statusResp["terminal_status"] == TerminalFailed {
+		return nil, agentFailedError(branchID, statusResp)
 	}
 
 	return result, nil
 }
 
-func (h *ToolHandler) checkStatus(arguments map[string]any) (map[string]any, error) {
+// agentFailedError reports a branch whose agent run failed as an error
+// result, with the failure reason, exit status and log tail, so the model
+// relaunches the phase instead of building on the branch.
+func agentFailedError(branchID string, resp map[string]any) error {
+	details := map[string]any{
+		"error_kind":      CodeAgentFailed,
+		"branch_id":       branchID,
+		"terminal_status": TerminalFailed,
+		"retryable":       false,
+		"hint":            "The agent run failed, so the branch holds no finished work. Relaunch execute_agent from the same parent with a prompt amended for the failure; do not use this branch as a parent.",
+	}
+	fd, _ := resp["failure_details"].(map[string]any)
+	reason := ""
+	for _, k := range []string{"error", "error_message", "reason", "message", "status_detail"} {
+		if v, ok := fd[k].(string); ok && v != "" {
+			reason = v
+			break
+		}
+	}
+	if reason != "" {
+		details["failure_reason"] = reason
+	}
+	for _, k := range []string{"exit_status", "exit_code"} {
+		if v, ok := fd[k]; ok {
+			details["exit_status"] = v
+			break
+		}
+	}
+	if fd != nil {
+		details["failure_details"] = fd
+	}
+	if tail, ok := resp["log_tail"].(string); ok && tail != "" {
+		details["log_tail"] = tail
+	}
+	msg := fmt.Sprintf("Agent run on branch %s failed", branchID)
+	if reason != "" {
+		msg += ": " + logx.Truncate(reason, 300)
+	}
+	return ToolExecutionError{Code: CodeAgentFailed, Msg: msg, Details: details}
+}
+
+// phasePattern finds the workflow phase a prompt names.
+var phasePattern = regexp.MustCompile(`(?i)\b(implement|review|fix|finali[sz]e|publish)`)
+
+// phaseHint returns the first phase (implement, review, fix or publish) a
+// prompt names, or "" when it names none.
+func phaseHint(prompt string) string {
+	m := phasePattern.FindStringSubmatch(prompt)
+	if m == nil {
+		return ""
+	}
+	switch phase := strings.ToLower(m[1]); phase {
+	case "finalize", "finalise":
+		return "publish"
+	default:
+		return phase
+	}
+}
+
+// terminalFields are lifted from a check_status result into execute_agent's.
+var terminalFields = []string{"terminal_status", "is_failure", "failure_details", "log_tail"}
+
+// awaitSiblings waits for the remaining branches of a multi-branch launch
+// and summarises each one. A sibling that cannot be waited for is reported
+// with its error rather than failing the whole launch.
+func (h *ToolHandler) awaitSiblings(ctx context.Context, branchIDs []string, first map[string]any, statusArgs map[string]any) []any {
+	results := []any{first}
+	for _, id := range branchIDs[1:] {
+		args := make(map[string]any, len(statusArgs))
+		for k, v := range statusArgs {
+			args[k] = v
+		}
+		args["branch_id"] = id
+		logx.Infof("Waiting for sibling branch %s to complete.", id)
+		final, resp, err := h.awaitBranch(ctx, args)
+		if err != nil {
+			results = append(results, map[string]any{"branch_id": id, "error": err.Error()})
+			continue
+		}
+		results = append(results, summariseBranch(final, resp))
+	}
+	return results
+}
+
+// summariseBranch is one branch_results entry.
+func summariseBranch(b BranchInfo, resp map[string]any) map[string]any {
+	out := map[string]any{"branch_id": b.ID}
+	if b.Status != "" {
+		out["status"] = b.Status
+	}
+	for _, k := range terminalFields {
+		if v, ok := resp[k]; ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// explorePrompts returns the prompts of an execute_agent call: either the
+// single "prompt" shared by all branches or "prompts", one per branch.
+func explorePrompts(arguments map[string]any) ([]string, error) {
+	prompt, _ := arguments["prompt"].(string)
+	list, hasList := arguments["prompts"].([]any)
+	switch {
+	case prompt != "" && hasList:
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`prompt` and `prompts` are mutually exclusive; pass one of them"}
+	case prompt != "":
+		return []string{prompt}, nil
+	case !hasList:
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`prompt` or `prompts` is required"}
+	case len(list) == 0:
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`prompts` must not be empty"}
+	}
+	prompts := make([]string, len(list))
+	for i, v := range list {
+		s, _ := v.(string)
+		if strings.TrimSpace(s) == "" {
+			return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`prompts[%d]` must be a non-empty string", i)}
+		}
+		prompts[i] = s
+	}
+	return prompts, nil
+}
+
+// exploreError turns an isError parallel_explore result into a readable
+// error. The server reports failures as a plain string, as an object with
+// message/code/details, or as content text; each is reduced to the same
+// message/code/details triple, alongside a summary of the request.
+func exploreError(resp, arguments map[string]any, numBranches int) ToolExecutionError {
+	info := map[string]any{}
+	switch e := resp["error"].(type) {
+	case string:
+		info["message"] = e
+	case map[string]any:
+		for _, k := range []string{"message", "code", "details", "data"} {
+			if v, ok := e[k]; ok && v != nil {
+				info[k] = v
+			}
+		}
+	}
+	if info["message"] == nil {
+		for _, k := range []string{"message", "text"} {
+			if v, ok := resp[k].(string); ok && v != "" {
+				info["message"] = v
+				break
+			}
+		}
+	}
+	if info["details"] == nil {
+		if v, ok := resp["details"]; ok && v != nil {
+			info["details"] = v
+		}
+	}
+	msg, _ := info["message"].(string)
+	if msg == "" {
+		msg = "parallel_explore reported an error without a message"
+		info["raw"] = logx.Truncate(toJSON(resp), 1000)
+	}
+	if code, ok := info["code"]; ok {
+		msg = fmt.Sprintf("parallel_explore failed (code %v): %s", code, msg)
+	} else {
+		msg = "parallel_explore failed: " + msg
+	}
+
+	prompt, _ := arguments["prompt"].(string)
+	if list, ok := arguments["prompts"].([]any); ok && len(list) > 0 {
+		prompt, _ = list[0].(string)
+	}
+	request := map[string]any{
+		"agent":            arguments["agent"],
+		"project_name":     arguments["project_name"],
+		"parent_branch_id": arguments["parent_branch_id"],
+		"num_branches":     numBranches,
+		"prompt_preview":   logx.Truncate(prompt, 200),
+	}
+	details := map[string]any{"mcp_error": info, "request": request}
+	if launched, ok := resp["launched_branch_ids"].([]string); ok && len(launched) > 0 {
+		details["launched_branch_ids"] = launched
+		details["hint"] = "Some branches were launched before the failure; cancel them or wait for them with check_status."
+	}
+	return ToolExecutionError{
+		Code:    CodeToolFailed,
+		Msg:     msg,
+		Details: details,
+	}
+}
+
+func (h *ToolHandler) checkStatus(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	blocking := true
+	if v, ok := arguments["blocking"].(bool); ok {
+		blocking = v
+	}
+	list, hasList := arguments["branch_ids"].([]any)
+	if !hasList {
+		if id, _ := arguments["branch_id"].(string); id == "" {
+			return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`branch_id` or `branch_ids` is required"}
+		}
+		await := h.awaitBranch
+		if !blocking {
+			await = h.peekBranch
+		}
+		_, resp, err := await(ctx, arguments)
+		if err == nil && resp["terminal_status"] == TerminalFailed {
+			id, _ := arguments["branch_id"].(string)
+			return nil, agentFailedError(id, resp)
+		}
+		return resp, err
+	}
+	if id, _ := arguments["branch_id"].(string); id != "" {
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`branch_id` and `branch_ids` are mutually exclusive; pass one of them"}
+	}
+	if len(list) == 0 {
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`branch_ids` must not be empty"}
+	}
+	seen := map[string]bool{}
+	var ids []string
+	for i, v := range list {
+		id, _ := v.(string)
+		if strings.TrimSpace(id) == "" {
+			return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`branch_ids[%d]` must be a non-empty string", i)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if !blocking {
+		return h.peekBranches(ctx, ids)
+	}
+	return h.awaitBranches(ctx, ids, arguments)
+}
+
+// awaitBranches waits for every branch in ids to reach a terminal state and
+// reports each outcome in branch_results. A branch that cannot be waited for
+// is listed with its error rather than failing the others; the call only
+// fails when ctx ends.
+func (h *ToolHandler) awaitBranches(ctx context.Context, ids []string, arguments map[string]any) (map[string]any, error) {
+	results := make([]any, 0, len(ids))
+	counts := map[string]int{}
+	for _, id := range ids {
+		args := make(map[string]any, len(arguments))
+		for k, v := range arguments {
+			if k != "branch_ids" {
+				args[k] = v
+			}
+		}
+		args["branch_id"] = id
+		final, resp, err := h.awaitBranch(ctx, args)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			entry := map[string]any{"branch_id": id, "error": err.Error()}
+			var te ToolExecutionError
+			if errors.As(err, &te) && te.Code != "" {
+				entry["code"] = te.Code
+			}
+			results = append(results, entry)
+			counts["unresolved"]++
+			continue
+		}
+		summary := summariseBranch(final, resp)
+		results = append(results, summary)
+		if terminal, _ := summary["terminal_status"].(string); terminal != "" {
+			counts[terminal]++
+		}
+	}
+	return map[string]any{
+		"branch_ids":     ids,
+		"branch_results": results,
+		"counts":         counts,
+		"all_succeeded":  counts[TerminalSucceeded] == len(ids),
+	}, nil
+}
+
+// awaitBranch polls a branch until it is terminal and returns it along with
+// the reply annotated for the model (see annotateTerminal).
+func (h *ToolHandler) awaitBranch(ctx context.Context, arguments map[string]any) (BranchInfo, map[string]any, error) {
 	branchID, _ := arguments["branch_id"].(string)
 	if branchID == "" {
-		return nil, ToolExecutionError{Msg: "`branch_id` is required"}
+		return BranchInfo{}, nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`branch_id` is required"}
+	}
+	timeout, poll, maxPoll, err := h.currentPollPolicy().resolve(h.toolTimeouts().CheckStatus, arguments)
+	if err != nil {
+		return BranchInfo{}, nil, err
 	}
-	timeout := 1800.0
-	if v, ok := arguments["timeout_seconds"].(float64); ok && v > 0 {
-		timeout = v
+	noProgress := defaultNoProgressSeconds
+	if v, ok, err := numberArg(arguments, "no_progress_timeout_seconds"); err != nil {
+		return BranchInfo{}, nil, err
+	} else if ok && v > 0 {
+		noProgress = v
 	}
-	poll := 3.0
-	if v, ok := arguments["poll_interval_seconds"].(float64); ok && v > 0 {
-		poll = v
+	cancelAfter := 0.0
+	if v, ok, err := numberArg(arguments, "cancel_after_seconds"); err != nil {
+		return BranchInfo{}, nil, err
+	} else if ok && v > 0 {
+		cancelAfter = v
 	}
-	maxPoll := 30.0
-	if v, ok := arguments["max_poll_interval_seconds"].(float64); ok && v >= poll {
-		maxPoll = v
+	if _, ok := ctx.Value(progressLabelKey{}).(string); !ok {
+		ctx = WithProgressLabel(ctx, h.agentFor(branchID))
+	}
+	started := time.Now()
+	deadline := started.Add(time.Duration(timeout) * time.Second)
+	factor := h.pollBackoffFactor()
+	sleep := pollSleep(poll, poll, maxPoll)
+	var history statusHistory
+
+	timedOut := func(status string) error {
+		waited := time.Since(started)
+		return ToolExecutionError{
+			Code: CodeTimeout,
+			Msg:  fmt.Sprintf("Timed out waiting for branch %s after %.0fs (last status=%s)", branchID, waited.Seconds(), status),
+			Details: map[string]any{
+				"branch_id":          branchID,
+				"status_history":     history.entries,
+				"total_wait_seconds": int(waited.Seconds()),
+			},
+		}
+	}
+	// pastDeadline tells a context that expired with the polling deadline,
+	// as the check_status tool timeout does, from a caller's cancellation.
+	pastDeadline := func() bool {
+		return errors.Is(ctx.Err(), context.DeadlineExceeded) && !time.Now().Before(deadline)
 	}
-	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
-	sleep := time.Duration(poll * float64(time.Second))
 
 	logx.Infof("Checking status for branch %s (timeout=%ds)", branchID, int(timeout))
+	prevStatus := ""
 	for attempt := 1; ; attempt++ {
-		resp, err := h.client.GetBranch(branchID)
-		if err != nil {
-			return nil, err
+		wait := 0
+		if h.longPollEnabled() {
+			until := time.Until(deadline)
+			if cancelAfter > 0 {
+				until = min(until, time.Until(started.Add(time.Duration(cancelAfter*float64(time.Second)))))
+			}
+			wait = min(longPollSeconds, int(until.Seconds()))
 		}
-		// Record/validate branch id
-		if id := ExtractBranchID(resp); id != "" {
-			h.branchTracker.Record(id)
-		} else {
-			return nil, ToolExecutionError{Msg: "Branch status response missing branch identifier."}
+		callStart := time.Now()
+		state, err := h.client.GetBranch(ctx, branchID, max(wait, 0))
+		if err != nil {
+			if pastDeadline() {
+				return BranchInfo{}, nil, timedOut(prevStatus)
+			}
+			return BranchInfo{}, nil, err
 		}
+		resp := state.Raw
+		h.branchTracker.RecordBranch(BranchRecord{BranchID: state.ID, Tool: "check_status", Agent: state.Agent, Parent: state.ParentID})
 
-		status := stringsLower(resp["status"])
+		status := state.Status
+		if status == "" {
+			logx.Warningf("Branch %s response has no recognizable status field (attempt %d); raw shape: %s", branchID, attempt, logx.Truncate(toJSON(resp), 500))
+		}
 		logx.Infof("Branch %s response (attempt %d): %s", branchID, attempt, toJSON(resp))
-		if status == "succeed" || status == "failed" || status == "manifesting" {
-			return resp, nil
+		h.reportPoll(branchID, status, attempt, time.Since(started))
+		if terminal := terminalStatus(status); terminal != "" {
+			return state, h.branchFinished(ctx, branchID, state, terminal), nil
+		}
+		longPolled := wait > 0
+		if longPolled && time.Since(callStart) < instantReturn && (attempt == 1 || status == prevStatus) {
+			logx.Infof("Server answered get_branch without waiting; it ignores wait_seconds, so falling back to polling.")
+			h.disableLongPoll()
+			longPolled = false
+		}
+		prevStatus = status
+		now := time.Now()
+		history.observe(status, now.Sub(started))
+		if awaitingStart(status) && history.unchangedFor(now.Sub(started)) > time.Duration(noProgress*float64(time.Second)) {
+			return BranchInfo{}, nil, ToolExecutionError{
+				Code: CodeNoProgress,
+				Msg:  fmt.Sprintf("Branch %s made no progress: status stayed %q for %.0fs", branchID, status, history.unchangedFor(now.Sub(started)).Seconds()),
+				Details: map[string]any{
+					"branch_id":          branchID,
+					"status_history":     history.entries,
+					"total_wait_seconds": int(now.Sub(started).Seconds()),
+					"hint":               "The branch never started running, which usually means a server-side scheduling problem. Cancel it and relaunch execute_agent rather than waiting longer.",
+				},
+			}
+		}
+		if cancelAfter > 0 && now.Sub(started) > time.Duration(cancelAfter*float64(time.Second)) {
+			return BranchInfo{}, nil, h.autoCancel(ctx, branchID, status, now.Sub(started), history)
 		}
-		if time.Now().After(deadline) {
-			return nil, ToolExecutionError{Msg: fmt.Sprintf("Timed out waiting for branch %s (last status=%s)", branchID, status)}
+		if now.After(deadline) {
+			return BranchInfo{}, nil, timedOut(status)
+		}
+		if longPolled {
+			logx.Infof("Branch %s still active (status=%s). Long-polling again.", branchID, status)
+			continue
 		}
 		logx.Infof("Branch %s still active (status=%s). Sleeping %.1fs.", branchID, status, sleep.Seconds())
-		time.Sleep(sleep)
-		// exponential-ish backoff
-		sleep = time.Duration(minFloat(float64(sleep/time.Second)*1.5, maxPoll)) * time.Second
+		select {
+		case <-ctx.Done():
+			if pastDeadline() {
+				return BranchInfo{}, nil, timedOut(status)
+			}
+			return BranchInfo{}, nil, ToolExecutionError{
+				Code:    CodeCancelled,
+				Msg:     fmt.Sprintf("Stopped waiting for branch %s: %v", branchID, ctx.Err()),
+				Details: map[string]any{"branch_id": branchID, "last_status": status},
+			}
+		case <-time.After(min(sleep, time.Until(deadline))):
+			// The last sleep ends at the deadline so the timeout is
+			// reported on time, after one more poll.
+		}
+		sleep = pollSleep(sleep.Seconds()*factor, poll, maxPoll)
+	}
+}
+
+// minPollSleep keeps fractional poll intervals from turning status polling
+// into a hot loop.
+const minPollSleep = 500 * time.Millisecond
+
+// defaultPollBackoff is the growth factor of the status poll interval unless
+// SetPollBackoffFactor overrides it.
+const defaultPollBackoff = 1.5
+
+// pollSleep converts secs, capped at maxPoll, to a sleep of at least
+// minPollSleep. The computation stays in float seconds so 4.5s is not
+// truncated to 4s.
+func pollSleep(secs, poll, maxPoll float64) time.Duration {
+	secs = math.Min(secs, math.Max(maxPoll, poll))
+	return max(time.Duration(secs*float64(time.Second)), minPollSleep)
+}
+
+// SetPollBackoffFactor sets how much the status poll interval grows after
+// each poll; f <= 1 keeps the default.
+func (h *ToolHandler) SetPollBackoffFactor(f float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if f > 1 {
+		h.pollBackoff = f
+	}
+}
+
+func (h *ToolHandler) pollBackoffFactor() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pollBackoff
+}
+
+// autoCancel cancels a branch that outlived cancel_after_seconds and reports
+// it as a timeout, recording whether the cancellation itself went through.
+func (h *ToolHandler) autoCancel(ctx context.Context, branchID, status string, waited time.Duration, history statusHistory) error {
+	logx.Warningf("Branch %s still %s after %.0fs; cancelling it.", branchID, status, waited.Seconds())
+	details := map[string]any{
+		"branch_id":          branchID,
+		"status_history":     history.entries,
+		"total_wait_seconds": int(waited.Seconds()),
+		"cancelled":          true,
+		"hint":               "The branch was cancelled. Relaunch execute_agent with a revised prompt if the work is still needed.",
+	}
+	if resp, err := h.client.CancelBranch(ctx, branchID); err != nil {
+		details["cancelled"] = false
+		details["cancel_error"] = err.Error()
+	} else if isErr, _ := resp["isError"].(bool); isErr {
+		details["cancelled"] = false
+		details["cancel_error"] = resp
+	} else {
+		h.branchDone(branchID)
+	}
+	return ToolExecutionError{
+		Code:    CodeTimeout,
+		Msg:     fmt.Sprintf("Branch %s exceeded cancel_after_seconds (last status=%s) and was cancelled", branchID, status),
+		Details: details,
 	}
 }
 
-func (h *ToolHandler) readArtifact(arguments map[string]any) (map[string]any, error) {
+func (h *ToolHandler) cancelAgent(ctx context.Context, arguments map[string]any) (map[string]any, error) {
 	branchID, _ := arguments["branch_id"].(string)
-	path, _ := arguments["path"].(string)
-	if branchID == "" || path == "" {
-		return nil, ToolExecutionError{Msg: "`branch_id` and `path` are required"}
+	logx.Infof("Cancelling branch %s", branchID)
+	resp, err := h.client.CancelBranch(ctx, branchID)
+	if err != nil {
+		return nil, err
 	}
-	logx.Infof("Reading artifact %s from branch %s", path, branchID)
-	return h.client.BranchReadFile(branchID, path)
+	if isErr, _ := resp["isError"].(bool); isErr {
+		return nil, ToolExecutionError{Code: CodeToolFailed, Msg: fmt.Sprintf("cancel_branch %s failed", branchID), Details: map[string]any{"mcp_error": resp}}
+	}
+	h.branchDone(branchID)
+	return map[string]any{"branch_id": branchID, "cancelled": true, "response": resp}, nil
 }
 
-func ExtractBranchID(m map[string]any) string {
-	if m == nil {
-		return ""
+// defaultNoProgressSeconds is how long a branch may sit in a not-yet-started
+// state before checkStatus gives up early with a no_progress error.
+const defaultNoProgressSeconds = 300.0
+
+// awaitingStart reports statuses that mean the branch has not begun running.
+// A long-running "running" status is normal; a long "pending" one is not.
+func awaitingStart(status string) bool {
+	switch status {
+	case "", "pending", "queued", "created", "scheduled":
+		return true
 	}
-	for _, k := range []string{"branch_id", "id"} {
-		if v, ok := m[k].(string); ok && v != "" {
-			return v
-		}
+	return false
+}
+
+// statusChange records when a polled branch entered a status.
+type statusChange struct {
+	Status         string `json:"status"`
+	ElapsedSeconds int    `json:"elapsed_seconds"`
+}
+
+// statusHistory is the sequence of distinct statuses seen while polling.
+type statusHistory struct {
+	entries []statusChange
+	since   time.Duration
+}
+
+func (h *statusHistory) observe(status string, elapsed time.Duration) {
+	if n := len(h.entries); n > 0 && h.entries[n-1].Status == status {
+		return
+	}
+	h.entries = append(h.entries, statusChange{Status: status, ElapsedSeconds: int(elapsed.Seconds())})
+	h.since = elapsed
+}
+
+// unchangedFor returns how long the latest status has been held.
+func (h *statusHistory) unchangedFor(elapsed time.Duration) time.Duration {
+	return elapsed - h.since
+}
+
+// Normalized terminal states reported as terminal_status.
+const (
+	TerminalSucceeded = "succeeded"
+	TerminalFailed    = "failed"
+	TerminalCancelled = "cancelled"
+)
+
+// terminalStatus maps a raw branch status to its normalized terminal state,
+// or "" while the branch is still active.
+func terminalStatus(status string) string {
+	switch status {
+	case "succeed", "succeeded", "success", "manifesting":
+		return TerminalSucceeded
+	case "failed", "failure", "error":
+		return TerminalFailed
+	case "cancelled", "canceled":
+		return TerminalCancelled
 	}
-	if b, ok := m["branch"].(map[string]any); ok {
-		if id := ExtractBranchID(b); id != "" {
-			return id
+	return ""
+}
+
+// failureFields are copied from a failed branch payload into failure_details.
+var failureFields = []string{"error", "error_message", "message", "reason", "exit_code", "exit_status", "status_detail"}
+
+// branchFinished records a branch seen terminal and returns its reply
+// annotated for the model, with the log tail of a failed run.
+func (h *ToolHandler) branchFinished(ctx context.Context, branchID string, state BranchInfo, terminal string) map[string]any {
+	h.branchTracker.RecordBranch(BranchRecord{BranchID: state.ID, Terminal: terminal})
+	h.branchDone(state.ID)
+	out := annotateTerminal(state.Raw, terminal)
+	if terminal == TerminalFailed {
+		if tail, ok := h.failureLogTail(ctx, branchID); ok {
+			out["log_tail"] = tail
 		}
 	}
-	if pe, ok := m["parallel_explore"].(map[string]any); ok {
-		if branches, ok := pe["branches"].([]any); ok {
-			for _, item := range branches {
-				if nested, _ := item.(map[string]any); nested != nil {
-					if id := ExtractBranchID(nested); id != "" {
-						return id
-					}
+	return out
+}
+
+// annotateTerminal returns a copy of a terminal branch payload carrying
+// terminal_status and, for failures, is_failure plus failure_details so the
+// model does not mistake a failed branch for a finished one.
+func annotateTerminal(resp map[string]any, terminal string) map[string]any {
+	out := make(map[string]any, len(resp)+3)
+	for k, v := range resp {
+		out[k] = v
+	}
+	out["terminal_status"] = terminal
+	if terminal == TerminalFailed {
+		out["is_failure"] = true
+		details := map[string]any{}
+		sources := []map[string]any{resp}
+		if nested, ok := resp["branch"].(map[string]any); ok {
+			sources = append(sources, nested)
+		}
+		for _, src := range sources {
+			for _, k := range failureFields {
+				if v, ok := src[k]; ok && v != nil && details[k] == nil {
+					details[k] = v
 				}
 			}
+			if st, ok := src["status"].(map[string]any); ok && details["status"] == nil {
+				details["status"] = st
+			}
+		}
+		if len(details) > 0 {
+			out["failure_details"] = details
 		}
 	}
-	if branches, ok := m["branches"].([]any); ok {
-		for _, item := range branches {
-			if nested, _ := item.(map[string]any); nested != nil {
-				if id := ExtractBranchID(nested); id != "" {
-					return id
-				}
+	return out
+}
+
+func (h *ToolHandler) readArtifact(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	path, _ := arguments["path"].(string)
+	if branchID == "" || path == "" {
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`branch_id` and `path` are required"}
+	}
+	requested, _ := arguments["encoding"].(string)
+	encoding := artifactEncoding(path, requested)
+	if encoding == EncodingText && tailRead(arguments) {
+		// Incremental reads follow a growing file, so they skip the cache.
+		return h.readArtifactTail(ctx, branchID, path, arguments)
+	}
+	var opts ReadFileOptions
+	if encoding == EncodingText {
+		offset, maxBytes, err := h.textReadRange(arguments)
+		if err != nil {
+			return nil, err
+		}
+		opts = ReadFileOptions{Offset: offset, MaxBytes: maxBytes}
+	}
+	// A file unchanged since an earlier identical read is not read again.
+	key, read := artifactKey{branchID, path}, readKey(encoding, opts.Offset, opts.MaxBytes)
+	sum := h.artifactChecksum(ctx, branchID, path)
+	if sum != "" {
+		if res, ok := h.cachedRead(key, sum, read); ok {
+			logx.Infof("Artifact %s of branch %s is unchanged (sha256 %s); using the earlier read", path, branchID, sum[:12])
+			h.takePrefetched(branchID, path, opts)
+			return res, nil
+		}
+	}
+	logx.Infof("Reading artifact %s from branch %s (encoding=%s)", path, branchID, encoding)
+	res, err := h.readArtifactVersion(ctx, branchID, path, encoding, arguments)
+	if err != nil || sum == "" {
+		return res, err
+	}
+	if isErr, _ := res["isError"].(bool); !isErr {
+		res["sha256"] = sum
+		h.cacheRead(key, sum, read, res)
+	}
+	return res, nil
+}
+
+func (h *ToolHandler) readArtifactVersion(ctx context.Context, branchID, path, encoding string, arguments map[string]any) (map[string]any, error) {
+	if encoding == EncodingText {
+		return h.readTextArtifact(ctx, branchID, path, arguments)
+	}
+	a, err := h.client.BranchReadFile(ctx, branchID, path, ReadFileOptions{Encoding: encoding})
+	var failed MCPToolError
+	if errors.As(err, &failed) {
+		return failed.Result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return binaryArtifactResult(branchID, path, a)
+}
+
+// maxListedArtifacts bounds the entries list_artifacts returns.
+const maxListedArtifacts = 300
+
+// listArtifacts returns the directory listing as compact "path (size)"
+// entries whatever shape the server used: plain path strings or objects
+// with path/name and size.
+func (h *ToolHandler) listArtifacts(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	dir, _ := arguments["dir"].(string)
+	logx.Infof("Listing artifacts of branch %s (dir=%q)", branchID, dir)
+	resp, err := h.client.BranchListFiles(ctx, branchID, dir)
+	if err != nil {
+		return nil, err
+	}
+	if isErr, _ := resp["isError"].(bool); isErr {
+		return resp, nil
+	}
+	items := listedFiles(resp)
+	if items == nil {
+		return resp, nil
+	}
+	entries := make([]string, 0, min(len(items), maxListedArtifacts))
+	for _, item := range items {
+		if len(entries) == maxListedArtifacts {
+			break
+		}
+		switch v := item.(type) {
+		case string:
+			entries = append(entries, v)
+		case map[string]any:
+			path := firstString(v, "path", "name", "file_path")
+			if size, ok := v["size"].(float64); ok {
+				path = fmt.Sprintf("%s (%d bytes)", path, int64(size))
 			}
+			entries = append(entries, path)
 		}
 	}
-	return ""
+	out := map[string]any{"branch_id": branchID, "files": entries, "total": len(items)}
+	if dir != "" {
+		out["dir"] = dir
+	}
+	if len(items) > len(entries) {
+		out["truncated"] = true
+	}
+	return out, nil
 }
 
-func (h *ToolHandler) errorPayload(msg string) map[string]any {
-	return map[string]any{"status": "error", "error": msg}
+// maxWriteArtifactBytes caps files seeded into a branch with write_artifact.
+const maxWriteArtifactBytes = 256 * 1024
+
+func (h *ToolHandler) writeArtifact(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	path, _ := arguments["path"].(string)
+	content, _ := arguments["content"].(string)
+	if len(content) > maxWriteArtifactBytes {
+		return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`content` is %d bytes; write_artifact accepts at most %d", len(content), maxWriteArtifactBytes)}
+	}
+	for _, seg := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if seg == ".." {
+			return nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: fmt.Sprintf("`path` %q must not contain '..' segments", path)}
+		}
+	}
+	logx.Infof("Writing artifact %s (%d bytes) to branch %s", path, len(content), branchID)
+	return h.client.BranchWriteFile(ctx, branchID, path, content)
 }
 
-func stringsLower(v any) string {
-	if v == nil {
-		return ""
+// requiredServerTools are the MCP tools the handler calls.
+var requiredServerTools = []string{"parallel_explore", "get_branch", "branch_read_file"}
+
+// ValidateServerTools checks that the server exposes every tool the handler
+// depends on, so a mismatched deployment fails at startup instead of
+// mid-run.
+func (h *ToolHandler) ValidateServerTools(ctx context.Context) error {
+	tools, err := h.client.ListTools(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list MCP server tools: %w", err)
+	}
+	have := make(map[string]bool, len(tools))
+	for _, tool := range tools {
+		have[tool.Name] = true
+	}
+	var missing []string
+	for _, name := range requiredServerTools {
+		if !have[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("MCP server is missing required tools: %s", strings.Join(missing, ", "))
 	}
-	s, _ := v.(string)
-	return stringsTrimLower(s)
+	return nil
 }
 
-func stringsTrimLower(s string) string {
-	return strings.ToLower(strings.TrimSpace(s))
+// defaultOutputMaxChars bounds each text field of a branch_output result,
+// in characters, unless SetOutputMaxChars overrides it, so a long agent
+// transcript does not flood the model's context.
+const defaultOutputMaxChars = 20000
+
+// branchOutput returns the server's summary of a run, or with full_output
+// its transcript. A text field over the budget keeps its head and tail, so
+// both the start of the run and its final verdict survive.
+func (h *ToolHandler) branchOutput(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	full, _ := arguments["full_output"].(bool)
+	logx.Infof("Fetching output of branch %s (full_output=%t)", branchID, full)
+	res, err := h.client.BranchOutput(ctx, branchID, full)
+	if err != nil {
+		return nil, err
+	}
+	_, outputMax, _ := h.budgets()
+	omitted := map[string]any{}
+	for k, v := range res {
+		if s, ok := v.(string); ok {
+			if excerpt, n := headTail(s, outputMax); n > 0 {
+				res[k] = excerpt
+				omitted[k] = n
+			}
+		}
+	}
+	if len(omitted) > 0 {
+		res["truncated"] = true
+		res["omitted_chars"] = omitted
+	}
+	return res, nil
 }
 
-func minFloat(a, b float64) float64 {
-	if a < b {
-		return a
+// headTail cuts s to about n characters, keeping its first and last halves
+// around a marker, and returns the number of characters dropped (0 when s
+// fits).
+func headTail(s string, n int) (string, int) {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s, 0
 	}
-	return b
+	head, tail := n/2, n-n/2
+	dropped := len(runes) - head - tail
+	return fmt.Sprintf("%s\n\n[... %d characters omitted ...]\n\n%s", string(runes[:head]), dropped, string(runes[len(runes)-tail:])), dropped
+}
+
+func (h *ToolHandler) errorPayload(msg string) map[string]any {
+	return map[string]any{"status": "error", "error": msg}
 }
 
-// Tool schema to feed the LLM
-func GetToolDefinitions() []map[string]any {
+func stringsTrimLower(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// builtinToolDefinitions are the schemas of the tools every ToolHandler
+// registers; see registerBuiltins.
+func builtinToolDefinitions() []map[string]any {
 	return []map[string]any{
 		{
 			"type": "function",
 			"function": map[string]any{
 				"name":        "execute_agent",
-				"description": "Launch an MCP parallel_explore job for a specialist agent.",
+				"description": "Launch an MCP parallel_explore job for a specialist agent and wait for it to finish. Check terminal_status (\"succeeded\", \"cancelled\") in the result before moving to the next phase; a failed run comes back as an error with code AGENT_FAILED and its failure reason, exit status and log_tail in error.details. INVALID_ARGS means fix the arguments rather than resend them; CONCURRENCY_LIMIT means wait for a running branch first; RESULT_UNKNOWN means the launch may have happened, so check before relaunching. With several branches the result lists every id in branch_ids and each branch's outcome in branch_results.",
 				"parameters": map[string]any{
 					"type": "object",
 					"properties": map[string]any{
 						"agent":                     map[string]any{"type": "string", "description": "Target specialist agent name."},
-						"prompt":                    map[string]any{"type": "string", "description": "Prompt for the agent."},
+						"prompt":                    map[string]any{"type": "string", "description": "Prompt for the agent, shared by all branches."},
+						"prompts":                   map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "One prompt per sibling branch, e.g. to try a different approach on each; use instead of prompt. num_branches defaults to its length."},
 						"project_name":              map[string]any{"type": "string", "description": "Pantheon project name."},
 						"parent_branch_id":          map[string]any{"type": "string", "description": "Branch UUID to branch from."},
-						"timeout_seconds":           map[string]any{"type": "number", "description": "Optional override for completion polling timeout."},
+						"num_branches":              map[string]any{"type": "integer", "minimum": 1, "description": "Number of sibling branches to run the prompt on (default 1). With prompts it must equal the number of prompts."},
+						"timeout_seconds":           map[string]any{"type": "number", "description": "Optional override for completion polling timeout (at most twice the configured one)."},
 						"poll_interval_seconds":     map[string]any{"type": "number", "description": "Optional override for initial poll interval."},
 						"max_poll_interval_seconds": map[string]any{"type": "number", "description": "Optional override for maximum poll interval."},
+						"cancel_after_seconds":      map[string]any{"type": "number", "description": "Cancel the branch automatically if it is still running after this many seconds."},
+					},
+					"required": []any{"agent", "project_name", "parent_branch_id"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "run_tests",
+				"description": "Independently verify a branch: launch a short test-only run from it that executes the project's test suite and writes a machine-readable summary, then return the parsed passed/failed/skipped counts, failing_tests and all_passed. The test branch is a side branch; keep building on branch_id.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id":       map[string]any{"type": "string", "description": "Branch whose tests to run, e.g. the latest Fix branch."},
+						"command":         map[string]any{"type": "string", "description": "Test command to use, when the project's is known (e.g. \"go test ./...\")."},
+						"agent":           map[string]any{"type": "string", "description": "Agent that runs the tests (default the first allowed agent)."},
+						"project_name":    map[string]any{"type": "string", "description": "Pantheon project name."},
+						"results_path":    map[string]any{"type": "string", "description": "Where the agent writes its JSON summary (default test_results.json)."},
+						"timeout_seconds": map[string]any{"type": "number", "description": "Optional override for completion polling timeout."},
+					},
+					"required": []any{"branch_id"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "check_status",
+				"description": "Wait for a branch to reach a terminal state, or with blocking false just look at its current status once. The result's terminal_status is \"succeeded\" or \"cancelled\"; a failed agent run is returned as an error with code AGENT_FAILED (failure reason, exit status and log_tail in error.details) and must not be treated as finished work. TIMEOUT and NO_PROGRESS mean the branch did not finish in time or never started running; the branch may still be alive, so cancel it or wait again rather than relaunching blindly. Pass branch_ids instead of branch_id to wait for several sibling branches: the result then lists each branch's outcome in branch_results, with counts per terminal status.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id":                   map[string]any{"type": "string", "description": "Branch UUID to poll."},
+						"branch_ids":                  map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "Several branch UUIDs to poll until all are terminal, e.g. the branch_ids of a multi-branch execute_agent; use instead of branch_id."},
+						"timeout_seconds":             map[string]any{"type": "number", "description": "Optional override for completion polling timeout (at most twice the configured one)."},
+						"poll_interval_seconds":       map[string]any{"type": "number", "description": "Optional override for initial poll interval."},
+						"max_poll_interval_seconds":   map[string]any{"type": "number", "description": "Optional override for maximum poll interval."},
+						"no_progress_timeout_seconds": map[string]any{"type": "number", "description": "Give up early with a NO_PROGRESS error when the branch stays pending/queued (never starts running) this long. Default 300."},
+						"cancel_after_seconds":        map[string]any{"type": "number", "description": "Cancel the branch automatically if it is still running after this many seconds, instead of only timing out."},
+						"blocking":                    map[string]any{"type": "boolean", "description": "Default true: wait until terminal. false polls once and returns the current status at once, with terminal true/false telling whether to check again later; use it to decide on parallel work without waiting."},
+					},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "branch_diff",
+				"description": "Fetch the unified diff of a branch against its parent, e.g. to give a Review run exactly what changed. Large diffs are truncated and binary patches collapsed.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id": map[string]any{"type": "string", "description": "Branch whose changes to diff."},
 					},
-					"required": []any{"agent", "prompt", "project_name", "parent_branch_id"},
+					"required": []any{"branch_id"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "cancel_agent",
+				"description": "Cancel a running agent branch that is stuck (e.g. running far longer than expected), so it can be relaunched with a revised prompt.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id": map[string]any{"type": "string", "description": "Branch UUID to cancel."},
+					},
+					"required": []any{"branch_id"},
 				},
 			},
 		},
@@ -291,17 +1553,115 @@ func GetToolDefinitions() []map[string]any {
 			"type": "function",
 			"function": map[string]any{
 				"name":        "read_artifact",
-				"description": "Read a text artifact produced by a branch.",
+				"description": "Read an artifact produced by a branch. Text is returned as-is (very large files as head/tail excerpts plus a local_path); binary files come back base64-encoded or, when large, saved locally. Re-reading a file that has not changed since the same read earlier in the run returns that result again with cached=true. To follow a growing log such as the review log, pass tail_lines for its end or since_offset for what was appended since an earlier read; those results carry next_offset for the next read.",
 				"parameters": map[string]any{
 					"type": "object",
 					"properties": map[string]any{
-						"branch_id": map[string]any{"type": "string", "description": "Branch that produced the artifact."},
-						"path":      map[string]any{"type": "string", "description": "Artifact path or filename."},
+						"branch_id":    map[string]any{"type": "string", "description": "Branch that produced the artifact."},
+						"path":         map[string]any{"type": "string", "description": "Artifact path or filename."},
+						"encoding":     map[string]any{"type": "string", "enum": []any{"text", "base64"}, "description": "Read mode; binary file types default to base64 and return content_base64, mime_type and size."},
+						"offset":       map[string]any{"type": "integer", "minimum": 0, "description": "Byte offset to start reading text from (default 0)."},
+						"max_bytes":    map[string]any{"type": "integer", "minimum": 1, "description": "Maximum bytes of text to return. When the result has truncated=true, read again with offset = offset + returned_bytes."},
+						"tail_lines":   map[string]any{"type": "integer", "minimum": 1, "description": "Return only the last N lines of a text file."},
+						"since_offset": map[string]any{"type": "integer", "minimum": -1, "description": "Return only the text appended after this byte offset, normally the next_offset of an earlier read; -1 continues from where the last tail_lines or since_offset read of this file ended. If the file shrank below it, it is read from the start and the result has reset=true."},
 					},
 					"required": []any{"branch_id", "path"},
 				},
 			},
 		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "grep_artifact",
+				"description": "Search a text file of a branch for lines matching a regular expression, e.g. \"P0|P1\" in the review log, instead of reading the whole file. Matches come back grouped in hunks as \"N:line\", with context lines as \"N-line\"; truncated=true means some matches were left out.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id":     map[string]any{"type": "string", "description": "Branch whose file to search."},
+						"path":          map[string]any{"type": "string", "description": "File path or filename."},
+						"pattern":       map[string]any{"type": "string", "description": "RE2 regular expression; prefix (?i) to ignore case."},
+						"max_matches":   map[string]any{"type": "integer", "minimum": 1, "maximum": maxGrepMatches, "description": "Maximum matching lines to return (default 50)."},
+						"context_lines": map[string]any{"type": "integer", "minimum": 0, "maximum": maxGrepContext, "description": "Lines of context before and after each match (default 0)."},
+					},
+					"required": []any{"branch_id", "path", "pattern"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "list_artifacts",
+				"description": "List files in a branch workspace with their sizes. Use it to find the exact path before read_artifact.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id": map[string]any{"type": "string", "description": "Branch whose workspace to list."},
+						"dir":       map[string]any{"type": "string", "description": "Directory to list; defaults to the workspace root."},
+					},
+					"required": []any{"branch_id"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "write_artifact",
+				"description": "Write a text file (at most 256KB) into a branch workspace, e.g. to seed context before launching an agent from that branch.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id": map[string]any{"type": "string", "description": "Branch to write into."},
+						"path":      map[string]any{"type": "string", "description": "Destination path; '..' segments are rejected."},
+						"content":   map[string]any{"type": "string", "description": "Full file content."},
+					},
+					"required": []any{"branch_id", "path", "content"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "branch_output",
+				"description": "Fetch the output of a completed agent run: by default the server's condensed summary, with full_output the whole transcript. Fields over the character budget keep their beginning and end; the result then carries truncated=true and omitted_chars.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id":   map[string]any{"type": "string", "description": "Branch whose agent output to fetch."},
+						"full_output": map[string]any{"type": "boolean", "description": "Return the full transcript instead of the summary (default false)."},
+					},
+					"required": []any{"branch_id"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "branch_logs",
+				"description": "Fetch the last lines of an agent's stdout/stderr for a branch, e.g. to learn why a run failed when it wrote no worklog. ANSI colour codes are stripped and long logs keep only their end.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id":  map[string]any{"type": "string", "description": "Branch whose agent logs to fetch."},
+						"tail_lines": map[string]any{"type": "integer", "minimum": 1, "description": "Number of trailing lines to return (default 200)."},
+					},
+					"required": []any{"branch_id"},
+				},
+			},
+		},
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name":        "branch_ancestry",
+				"description": "List the chain of branches leading to a branch, oldest first, by following parent pointers. Use it to recover the lineage when unsure which branch a run built on.",
+				"parameters": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"branch_id": map[string]any{"type": "string", "description": "Branch whose ancestry to list."},
+					},
+					"required": []any{"branch_id"},
+				},
+			},
+		},
 	}
 }
 
@@ -0,0 +1,1459 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev_agent/internal/logx"
+	"dev_agent/internal/tools/mcptest"
+)
+
+const testParent = "11111111-1111-4111-8111-111111111111"
+
+// fakeBranchID is the id mcptest gives the n-th branch it creates.
+func fakeBranchID(n int) string { return fmt.Sprintf("00000000-0000-4000-8000-%012d", n) }
+
+// newTestClient returns a client of srv that does not retry, so failure
+// tests stay fast.
+func newTestClient(t *testing.T, srv *mcptest.FakeServer) *MCPClient {
+	t.Helper()
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, SpillDir: t.TempDir()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestHandler returns a handler on a fresh fake MCP server whose branches
+// succeed on their first poll. Oversized results spill under a temp dir.
+func newTestHandler(t *testing.T) (*ToolHandler, *mcptest.FakeServer) {
+	t.Helper()
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	srv.SetDefaultScript("succeed")
+	h := NewToolHandler(newTestClient(t, srv), "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	return h, srv
+}
+
+// callTool runs one tool call through Handle.
+func callTool(h *ToolHandler, name string, args map[string]any) map[string]any {
+	return callToolCtx(context.Background(), h, name, args)
+}
+
+func callToolCtx(ctx context.Context, h *ToolHandler, name string, args map[string]any) map[string]any {
+	raw, _ := json.Marshal(args)
+	call := ToolCall{ID: "call_" + name, Type: "function"}
+	call.Function.Name = name
+	call.Function.Arguments = string(raw)
+	return h.Handle(ctx, call)
+}
+
+// mustSucceed returns the data of a success result.
+func mustSucceed(t *testing.T, result map[string]any) map[string]any {
+	t.Helper()
+	if result["status"] != "success" {
+		t.Fatalf("result = %s, want success", toJSON(result))
+	}
+	data, _ := result["data"].(map[string]any)
+	return data
+}
+
+// mustFail returns the code and details of an error result.
+func mustFail(t *testing.T, result map[string]any) (string, map[string]any) {
+	t.Helper()
+	code, _, details, ok := ErrorInfo(result)
+	if !ok {
+		t.Fatalf("result = %s, want an error", toJSON(result))
+	}
+	return code, details
+}
+
+func TestCheckStatusTerminalShapes(t *testing.T) {
+	cases := []struct {
+		name     string
+		reply    map[string]any
+		terminal string
+	}{
+		{"succeed", map[string]any{"id": "b-1", "status": "succeed"}, TerminalSucceeded},
+		{"succeeded", map[string]any{"branch_id": "b-1", "status": "Succeeded"}, TerminalSucceeded},
+		{"manifesting", map[string]any{"id": "b-1", "status": "manifesting"}, TerminalSucceeded},
+		{"cancelled", map[string]any{"id": "b-1", "status": "cancelled"}, TerminalCancelled},
+		{"canceled", map[string]any{"id": "b-1", "status": "canceled"}, TerminalCancelled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			srv.Respond("get_branch", c.reply)
+			data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+			if data["terminal_status"] != c.terminal {
+				t.Errorf("terminal_status = %v, want %s", data["terminal_status"], c.terminal)
+			}
+			if _, flagged := data["is_failure"]; flagged {
+				t.Errorf("is_failure set on a %s branch: %v", c.terminal, data)
+			}
+		})
+	}
+}
+
+func TestCheckStatusFailureShapes(t *testing.T) {
+	cases := []struct {
+		name   string
+		reply  map[string]any
+		reason string
+		exit   any
+	}{
+		{"flat", map[string]any{"id": "b-1", "status": "failed", "error": "tests failed", "exit_code": 2}, "tests failed", 2.0},
+		{"error status", map[string]any{"id": "b-1", "status": "error", "error_message": "agent crashed"}, "agent crashed", nil},
+		{"nested", map[string]any{"branch": map[string]any{"id": "b-1", "status": "failure", "reason": "OOM killed", "exit_status": 137}}, "OOM killed", 137.0},
+		{"status object", map[string]any{"id": "b-1", "status": map[string]any{"state": "failed", "detail": "timeout"}, "message": "agent timed out"}, "agent timed out", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			srv.Respond("get_branch", c.reply)
+			srv.Respond("branch_logs", map[string]any{"logs": "step 1\nFAIL: TestX\n"})
+			code, details := mustFail(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+			if code != CodeAgentFailed {
+				t.Fatalf("code = %s, want %s", code, CodeAgentFailed)
+			}
+			if details["terminal_status"] != TerminalFailed || details["branch_id"] != "b-1" {
+				t.Errorf("details = %v", details)
+			}
+			if details["failure_reason"] != c.reason {
+				t.Errorf("failure_reason = %v, want %q", details["failure_reason"], c.reason)
+			}
+			if details["exit_status"] != c.exit {
+				t.Errorf("exit_status = %v, want %v", details["exit_status"], c.exit)
+			}
+			if details["log_tail"] != "step 1\nFAIL: TestX" {
+				t.Errorf("log_tail = %q", details["log_tail"])
+			}
+		})
+	}
+}
+
+func TestCheckStatusDescribesTerminalStatus(t *testing.T) {
+	h, _ := newTestHandler(t)
+	for _, def := range h.ToolDefinitions() {
+		fn, _ := def["function"].(map[string]any)
+		if fn["name"] != "check_status" {
+			continue
+		}
+		desc, _ := fn["description"].(string)
+		for _, want := range []string{"terminal_status", "AGENT_FAILED"} {
+			if !strings.Contains(desc, want) {
+				t.Errorf("check_status description does not mention %s: %s", want, desc)
+			}
+		}
+		return
+	}
+	t.Fatal("check_status is not defined")
+}
+
+// TestAgentFailedPayload checks the wire form of a failed run and that its
+// log tail keeps only the last lines of a long log.
+func TestAgentFailedPayload(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.ScriptBranch("b-1", "failed")
+	var lines []string
+	for i := 1; i <= 250; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	srv.Handle("branch_logs", func(args map[string]any) (map[string]any, error) {
+		n := len(lines)
+		if v, ok := args["tail_lines"].(float64); ok && int(v) < n {
+			n = int(v)
+		}
+		return map[string]any{"logs": strings.Join(lines[len(lines)-n:], "\n")}, nil
+	})
+	result := callTool(h, "check_status", map[string]any{"branch_id": "b-1"})
+	errObj, _ := result["error"].(map[string]any)
+	if result["status"] != "error" || errObj["code"] != ErrorCodeAgentFailed || errObj["retryable"] != false {
+		t.Fatalf("result = %s, want a non-retryable %s error", toJSON(result), ErrorCodeAgentFailed)
+	}
+	_, details := mustFail(t, result)
+	if details["error_kind"] != CodeAgentFailed || details["hint"] == nil {
+		t.Errorf("details = %v, want error_kind %s and a relaunch hint", details, CodeAgentFailed)
+	}
+	tail, _ := details["log_tail"].(string)
+	got := strings.Split(tail, "\n")
+	if len(got) != failureLogTailLines || got[0] != "line 151" || got[len(got)-1] != "line 250" {
+		t.Errorf("log_tail has %d lines from %q to %q, want the last %d", len(got), got[0], got[len(got)-1], failureLogTailLines)
+	}
+}
+
+func TestAgentFailedWithoutLogs(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.ScriptBranch("b-1", "failed")
+	srv.Handle("branch_logs", func(map[string]any) (map[string]any, error) {
+		return nil, errors.New("logs expired")
+	})
+	code, details := mustFail(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+	if code != CodeAgentFailed || details["terminal_status"] != TerminalFailed {
+		t.Errorf("code %s, details %v; want the failure reported without logs", code, details)
+	}
+	if _, ok := details["log_tail"]; ok {
+		t.Errorf("log_tail = %v, want none when the logs cannot be fetched", details["log_tail"])
+	}
+}
+
+func TestExecuteAgentReportsTerminalStatus(t *testing.T) {
+	h, srv := newTestHandler(t)
+	data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement it", "parent_branch_id": testParent}))
+	if data["branch_id"] != fakeBranchID(1) || data["terminal_status"] != TerminalSucceeded {
+		t.Errorf("data = %v", data)
+	}
+
+	srv.ScriptBranch(fakeBranchID(2), "failed")
+	code, details := mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Fix it", "parent_branch_id": fakeBranchID(1)}))
+	if code != CodeAgentFailed || details["branch_id"] != fakeBranchID(2) {
+		t.Errorf("code %s details %v", code, details)
+	}
+	for _, r := range h.BranchLineage() {
+		if r.BranchID == fakeBranchID(2) && r.Terminal != TerminalFailed {
+			t.Errorf("lineage records the failed branch as %q", r.Terminal)
+		}
+	}
+}
+
+func TestExecuteAgentPrompts(t *testing.T) {
+	t.Run("shared prompt", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		h.SetMaxConcurrentBranches(3)
+		data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement it", "parent_branch_id": testParent, "num_branches": 3}))
+		calls := srv.CallsTo("parallel_explore")
+		if len(calls) != 1 || calls[0].Arguments["num_branches"] != 3.0 || !reflect.DeepEqual(calls[0].Arguments["shared_prompt_sequence"], []any{"Implement it"}) {
+			t.Fatalf("parallel_explore calls = %+v, want one for 3 branches", calls)
+		}
+		want := []string{fakeBranchID(1), fakeBranchID(2), fakeBranchID(3)}
+		if !reflect.DeepEqual(data["branch_ids"], want) || data["branch_id"] != want[0] {
+			t.Errorf("branch_ids = %v, branch_id = %v, want %v", data["branch_ids"], data["branch_id"], want)
+		}
+		if results, _ := data["branch_results"].([]any); len(results) != 3 {
+			t.Errorf("branch_results = %v, want one per branch", data["branch_results"])
+		}
+	})
+
+	t.Run("one prompt per branch", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		prompts := []any{"Implement it with a map", "Implement it with a slice"}
+		data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompts": prompts, "parent_branch_id": testParent}))
+		calls := srv.CallsTo("parallel_explore")
+		if len(calls) != 2 {
+			t.Fatalf("%d parallel_explore calls, want one per prompt", len(calls))
+		}
+		for i, c := range calls {
+			if c.Arguments["num_branches"] != 1.0 || !reflect.DeepEqual(c.Arguments["shared_prompt_sequence"], []any{prompts[i]}) {
+				t.Errorf("launch %d arguments = %v", i, c.Arguments)
+			}
+		}
+		want := []string{fakeBranchID(1), fakeBranchID(2)}
+		if !reflect.DeepEqual(data["branch_ids"], want) {
+			t.Errorf("branch_ids = %v, want %v", data["branch_ids"], want)
+		}
+		results, _ := data["branch_results"].([]any)
+		if len(results) != 2 {
+			t.Fatalf("branch_results = %v, want one per branch", data["branch_results"])
+		}
+		for i, r := range results {
+			if r.(map[string]any)["branch_id"] != want[i] {
+				t.Errorf("branch_results[%d] = %v", i, r)
+			}
+		}
+	})
+}
+
+func TestCheckStatusBranchIDs(t *testing.T) {
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	srv.ScriptBranch("b-1", "running", "succeed")
+	srv.ScriptBranch("b-2", "pending", "failed")
+	srv.ScriptBranch("b-3", "cancelled")
+	data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_ids": []any{"b-1", "b-2", "b-1", "b-3", "ghost"}}))
+
+	if want := []string{"b-1", "b-2", "b-3", "ghost"}; !reflect.DeepEqual(data["branch_ids"], want) {
+		t.Errorf("branch_ids = %v, want %v without the duplicate", data["branch_ids"], want)
+	}
+	results, _ := data["branch_results"].([]any)
+	if len(results) != 4 {
+		t.Fatalf("branch_results = %v, want one per branch", data["branch_results"])
+	}
+	for i, want := range []string{TerminalSucceeded, TerminalFailed, TerminalCancelled} {
+		r := results[i].(map[string]any)
+		if r["branch_id"] != fmt.Sprintf("b-%d", i+1) || r["terminal_status"] != want {
+			t.Errorf("branch_results[%d] = %v, want %s", i, r, want)
+		}
+	}
+	if failed := results[1].(map[string]any); failed["is_failure"] != true {
+		t.Errorf("failed branch result = %v, want is_failure", failed)
+	}
+	if ghost := results[3].(map[string]any); ghost["branch_id"] != "ghost" || !strings.Contains(fmt.Sprint(ghost["error"]), "not found") {
+		t.Errorf("unknown branch result = %v, want its error", ghost)
+	}
+	wantCounts := map[string]int{TerminalSucceeded: 1, TerminalFailed: 1, TerminalCancelled: 1, "unresolved": 1}
+	if !reflect.DeepEqual(data["counts"], wantCounts) || data["all_succeeded"] != false {
+		t.Errorf("counts = %v, all_succeeded = %v; want %v and false", data["counts"], data["all_succeeded"], wantCounts)
+	}
+
+	all := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_ids": []any{"b-1"}}))
+	if all["all_succeeded"] != true {
+		t.Errorf("all_succeeded = %v for a single succeeded branch", all["all_succeeded"])
+	}
+}
+
+func TestCheckStatusBranchIDsValidation(t *testing.T) {
+	h, srv := newTestHandler(t)
+	for _, c := range []struct {
+		name string
+		args map[string]any
+		want string
+	}{
+		{"both", map[string]any{"branch_id": "b-1", "branch_ids": []any{"b-2"}}, "mutually exclusive"},
+		{"neither", map[string]any{}, "`branch_id` or `branch_ids` is required"},
+		{"empty list", map[string]any{"branch_ids": []any{}}, "must not be empty"},
+		{"blank entry", map[string]any{"branch_ids": []any{"b-1", " "}}, "`branch_ids[1]` must be a non-empty string"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			result := callTool(h, "check_status", c.args)
+			code, _ := mustFail(t, result)
+			if _, msg, _, _ := ErrorInfo(result); code != CodeInvalidArguments || !strings.Contains(msg, c.want) {
+				t.Errorf("code %s, message %q; want %s", code, msg, c.want)
+			}
+		})
+	}
+	if n := len(srv.CallsTo("get_branch")); n != 0 {
+		t.Errorf("%d polls for invalid calls", n)
+	}
+}
+
+// TestExecuteAgentRecordsSiblings checks every branch of a multi-branch
+// launch is recorded, and that check_status accepts the returned ids.
+func TestExecuteAgentRecordsSiblings(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.SetMaxConcurrentBranches(3)
+	data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Explore designs", "parent_branch_id": testParent, "num_branches": 3}))
+	ids, _ := data["branch_ids"].([]string)
+	if got := h.branchTracker.IDs(); !reflect.DeepEqual(got, ids) {
+		t.Errorf("tracked %v, want all of %v", got, ids)
+	}
+	for _, r := range h.BranchLineage() {
+		if r.Parent != testParent || r.Tool != "execute_agent" {
+			t.Errorf("record %+v, want a sibling launched from the parent", r)
+		}
+	}
+	list := make([]any, len(ids))
+	for i, id := range ids {
+		list[i] = id
+	}
+	if status := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_ids": list})); status["all_succeeded"] != true {
+		t.Errorf("check_status = %v, want all siblings succeeded", status)
+	}
+}
+
+func TestExecuteAgentPromptValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		args map[string]any
+		want string
+	}{
+		{"both", map[string]any{"prompt": "a", "prompts": []any{"b", "c"}}, "mutually exclusive"},
+		{"neither", map[string]any{}, "is required"},
+		{"empty list", map[string]any{"prompts": []any{}}, "must not be empty"},
+		{"blank entry", map[string]any{"prompts": []any{"a", ""}}, "`prompts[1]` must be a non-empty string"},
+		{"count mismatch", map[string]any{"prompts": []any{"a", "b"}, "num_branches": 3}, "`prompts` has 2 entries but `num_branches` is 3"},
+		{"zero branches", map[string]any{"prompt": "a", "num_branches": 0}, "num_branches: must be >= 1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			args := map[string]any{"agent": "claude_code", "parent_branch_id": testParent}
+			for k, v := range c.args {
+				args[k] = v
+			}
+			result := callTool(h, "execute_agent", args)
+			code, msg, _, _ := ErrorInfo(result)
+			if code != CodeInvalidArguments || !strings.Contains(msg, c.want) {
+				t.Errorf("got %s %q, want %s mentioning %q", code, msg, CodeInvalidArguments, c.want)
+			}
+			if n := len(srv.CallsTo("parallel_explore")); n != 0 {
+				t.Errorf("invalid call launched %d times", n)
+			}
+		})
+	}
+}
+
+func TestExecuteAgentExploreErrorShapes(t *testing.T) {
+	cases := []struct {
+		name    string
+		setup   func(srv *mcptest.FakeServer)
+		wantMsg string
+		wantErr map[string]any
+	}{
+		{"string", func(srv *mcptest.FakeServer) {
+			srv.Respond("parallel_explore", map[string]any{"isError": true, "error": "project demo is archived"})
+		}, "parallel_explore failed: project demo is archived", map[string]any{"message": "project demo is archived"}},
+		{"object", func(srv *mcptest.FakeServer) {
+			srv.Respond("parallel_explore", map[string]any{"isError": true, "error": map[string]any{"code": "QUOTA_EXCEEDED", "message": "too many running branches", "details": map[string]any{"limit": 4.0}}})
+		}, "parallel_explore failed (code QUOTA_EXCEEDED): too many running branches", map[string]any{"code": "QUOTA_EXCEEDED", "message": "too many running branches", "details": map[string]any{"limit": 4.0}}},
+		{"content", func(srv *mcptest.FakeServer) {
+			srv.Handle("parallel_explore", func(map[string]any) (map[string]any, error) {
+				return nil, errors.New("parent branch is not ready")
+			})
+		}, "parallel_explore failed: parent branch is not ready", map[string]any{"message": "parent branch is not ready"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			c.setup(srv)
+			result := callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent})
+			code, msg, details, _ := ErrorInfo(result)
+			if code != CodeToolFailed || msg != c.wantMsg {
+				t.Errorf("got %s %q, want %s %q", code, msg, CodeToolFailed, c.wantMsg)
+			}
+			if strings.Contains(msg, "map[") {
+				t.Errorf("message renders a Go map: %s", msg)
+			}
+			if got := details["mcp_error"]; !reflect.DeepEqual(got, c.wantErr) {
+				t.Errorf("mcp_error = %v, want %v", got, c.wantErr)
+			}
+			request, _ := details["request"].(map[string]any)
+			if request["agent"] != "claude_code" || request["parent_branch_id"] != testParent || request["prompt_preview"] != "Implement the task." {
+				t.Errorf("request summary = %v", request)
+			}
+		})
+	}
+}
+
+func TestExploreErrorWithoutMessage(t *testing.T) {
+	err := exploreError(map[string]any{"isError": true, "error": map[string]any{"data": "x"}}, map[string]any{"prompts": []any{"first", "second"}}, 2)
+	if err.Msg != "parallel_explore failed: parallel_explore reported an error without a message" {
+		t.Errorf("Msg = %q", err.Msg)
+	}
+	info, _ := err.Details["mcp_error"].(map[string]any)
+	if info["raw"] == nil || info["data"] != "x" {
+		t.Errorf("mcp_error = %v, want the raw reply and its data", info)
+	}
+	request, _ := err.Details["request"].(map[string]any)
+	if request["num_branches"] != 2 || request["prompt_preview"] != "first" {
+		t.Errorf("request summary = %v", request)
+	}
+}
+
+// fastPolls makes h poll every minPollSleep.
+func fastPolls(h *ToolHandler) {
+	h.SetPollPolicy(PollPolicy{Initial: time.Millisecond, Max: 2 * time.Millisecond})
+}
+
+func TestPollSleepProgression(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	cases := []struct {
+		name          string
+		poll, maxPoll float64
+		factor        float64
+		want          []time.Duration
+	}{
+		{"default start keeps fractions", 3, 30, 1.5, []time.Duration{ms(3000), ms(4500), ms(6750), ms(10125), ms(15187)}},
+		{"capped at max", 3, 8, 2, []time.Duration{ms(3000), ms(6000), ms(8000), ms(8000)}},
+		{"fractional interval", 0.5, 2, 1.5, []time.Duration{ms(500), ms(750), ms(1125), ms(1687), ms(2000)}},
+		{"below the floor", 0.1, 0.2, 1.5, []time.Duration{ms(500), ms(500), ms(500)}},
+		{"zero interval", 0, 0, 2, []time.Duration{ms(500), ms(500)}},
+		{"max below interval", 5, 1, 1.5, []time.Duration{ms(5000), ms(5000)}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The progression checkStatus follows between polls.
+			sleep := pollSleep(c.poll, c.poll, c.maxPoll)
+			var got []time.Duration
+			for range c.want {
+				got = append(got, sleep.Truncate(time.Millisecond))
+				sleep = pollSleep(sleep.Seconds()*c.factor, c.poll, c.maxPoll)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("sleeps = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSetPollBackoffFactor(t *testing.T) {
+	h, _ := newTestHandler(t)
+	for _, c := range []struct{ set, want float64 }{{2.5, 2.5}, {1, 2.5}, {0, 2.5}, {-3, 2.5}, {1.1, 1.1}} {
+		h.SetPollBackoffFactor(c.set)
+		if got := h.pollBackoffFactor(); got != c.want {
+			t.Errorf("after SetPollBackoffFactor(%v) factor = %v, want %v", c.set, got, c.want)
+		}
+	}
+	if got := NewToolHandler(nil, "demo", testParent).pollBackoffFactor(); got != defaultPollBackoff {
+		t.Errorf("default factor = %v, want %v", got, defaultPollBackoff)
+	}
+}
+
+// TestCheckStatusFractionalInterval checks a fractional poll interval
+// neither truncates to a hot loop nor ignores the backoff factor.
+func TestCheckStatusFractionalInterval(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetPollBackoffFactor(2)
+	var mu sync.Mutex
+	var polls []time.Time
+	statuses := []string{"running", "running", "running", "succeed"}
+	srv.Handle("get_branch", func(map[string]any) (map[string]any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls = append(polls, time.Now())
+		return map[string]any{"id": "b-1", "status": statuses[len(polls)-1]}, nil
+	})
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "poll_interval_seconds": 0.3, "max_poll_interval_seconds": 5}))
+	if len(polls) != 4 {
+		t.Fatalf("%d polls, want 4", len(polls))
+	}
+	// 0.3s is raised to the 0.5s floor, then doubles: 0.5s, 1s, 2s.
+	for i, want := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second} {
+		if gap := polls[i+1].Sub(polls[i]); gap < want || gap > want+400*time.Millisecond {
+			t.Errorf("gap %d = %s, want about %s", i+1, gap, want)
+		}
+	}
+}
+
+// TestOnPoll checks a 10-poll wait reports every poll, in order, and that
+// the callback leaves the result unchanged.
+func TestOnPoll(t *testing.T) {
+	script := []string{"pending", "running", "running", "running", "running", "running", "running", "running", "running", "succeed"}
+	type poll struct {
+		status  string
+		attempt int
+	}
+	var polls []poll
+	var elapsed []time.Duration
+	run := func(withCallback bool) map[string]any {
+		h, srv := newTestHandler(t)
+		fastPolls(h)
+		h.SetPollBackoffFactor(1.01)
+		srv.ScriptBranch("b-1", script...)
+		if withCallback {
+			h.OnPoll(func(branchID, status string, attempt int, d time.Duration) {
+				if branchID != "b-1" {
+					t.Errorf("poll reported for %s", branchID)
+				}
+				polls = append(polls, poll{status, attempt})
+				elapsed = append(elapsed, d)
+			})
+		}
+		return mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": 60}))
+	}
+
+	with := run(true)
+	if len(polls) != len(script) {
+		t.Fatalf("callback called %d times, want %d", len(polls), len(script))
+	}
+	for i, p := range polls {
+		if p.attempt != i+1 || p.status != script[i] {
+			t.Errorf("poll %d = %+v, want attempt %d status %s", i, p, i+1, script[i])
+		}
+		if i > 0 && elapsed[i] < elapsed[i-1] {
+			t.Errorf("elapsed went back from %s to %s", elapsed[i-1], elapsed[i])
+		}
+	}
+	without := run(false)
+	if with["terminal_status"] != without["terminal_status"] || with["branch_id"] != without["branch_id"] || len(with) != len(without) {
+		t.Errorf("result with callback %v differs from %v", with, without)
+	}
+}
+
+func TestOnPollCleared(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.ScriptBranch("b-1", "succeed")
+	srv.ScriptBranch("b-2", "succeed")
+	calls := 0
+	h.OnPoll(func(string, string, int, time.Duration) { calls++ })
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+	h.OnPoll(nil)
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-2"}))
+	if calls != 1 {
+		t.Errorf("callback called %d times, want once before it was cleared", calls)
+	}
+}
+
+// TestCheckStatusLongPoll simulates a server that honours wait_seconds and
+// a legacy one that ignores it.
+func TestCheckStatusLongPoll(t *testing.T) {
+	t.Run("long-poll server", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		statuses := []string{"running", "succeed"}
+		var mu sync.Mutex
+		srv.Handle("get_branch", func(args map[string]any) (map[string]any, error) {
+			if wait, _ := args["wait_seconds"].(float64); wait > 0 {
+				time.Sleep(instantReturn + 100*time.Millisecond) // holds the reply until the status changes
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			status := statuses[0]
+			if len(statuses) > 1 {
+				statuses = statuses[1:]
+			}
+			return map[string]any{"id": "b-1", "status": status}, nil
+		})
+		data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": 600}))
+		if data["terminal_status"] != TerminalSucceeded {
+			t.Errorf("terminal_status = %v", data["terminal_status"])
+		}
+		calls := srv.CallsTo("get_branch")
+		if len(calls) != 2 {
+			t.Fatalf("%d get_branch calls, want 2", len(calls))
+		}
+		for _, c := range calls {
+			if c.Arguments["wait_seconds"] != float64(longPollSeconds) {
+				t.Errorf("wait_seconds = %v, want %d", c.Arguments["wait_seconds"], longPollSeconds)
+			}
+		}
+		if !h.longPollEnabled() {
+			t.Error("long-polling was disabled for a server that waits")
+		}
+	})
+
+	t.Run("legacy server", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		fastPolls(h)
+		srv.ScriptBranch("b-1", "running", "running", "succeed")
+		mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": 60}))
+		calls := srv.CallsTo("get_branch")
+		if len(calls) != 3 {
+			t.Fatalf("%d get_branch calls, want 3", len(calls))
+		}
+		if calls[0].Arguments["wait_seconds"] == nil {
+			t.Error("the first poll did not try long-polling")
+		}
+		for _, c := range calls[1:] {
+			if c.Arguments["wait_seconds"] != nil {
+				t.Errorf("poll after the fallback sent wait_seconds %v", c.Arguments["wait_seconds"])
+			}
+		}
+		if h.longPollEnabled() {
+			t.Error("long-polling still enabled for a server that ignores wait_seconds")
+		}
+	})
+}
+
+func TestCheckStatusNoProgress(t *testing.T) {
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	srv.ScriptBranch("b-1", "pending")
+	started := time.Now()
+	result := callTool(h, "check_status", map[string]any{"branch_id": "b-1", "no_progress_timeout_seconds": 1, "timeout_seconds": 60})
+	code, msg, details, _ := ErrorInfo(result)
+	if code != CodeNoProgress || !strings.Contains(msg, `status stayed "pending"`) {
+		t.Fatalf("got %s %q, want %s", code, msg, CodeNoProgress)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("gave up after %s, want soon after the 1s threshold", elapsed)
+	}
+	history, _ := details["status_history"].([]statusChange)
+	if len(history) != 1 || history[0].Status != "pending" {
+		t.Errorf("status_history = %v", details["status_history"])
+	}
+	if _, ok := details["total_wait_seconds"].(int); !ok || details["hint"] == nil {
+		t.Errorf("details = %v, want the total wait and a hint", details)
+	}
+}
+
+func TestCheckStatusSlowButProgressing(t *testing.T) {
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	srv.ScriptBranch("b-1", "pending", "running", "running", "running", "running", "succeed")
+	data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "no_progress_timeout_seconds": 1, "timeout_seconds": 60}))
+	if data["terminal_status"] != TerminalSucceeded {
+		t.Errorf("terminal_status = %v, want %s", data["terminal_status"], TerminalSucceeded)
+	}
+	if n := len(srv.CallsTo("get_branch")); n != 6 {
+		t.Errorf("polled %d times, want 6", n)
+	}
+}
+
+func TestCheckStatusTimeoutCarriesHistory(t *testing.T) {
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	srv.ScriptBranch("b-1", "pending", "running")
+	code, details := mustFail(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": 1}))
+	if code != CodeTimeout {
+		t.Fatalf("code = %s, want %s", code, CodeTimeout)
+	}
+	history, _ := details["status_history"].([]statusChange)
+	if len(history) != 2 || history[0].Status != "pending" || history[1].Status != "running" {
+		t.Errorf("status_history = %v", details["status_history"])
+	}
+}
+
+func TestBranchTrackerCounts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		recorded   []string
+		wantLatest string
+		wantIDs    []string
+	}{
+		{"no branches", nil, "", []string{}},
+		{"only the start", []string{testParent}, "", []string{}},
+		{"one branch", []string{testParent, "b1", "b1"}, "b1", []string{"b1"}},
+		{"several branches", []string{"b1", testParent, "b2", "b1", "b3"}, "b3", []string{"b1", "b2", "b3"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bt := NewBranchTracker(testParent)
+			for _, id := range tc.recorded {
+				bt.Record(id)
+			}
+			r := bt.Range()
+			if r["start_branch_id"] != testParent || r["latest_branch_id"] != tc.wantLatest {
+				t.Errorf("Range() = %v, want start %s and latest %q", r, testParent, tc.wantLatest)
+			}
+			if got := bt.Created(); got != len(tc.wantIDs) {
+				t.Errorf("Created() = %d, want %d", got, len(tc.wantIDs))
+			}
+			if got := bt.IDs(); !reflect.DeepEqual(got, tc.wantIDs) {
+				t.Errorf("IDs() = %v, want %v", got, tc.wantIDs)
+			}
+			if got := bt.Lineage(); len(got) != len(tc.wantIDs) {
+				t.Errorf("Lineage() has %d records, want %d", len(got), len(tc.wantIDs))
+			}
+		})
+	}
+}
+
+func TestBranchTrackerMergesRecords(t *testing.T) {
+	bt := NewBranchTracker(testParent)
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	bt.RecordBranch(BranchRecord{BranchID: "b1", Tool: "execute_agent", Agent: "claude_code", Phase: "implement", Parent: testParent, Time: at})
+	bt.RecordBranch(BranchRecord{BranchID: "b2", Tool: "check_status"})
+	bt.RecordBranch(BranchRecord{BranchID: "b1", Tool: "check_status", Agent: "codex", Terminal: TerminalFailed})
+	bt.RecordBranch(BranchRecord{BranchID: "b1", Terminal: TerminalSucceeded})
+	bt.RecordBranch(BranchRecord{BranchID: "b2", Agent: "codex", Parent: "b1"})
+
+	lineage := bt.Lineage()
+	want := []BranchRecord{
+		{BranchID: "b1", Tool: "execute_agent", Agent: "claude_code", Phase: "implement", Parent: testParent, Time: at, Terminal: TerminalSucceeded},
+		{BranchID: "b2", Tool: "check_status", Agent: "codex", Parent: "b1", Time: lineage[1].Time},
+	}
+	if !reflect.DeepEqual(lineage, want) {
+		t.Errorf("lineage =\n%+v\nwant\n%+v", lineage, want)
+	}
+	if lineage[1].Time.IsZero() {
+		t.Error("a record without a time was not stamped")
+	}
+	lineage[0].Agent = "changed"
+	if bt.Lineage()[0].Agent != "claude_code" {
+		t.Error("Lineage returned the tracker's own records")
+	}
+}
+
+// TestBranchTrackerInterleaved records branches from many goroutines, each
+// seen several times, and checks every branch has exactly one complete
+// record and the latest is one of them.
+func TestBranchTrackerInterleaved(t *testing.T) {
+	const workers, perWorker = 8, 25
+	bt := NewBranchTracker(testParent)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id := fmt.Sprintf("w%d-b%d", w, i)
+				bt.RecordBranch(BranchRecord{BranchID: id, Tool: "execute_agent", Agent: fmt.Sprintf("agent-%d", w)})
+				bt.Record(testParent)
+				bt.RecordBranch(BranchRecord{BranchID: id, Parent: fmt.Sprintf("w%d-b%d", w, i-1), Terminal: TerminalSucceeded})
+				bt.Range()
+				bt.Lineage()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	lineage := bt.Lineage()
+	if len(lineage) != workers*perWorker || bt.Created() != workers*perWorker {
+		t.Fatalf("%d records, %d created; want %d", len(lineage), bt.Created(), workers*perWorker)
+	}
+	seen := map[string]bool{}
+	perWorkerOrder := map[string]int{}
+	for _, r := range lineage {
+		var w, i int
+		fmt.Sscanf(r.BranchID, "w%d-b%d", &w, &i)
+		if seen[r.BranchID] || r.Agent != fmt.Sprintf("agent-%d", w) || r.Terminal != TerminalSucceeded || r.Parent == "" {
+			t.Errorf("record %+v is a duplicate or incomplete", r)
+		}
+		seen[r.BranchID] = true
+		// Each worker's branches keep their own order.
+		key := fmt.Sprintf("w%d", w)
+		if last, ok := perWorkerOrder[key]; ok && i <= last {
+			t.Errorf("%s recorded before %s-b%d", r.BranchID, key, last)
+		}
+		perWorkerOrder[key] = i
+	}
+	if latest := bt.Range()["latest_branch_id"]; !seen[latest] {
+		t.Errorf("latest = %q, want one of the recorded branches", latest)
+	}
+}
+
+// TestHandleConcurrent calls Handle from 20 goroutines at once, each
+// launching a branch, checking it, and reading its artifacts, while the
+// handler's accessors are read alongside. Run with -race it covers the
+// handler's concurrency contract.
+func TestHandleConcurrent(t *testing.T) {
+	const workers = 20
+	const worklog = "/home/dev/workspace/worklog.md"
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	h.SetMaxConcurrentBranches(0)
+	var polls atomic.Int64
+	h.OnPoll(func(string, string, int, time.Duration) { polls.Add(1) })
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			agent := []string{"claude_code", "codex"}[w%2]
+			res := callTool(h, "execute_agent", map[string]any{"agent": agent, "prompt": fmt.Sprintf("Task %d.", w), "parent_branch_id": testParent})
+			if res["status"] != "success" {
+				t.Errorf("worker %d: execute_agent = %s", w, toJSON(res))
+				return
+			}
+			id, _ := res["data"].(map[string]any)["branch_id"].(string)
+			srv.PutArtifact(id, worklog, fmt.Sprintf("worker %d\nline 2\n", w))
+			if res := callTool(h, "check_status", map[string]any{"branch_id": id}); res["status"] != "success" {
+				t.Errorf("worker %d: check_status = %s", w, toJSON(res))
+			}
+			for _, args := range []map[string]any{
+				{"branch_id": id, "path": worklog},
+				{"branch_id": id, "path": worklog, "since_offset": -1},
+			} {
+				res := callTool(h, "read_artifact", args)
+				data, _ := res["data"].(map[string]any)
+				if content, _ := data["content"].(string); !strings.HasPrefix(content, fmt.Sprintf("worker %d\n", w)) {
+					t.Errorf("worker %d: read_artifact %v = %s", w, args, toJSON(res))
+				}
+			}
+			h.BranchRange()
+			h.BranchLineage()
+			h.Stats()
+		}(w)
+	}
+	wg.Wait()
+
+	if n := h.BranchesCreated(); n != workers {
+		t.Errorf("%d branches created, want %d", n, workers)
+	}
+	seen := map[string]bool{}
+	for _, r := range h.BranchLineage() {
+		seen[r.BranchID] = true
+	}
+	if len(seen) != workers {
+		t.Errorf("lineage has %d branches, want %d", len(seen), workers)
+	}
+	stats := h.Stats().Tools
+	if stats["execute_agent"].Calls != workers || stats["check_status"].Calls != workers || stats["read_artifact"].Calls != 2*workers {
+		t.Errorf("stats = %+v, want %d launches and checks and %d reads", stats, workers, 2*workers)
+	}
+	if polls.Load() < 2*workers {
+		t.Errorf("%d polls reported, want at least one per launch and check", polls.Load())
+	}
+}
+
+func TestPhaseHint(t *testing.T) {
+	for prompt, want := range map[string]string{
+		"Implement the task in worklog.md":      "implement",
+		"#### Review\nCheck the implementation": "review",
+		"Please FIX the P0 issues":              "fix",
+		"Finalise the branch and push it":       "publish",
+		"Publish the result":                    "publish",
+		"Explore candidate designs":             "",
+		"Prefix the ids":                        "",
+	} {
+		if got := phaseHint(prompt); got != want {
+			t.Errorf("phaseHint(%q) = %q, want %q", prompt, got, want)
+		}
+	}
+}
+
+// TestBranchLineageRecordsContext checks execute_agent records the agent,
+// phase and parent of each launch and check_status the terminal status.
+func TestBranchLineageRecordsContext(t *testing.T) {
+	h, srv := newTestHandler(t)
+	mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent}))
+	srv.ScriptBranch(fakeBranchID(2), "failed")
+	mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "codex", "prompt": "Review the implementation.", "parent_branch_id": fakeBranchID(1)}))
+	srv.ScriptBranch("b-9", "succeed")
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-9"}))
+
+	lineage := h.BranchLineage()
+	if len(lineage) != 3 {
+		t.Fatalf("lineage = %+v, want 3 branches", lineage)
+	}
+	want := []BranchRecord{
+		{BranchID: fakeBranchID(1), Tool: "execute_agent", Agent: "claude_code", Phase: "implement", Parent: testParent, Terminal: TerminalSucceeded},
+		{BranchID: fakeBranchID(2), Tool: "execute_agent", Agent: "codex", Phase: "review", Parent: fakeBranchID(1), Terminal: TerminalFailed},
+	}
+	for i := range want {
+		got := lineage[i]
+		got.Time = time.Time{}
+		if got != want[i] {
+			t.Errorf("lineage[%d] = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if got := lineage[2]; got.BranchID != "b-9" || got.Tool != "check_status" || got.Phase != "" || got.Terminal != TerminalSucceeded {
+		t.Errorf("lineage[2] = %+v, want b-9 first seen by check_status, succeeded", got)
+	}
+}
+
+func TestUnknownToolError(t *testing.T) {
+	h, _ := newTestHandler(t)
+	var names []any
+	for _, def := range h.ToolDefinitions() {
+		fn, _ := def["function"].(map[string]any)
+		names = append(names, fn["name"])
+	}
+	cases := []struct {
+		name    string
+		suggest string // "" when no tool is close enough
+	}{
+		{"exeute_agent", "execute_agent"},
+		{"branch_status", "check_status"},
+		{"get_artifact", "grep_artifact"},
+		{"read_artefact", "read_artifact"},
+		{"Check_Statuss", "check_status"},
+		{"summon_unicorn", ""},
+		{"x", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code, details := mustFail(t, callTool(h, c.name, map[string]any{}))
+			if code != CodeUnknownTool {
+				t.Errorf("code = %s, want %s", code, CodeUnknownTool)
+			}
+			if !reflect.DeepEqual(details["supported_tools"], names) {
+				t.Errorf("supported_tools = %v, want the registry's %v", details["supported_tools"], names)
+			}
+			hint, _ := details["did_you_mean"].(map[string]any)
+			switch {
+			case c.suggest == "" && hint != nil:
+				t.Errorf("did_you_mean = %v, want none", hint)
+			case c.suggest != "" && hint["name"] != c.suggest:
+				t.Errorf("did_you_mean = %v, want %s", hint, c.suggest)
+			case c.suggest != "" && !strings.HasSuffix(fmt.Sprint(hint["usage"]), "."):
+				t.Errorf("did_you_mean = %v, want a usage hint of whole sentences", hint)
+			case c.suggest == "grep_artifact" && !strings.Contains(fmt.Sprint(hint["usage"]), `e.g. "P0|P1" in the review log`):
+				t.Errorf("usage = %v, want the first sentence in full", hint["usage"])
+			}
+		})
+	}
+}
+
+func TestBranchOutput(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetOutputMaxChars(100)
+	long := strings.Repeat("x", 150)
+	srv.Handle("branch_output", func(args map[string]any) (map[string]any, error) {
+		return map[string]any{"branch_id": args["branch_id"], "output": "all tests pass", "log": long, "exit_code": 0}, nil
+	})
+	for _, full := range []bool{false, true} {
+		data := mustSucceed(t, callTool(h, "branch_output", map[string]any{"branch_id": fakeBranchID(7), "full_output": full}))
+		calls := srv.CallsTo("branch_output")
+		if got := calls[len(calls)-1].Arguments; !reflect.DeepEqual(got, map[string]any{"branch_id": fakeBranchID(7), "full_output": full}) {
+			t.Errorf("arguments = %v", got)
+		}
+		if data["branch_id"] != fakeBranchID(7) || data["output"] != "all tests pass" || data["exit_code"] != 0.0 {
+			t.Errorf("data = %v, want the server's result", data)
+		}
+		if data["truncated"] != true || fmt.Sprint(data["omitted_chars"]) != "map[log:50]" {
+			t.Errorf("truncated = %v, omitted_chars = %v, want 50 characters of log", data["truncated"], data["omitted_chars"])
+		}
+		if log, _ := data["log"].(string); !strings.HasPrefix(log, strings.Repeat("x", 50)) || !strings.Contains(log, "[... 50 characters omitted ...]") {
+			t.Errorf("log = %q, want head and tail around a marker", log)
+		}
+	}
+}
+
+// TestBranchOutputSummary checks the default call asks for the summary and
+// passes output within the budget through untouched.
+func TestBranchOutputSummary(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.Handle("branch_output", func(args map[string]any) (map[string]any, error) {
+		return map[string]any{"branch_id": args["branch_id"], "output": "No P0/P1 issues found."}, nil
+	})
+	data := mustSucceed(t, callTool(h, "branch_output", map[string]any{"branch_id": fakeBranchID(3)}))
+	calls := srv.CallsTo("branch_output")
+	if len(calls) != 1 || calls[0].Arguments["full_output"] != false {
+		t.Errorf("calls = %v, want one call with full_output=false", calls)
+	}
+	if data["output"] != "No P0/P1 issues found." {
+		t.Errorf("output = %v, want the summary unchanged", data["output"])
+	}
+	if _, ok := data["truncated"]; ok {
+		t.Errorf("data = %v, want no truncated flag", data)
+	}
+	if _, ok := data["omitted_chars"]; ok {
+		t.Errorf("data = %v, want no omitted_chars", data)
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	cases := []struct {
+		name    string
+		s       string
+		n       int
+		want    string
+		dropped int
+	}{
+		{"fits", "abcdef", 10, "abcdef", 0},
+		{"exact", "abcdef", 6, "abcdef", 0},
+		{"even budget", "abcdefghij", 4, "ab\n\n[... 6 characters omitted ...]\n\nij", 6},
+		{"odd budget", "abcdefghij", 5, "ab\n\n[... 5 characters omitted ...]\n\nhij", 5},
+		{"multibyte", "ééééé✓✓✓✓✓", 4, "éé\n\n[... 6 characters omitted ...]\n\n✓✓", 6},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, dropped := headTail(c.s, c.n)
+			if got != c.want || dropped != c.dropped {
+				t.Errorf("headTail = %q, %d; want %q, %d", got, dropped, c.want, c.dropped)
+			}
+		})
+	}
+}
+
+func TestBranchOutputDefinition(t *testing.T) {
+	h, _ := newTestHandler(t)
+	for _, def := range h.ToolDefinitions() {
+		fn, _ := def["function"].(map[string]any)
+		if fn["name"] != "branch_output" {
+			continue
+		}
+		params, _ := fn["parameters"].(map[string]any)
+		props, _ := params["properties"].(map[string]any)
+		full, _ := props["full_output"].(map[string]any)
+		if full["type"] != "boolean" || props["branch_id"] == nil {
+			t.Errorf("properties = %v, want branch_id and a boolean full_output", props)
+		}
+		if !reflect.DeepEqual(params["required"], []any{"branch_id"}) {
+			t.Errorf("required = %v, want only branch_id", params["required"])
+		}
+		return
+	}
+	t.Fatal("branch_output is not defined")
+}
+
+// TestCheckStatusCancelled cancels check_status while it sleeps between
+// polls and while a poll is in flight; both must return well within one
+// poll interval.
+func TestCheckStatusCancelled(t *testing.T) {
+	const pollInterval = 5 * time.Second
+	for _, tc := range []struct {
+		name     string
+		inFlight bool
+	}{{"between polls", false}, {"in-flight poll", true}} {
+		inFlight := tc.inFlight
+		t.Run(tc.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			srv.ScriptBranch("b-1", "pending")
+			polled := make(chan struct{}, 10)
+			release := make(chan struct{})
+			defer close(release)
+			srv.Handle("get_branch", func(map[string]any) (map[string]any, error) {
+				polled <- struct{}{}
+				if inFlight {
+					<-release
+				}
+				return map[string]any{"id": "b-1", "status": "pending"}, nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan map[string]any)
+			go func() {
+				done <- callToolCtx(ctx, h, "check_status", map[string]any{"branch_id": "b-1", "poll_interval_seconds": pollInterval.Seconds(), "timeout_seconds": 600})
+			}()
+			<-polled
+			if !inFlight {
+				time.Sleep(50 * time.Millisecond) // into the sleep after the poll
+			}
+			cancelled := time.Now()
+			cancel()
+			select {
+			case result := <-done:
+				if elapsed := time.Since(cancelled); elapsed > pollInterval/2 {
+					t.Errorf("returned %s after cancel, want well within the %s poll interval", elapsed, pollInterval)
+				}
+				mustFail(t, result)
+			case <-time.After(pollInterval):
+				t.Fatal("check_status kept polling after its context was cancelled")
+			}
+			if n := len(srv.CallsTo("get_branch")); n != 1 {
+				t.Errorf("polled %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestWriteArtifact(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.Respond("branch_write_file", map[string]any{"ok": true})
+
+	content := "line one\n\"quoted\" ünïcode\n"
+	mustSucceed(t, callTool(h, "write_artifact", map[string]any{"branch_id": "b1", "path": "docs/issue.md", "content": content}))
+	calls := srv.CallsTo("branch_write_file")
+	if len(calls) != 1 {
+		t.Fatalf("%d branch_write_file calls, want 1", len(calls))
+	}
+	want := map[string]any{"branch_id": "b1", "file_path": "docs/issue.md", "content": content}
+	if !reflect.DeepEqual(calls[0].Arguments, want) {
+		t.Errorf("arguments = %v, want %v", calls[0].Arguments, want)
+	}
+
+	for _, c := range []struct {
+		name, path, content, wantMsg string
+	}{
+		{"oversized", "big.txt", strings.Repeat("x", maxWriteArtifactBytes+1), "at most"},
+		{"parent segment", "../etc/passwd", "x", "'..'"},
+		{"inner parent segment", "docs/../../x", "x", "'..'"},
+		{"backslash parent segment", `docs\..\x`, "x", "'..'"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			before := len(srv.CallsTo("branch_write_file"))
+			result := callTool(h, "write_artifact", map[string]any{"branch_id": "b1", "path": c.path, "content": c.content})
+			code, _ := mustFail(t, result)
+			if _, msg, _, _ := ErrorInfo(result); code != CodeInvalidArguments || !strings.Contains(msg, c.wantMsg) {
+				t.Errorf("error %s %q, want %s mentioning %s", code, msg, CodeInvalidArguments, c.wantMsg)
+			}
+			if len(srv.CallsTo("branch_write_file")) != before {
+				t.Error("a rejected write reached the server")
+			}
+		})
+	}
+
+	mustSucceed(t, callTool(h, "write_artifact", map[string]any{"branch_id": "b1", "path": "a..b/c.txt", "content": strings.Repeat("x", maxWriteArtifactBytes)}))
+}
+
+func TestCancelAgent(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.Respond("cancel_branch", map[string]any{"status": "cancelled"})
+
+	data := mustSucceed(t, callTool(h, "cancel_agent", map[string]any{"branch_id": "b1"}))
+	if data["branch_id"] != "b1" || data["cancelled"] != true {
+		t.Errorf("data = %v", data)
+	}
+	calls := srv.CallsTo("cancel_branch")
+	if len(calls) != 1 || calls[0].Arguments["branch_id"] != "b1" {
+		t.Errorf("cancel_branch calls = %v", calls)
+	}
+
+	srv.Handle("cancel_branch", func(map[string]any) (map[string]any, error) {
+		return nil, errors.New("branch b2 already finished")
+	})
+	code, details := mustFail(t, callTool(h, "cancel_agent", map[string]any{"branch_id": "b2"}))
+	if code != CodeToolFailed || details["mcp_error"] == nil {
+		t.Errorf("code %s details %v, want %s with the server's error", code, details, CodeToolFailed)
+	}
+}
+
+func TestCheckStatusAutoCancel(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		cancelErr error
+	}{
+		{"cancelled", nil},
+		{"cancel fails", errors.New("cancel refused")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			fastPolls(h)
+			srv.ScriptBranch("b-1", "running")
+			srv.Handle("cancel_branch", func(map[string]any) (map[string]any, error) {
+				return map[string]any{"status": "cancelled"}, c.cancelErr
+			})
+
+			result := callTool(h, "check_status", map[string]any{"branch_id": "b-1", "cancel_after_seconds": 0.2, "timeout_seconds": 60})
+			code, details := mustFail(t, result)
+			if code != CodeTimeout {
+				t.Fatalf("code = %s, want %s", code, CodeTimeout)
+			}
+			calls := srv.CallsTo("cancel_branch")
+			if len(calls) != 1 || calls[0].Arguments["branch_id"] != "b-1" {
+				t.Errorf("cancel_branch calls = %v, want one for b-1", calls)
+			}
+			if details["cancelled"] != (c.cancelErr == nil) || (c.cancelErr != nil) != (details["cancel_error"] != nil) {
+				t.Errorf("details = %v", details)
+			}
+			if polls := len(srv.CallsTo("get_branch")); polls < 2 {
+				t.Errorf("%d polls before cancelling, want at least 2", polls)
+			}
+		})
+	}
+
+	h, srv := newTestHandler(t)
+	fastPolls(h)
+	srv.ScriptBranch("b-1", "running", "succeed")
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "cancel_after_seconds": 30}))
+	if n := len(srv.CallsTo("cancel_branch")); n != 0 {
+		t.Errorf("%d cancel_branch calls for a branch that finished in time", n)
+	}
+}
+
+func TestBranchDiff(t *testing.T) {
+	textPatch := "diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@\n-old\n+new\n"
+	binaryPatch := "diff --git a/logo.png b/logo.png\nindex 1..2 100644\nGIT binary patch\nliteral 12\nzcmV?d00001\n\nliteral 0\nHcmV?d00001\n"
+	cases := []struct {
+		name      string
+		reply     map[string]any
+		maxBytes  int
+		want      string
+		empty     bool
+		truncated bool
+	}{
+		{"empty", map[string]any{"diff": ""}, 0, "", true, false},
+		{"whitespace only", map[string]any{"patch": "\n  \n"}, 0, "", true, false},
+		{"small", map[string]any{"diff": textPatch}, 0, textPatch, false, false},
+		{"binary collapsed", map[string]any{"diff": binaryPatch + textPatch}, 0, "diff --git a/logo.png b/logo.png\nindex 1..2 100644\n[binary patch omitted]\n" + textPatch, false, false},
+		{"truncated", map[string]any{"text": textPatch}, 20, logx.Truncate(textPatch, 20), false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			h.SetDiffMaxBytes(c.maxBytes)
+			srv.Respond("branch_diff", c.reply)
+			data := mustSucceed(t, callTool(h, "branch_diff", map[string]any{"branch_id": "b1"}))
+			if data["diff"] != c.want {
+				t.Errorf("diff = %q, want %q", data["diff"], c.want)
+			}
+			if (data["empty"] == true) != c.empty || (data["truncated"] == true) != c.truncated {
+				t.Errorf("data = %v, want empty=%t truncated=%t", data, c.empty, c.truncated)
+			}
+			if (c.empty || c.truncated) != (data["note"] != nil) {
+				t.Errorf("note = %v", data["note"])
+			}
+		})
+	}
+}
+
+// binaryFileServer serves files of branch b1 from files, base64-encoded when
+// the read asks for it, and records the encodings requested.
+func binaryFileServer(t *testing.T, h *ToolHandler, srv *mcptest.FakeServer, files map[string][]byte) {
+	t.Helper()
+	srv.Handle("branch_read_file", func(args map[string]any) (map[string]any, error) {
+		data, ok := files[args["file_path"].(string)]
+		if !ok {
+			return nil, fmt.Errorf("file %v not found", args["file_path"])
+		}
+		if args["encoding"] == EncodingBase64 {
+			return map[string]any{"content": base64.StdEncoding.EncodeToString(data), "encoding": "base64"}, nil
+		}
+		return map[string]any{"content": string(data)}, nil
+	})
+}
+
+func TestReadArtifactEncodings(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	png := append([]byte("\x89PNG\r\n\x1a\n"), 0, 0xff, 0xfe, 0x80)
+	large := bytes.Repeat([]byte{0, 1, 2, 0xff}, maxInlineBase64Bytes)
+	files := map[string][]byte{"worklog.md": []byte("# Worklog\n"), "shot.png": png, "blob.txt": png, "ascii-art.png": []byte("(>_<)\n"), "dist/app.tar": large}
+	cases := []struct {
+		name, path, encoding string
+		wantEncoding         any
+	}{
+		{"text by default", "worklog.md", "", nil},
+		{"binary by extension", "shot.png", "", EncodingBase64},
+		{"explicit base64", "blob.txt", EncodingBase64, EncodingBase64},
+		{"explicit text", "ascii-art.png", EncodingText, nil},
+		{"large binary", "dist/app.tar", "", EncodingBase64},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			binaryFileServer(t, h, srv, files)
+			args := map[string]any{"branch_id": "b1", "path": c.path}
+			if c.encoding != "" {
+				args["encoding"] = c.encoding
+			}
+			data := mustSucceed(t, callTool(h, "read_artifact", args))
+			reads := srv.CallsTo("branch_read_file")
+			if len(reads) != 1 || reads[0].Arguments["encoding"] != c.wantEncoding {
+				t.Fatalf("branch_read_file calls = %v, want one with encoding %v", reads, c.wantEncoding)
+			}
+			raw := files[c.path]
+			switch {
+			case c.wantEncoding == nil:
+				if data["content"] != string(raw) {
+					t.Errorf("content = %q, want %q", data["content"], raw)
+				}
+			case len(raw) > maxInlineBase64Bytes:
+				local, _ := data["local_path"].(string)
+				saved, err := os.ReadFile(local)
+				if err != nil || !bytes.Equal(saved, raw) || data["content_base64"] != nil {
+					t.Errorf("large binary: data = %v, saved %d bytes (%v)", data, len(saved), err)
+				}
+				if fmt.Sprint(data["size"]) != fmt.Sprint(len(raw)) {
+					t.Errorf("size = %v, want %d", data["size"], len(raw))
+				}
+			default:
+				decoded, err := base64.StdEncoding.DecodeString(fmt.Sprint(data["content_base64"]))
+				if err != nil || !bytes.Equal(decoded, raw) || fmt.Sprint(data["size"]) != fmt.Sprint(len(raw)) || data["mime_type"] == nil || data["local_path"] != nil {
+					t.Errorf("data = %v", data)
+				}
+			}
+		})
+	}
+
+	h, srv := newTestHandler(t)
+	srv.Respond("branch_read_file", map[string]any{"content": "not base64!"})
+	if code, _ := mustFail(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b1", "path": "shot.png"})); code != CodeToolFailed {
+		t.Errorf("invalid base64: code = %s, want %s", code, CodeToolFailed)
+	}
+}
+
+func TestReadArtifactRanges(t *testing.T) {
+	const text = "0123456789"
+	cases := []struct {
+		name      string
+		offset    any
+		maxBytes  any
+		want      string
+		truncated bool
+	}{
+		{"first chunk", 0, 4, "0123", true},
+		{"middle chunk", 4, 4, "4567", true},
+		{"chunk ending at EOF", 6, 4, "6789", false},
+		{"chunk past EOF", 8, 4, "89", false},
+		{"offset at EOF", 10, 4, "", false},
+		{"offset beyond EOF", 15, 4, "", false},
+		{"configured default", nil, nil, "012", true},
+		{"whole file", 0, 100, text, false},
+	}
+	for _, ranged := range []bool{false, true} {
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("%s/server ranged %t", c.name, ranged), func(t *testing.T) {
+				h, srv := newTestHandler(t)
+				h.SetArtifactMaxBytes(3)
+				if ranged {
+					srv.Handle("branch_read_file", func(args map[string]any) (map[string]any, error) {
+						off, _ := args["offset"].(float64)
+						n, _ := args["max_bytes"].(float64)
+						start := min(int(off), len(text))
+						return map[string]any{"content": text[start:min(start+int(n), len(text))], "total_size": len(text), "offset": off}, nil
+					})
+				} else {
+					srv.PutArtifact("b1", "worklog.md", text)
+				}
+				args := map[string]any{"branch_id": "b1", "path": "worklog.md"}
+				if c.offset != nil {
+					args["offset"], args["max_bytes"] = c.offset, c.maxBytes
+				}
+				data := mustSucceed(t, callTool(h, "read_artifact", args))
+				if data["content"] != c.want || data["truncated"] != c.truncated {
+					t.Errorf("content %q truncated %v, want %q %t", data["content"], data["truncated"], c.want, c.truncated)
+				}
+				if fmt.Sprint(data["total_size"]) != fmt.Sprint(len(text)) || fmt.Sprint(data["returned_bytes"]) != fmt.Sprint(len(c.want)) {
+					t.Errorf("total_size %v returned_bytes %v", data["total_size"], data["returned_bytes"])
+				}
+				read := srv.CallsTo("branch_read_file")[0].Arguments
+				wantMax := c.maxBytes
+				if wantMax == nil {
+					wantMax = 3
+				}
+				if fmt.Sprint(read["max_bytes"]) != fmt.Sprint(wantMax) {
+					t.Errorf("max_bytes sent = %v, want %v", read["max_bytes"], wantMax)
+				}
+			})
+		}
+	}
+
+	h, srv := newTestHandler(t)
+	srv.PutArtifact("b1", "notes.md", "héllo")
+	data := mustSucceed(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b1", "path": "notes.md", "max_bytes": 2}))
+	if data["content"] != "h" || data["truncated"] != true {
+		t.Errorf("a chunk ending inside a rune: content %q truncated %v, want \"h\" true", data["content"], data["truncated"])
+	}
+	if code, _ := mustFail(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b1", "path": "notes.md", "offset": -1})); code != CodeInvalidArguments {
+		t.Errorf("negative offset: code = %s, want %s", code, CodeInvalidArguments)
+	}
+}
+
+// progressServer answers get_branch over SSE with three progress
+// notifications for the call's progressToken ahead of a succeeded branch,
+// recording the tokens it was sent.
+func progressServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+			Params struct {
+				Name      string         `json:"name"`
+				Arguments map[string]any `json:"arguments"`
+				Meta      struct {
+					ProgressToken string `json:"progressToken"`
+				} `json:"_meta"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		if req.Method != "tools/call" {
+			fmt.Fprintf(w, "data: {\"jsonrpc\":\"2.0\",\"id\":%v,\"result\":{}}\n\n", req.ID)
+			return
+		}
+		token := req.Params.Meta.ProgressToken
+		mu.Lock()
+		tokens = append(tokens, token)
+		mu.Unlock()
+		for i, msg := range []string{"cloning", "running tests", "writing worklog"} {
+			note, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "method": "notifications/progress", "params": map[string]any{"progressToken": token, "progress": i + 1, "total": 4, "message": msg}})
+			fmt.Fprintf(w, "data: %s\n\n", note)
+		}
+		result, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"id": req.Params.Arguments["branch_id"], "status": "succeed"}}})
+		fmt.Fprintf(w, "data: %s\n\n", result)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), tokens...)
+	}
+}
+
+func TestProgressNotifications(t *testing.T) {
+	srv, tokens := progressServer(t)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+
+	var got []string
+	h.OnProgress(func(label string, pct float64, message string) {
+		got = append(got, fmt.Sprintf("%s %.0f%%: %s", label, pct, message))
+	})
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+	want := []string{"b-1 25%: cloning", "b-1 50%: running tests", "b-1 75%: writing worklog"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("progress = %q, want %q", got, want)
+	}
+	if sent := tokens(); len(sent) != 1 || !strings.HasPrefix(sent[0], "b-1#") {
+		t.Errorf("progress tokens sent = %q, want one labelled with the branch", sent)
+	}
+
+	// Without a callback the progress is logged.
+	logs := captureLogs(t)
+	h.OnProgress(nil)
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+	if !strings.Contains(logs.String(), "b-1 50%: running tests") {
+		t.Errorf("progress not logged:\n%s", logs)
+	}
+}
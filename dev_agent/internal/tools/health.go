@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// pingTimeout bounds the whole health check, retries included.
+const pingTimeout = 10 * time.Second
+
+// MCPHealthError is a failed Ping with a diagnosis of the likely cause.
+type MCPHealthError struct {
+	Diagnosis string
+	Err       error
+}
+
+func (e *MCPHealthError) Error() string { return fmt.Sprintf("%s (%v)", e.Diagnosis, e.Err) }
+
+func (e *MCPHealthError) Unwrap() error { return e.Err }
+
+// Ping runs the handshake and a tools/list under a short deadline and, on
+// failure, explains what is most likely wrong with the configured server.
+func (c *MCPClient) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	res, err := c.call(ctx, "tools/list", map[string]any{}, pingTimeout)
+	if err != nil {
+		return &MCPHealthError{Diagnosis: c.diagnose(err), Err: err}
+	}
+	if _, ok := res["tools"]; !ok {
+		return &MCPHealthError{
+			Diagnosis: fmt.Sprintf("%s answered with JSON that is not an MCP tools/list result; MCP_BASE_URL probably points at a different service", c.rpcURL),
+			Err:       fmt.Errorf("unexpected reply: %s", rawDump(res)),
+		}
+	}
+	return nil
+}
+
+// diagnose maps a failed call to the most likely configuration problem.
+func (c *MCPClient) diagnose(err error) string {
+	var (
+		dnsErr    *net.DNSError
+		httpErr   MCPHTTPError
+		syntaxErr *json.SyntaxError
+		certErr   *x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		timeout   MCPTimeoutError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("cannot resolve MCP host %q; check the host name in MCP_BASE_URL", dnsErr.Name)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Sprintf("connection refused at %s; is the MCP server running and listening on that port?", c.rpcURL)
+	case errors.As(err, &timeout) && timeout.Phase == "connect":
+		return fmt.Sprintf("could not connect to %s within %s; the host is unreachable (wrong address, firewall or proxy)", c.rpcURL, timeout.Limit)
+	case errors.As(err, &timeout):
+		return fmt.Sprintf("%s from %s took longer than %s; the server is up but not answering", timeout.Phase, c.rpcURL, timeout.Limit)
+	case errors.As(err, &certErr), errors.As(err, &hostErr):
+		return "the MCP server's TLS certificate was rejected; set MCP_CA_CERT_FILE for a private CA"
+	case errors.As(err, &httpErr) && httpErr.Status == http.StatusNotFound:
+		return fmt.Sprintf("HTTP 404 at %s; the host is up but serves no MCP endpoint at that path (the default is /mcp/sse)", c.rpcURL)
+	case errors.As(err, &httpErr) && (httpErr.Status == http.StatusUnauthorized || httpErr.Status == http.StatusForbidden):
+		return fmt.Sprintf("HTTP %d from %s; check MCP_API_TOKEN", httpErr.Status, c.rpcURL)
+	case errors.As(err, &httpErr):
+		return fmt.Sprintf("HTTP %d from %s; the MCP server is failing", httpErr.Status, c.rpcURL)
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("%s did not answer with JSON; MCP_BASE_URL probably points at a web page or a different service", c.rpcURL)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Sprintf("no answer from %s within %s; check the URL, proxy settings and firewall", c.rpcURL, pingTimeout)
+	case errors.Is(err, ErrMCPUnavailable):
+		return "the MCP server failed repeatedly and the client stopped calling it"
+	}
+	if _, isHTTP := c.transport.(httpTransport); !isHTTP {
+		return "the MCP server subprocess did not complete the handshake; check MCP_COMMAND"
+	}
+	return fmt.Sprintf("the MCP server at %s did not complete the handshake", c.rpcURL)
+}
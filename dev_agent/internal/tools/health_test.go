@@ -0,0 +1,92 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// staticServer answers every request with status, content type and body.
+func staticServer(t *testing.T, status int, contentType, body string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestPingDiagnosis(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+	notMCP := `{"jsonrpc": "2.0", "id": 1, "result": {"status": "ok"}}`
+
+	cases := []struct {
+		name string
+		url  string
+		opts MCPClientOptions
+		want string
+	}{
+		{"connection refused", closed.URL, MCPClientOptions{}, "connection refused"},
+		{"DNS failure", "http://mcp.invalid", MCPClientOptions{}, `cannot resolve MCP host "mcp.invalid"`},
+		{"wrong path", staticServer(t, http.StatusNotFound, "text/plain", "404 page not found"), MCPClientOptions{}, "HTTP 404"},
+		{"bad token", staticServer(t, http.StatusUnauthorized, "text/plain", "unauthorized"), MCPClientOptions{}, "check MCP_API_TOKEN"},
+		{"server error", staticServer(t, http.StatusInternalServerError, "text/plain", "boom"), MCPClientOptions{}, "the MCP server is failing"},
+		{"web page", staticServer(t, http.StatusOK, "application/json", "<html><body>Welcome</body></html>"), MCPClientOptions{}, "did not answer with JSON"},
+		{"non-MCP JSON", staticServer(t, http.StatusOK, "application/json", notMCP), MCPClientOptions{}, "not an MCP tools/list result"},
+		{"no answer", hung.URL, MCPClientOptions{ResponseHeaderTimeout: 50 * time.Millisecond}, "took longer than"},
+	}
+	captureLogs(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.opts.MaxRetries, c.opts.BaseBackoff, c.opts.BreakerThreshold = 1, time.Millisecond, -1
+			client := NewMCPClientWithOptions(c.url, c.opts)
+			defer client.Close()
+			var healthErr *MCPHealthError
+			if err := client.Ping(context.Background()); !errors.As(err, &healthErr) {
+				t.Fatalf("Ping() = %v, want an MCPHealthError", err)
+			}
+			if !strings.Contains(healthErr.Diagnosis, c.want) {
+				t.Errorf("diagnosis = %q, want it to mention %q", healthErr.Diagnosis, c.want)
+			}
+			if healthErr.Err == nil {
+				t.Error("the underlying error was dropped")
+			}
+		})
+	}
+}
+
+func TestPingHealthyServer(t *testing.T) {
+	srv := mcptest.NewFakeServer()
+	defer srv.Close()
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, c := range srv.Calls() {
+		methods = append(methods, c.Method)
+	}
+	if !slices.Contains(methods, "initialize") || !slices.Contains(methods, "tools/list") {
+		t.Errorf("Ping sent %v, want the handshake and a tools/list", methods)
+	}
+}
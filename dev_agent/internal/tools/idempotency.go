@@ -0,0 +1,125 @@
+package tools
+
+import (
+	"context"
+	"errors"
+
+	"dev_agent/internal/logx"
+)
+
+// idempotencyKeyOf digs the key out of a tools/call payload so rpcPost can
+// mirror it into the Idempotency-Key header.
+func idempotencyKeyOf(msg map[string]any) string {
+	params, _ := msg["params"].(map[string]any)
+	args, _ := params["arguments"].(map[string]any)
+	key, _ := args["idempotency_key"].(string)
+	return key
+}
+
+// readOnlyTools only read server state, so sending one again is harmless.
+var readOnlyTools = map[string]bool{
+	"get_branch":        true,
+	"branch_read_file":  true,
+	"branch_list_files": true,
+	"branch_output":     true,
+	"branch_diff":       true,
+	"branch_logs":       true,
+	"list_branches":     true,
+	"list_projects":     true,
+	"get_project":       true,
+}
+
+// idempotentCall reports whether a request may be repeated when the outcome
+// of an earlier attempt is unknown: every method other than tools/call,
+// read-only tools, and calls carrying an idempotency key, which the server
+// uses to drop the duplicate.
+func idempotentCall(method string, params any) bool {
+	if method != "tools/call" {
+		return true
+	}
+	p, _ := params.(map[string]any)
+	name, _ := p["name"].(string)
+	args, _ := p["arguments"].(map[string]any)
+	if key, _ := args["idempotency_key"].(string); key != "" {
+		return true
+	}
+	return readOnlyTools[name]
+}
+
+// lostReply turns the failure of a non-idempotent request that was already
+// written, such as a timeout waiting for the reply or a dropped connection,
+// into a ResultUnknownError, so send does not repeat a mutation that may
+// have taken effect. Replies the server did send (HTTP and JSON-RPC errors)
+// and a cancelled caller are left alone.
+func lostReply(ctx context.Context, method string, params any, err error) error {
+	if ctx.Err() != nil || errors.Is(err, ErrResultUnknown) || idempotentCall(method, params) {
+		return err
+	}
+	var he MCPHTTPError
+	var re MCPRPCError
+	if errors.As(err, &he) || errors.As(err, &re) || KindOf(err) != KindTransport {
+		return err
+	}
+	p, _ := params.(map[string]any)
+	return ResultUnknownError{Method: metricKey(method, p), Cause: err}
+}
+
+// retryGuard is consulted by send before repeating a failed attempt. When it
+// finds that the earlier attempt took effect after all, it returns that
+// result and the retry is skipped.
+type retryGuard func(ctx context.Context) (map[string]any, bool)
+
+type retryGuardKey struct{}
+
+type exploreKeyKey struct{}
+
+type exploreAttempt struct {
+	key    string
+	repeat bool
+}
+
+func withRetryGuard(ctx context.Context, guard retryGuard) context.Context {
+	return context.WithValue(ctx, retryGuardKey{}, guard)
+}
+
+func retryGuardFrom(ctx context.Context) retryGuard {
+	guard, _ := ctx.Value(retryGuardKey{}).(retryGuard)
+	return guard
+}
+
+// WithExploreKey makes ParallelExplore send key as its idempotency key
+// (suffixed per launch when prompts differ per branch) instead of a fresh
+// one. repeat marks a second attempt of the same launch: a branch already
+// tagged with the key is then returned instead of launching another.
+func WithExploreKey(ctx context.Context, key string, repeat bool) context.Context {
+	return context.WithValue(ctx, exploreKeyKey{}, exploreAttempt{key, repeat})
+}
+
+func exploreKeyFrom(ctx context.Context) (string, bool) {
+	k, _ := ctx.Value(exploreKeyKey{}).(exploreAttempt)
+	return k.key, k.repeat
+}
+
+// exploredBranchGuard looks for a branch created by an earlier attempt of
+// the parallel_explore carrying key, for servers that ignore the key: a
+// timed-out request may still have launched the branch.
+func (c *MCPClient) exploredBranchGuard(projectName, key string) retryGuard {
+	return func(ctx context.Context) (map[string]any, bool) {
+		ctx = withRetryGuard(ctx, nil)
+		branches, _, err := c.ListBranches(ctx, projectName, "", 50)
+		if err != nil {
+			logx.Debugf("Duplicate check for idempotency key %s failed: %v", key, err)
+			return nil, false
+		}
+		for _, b := range branches {
+			if b.IdempotencyKey == key && b.ID != "" {
+				logx.Warningf("parallel_explore attempt with key %s already created branch %s; not launching it again.", key, b.ID)
+				return map[string]any{
+					"branches":     []any{map[string]any{"branch_id": b.ID, "status": b.Status}},
+					"deduplicated": true,
+				}, true
+			}
+		}
+		return nil, false
+	}
+}
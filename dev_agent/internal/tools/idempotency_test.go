@@ -0,0 +1,193 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// lostReplyServer creates a branch per parallel_explore and holds the first
+// reply past the client's header timeout, as if the response were lost.
+// With dedupe it returns the existing branch for a repeated key and has no
+// list_branches; otherwise it only tags branches with the key for
+// list_branches to report.
+func lostReplyServer(t *testing.T, dedupe bool) (*mcptest.FakeServer, func() int) {
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	var (
+		mu       sync.Mutex
+		branches []map[string]any
+		byKey    = map[string]map[string]any{}
+	)
+	srv.Handle("parallel_explore", func(args map[string]any) (map[string]any, error) {
+		mu.Lock()
+		key, _ := args["idempotency_key"].(string)
+		if b := byKey[key]; dedupe && b != nil {
+			mu.Unlock()
+			return map[string]any{"branches": []any{b}}, nil
+		}
+		b := map[string]any{"branch_id": fmt.Sprintf("b-%d", len(branches)+1), "status": "pending", "idempotency_key": key}
+		branches = append(branches, b)
+		byKey[key] = b
+		first := len(branches) == 1
+		mu.Unlock()
+		if first {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return map[string]any{"branches": []any{b}}, nil
+	})
+	if !dedupe {
+		srv.Handle("list_branches", func(map[string]any) (map[string]any, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			items := make([]any, len(branches))
+			for i, b := range branches {
+				items[i] = b
+			}
+			return map[string]any{"branches": items}, nil
+		})
+	}
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(branches)
+	}
+}
+
+func lostReplyClient(t *testing.T, srv *mcptest.FakeServer) *MCPClient {
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, ResponseHeaderTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestParallelExploreRetryReusesKey(t *testing.T) {
+	srv, created := lostReplyServer(t, true)
+	client := lostReplyClient(t, srv)
+	captureLogs(t)
+
+	res, err := client.ParallelExplore(context.Background(), "demo", testParent, []string{"Implement it"}, "claude_code", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Branches) != 1 || res.Branches[0].ID != "b-1" || created() != 1 {
+		t.Errorf("branches = %+v with %d created, want the one branch b-1", res.Branches, created())
+	}
+	calls := srv.CallsTo("parallel_explore")
+	if len(calls) < 2 {
+		t.Fatalf("%d parallel_explore calls, want the timed-out call and its retry", len(calls))
+	}
+	key, _ := calls[0].Arguments["idempotency_key"].(string)
+	if key == "" {
+		t.Fatal("parallel_explore sent no idempotency_key")
+	}
+	for i, c := range calls {
+		if c.Arguments["idempotency_key"] != key || c.Header.Get("Idempotency-Key") != key {
+			t.Errorf("call %d: key %v, header %q, want %s in both", i, c.Arguments["idempotency_key"], c.Header.Get("Idempotency-Key"), key)
+		}
+	}
+
+	// A new launch gets a new key.
+	if _, err := client.ParallelExplore(context.Background(), "demo", testParent, []string{"Review it"}, "codex", 1); err != nil {
+		t.Fatal(err)
+	}
+	calls = srv.CallsTo("parallel_explore")
+	if last := calls[len(calls)-1].Arguments["idempotency_key"]; last == key {
+		t.Error("a second launch reused the first launch's key")
+	}
+}
+
+func TestParallelExploreRetryFindsDuplicate(t *testing.T) {
+	srv, created := lostReplyServer(t, false)
+	client := lostReplyClient(t, srv)
+	captureLogs(t)
+
+	res, err := client.ParallelExplore(context.Background(), "demo", testParent, []string{"Implement it"}, "claude_code", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Branches) != 1 || res.Branches[0].ID != "b-1" || res.Raw["deduplicated"] != true {
+		t.Errorf("result = %+v, want the deduplicated branch b-1", res)
+	}
+	if n := len(srv.CallsTo("parallel_explore")); n != 1 || created() != 1 {
+		t.Errorf("%d parallel_explore calls created %d branches; the retry must not relaunch", n, created())
+	}
+	if n := len(srv.CallsTo("list_branches")); n != 1 {
+		t.Errorf("%d list_branches calls, want one duplicate check", n)
+	}
+}
+
+// TestLostReplyByIdempotency sends each kind of call to a server that holds
+// the first reply past the header timeout, after the request took effect.
+func TestLostReplyByIdempotency(t *testing.T) {
+	cases := []struct {
+		name  string
+		tool  string
+		args  map[string]any
+		calls int
+		// unknown: the call fails as ErrResultUnknown instead of retrying.
+		unknown bool
+	}{
+		{"read-only get_branch", "get_branch", map[string]any{"branch_id": "b-1"}, 2, false},
+		{"read-only branch_read_file", "branch_read_file", map[string]any{"branch_id": "b-1", "file_path": "/w/a.md"}, 2, false},
+		{"mutation without a key", "parallel_explore", map[string]any{"parent_branch_id": testParent}, 1, true},
+		{"mutation with a key", "parallel_explore", map[string]any{"parent_branch_id": testParent, "idempotency_key": "k-1"}, 2, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := mcptest.NewFakeServer()
+			t.Cleanup(srv.Close)
+			var mu sync.Mutex
+			calls := 0
+			srv.Handle(c.tool, func(map[string]any) (map[string]any, error) {
+				mu.Lock()
+				calls++
+				first := calls == 1
+				mu.Unlock()
+				if first {
+					time.Sleep(300 * time.Millisecond)
+				}
+				return map[string]any{"ok": true}, nil
+			})
+			_, err := lostReplyClient(t, srv).CallTool(context.Background(), c.tool, c.args)
+			mu.Lock()
+			got := calls
+			mu.Unlock()
+			if got != c.calls {
+				t.Errorf("%d calls reached the server, want %d", got, c.calls)
+			}
+			if !c.unknown {
+				if err != nil {
+					t.Errorf("err = %v, want the retry to succeed", err)
+				}
+				return
+			}
+			var unknown ResultUnknownError
+			if !errors.Is(err, ErrResultUnknown) || !errors.As(err, &unknown) || unknown.Method != "tools/call:"+c.tool {
+				t.Fatalf("err = %v, want a result-unknown error for tools/call:%s", err, c.tool)
+			}
+			if isRetryable(err) {
+				t.Error("a lost mutation reply is retryable")
+			}
+		})
+	}
+}
+
+// TestMutationRetriedOnServerError checks a non-idempotent call the server
+// answered with an error is still retried: it did not take effect.
+func TestMutationRetriedOnServerError(t *testing.T) {
+	srv, attempts := scriptedStatusServer(t, "", http.StatusServiceUnavailable)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	if _, err := client.CallTool(context.Background(), "parallel_explore", map[string]any{"parent_branch_id": testParent}); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+}
@@ -0,0 +1,73 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+const (
+	// launchAttempts bounds how often executeAgent sends one launch.
+	launchAttempts = 2
+	// launchRetryDelay is the pause before the second attempt, unless the
+	// server asked for a longer one; maxLaunchRetryDelay caps that.
+	launchRetryDelay    = 2 * time.Second
+	maxLaunchRetryDelay = 30 * time.Second
+)
+
+// retriedError is a launch that still failed after its automatic retry.
+type retriedError struct{ err error }
+
+func (e retriedError) Error() string { return e.err.Error() + " (after an automatic retry)" }
+func (e retriedError) Unwrap() error { return e.err }
+
+// transientLaunchError reports whether a failed parallel_explore may pass
+// when sent again unchanged: the connection broke, the server answered 503
+// or it rate limited us. An open circuit is left alone; it fails fast by
+// design.
+func transientLaunchError(err error) bool {
+	if errors.Is(err, ErrMCPUnavailable) {
+		return false
+	}
+	var he MCPHTTPError
+	if errors.As(err, &he) && he.Status == http.StatusServiceUnavailable {
+		return true
+	}
+	switch KindOf(err) {
+	case KindTransport, KindRateLimited:
+		return true
+	}
+	return false
+}
+
+// launch runs parallel_explore, sending it once more with the same
+// arguments and idempotency key when the first attempt fails transiently,
+// so a flaky link costs neither an iteration nor a fresh prompt. retried
+// reports whether the second attempt was made.
+func (h *ToolHandler) launch(ctx context.Context, project, parent string, prompts []string, agent string, numBranches int) (explored ExploreResult, retried bool, err error) {
+	key := newUUID()
+	for attempt := 1; ; attempt++ {
+		actx := WithExploreKey(ctx, key, attempt > 1)
+		explored, err = h.client.ParallelExplore(actx, project, parent, prompts, agent, numBranches)
+		if err == nil || attempt == launchAttempts || ctx.Err() != nil || !transientLaunchError(err) {
+			break
+		}
+		wait := launchRetryDelay
+		var he MCPHTTPError
+		if errors.As(err, &he) && he.RetryAfter > wait {
+			wait = min(he.RetryAfter, maxLaunchRetryDelay)
+		}
+		logx.Warningf("Launching %s from %s failed (%v); retrying the same launch in %s.", agent, parent, err, wait)
+		if serr := sleepCtx(ctx, wait); serr != nil {
+			break
+		}
+		retried = true
+	}
+	if err != nil && retried {
+		err = retriedError{err}
+	}
+	return explored, retried, err
+}
@@ -0,0 +1,118 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+func TestTransientLaunchError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"503", MCPHTTPError{Status: http.StatusServiceUnavailable}, true},
+		{"429", MCPHTTPError{Status: http.StatusTooManyRequests}, true},
+		{"transport", context.DeadlineExceeded, true},
+		{"rate limited tool error", MCPToolError{Result: map[string]any{"isError": true, "error": "Rate limit exceeded"}}, true},
+		{"500", MCPHTTPError{Status: http.StatusInternalServerError}, false},
+		{"invalid params", MCPHTTPError{Status: http.StatusBadRequest}, false},
+		{"auth", MCPHTTPError{Status: http.StatusUnauthorized}, false},
+		{"open circuit", fmt.Errorf("parallel_explore: %w", ErrMCPUnavailable), false},
+		{"rejected prompt", MCPToolError{Result: map[string]any{"isError": true, "error": "prompt too long"}}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := transientLaunchError(c.err); got != c.want {
+				t.Errorf("transientLaunchError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+// flakyExplore makes parallel_explore fail with errs in turn and then
+// launch branch id, which succeeds on its first poll. The returned func
+// lists the arguments of every attempt so far.
+func flakyExplore(srv *mcptest.FakeServer, id string, errs ...error) func() []map[string]any {
+	var mu sync.Mutex
+	var attempts []map[string]any
+	srv.ScriptBranch(id, "succeed")
+	srv.Handle("parallel_explore", func(args map[string]any) (map[string]any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, args)
+		if n := len(attempts); n <= len(errs) {
+			return nil, errs[n-1]
+		}
+		return map[string]any{"branches": []any{map[string]any{"branch_id": id, "status": "pending"}}}, nil
+	})
+	return func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts
+	}
+}
+
+func TestExecuteAgentLaunchRetry(t *testing.T) {
+	const id = "b-retry"
+	rateLimited := errors.New("Rate limit exceeded")
+	launchArgs := map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent}
+
+	t.Run("retried success", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+		audit, err := NewAuditLog(auditPath, "run-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.SetAuditLog(audit)
+		attempts := flakyExplore(srv, id, rateLimited)
+		data := mustSucceed(t, callTool(h, "execute_agent", launchArgs))
+		audit.Close()
+		if data["branch_id"] != id || data["retried"] != true {
+			t.Errorf("data = %v, want branch %s marked retried", data, id)
+		}
+		got := attempts()
+		if len(got) != 2 {
+			t.Fatalf("%d launch attempts, want 2", len(got))
+		}
+		if !reflect.DeepEqual(got[0], got[1]) || got[0]["idempotency_key"] == nil {
+			t.Errorf("attempts differ:\n%v\n%v\nwant identical arguments with one idempotency key", got[0], got[1])
+		}
+		if entries := readJSONL(t, auditPath); len(entries) != 1 || entries[0]["retried"] != true {
+			t.Errorf("audit entries = %v, want one marked retried", entries)
+		}
+	})
+
+	t.Run("retried failure", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		attempts := flakyExplore(srv, id, rateLimited, rateLimited)
+		code, details := mustFail(t, callTool(h, "execute_agent", launchArgs))
+		if code != CodeToolFailed || details["retried"] != true {
+			t.Errorf("code %s, details %v; want %s marked retried", code, details, CodeToolFailed)
+		}
+		if n := len(attempts()); n != launchAttempts {
+			t.Errorf("%d launch attempts, want %d", n, launchAttempts)
+		}
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		attempts := flakyExplore(srv, id, errors.New("prompt too long"))
+		_, details := mustFail(t, callTool(h, "execute_agent", launchArgs))
+		if details["retried"] != nil {
+			t.Errorf("details = %v, want no retry", details)
+		}
+		if n := len(attempts()); n != 1 {
+			t.Errorf("%d launch attempts, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package tools
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+const (
+	// defaultLogTailLines is how many log lines branch_logs returns when the
+	// model does not ask for a specific number.
+	defaultLogTailLines = 200
+	// failureLogTailLines is the tail attached to failed check_status results.
+	failureLogTailLines = 100
+	// maxBranchLogBytes bounds the log text handed to the model; the end of
+	// the log is kept because that is where the failure is.
+	maxBranchLogBytes = 16000
+)
+
+// ansiEscape matches CSI sequences (colours, cursor movement) and OSC
+// sequences (terminal titles, hyperlinks).
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// BranchLogs returns the last tailLines lines of the agent's stdout/stderr
+// for a branch; tailLines <= 0 leaves the count to the server.
+func (c *MCPClient) BranchLogs(ctx context.Context, branchID string, tailLines int) (map[string]any, error) {
+	args := map[string]any{"branch_id": branchID}
+	if tailLines > 0 {
+		args["tail_lines"] = tailLines
+	}
+	return c.CallTool(ctx, "branch_logs", args)
+}
+
+func (h *ToolHandler) branchLogs(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	lines := defaultLogTailLines
+	if n, ok, err := intArg(arguments, "tail_lines"); err != nil {
+		return nil, err
+	} else if ok && n > 0 {
+		lines = n
+	}
+	logx.Infof("Fetching the last %d log lines of branch %s", lines, branchID)
+	return h.logTail(ctx, branchID, lines)
+}
+
+// logTail fetches a branch's log and reduces it to clean, bounded text.
+func (h *ToolHandler) logTail(ctx context.Context, branchID string, lines int) (map[string]any, error) {
+	res, err := h.client.BranchLogs(ctx, branchID, lines)
+	if err != nil {
+		return nil, err
+	}
+	if err := toolFailed("branch_logs", res); err != nil {
+		return nil, err
+	}
+	text, truncated := cleanLog(logText(res), lines)
+	return map[string]any{
+		"branch_id": branchID,
+		"logs":      text,
+		"truncated": truncated,
+	}, nil
+}
+
+// failureLogTail is attached to failed check_status results so the model
+// learns why a run failed even when it wrote no worklog. It is best effort:
+// servers without branch_logs simply yield nothing.
+func (h *ToolHandler) failureLogTail(ctx context.Context, branchID string) (string, bool) {
+	res, err := h.logTail(ctx, branchID, failureLogTailLines)
+	if err != nil {
+		logx.Debugf("Could not fetch logs of failed branch %s: %v", branchID, err)
+		return "", false
+	}
+	text, _ := res["logs"].(string)
+	return text, text != ""
+}
+
+// logText pulls the log text out of a branch_logs result. Servers return it
+// as a string field, as a list of lines, or as bare content text.
+func logText(res map[string]any) string {
+	for _, k := range []string{"logs", "log", "output", "lines", "text"} {
+		switch v := res[k].(type) {
+		case string:
+			return v
+		case []any:
+			parts := make([]string, 0, len(v))
+			for _, line := range v {
+				if s, ok := line.(string); ok {
+					parts = append(parts, s)
+				}
+			}
+			return strings.Join(parts, "\n")
+		}
+	}
+	return ""
+}
+
+// cleanLog strips ANSI escapes and carriage-return redraws, then keeps the
+// last lines lines and at most maxBranchLogBytes.
+func cleanLog(text string, lines int) (string, bool) {
+	text = ansiEscape.ReplaceAllString(text, "")
+	all := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range all {
+		// Progress bars redraw with \r; only the final state is readable.
+		if j := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); j >= 0 {
+			line = line[j+1:]
+		}
+		all[i] = strings.TrimRight(line, "\r")
+	}
+	truncated := false
+	if lines > 0 && len(all) > lines {
+		all = all[len(all)-lines:]
+		truncated = true
+	}
+	text = strings.Join(all, "\n")
+	if len(text) > maxBranchLogBytes {
+		text = text[len(text)-maxBranchLogBytes:]
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		}
+		truncated = true
+	}
+	return text, truncated
+}
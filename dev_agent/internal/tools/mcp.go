@@ -4,59 +4,431 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"dev_agent/internal/logx"
 )
 
-type MCPError struct{ Msg string }
+// MCPError is a classified MCP failure; call wraps every failure it
+// recognises in one. Err is the underlying error, if any.
+type MCPError struct {
+	Kind ErrorKind
+	Msg  string
+	Err  error
+	// RequestID is the X-Request-Id of the failed call, also quoted in Msg.
+	RequestID string
+}
 
 func (e MCPError) Error() string { return e.Msg }
 
+func (e MCPError) Unwrap() error { return e.Err }
+
+// IsRetryable reports whether the failure may go away on another attempt.
+func (e MCPError) IsRetryable() bool { return e.Kind.Retryable() }
+
+// MCPHTTPError is a non-2xx MCP response. RetryAfter is the server's
+// Retry-After hint, zero when absent.
+type MCPHTTPError struct {
+	Status     int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e MCPHTTPError) Error() string {
+	if e.Status == http.StatusUnauthorized {
+		return fmt.Sprintf("MCP authentication failed (HTTP 401; check MCP_API_TOKEN): %s", e.Body)
+	}
+	return fmt.Sprintf("MCP HTTP %d: %s", e.Status, e.Body)
+}
+
+// Retryable reports whether repeating the request could succeed. Client
+// errors such as a bad request, bad credentials or an unknown endpoint fail
+// the same way every time.
+func (e MCPHTTPError) Retryable() bool {
+	switch e.Status {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed:
+		return false
+	}
+	return true
+}
+
+// JSON-RPC error codes with a defined meaning.
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+// MCPRPCError is a JSON-RPC error object returned by the server.
+type MCPRPCError struct {
+	Code    int
+	Message string
+	Data    any
+}
+
+func (e MCPRPCError) Error() string {
+	return fmt.Sprintf("MCP JSON-RPC error %d: %s", e.Code, e.Message)
+}
+
+// Retryable reports whether the same request could succeed later. Malformed
+// requests and bad parameters need different arguments, not another try,
+// and a missing branch or file stays missing.
+func (e MCPRPCError) Retryable() bool {
+	return !e.malformed() && !mentionsNotFound(e.Message)
+}
+
+// malformed reports whether the server rejected the request itself.
+func (e MCPRPCError) malformed() bool {
+	switch e.Code {
+	case RPCParseError, RPCInvalidRequest, RPCMethodNotFound, RPCInvalidParams:
+		return true
+	}
+	return false
+}
+
+func parseRPCError(v any) (MCPRPCError, bool) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return MCPRPCError{}, false
+	}
+	code, _ := m["code"].(float64)
+	msg, _ := m["message"].(string)
+	return MCPRPCError{Code: int(code), Message: msg, Data: m["data"]}, true
+}
+
+// mcpProtocolVersion is the MCP revision announced in initialize and sent as
+// MCP-Protocol-Version until the server names the one it chose.
+const mcpProtocolVersion = "2025-03-26"
+
+// clientName identifies dev_agent in the initialize handshake.
+const clientName = "dev_agent"
+
+// defaultUserAgent is sent when MCPClientOptions.UserAgent is empty.
+const defaultUserAgent = "dev-agent-go"
+
+// MCPClientOptions tunes retry behaviour. Zero fields take the defaults.
+type MCPClientOptions struct {
+	// MaxRetries is the total number of attempts per call.
+	MaxRetries int
+	// BaseBackoff and MaxBackoff bound the full-jitter exponential backoff
+	// between attempts.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// APIToken, when set, is sent as "Authorization: Bearer <token>".
+	APIToken string
+	// TLS replaces the default TLS settings, e.g. for a private CA.
+	TLS *tls.Config
+	// Transport replaces the built-in HTTP/SSE transport, e.g. with a
+	// StdioTransport. HTTP-only options are then ignored.
+	Transport MCPTransport
+	// WireLog, when set, records every request and response.
+	WireLog *WireLog
+	// BreakerThreshold consecutive transport failures open the circuit for
+	// BreakerCooldown, during which calls fail fast with ErrMCPUnavailable.
+	// Zero values pick 5 failures and 30s; a negative threshold disables it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// MaxRPS caps requests per second across the client; MethodRPS sets
+	// tighter caps per tool ("get_branch") or method ("tools/list"). Zero
+	// means unlimited.
+	MaxRPS    float64
+	MethodRPS map[string]float64
+	// UserAgent is sent with every HTTP request; empty means "dev-agent-go".
+	UserAgent string
+	// SkipArgValidation turns off the client-side check of tools/call
+	// arguments against the inputSchemas from tools/list, for servers that
+	// publish incomplete schemas.
+	SkipArgValidation bool
+	// GzipRequests compresses request bodies of 1KB or more. Responses are
+	// always accepted gzipped.
+	GzipRequests bool
+	// MaxResponseBytes bounds a reply decoded in memory; bigger replies are
+	// streamed to a file under SpillDir and returned as its path and size.
+	// Zero picks 32MB; negative disables the limit. SpillDir defaults to
+	// dev_agent_responses under the system temp dir.
+	MaxResponseBytes int64
+	SpillDir         string
+	// Proxy overrides the HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment.
+	Proxy *url.URL
+	// Transport tuning; zero values keep net/http's defaults.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// DialTimeout bounds connecting (30s), TLSHandshakeTimeout the
+	// handshake (10s) and ResponseHeaderTimeout the wait for the reply's
+	// headers once the request is sent (none). They fail with an
+	// MCPTimeoutError naming the phase; the per-call deadline covers the
+	// whole exchange on top of them.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+const (
+	defaultMaxRetries  = 3
+	defaultBaseBackoff = time.Second
+	defaultMaxBackoff  = 8 * time.Second
+	// maxRetryAfter caps a server's Retry-After so a bogus value cannot
+	// stall the run.
+	maxRetryAfter = 2 * time.Minute
+)
+
+// MCPClient speaks JSON-RPC to the Pantheon MCP server. It is safe for
+// concurrent use; requests sent at once share the session, the rate limiter
+// and the circuit breaker.
 type MCPClient struct {
-	rpcURL     string
-	timeout    time.Duration
-	maxRetries int
-	sessionID  string
-	client     *http.Client
-	requestID  int
+	rpcURL       string
+	timeout      time.Duration
+	maxRetries   int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	apiToken     string
+	wireLog      *WireLog
+	transport    MCPTransport
+	metrics      clientMetrics
+	breaker      breaker
+	limiter      *rateLimiter
+	gzipRequests bool
+	maxResponse  int64
+	spillDir     string
+	// skipArgCheck disables checkServerArgs.
+	skipArgCheck bool
+	userAgent    string
+	// dialTimeout, tlsTimeout and headerTimeout are the effective
+	// transport timeouts, quoted in MCPTimeoutError.
+	dialTimeout   time.Duration
+	tlsTimeout    time.Duration
+	headerTimeout time.Duration
+	client        *http.Client
+
+	// initMu serializes the initialize handshake; mu guards the session
+	// state it produces, requestID and runID. sessionID starts as a local
+	// fallback for servers that do not assign one.
+	initMu        sync.Mutex
+	mu            sync.Mutex
+	requestID     int
+	runID         string
+	initialized   bool
+	sessionID     string
+	serverSession bool
+	// protocolVersion is the revision the server chose in initialize.
+	protocolVersion string
+	onProgress      ProgressFunc
+	// batchUnsupported is set once the server mishandles a batch.
+	batchUnsupported bool
+	// spilled lists the reply files to remove on Close.
+	spilled []string
+	// schemas are the tool inputSchemas from the last complete tools/list.
+	schemas map[string]map[string]any
 }
 
 func NewMCPClient(baseURL string) *MCPClient {
+	return NewMCPClientWithOptions(baseURL, MCPClientOptions{})
+}
+
+func NewMCPClientWithOptions(baseURL string, opts MCPClientOptions) *MCPClient {
 	base := strings.TrimRight(baseURL, "/")
 	if base == "" {
 		base = "http://localhost:8000/mcp/sse"
 	}
-	return &MCPClient{
-		rpcURL:     base,
-		timeout:    30 * time.Second,
-		maxRetries: 3,
-		sessionID:  fmt.Sprintf("%d", time.Now().UnixNano()),
-		client:     &http.Client{},
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = defaultBaseBackoff
+	}
+	if opts.MaxBackoff < opts.BaseBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.BaseBackoff)
+	}
+	c := &MCPClient{
+		rpcURL:        base,
+		timeout:       30 * time.Second,
+		maxRetries:    opts.MaxRetries,
+		baseBackoff:   opts.BaseBackoff,
+		maxBackoff:    opts.MaxBackoff,
+		apiToken:      opts.APIToken,
+		wireLog:       opts.WireLog,
+		gzipRequests:  opts.GzipRequests,
+		maxResponse:   opts.MaxResponseBytes,
+		spillDir:      opts.SpillDir,
+		skipArgCheck:  opts.SkipArgValidation,
+		userAgent:     opts.UserAgent,
+		dialTimeout:   opts.DialTimeout,
+		tlsTimeout:    opts.TLSHandshakeTimeout,
+		headerTimeout: opts.ResponseHeaderTimeout,
+		limiter:       newRateLimiter(opts.MaxRPS, opts.MethodRPS),
+		sessionID:     fmt.Sprintf("%d", time.Now().UnixNano()),
+		client:        newHTTPClient(opts),
+	}
+	if c.maxResponse == 0 {
+		c.maxResponse = defaultMaxResponseBytes
+	}
+	if c.spillDir == "" {
+		c.spillDir = defaultSpillDir()
 	}
+	if c.userAgent == "" {
+		c.userAgent = defaultUserAgent
+	}
+	if c.dialTimeout <= 0 {
+		c.dialTimeout = defaultDialTimeout
+	}
+	if c.tlsTimeout <= 0 {
+		c.tlsTimeout = defaultTLSHandshakeTimeout
+	}
+	c.breaker.threshold, c.breaker.cooldown = opts.BreakerThreshold, opts.BreakerCooldown
+	if c.breaker.threshold == 0 {
+		c.breaker.threshold = defaultBreakerThreshold
+	}
+	if c.breaker.cooldown <= 0 {
+		c.breaker.cooldown = defaultBreakerCooldown
+	}
+	c.transport = opts.Transport
+	if c.transport == nil {
+		c.transport = httpTransport{c}
+	}
+	return c
+}
+
+// newHTTPClient deliberately sets no client-wide Timeout: every request
+// carries its own deadline from rpcPost, and a global limit would cut off
+// the long get_branch calls.
+func newHTTPClient(opts MCPClientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.Proxy != nil {
+		transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+	if opts.TLS != nil {
+		transport.TLSClientConfig = opts.TLS
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		transport.MaxIdleConns = max(transport.MaxIdleConns, opts.MaxIdleConnsPerHost)
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if opts.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	if opts.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	}
+	return &http.Client{Transport: transport}
 }
 
-func (c *MCPClient) rpcPost(url string, body map[string]any, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+// Close flushes the wire log, removes spilled replies and shuts down the
+// transport when it holds resources such as a subprocess.
+func (c *MCPClient) Close() error {
+	c.removeSpills()
+	if closer, ok := c.transport.(io.Closer); ok {
+		closer.Close()
+	}
+	return c.wireLog.Close()
+}
+
+// Metrics returns a snapshot of the per-method call counters.
+func (c *MCPClient) Metrics() map[string]MethodMetrics { return c.metrics.snapshot() }
+
+// SetRunID sends id as X-Run-Id on every request for server-side correlation.
+func (c *MCPClient) SetRunID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runID = id
+}
+
+func (c *MCPClient) currentRunID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.runID
+}
+
+// nextRequestID numbers JSON-RPC requests; calls may be sent concurrently.
+func (c *MCPClient) nextRequestID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requestID++
+	return c.requestID
+}
+
+// rpcPost sends one request. timeout bounds the whole exchange, including
+// reading a streamed body, and falls back to the client default when zero.
+// The caller must invoke the returned cancel once done with the body. body
+// is a single message or, for CallBatch, a slice of them.
+func (c *MCPClient) rpcPost(ctx context.Context, url string, body any, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
 	payload, _ := json.Marshal(body)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	compressed := c.gzipRequests && len(payload) >= gzipMinBytes
+	if compressed {
+		payload = gzipRequestBody(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
 	if err != nil {
 		return nil, nil, err
 	}
 	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Mcp-Session-Id", c.sessionID)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	msg, _ := body.(map[string]any)
+	c.setHeaders(req, msg["method"] != "initialize")
+	if key := idempotencyKeyOf(msg); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return c.do(ctx, req, timeout)
+}
 
+// setHeaders adds the headers every request to the server carries: the
+// session and negotiated protocol version (unless the request opens the
+// session), request and run ids, User-Agent and credentials.
+func (c *MCPClient) setHeaders(req *http.Request, withSession bool) {
+	req.Header.Set("User-Agent", c.userAgent)
+	if id := requestIDFrom(req.Context()); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	if withSession {
+		if sid := c.session(); sid != "" {
+			req.Header.Set("Mcp-Session-Id", sid)
+		}
+		req.Header.Set("MCP-Protocol-Version", c.negotiatedVersion())
+	}
+	if runID := c.currentRunID(); runID != "" {
+		req.Header.Set("X-Run-Id", runID)
+	}
+	if c.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	}
+}
+
+// do sends req under timeout (the client default when zero) and decodes the
+// body's content encoding. The caller must invoke cancel once done with the
+// body.
+func (c *MCPClient) do(ctx context.Context, req *http.Request, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
 	effectiveTimeout := timeout
 	if effectiveTimeout <= 0 {
 		effectiveTimeout = c.timeout
 	}
 
-	ctx := context.Background()
 	var cancel context.CancelFunc
 	if effectiveTimeout > 0 {
 		ctx, cancel = context.WithTimeout(ctx, effectiveTimeout)
@@ -66,125 +438,766 @@ func (c *MCPClient) rpcPost(url string, body map[string]any, timeout time.Durati
 	req = req.WithContext(ctx)
 
 	resp, err := c.client.Do(req)
+	if err == nil {
+		if err = decodeResponseBody(resp); err != nil {
+			resp.Body.Close()
+		}
+	}
 	if err != nil {
+		if ctx.Err() == nil {
+			err = c.transportTimeout(err)
+		}
 		cancel()
 		return nil, nil, err
 	}
 	return resp, cancel, nil
 }
 
-func (c *MCPClient) call(method string, params map[string]any, timeout time.Duration) (map[string]any, error) {
-	c.requestID++
+func (c *MCPClient) session() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionID
+}
+
+func (c *MCPClient) negotiatedVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocolVersion != "" {
+		return c.protocolVersion
+	}
+	return mcpProtocolVersion
+}
+
+// ensureInitialized performs the MCP initialize handshake once: initialize,
+// adopt the server's Mcp-Session-Id, then notifications/initialized. Servers
+// that answer "method not found" predate the handshake and are used as-is.
+func (c *MCPClient) ensureInitialized(ctx context.Context) error {
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	c.mu.Lock()
+	done := c.initialized
+	c.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	res, err := c.send(ctx, "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": clientName, "version": "0"},
+	}, c.timeout)
+	var rpcErr MCPRPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == RPCMethodNotFound {
+		logx.Debugf("MCP server does not implement initialize; skipping handshake")
+	} else if err != nil {
+		return fmt.Errorf("MCP initialize failed: %w", err)
+	} else {
+		if v, _ := res["protocolVersion"].(string); v != "" {
+			c.mu.Lock()
+			c.protocolVersion = v
+			c.mu.Unlock()
+		}
+		resp, cancel, err := c.rpcPost(ctx, c.rpcURL, map[string]any{"jsonrpc": "2.0", "method": "notifications/initialized"}, c.timeout)
+		if err != nil {
+			return fmt.Errorf("MCP initialized notification failed: %w", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		cancel()
+	}
+
+	c.mu.Lock()
+	c.initialized = true
+	c.mu.Unlock()
+	return nil
+}
+
+// maxSessionReinits bounds how often one call re-runs the handshake after
+// the server reports the session gone, so a broken server cannot loop us.
+const maxSessionReinits = 2
+
+// call sends method through the configured transport; timeout bounds each
+// attempt.
+func (c *MCPClient) call(ctx context.Context, method string, params map[string]any, timeout time.Duration) (map[string]any, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	reqID := newUUID()
+	ctx = withRequestID(withNotify(withCallTimeout(ctx, timeout), c.handleNotification), reqID)
+	res, err := c.transport.Call(ctx, method, params)
+	c.metrics.observe(metricKey(method, params), time.Since(start), err)
+	c.breaker.record(err)
+	return res, classify(err, reqID)
+}
+
+// httpTransport is the streamable HTTP/SSE transport built into MCPClient.
+type httpTransport struct{ c *MCPClient }
+
+// Call runs method after the handshake. When the server reports the session
+// expired, the handshake is redone and the request replayed.
+func (t httpTransport) Call(ctx context.Context, method string, params map[string]any) (map[string]any, error) {
+	c := t.c
+	timeout := callTimeout(ctx, c.timeout)
+	for reinit := 0; ; reinit++ {
+		if err := c.ensureInitialized(ctx); err != nil {
+			return nil, err
+		}
+		res, err := c.send(ctx, method, params, timeout)
+		if err == nil || !c.sessionExpired(err) {
+			return res, err
+		}
+		if reinit == maxSessionReinits {
+			return nil, MCPError{Kind: KindSessionExpired, Msg: fmt.Sprintf("MCP session still rejected after %d re-initializations: %v", reinit, err), Err: err}
+		}
+		c.expireSession()
+		logx.Warningf("MCP session expired; re-initializing before retrying %s", method)
+	}
+}
+
+// sessionExpired recognizes the server rejecting our session: a 404 on a
+// server-assigned session (what the spec prescribes), or any 400/404 or
+// JSON-RPC error whose message says the session is unknown or expired.
+func (c *MCPClient) sessionExpired(err error) bool {
+	var he MCPHTTPError
+	if errors.As(err, &he) {
+		if he.Status == http.StatusNotFound && c.hasServerSession() {
+			return true
+		}
+		return (he.Status == http.StatusNotFound || he.Status == http.StatusBadRequest) && mentionsBadSession(he.Body)
+	}
+	var re MCPRPCError
+	if errors.As(err, &re) {
+		return mentionsBadSession(re.Message)
+	}
+	return false
+}
+
+func mentionsBadSession(msg string) bool {
+	msg = strings.ToLower(msg)
+	if !strings.Contains(msg, "session") {
+		return false
+	}
+	for _, w := range []string{"expired", "not found", "unknown", "invalid", "no valid"} {
+		if strings.Contains(msg, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireSession drops the current session, minting a fresh local fallback
+// id, so the next call performs the handshake again.
+func (c *MCPClient) expireSession() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.initialized = false
+	c.serverSession = false
+	c.sessionID = fmt.Sprintf("%d", time.Now().UnixNano())
+}
+
+func (c *MCPClient) hasServerSession() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverSession
+}
+
+func (c *MCPClient) send(ctx context.Context, method string, params map[string]any, timeout time.Duration) (map[string]any, error) {
 	payload := map[string]any{
 		"jsonrpc": "2.0",
-		"id":      c.requestID,
+		"id":      c.nextRequestID(),
 		"method":  method,
 		"params":  params,
 	}
 	var lastErr error
 
 	for attempt := 0; attempt < c.maxRetries; attempt++ {
-		logx.Debugf("MCP POST %s attempt %d to %s", method, attempt+1, c.rpcURL)
-		resp, cancel, err := c.rpcPost(c.rpcURL, payload, timeout)
-		if err != nil {
-			lastErr = err
-		} else {
-			ct := resp.Header.Get("Content-Type")
-			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-				body, _ := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				cancel()
-				logx.Errorf("MCP HTTP error %d for %s (CT=%s): %.500s", resp.StatusCode, method, ct, string(body))
-				lastErr = fmt.Errorf("MCP HTTP %d: %s", resp.StatusCode, string(body))
-			} else if strings.Contains(ct, "text/event-stream") {
-				data, preview, err := parseSSEStream(resp.Body)
-				resp.Body.Close()
-				cancel()
-				if preview != "" {
-					logx.Debugf("MCP SSE preview: %q", preview)
-				}
-				if err != nil {
-					logx.Errorf("Failed to parse SSE JSON for %s. Content-Type: %s, Status: %d (%v)", method, ct, resp.StatusCode, err)
-					lastErr = err
-				} else {
-					var obj map[string]any
-					if err := json.Unmarshal(data, &obj); err != nil {
-						logx.Errorf("MCP SSE payload not JSON (status %d, CT=%s). Preview: %.200s", resp.StatusCode, ct, string(data[:min(200, len(data))]))
-						lastErr = err
-					} else {
-						return normalizeRPC(obj), nil
-					}
-				}
-			} else {
-				data, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				cancel()
-				if err != nil {
-					logx.Errorf("Failed reading MCP response body for %s: %v (bytes=%d)", method, err, len(data))
-					lastErr = err
-					continue
-				}
-				var obj map[string]any
-				if err := json.Unmarshal(data, &obj); err != nil {
-					logx.Errorf("MCP response not JSON (status %d, CT=%s). First 1000 bytes: %q", resp.StatusCode, ct, string(data[:min(1000, len(data))]))
-					lastErr = err
-				} else {
-					return normalizeRPC(obj), nil
+		if err := c.limiter.wait(ctx, metricKey(method, params)); err != nil {
+			return nil, err
+		}
+		logx.Debugf("MCP POST %s attempt %d to %s", callLabel(ctx, method), attempt+1, c.rpcURL)
+		res, err := c.attempt(ctx, method, payload, timeout)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+		var he MCPHTTPError
+		if errors.As(err, &he) && he.Status == http.StatusTooManyRequests {
+			c.limiter.pause(max(he.RetryAfter, c.baseBackoff))
+		}
+		if !isRetryable(err) {
+			// A mutation whose reply was lost may still have taken effect.
+			if guard := retryGuardFrom(ctx); guard != nil && errors.Is(err, ErrResultUnknown) {
+				if res, done := guard(ctx); done {
+					return res, nil
 				}
 			}
+			return nil, err
 		}
 		if attempt < c.maxRetries-1 {
-			wait := time.Duration(1<<attempt) * time.Second
-			logx.Warningf("MCP call %s failed (attempt %d/%d): %v. Retrying in %ds...", method, attempt+1, c.maxRetries, lastErr, int(wait.Seconds()))
-			time.Sleep(wait)
+			if guard := retryGuardFrom(ctx); guard != nil {
+				if res, done := guard(ctx); done {
+					return res, nil
+				}
+			}
+			c.metrics.retry(metricKey(method, params))
+			wait := c.backoff(attempt, lastErr)
+			logx.Warningf("MCP call %s failed (attempt %d/%d): %v. Retrying in %.1fs...", callLabel(ctx, method), attempt+1, c.maxRetries, lastErr, wait.Seconds())
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
 		}
 	}
 	if lastErr == nil {
-		lastErr = MCPError{Msg: "Unknown MCP error"}
+		lastErr = MCPError{Kind: KindTransport, Msg: "Unknown MCP error"}
 	}
 	return nil, lastErr
 }
 
-func normalizeRPC(obj map[string]any) map[string]any {
-	if errVal, ok := obj["error"]; ok {
-		_ = errVal
-		return obj
+// attempt performs one POST and decodes the reply. The body is always
+// drained and closed before returning so the connection goes back to the
+// pool, whatever the outcome.
+func (c *MCPClient) attempt(ctx context.Context, method string, payload map[string]any, timeout time.Duration) (res map[string]any, err error) {
+	entry := wireEntry{Time: time.Now(), Method: method, RequestID: payload["id"], Params: payload["params"], Headers: c.wireHeaders(ctx, method)}
+	var body []byte
+	defer func() {
+		if c.wireLog == nil {
+			return
+		}
+		entry.DurationMS = time.Since(entry.Time).Milliseconds()
+		entry.Body = string(body)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		c.wireLog.record(entry)
+	}()
+
+	// sent records that the request was written, after which a failure
+	// leaves its effect unknown.
+	var sent atomic.Bool
+	defer func() {
+		if err != nil && sent.Load() {
+			err = lostReply(ctx, method, payload["params"], err)
+		}
+	}()
+	traced := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				sent.Store(true)
+			}
+		},
+	})
+	resp, cancel, err := c.rpcPost(traced, c.rpcURL, payload, timeout)
+	if err != nil {
+		return nil, err
+	}
+	entry.Status = resp.StatusCode
+	defer cancel()
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if sid := resp.Header.Get("Mcp-Session-Id"); sid != "" && method == "initialize" {
+		c.mu.Lock()
+		c.sessionID, c.serverSession = sid, true
+		c.mu.Unlock()
+	}
+	ct := resp.Header.Get("Content-Type")
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ = io.ReadAll(resp.Body)
+		logx.Errorf("MCP HTTP error %d for %s (CT=%s): %s", resp.StatusCode, callLabel(ctx, method), ct, logx.Truncate(string(body), 500))
+		return nil, MCPHTTPError{Status: resp.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
+
+	var data []byte
+	if strings.Contains(ct, "text/event-stream") {
+		data, err = c.readSSE(ctx, method, payload, resp.Body, timeout)
+		if err != nil {
+			logx.Errorf("Failed to parse SSE JSON for %s. Content-Type: %s, Status: %d (%v)", callLabel(ctx, method), ct, resp.StatusCode, err)
+			return nil, err
+		}
+	} else {
+		var spilled map[string]any
+		data, spilled, err = c.readBody(callLabel(ctx, method), resp.Body)
+		if err != nil {
+			logx.Errorf("Failed reading MCP response body for %s: %v (bytes=%d)", callLabel(ctx, method), err, len(data))
+			return nil, err
+		}
+		if spilled != nil {
+			body = []byte(toJSON(spilled))
+			return spilled, nil
+		}
+	}
+	body = data
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		logx.Errorf("MCP %s response not JSON (status %d, CT=%s). Preview: %q", callLabel(ctx, method), resp.StatusCode, ct, logx.Truncate(string(data), 1000))
+		return nil, err
+	}
+	if rpcErr, ok := parseRPCError(obj["error"]); ok {
+		logx.Warningf("MCP %s returned JSON-RPC error %d: %s", callLabel(ctx, method), rpcErr.Code, rpcErr.Message)
+		return nil, rpcErr
+	}
+	return normalizeRPC(obj), nil
+}
+
+// wireHeaders are the request headers worth logging; credentials appear only
+// as a marker.
+func (c *MCPClient) wireHeaders(ctx context.Context, method string) map[string]any {
+	h := map[string]any{"User-Agent": c.userAgent}
+	if id := requestIDFrom(ctx); id != "" {
+		h["X-Request-Id"] = id
+	}
+	if method != "initialize" {
+		h["Mcp-Session-Id"] = c.session()
+		h["MCP-Protocol-Version"] = c.negotiatedVersion()
+	}
+	if runID := c.currentRunID(); runID != "" {
+		h["X-Run-Id"] = runID
+	}
+	if c.apiToken != "" {
+		h["Authorization"] = "Bearer [REDACTED]"
+	}
+	return h
+}
+
+// backoff picks the wait before the next attempt: the server's Retry-After
+// on 429/503, otherwise full jitter over an exponentially growing window so
+// clients retrying together spread out.
+func (c *MCPClient) backoff(attempt int, err error) time.Duration {
+	var he MCPHTTPError
+	if errors.As(err, &he) && he.RetryAfter > 0 && (he.Status == http.StatusTooManyRequests || he.Status == http.StatusServiceUnavailable) {
+		return min(he.RetryAfter, maxRetryAfter)
+	}
+	window := c.maxBackoff
+	if attempt < 30 {
+		window = min(c.baseBackoff<<attempt, c.maxBackoff)
+	}
+	return time.Duration(mathrand.Int63n(int64(window) + 1))
+}
+
+// parseRetryAfter accepts both Retry-After forms: delay seconds and an HTTP
+// date.
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func normalizeRPC(obj map[string]any) map[string]any {
 	if res, ok := obj["result"].(map[string]any); ok {
-		if sc, ok := res["structuredContent"].(map[string]any); ok {
-			return sc
+		return normalizeToolResult(res)
+	}
+	return obj
+}
+
+// normalizeToolResult unwraps a tools/call result envelope. structuredContent
+// wins when present; otherwise the text items of the spec's content array are
+// concatenated and, when they form a JSON object, decoded into the result.
+// The envelope's isError flag is preserved either way.
+func normalizeToolResult(res map[string]any) map[string]any {
+	isError, _ := res["isError"].(bool)
+	var out map[string]any
+	if sc, ok := res["structuredContent"].(map[string]any); ok {
+		out = sc
+	} else if text, ok := contentText(res["content"]); ok {
+		var parsed map[string]any
+		if err := json.Unmarshal([]byte(strings.TrimSpace(text)), &parsed); err == nil {
+			out = parsed
+		} else {
+			out = make(map[string]any, len(res)+1)
+			for k, v := range res {
+				out[k] = v
+			}
+			out["text"] = text
 		}
+	} else {
 		return res
 	}
-	return obj
+	if isError {
+		if _, ok := out["isError"]; !ok {
+			out["isError"] = true
+		}
+	}
+	return out
+}
+
+// contentText concatenates the text items of an MCP content array.
+func contentText(v any) (string, bool) {
+	items, ok := v.([]any)
+	if !ok {
+		return "", false
+	}
+	var parts []string
+	for _, item := range items {
+		m, _ := item.(map[string]any)
+		if m == nil {
+			continue
+		}
+		if typ, _ := m["type"].(string); typ != "" && typ != "text" {
+			continue
+		}
+		if text, ok := m["text"].(string); ok {
+			parts = append(parts, text)
+		}
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, "\n"), true
+}
+
+// CallTool runs a server tool. Once tools/list has been fetched, arguments
+// are checked against the tool's inputSchema first, so a renamed parameter
+// is reported by name instead of as an invalid-params error from the server.
+func (c *MCPClient) CallTool(ctx context.Context, name string, arguments map[string]any) (map[string]any, error) {
+	return c.callTool(ctx, name, arguments, c.timeout)
+}
+
+func (c *MCPClient) callTool(ctx context.Context, name string, arguments map[string]any, timeout time.Duration) (map[string]any, error) {
+	if schema := c.serverSchema(name); schema != nil && !c.skipArgCheck {
+		if err := checkServerArgs(name, schema, arguments); err != nil {
+			return nil, err
+		}
+	}
+	return c.call(ctx, "tools/call", toolCallParams(ctx, name, arguments), timeout)
+}
+
+// toolCallParams builds tools/call params, asking for progress updates.
+func toolCallParams(ctx context.Context, name string, arguments map[string]any) map[string]any {
+	return map[string]any{"name": name, "arguments": arguments, "_meta": progressMeta(ctx, name)}
 }
 
-func (c *MCPClient) CallTool(name string, arguments map[string]any) (map[string]any, error) {
-	return c.call("tools/call", map[string]any{"name": name, "arguments": arguments}, c.timeout)
+// ServerTool is one entry of the server's tools/list.
+type ServerTool struct {
+	Name        string
+	Description string
+	InputSchema map[string]any
+}
+
+// maxToolPages guards against a server that keeps returning a cursor.
+const maxToolPages = 50
+
+// ListTools returns every tool the server exposes, following nextCursor
+// pagination, and caches their inputSchemas for CallTool.
+func (c *MCPClient) ListTools(ctx context.Context) ([]ServerTool, error) {
+	var out []ServerTool
+	cursor := ""
+	for page := 0; page < maxToolPages; page++ {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		res, err := c.call(ctx, "tools/list", params, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		items, _ := res["tools"].([]any)
+		for _, item := range items {
+			m, _ := item.(map[string]any)
+			name, _ := m["name"].(string)
+			if name == "" {
+				continue
+			}
+			desc, _ := m["description"].(string)
+			schema, _ := m["inputSchema"].(map[string]any)
+			out = append(out, ServerTool{Name: name, Description: desc, InputSchema: schema})
+		}
+		cursor, _ = res["nextCursor"].(string)
+		if cursor == "" {
+			c.cacheSchemas(out)
+			return out, nil
+		}
+	}
+	return nil, MCPError{Msg: fmt.Sprintf("tools/list did not finish after %d pages", maxToolPages)}
 }
 
-func (c *MCPClient) ParallelExplore(projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
-	return c.CallTool("parallel_explore", map[string]any{
+// ParallelExplore launches agent branches from parentBranchID. A single
+// prompt runs on numBranches siblings. Several prompts give each branch its
+// own, so numBranches must equal len(prompts): the server can only replicate
+// one prompt, so each branch is launched separately and Raw holds the
+// replies under "launches". An isError reply stops the launches and is
+// returned as an MCPToolError whose Result lists the ids already launched
+// under "launched_branch_ids".
+func (c *MCPClient) ParallelExplore(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (ExploreResult, error) {
+	if len(prompts) <= 1 {
+		return c.exploreOnce(ctx, projectName, parentBranchID, prompts, agent, numBranches)
+	}
+	if numBranches != len(prompts) {
+		return ExploreResult{}, fmt.Errorf("parallel_explore: %d prompts given for %d branches", len(prompts), numBranches)
+	}
+	var out ExploreResult
+	var launches []any
+	var launched []string
+	for i, prompt := range prompts {
+		lctx := ctx
+		if key, repeat := exploreKeyFrom(ctx); key != "" {
+			lctx = WithExploreKey(ctx, fmt.Sprintf("%s-%d", key, i+1), repeat)
+		}
+		explored, err := c.exploreOnce(lctx, projectName, parentBranchID, []string{prompt}, agent, 1)
+		if err == nil {
+			out.Branches = append(out.Branches, explored.Branches...)
+			for _, b := range explored.Branches {
+				launched = append(launched, b.ID)
+			}
+			launches = append(launches, explored.Raw)
+			continue
+		}
+		var te MCPToolError
+		if errors.As(err, &te) {
+			te.Result["launched_branch_ids"] = launched
+			return ExploreResult{}, te
+		}
+		if len(launched) > 0 {
+			err = fmt.Errorf("launching branch %d of %d (already launched: %s): %w", i+1, len(prompts), strings.Join(launched, ", "), err)
+		}
+		return ExploreResult{}, err
+	}
+	out.Raw = map[string]any{"launches": launches}
+	return out, nil
+}
+
+// exploreOnce makes one parallel_explore call. It carries an idempotency
+// key, fresh unless WithExploreKey set one, reused by the transport's
+// retries, so a server can drop a duplicate launch; for servers that cannot,
+// a retry is skipped when a branch tagged with the key already exists.
+func (c *MCPClient) exploreOnce(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (ExploreResult, error) {
+	key, repeat := exploreKeyFrom(ctx)
+	if key == "" {
+		key = newUUID()
+	}
+	guard := c.exploredBranchGuard(projectName, key)
+	if repeat {
+		if res, done := guard(ctx); done {
+			return DecodeExploreResult(res)
+		}
+	}
+	ctx = withRetryGuard(ctx, guard)
+	res, err := c.CallTool(ctx, "parallel_explore", map[string]any{
 		"project_name":           projectName,
 		"parent_branch_id":       parentBranchID,
 		"shared_prompt_sequence": prompts,
 		"num_branches":           numBranches,
 		"agent":                  agent,
+		"idempotency_key":        key,
 	})
+	if err != nil {
+		return ExploreResult{}, err
+	}
+	if err := toolFailed("parallel_explore", res); err != nil {
+		return ExploreResult{}, err
+	}
+	return DecodeExploreResult(res)
+}
+
+// GetBranch fetches a branch; the reply as sent is in BranchInfo.Raw.
+// waitSeconds > 0 asks servers that support long-polling to hold the reply
+// until the status changes or the wait ends; other servers ignore it and
+// answer at once. A reply without a branch id is a *ResponseSchemaError.
+func (c *MCPClient) GetBranch(ctx context.Context, branchID string, waitSeconds int) (BranchInfo, error) {
+	args := map[string]any{"branch_id": branchID}
+	timeout := 300 * time.Second
+	if waitSeconds > 0 {
+		args["wait_seconds"] = waitSeconds
+		timeout = max(timeout, time.Duration(waitSeconds+30)*time.Second)
+	}
+	res, err := c.callTool(ctx, "get_branch", args, timeout)
+	if err != nil {
+		return BranchInfo{}, err
+	}
+	if err := toolFailed("get_branch", res); err != nil {
+		return BranchInfo{}, err
+	}
+	return DecodeBranch(res)
+}
+
+// ReadFileOptions tunes BranchReadFile. Zero values leave the server
+// defaults: text encoding, whole file.
+type ReadFileOptions struct {
+	// Encoding is EncodingText or EncodingBase64.
+	Encoding string
+	// Offset and MaxBytes request a byte range of the file.
+	Offset   int
+	MaxBytes int
+}
+
+// BranchReadFile reads a file of a branch workspace. A failed read is an
+// MCPToolError carrying the server's reply.
+func (c *MCPClient) BranchReadFile(ctx context.Context, branchID, filePath string, opts ReadFileOptions) (ArtifactContent, error) {
+	res, err := c.CallTool(ctx, "branch_read_file", readFileArgs(branchID, filePath, opts))
+	if err != nil {
+		return ArtifactContent{}, err
+	}
+	return decodeArtifact(res)
+}
+
+func readFileArgs(branchID, filePath string, opts ReadFileOptions) map[string]any {
+	args := map[string]any{"branch_id": branchID, "file_path": filePath}
+	if opts.Encoding != "" {
+		args["encoding"] = opts.Encoding
+	}
+	if opts.Offset > 0 {
+		args["offset"] = opts.Offset
+	}
+	if opts.MaxBytes > 0 {
+		args["max_bytes"] = opts.MaxBytes
+	}
+	return args
+}
+
+// ProjectInfo is one entry of ListProjects.
+type ProjectInfo struct {
+	Name        string
+	Description string
+}
+
+func (c *MCPClient) ListProjects(ctx context.Context) ([]ProjectInfo, error) {
+	res, err := c.CallTool(ctx, "list_projects", map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+	if err := toolFailed("list_projects", res); err != nil {
+		return nil, err
+	}
+	items, _ := res["projects"].([]any)
+	if items == nil {
+		items, _ = res["items"].([]any)
+	}
+	out := make([]ProjectInfo, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			out = append(out, ProjectInfo{Name: v})
+		case map[string]any:
+			if name := firstString(v, "name", "project_name"); name != "" {
+				out = append(out, ProjectInfo{Name: name, Description: firstString(v, "description")})
+			}
+		}
+	}
+	return out, nil
+}
+
+func (c *MCPClient) GetProject(ctx context.Context, name string) (map[string]any, error) {
+	return c.CallTool(ctx, "get_project", map[string]any{"project_name": name})
+}
+
+// ListBranches returns one page of a project's branches and the cursor for
+// the next page ("" on the last page). limit <= 0 leaves the page size to
+// the server.
+func (c *MCPClient) ListBranches(ctx context.Context, projectName, cursor string, limit int) ([]BranchInfo, string, error) {
+	args := map[string]any{"project_name": projectName}
+	if cursor != "" {
+		args["cursor"] = cursor
+	}
+	if limit > 0 {
+		args["limit"] = limit
+	}
+	res, err := c.CallTool(ctx, "list_branches", args)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := toolFailed("list_branches", res); err != nil {
+		return nil, "", err
+	}
+	page := branchPage(res)
+	items, _ := page["branches"].([]any)
+	if items == nil {
+		items, _ = page["items"].([]any)
+	}
+	out := make([]BranchInfo, 0, len(items))
+	for _, item := range items {
+		m, _ := item.(map[string]any)
+		if m == nil {
+			continue
+		}
+		var w branchWire
+		if err := decodeInto(m, &w); err != nil {
+			logx.Debugf("Skipping undecodable list_branches entry: %v", err)
+			continue
+		}
+		b := w.info()
+		b.Raw = m
+		out = append(out, b)
+	}
+	next := firstString(page, "next_cursor", "nextCursor", "cursor")
+	return out, next, nil
+}
+
+// branchPage finds the object holding the branch list: servers return it at
+// the top level or wrapped in result/structuredContent.
+func branchPage(res map[string]any) map[string]any {
+	for _, key := range []string{"result", "structuredContent"} {
+		if nested, ok := res[key].(map[string]any); ok {
+			if _, has := res["branches"]; !has {
+				return branchPage(nested)
+			}
+		}
+	}
+	return res
+}
+
+func firstString(m map[string]any, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := m[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (c *MCPClient) DeleteBranch(ctx context.Context, branchID string) (map[string]any, error) {
+	return c.CallTool(ctx, "delete_branch", map[string]any{"branch_id": branchID})
 }
 
-func (c *MCPClient) GetBranch(branchID string) (map[string]any, error) {
-	return c.call("tools/call", map[string]any{
-		"name":      "get_branch",
-		"arguments": map[string]any{"branch_id": branchID},
-	}, 300*time.Second)
+func (c *MCPClient) BranchWriteFile(ctx context.Context, branchID, filePath, content string) (map[string]any, error) {
+	return c.CallTool(ctx, "branch_write_file", map[string]any{"branch_id": branchID, "file_path": filePath, "content": content})
 }
 
-func (c *MCPClient) BranchReadFile(branchID, filePath string) (map[string]any, error) {
-	return c.CallTool("branch_read_file", map[string]any{"branch_id": branchID, "file_path": filePath})
+// BranchDiff returns the unified diff of a branch against its parent.
+func (c *MCPClient) BranchDiff(ctx context.Context, branchID string) (map[string]any, error) {
+	return c.CallTool(ctx, "branch_diff", map[string]any{"branch_id": branchID})
+}
+
+func (c *MCPClient) CancelBranch(ctx context.Context, branchID string) (map[string]any, error) {
+	return c.CallTool(ctx, "cancel_branch", map[string]any{"branch_id": branchID})
+}
+
+// BranchListFiles lists a directory of a branch workspace; dir "" means the
+// workspace root.
+func (c *MCPClient) BranchListFiles(ctx context.Context, branchID, dir string) (map[string]any, error) {
+	args := map[string]any{"branch_id": branchID}
+	if dir != "" {
+		args["directory"] = dir
+	}
+	return c.CallTool(ctx, "branch_list_files", args)
 }
 
-func parseSSEStream(r io.Reader) ([]byte, string, error) {
+// BranchOutput returns the textual output of an agent run. fullOutput asks
+// the server for the untrimmed output instead of its summary.
+func (c *MCPClient) BranchOutput(ctx context.Context, branchID string, fullOutput bool) (map[string]any, error) {
+	return c.CallTool(ctx, "branch_output", map[string]any{"branch_id": branchID, "full_output": fullOutput})
+}
+
+// parseSSEStream returns the JSON-RPC response whose id equals wantID.
+// Notifications (e.g. notifications/progress) and responses to other ids
+// interleaved in the stream are skipped, as are comment keepalives; objects
+// that are not JSON-RPC messages at all are accepted for servers that send
+// bare results. A stream that breaks or ends after some events but before
+// the response yields an *sseDisconnectError carrying the last event id.
+func parseSSEStream(r io.Reader, wantID any, onNotify func([]byte)) ([]byte, string, error) {
 	scanner := bufio.NewScanner(r)
 	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 
@@ -192,7 +1205,10 @@ func parseSSEStream(r io.Reader) ([]byte, string, error) {
 		current strings.Builder
 		total   strings.Builder
 		preview strings.Builder
+		skipped int
+		eventID string
 	)
+	want, _ := json.Marshal(wantID)
 
 	appendPreview := func(line string) {
 		const maxPreview = 2000
@@ -200,7 +1216,7 @@ func parseSSEStream(r io.Reader) ([]byte, string, error) {
 			return
 		}
 		if preview.Len()+len(line) > maxPreview {
-			line = line[:maxPreview-preview.Len()]
+			line = logx.Truncate(line, maxPreview-preview.Len())
 		}
 		preview.WriteString(line)
 		preview.WriteByte('\n')
@@ -220,18 +1236,52 @@ func parseSSEStream(r io.Reader) ([]byte, string, error) {
 		return nil, false
 	}
 
+	// accept reports whether a decoded event is our response. A skipped
+	// event clears the buffers so it is not decoded again.
+	accept := func(data []byte) bool {
+		var msg struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return true
+		}
+		matched := len(msg.ID) > 0 && bytes.Equal(bytes.TrimSpace(msg.ID), want)
+		bare := len(msg.ID) == 0 && msg.Method == ""
+		if matched || bare {
+			return true
+		}
+		skipped++
+		if msg.Method != "" && onNotify != nil {
+			onNotify(data)
+		}
+		if msg.Method != "" {
+			logx.Debugf("MCP SSE skipped notification %s: %s", msg.Method, logx.Truncate(string(data), 300))
+		} else {
+			logx.Debugf("MCP SSE skipped response for id %s (want %s)", msg.ID, want)
+		}
+		current.Reset()
+		total.Reset()
+		return false
+	}
+
+	decode := func(text string) ([]byte, bool) {
+		data, ok := tryDecode(text)
+		return data, ok && accept(data)
+	}
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		appendPreview(line)
 		line = strings.TrimRight(line, "\r")
 		if line == "" {
 			if current.Len() > 0 {
-				if data, ok := tryDecode(current.String()); ok {
+				if data, ok := decode(current.String()); ok {
 					return data, preview.String(), nil
 				}
 				current.Reset()
 			}
-			if data, ok := tryDecode(total.String()); ok {
+			if data, ok := decode(total.String()); ok {
 				return data, preview.String(), nil
 			}
 			continue
@@ -242,15 +1292,18 @@ func parseSSEStream(r io.Reader) ([]byte, string, error) {
 		if i := strings.Index(line, ":"); i >= 0 {
 			field := strings.TrimSpace(line[:i])
 			value := strings.TrimSpace(line[i+1:])
+			if strings.EqualFold(field, "id") {
+				eventID = value
+			}
 			if strings.EqualFold(field, "data") {
 				current.WriteString(value)
 				current.WriteByte('\n')
 				total.WriteString(value)
 				total.WriteByte('\n')
-				if data, ok := tryDecode(current.String()); ok {
+				if data, ok := decode(current.String()); ok {
 					return data, preview.String(), nil
 				}
-				if data, ok := tryDecode(total.String()); ok {
+				if data, ok := decode(total.String()); ok {
 					return data, preview.String(), nil
 				}
 			}
@@ -258,18 +1311,27 @@ func parseSSEStream(r io.Reader) ([]byte, string, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, preview.String(), err
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, preview.String(), err
+		}
+		return nil, preview.String(), &sseDisconnectError{LastEventID: eventID, Cause: err}
 	}
 	if current.Len() > 0 {
-		if data, ok := tryDecode(current.String()); ok {
+		if data, ok := decode(current.String()); ok {
 			return data, preview.String(), nil
 		}
 	}
 	if total.Len() > 0 {
-		if data, ok := tryDecode(total.String()); ok {
+		if data, ok := decode(total.String()); ok {
 			return data, preview.String(), nil
 		}
 	}
+	if skipped > 0 || eventID != "" {
+		return nil, preview.String(), &sseDisconnectError{
+			LastEventID: eventID,
+			Cause:       fmt.Errorf("SSE stream ended without a response for request id %s (skipped %d notification/other events)", want, skipped),
+		}
+	}
 	if data, err := extractJSONFromText(preview.String()); err == nil {
 		return data, preview.String(), nil
 	}
@@ -296,10 +1358,3 @@ func extractJSONFromText(text string) ([]byte, error) {
 	}
 	return raw, nil
 }
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
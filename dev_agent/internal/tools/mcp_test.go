@@ -0,0 +1,1265 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+func TestNormalizeToolResult(t *testing.T) {
+	text := func(s string) map[string]any { return map[string]any{"type": "text", "text": s} }
+	cases := []struct {
+		name string
+		res  map[string]any
+		want map[string]any
+	}{
+		{
+			"structured only",
+			map[string]any{"structuredContent": map[string]any{"branch_id": "b-1"}},
+			map[string]any{"branch_id": "b-1"},
+		},
+		{
+			"content JSON",
+			map[string]any{"content": []any{text(`{"branch_id": "b-1", "status": "running"}`)}},
+			map[string]any{"branch_id": "b-1", "status": "running"},
+		},
+		{
+			"content JSON split over items",
+			map[string]any{"content": []any{text(`{"branch_id":`), map[string]any{"type": "image", "data": "AAAA"}, text(`"b-1"}`)}},
+			map[string]any{"branch_id": "b-1"},
+		},
+		{
+			"content prose",
+			map[string]any{"content": []any{text("branch created"), text("id b-1")}},
+			map[string]any{"content": []any{text("branch created"), text("id b-1")}, "text": "branch created\nid b-1"},
+		},
+		{
+			"mixed prefers structured",
+			map[string]any{"structuredContent": map[string]any{"branch_id": "b-1"}, "content": []any{text(`{"branch_id": "other"}`)}},
+			map[string]any{"branch_id": "b-1"},
+		},
+		{
+			"isError from envelope",
+			map[string]any{"isError": true, "content": []any{text(`{"error": {"message": "quota exceeded"}}`)}},
+			map[string]any{"error": map[string]any{"message": "quota exceeded"}, "isError": true},
+		},
+		{
+			"isError prose",
+			map[string]any{"isError": true, "content": []any{text("quota exceeded")}},
+			map[string]any{"isError": true, "content": []any{text("quota exceeded")}, "text": "quota exceeded"},
+		},
+		{
+			"no content",
+			map[string]any{"tools": []any{}},
+			map[string]any{"tools": []any{}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := normalizeRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "result": c.res})
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("normalizeRPC = %s, want %s", toJSON(got), toJSON(c.want))
+			}
+		})
+	}
+}
+
+// mcptest answers tools/call with content arrays only, as a spec-compliant
+// server does; the handler must not notice.
+func TestContentOnlyRepliesAreTransparent(t *testing.T) {
+	h, srv := newTestHandler(t)
+	data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement it", "parent_branch_id": testParent}))
+	if data["branch_id"] != fakeBranchID(1) {
+		t.Errorf("branch_id = %v", data["branch_id"])
+	}
+	srv.PutArtifact(fakeBranchID(1), "worklog.md", "done")
+	data = mustSucceed(t, callTool(h, "read_artifact", map[string]any{"branch_id": fakeBranchID(1), "path": "worklog.md"}))
+	if data["content"] != "done" {
+		t.Errorf("read_artifact data = %v", data)
+	}
+}
+
+// handshakeServer is a strict MCP endpoint: tools/call needs the session id
+// it handed out in initialize. It records each request's method and session.
+type handshakeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	log      []string
+	sessions int
+	valid    string
+	// noInit answers initialize with "method not found", like servers that
+	// predate the handshake.
+	noInit bool
+	// rejectAll answers every tools/call with "session not found".
+	rejectAll bool
+	// rpcRejects is how many more tools/call requests get a JSON-RPC
+	// "session expired" error instead of an HTTP one.
+	rpcRejects int
+	// version, when set, is the protocol version initialize answers with.
+	version string
+	// versions records each request's MCP-Protocol-Version header.
+	versions []string
+}
+
+func newHandshakeServer(t *testing.T) *handshakeServer {
+	s := &handshakeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *handshakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     any    `json:"id"`
+		Method string `json:"method"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	sid := r.Header.Get("Mcp-Session-Id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = append(s.log, req.Method+" "+sid)
+	s.versions = append(s.versions, r.Header.Get("MCP-Protocol-Version"))
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case req.Method == "initialize" && s.noInit:
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": RPCMethodNotFound, "message": "method not found"}})
+	case req.Method == "initialize":
+		s.sessions++
+		s.valid = fmt.Sprintf("sess-%d", s.sessions)
+		w.Header().Set("Mcp-Session-Id", s.valid)
+		version := mcpProtocolVersion
+		if s.version != "" {
+			version = s.version
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"protocolVersion": version, "capabilities": map[string]any{}}})
+	case req.ID == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case s.rpcRejects > 0:
+		s.rpcRejects--
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": -32000, "message": "Session expired"}})
+	case s.rejectAll || !s.noInit && sid != s.valid:
+		http.Error(w, "session not found", http.StatusNotFound)
+	default:
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"ok": true}}})
+	}
+}
+
+// Log returns "method session-id" for each request so far.
+func (s *handshakeServer) Log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// expire forgets the current session.
+func (s *handshakeServer) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.valid = ""
+}
+
+func TestHandshakeOrdering(t *testing.T) {
+	srv := newHandshakeServer(t)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	log := srv.Log()
+	want := []string{"initialize ", "notifications/initialized sess-1"}
+	if len(log) != 7 || !reflect.DeepEqual(log[:2], want) {
+		t.Fatalf("requests = %q, want %q then 5 tool calls", log, want)
+	}
+	for _, entry := range log[2:] {
+		if entry != "tools/call sess-1" {
+			t.Errorf("request %q, want tools/call on sess-1", entry)
+		}
+	}
+}
+
+func TestHandshakeRedoneAfterSessionExpiry(t *testing.T) {
+	srv := newHandshakeServer(t)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	ctx := context.Background()
+	if _, err := client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.expire()
+	if _, err := client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"initialize ", "notifications/initialized sess-1", "tools/call sess-1",
+		"tools/call sess-1", // rejected: the session expired
+		"initialize ", "notifications/initialized sess-2", "tools/call sess-2",
+	}
+	if got := srv.Log(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestSessionRoundTripStrictServer(t *testing.T) {
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	srv.StrictSessions = true
+	client := newTestClient(t, srv)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			srv.ExpireSessions()
+		}
+		if _, err := client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+	}
+	var got []string
+	for _, call := range srv.Calls() {
+		if call.Method == "initialize" {
+			if call.SessionID != "" || call.ProtocolVersion != "" {
+				t.Errorf("initialize sent session %q and version %q, want neither", call.SessionID, call.ProtocolVersion)
+			}
+		} else if call.ProtocolVersion != mcpProtocolVersion {
+			t.Errorf("%s sent MCP-Protocol-Version %q, want %q", call.Method, call.ProtocolVersion, mcpProtocolVersion)
+		}
+		got = append(got, strings.TrimSpace(call.Method+" "+call.SessionID))
+	}
+	want := []string{
+		"initialize", "notifications/initialized fake-session-1", "tools/call fake-session-1", "tools/call fake-session-1",
+		"tools/call fake-session-1", // rejected: the sessions were expired
+		"initialize", "notifications/initialized fake-session-2", "tools/call fake-session-2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestNegotiatedProtocolVersion(t *testing.T) {
+	srv := newHandshakeServer(t)
+	srv.version = "2024-11-05"
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if want := []string{"", "2024-11-05", "2024-11-05"}; !reflect.DeepEqual(srv.versions, want) {
+		t.Errorf("MCP-Protocol-Version headers = %q, want %q", srv.versions, want)
+	}
+}
+
+// TestClientSessionWithoutServerID checks the client keeps its own session
+// id when the server's initialize reply names none.
+func TestClientSessionWithoutServerID(t *testing.T) {
+	var mu sync.Mutex
+	var sessions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method != "initialize" {
+			mu.Lock()
+			sessions = append(sessions, r.Header.Get("Mcp-Session-Id"))
+			mu.Unlock()
+		}
+		if req.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"ok": true}}})
+	}))
+	defer srv.Close()
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) != 3 || sessions[0] == "" || sessions[1] != sessions[0] || sessions[2] != sessions[0] {
+		t.Errorf("session ids sent = %q, want one client-chosen id throughout", sessions)
+	}
+}
+
+func TestSessionExpiredRPCError(t *testing.T) {
+	srv := newHandshakeServer(t)
+	srv.rpcRejects = 1
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"initialize ", "notifications/initialized sess-1", "tools/call sess-1",
+		"initialize ", "notifications/initialized sess-2", "tools/call sess-2",
+	}
+	if got := srv.Log(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestSessionReinitsBounded(t *testing.T) {
+	srv := newHandshakeServer(t)
+	srv.rejectAll = true
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	_, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+	if KindOf(err) != KindSessionExpired || !strings.Contains(fmt.Sprint(err), "re-initializations") {
+		t.Fatalf("err = %v, want a session_expired error", err)
+	}
+	var inits, calls int
+	for _, entry := range srv.Log() {
+		switch strings.Fields(entry)[0] {
+		case "initialize":
+			inits++
+		case "tools/call":
+			calls++
+		}
+	}
+	if inits != maxSessionReinits+1 || calls != maxSessionReinits+1 {
+		t.Errorf("%d handshakes and %d tool calls, want %d of each", inits, calls, maxSessionReinits+1)
+	}
+}
+
+func TestHandshakeSkippedForLegacyServers(t *testing.T) {
+	srv := newHandshakeServer(t)
+	srv.noInit = true
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var methods []string
+	for _, entry := range srv.Log() {
+		methods = append(methods, strings.Fields(entry)[0])
+	}
+	if want := []string{"initialize", "tools/call", "tools/call"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("methods = %q, want %q", methods, want)
+	}
+}
+
+// scriptedStatusServer answers tools/call with the scripted HTTP statuses in
+// order, then with success, counting the attempts. A status of 429 or 503
+// carries retryAfter when set.
+func scriptedStatusServer(t *testing.T, retryAfter string, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method != "tools/call" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{}})
+			return
+		}
+		if n := int(attempts.Add(1)); n <= len(statuses) {
+			if status := statuses[n-1]; status != http.StatusOK {
+				if retryAfter != "" && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				http.Error(w, "scripted failure", status)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"ok": true}}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &attempts
+}
+
+func TestRetryAttempts(t *testing.T) {
+	cases := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int32
+		wantStatus   int // HTTP status of the returned error, 0 for success
+	}{
+		{"success", nil, 1, 0},
+		{"transient then success", []int{503, 502, 200}, 3, 0},
+		{"retries exhausted", []int{503, 503, 503, 503, 503}, 4, 503},
+		{"bad request", []int{400, 200}, 1, 400},
+		{"unauthorized", []int{401, 200}, 1, 401},
+		{"not found", []int{404, 200}, 1, 404},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, attempts := scriptedStatusServer(t, "", c.statuses...)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 4, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+			defer client.Close()
+			_, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+			if got := attempts.Load(); got != c.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, c.wantAttempts)
+			}
+			var he MCPHTTPError
+			switch {
+			case c.wantStatus == 0 && err != nil:
+				t.Errorf("err = %v, want success", err)
+			case c.wantStatus != 0 && (!errors.As(err, &he) || he.Status != c.wantStatus):
+				t.Errorf("err = %v, want an MCPHTTPError with status %d", err, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		t.Run(fmt.Sprint(status), func(t *testing.T) {
+			srv, attempts := scriptedStatusServer(t, "1", status)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+			defer client.Close()
+			started := time.Now()
+			if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+				t.Fatal(err)
+			}
+			if n := attempts.Load(); n != 2 {
+				t.Errorf("%d attempts, want 2", n)
+			}
+			if elapsed := time.Since(started); elapsed < time.Second {
+				t.Errorf("retried after %s, want the 1s Retry-After instead of the 2ms backoff", elapsed)
+			}
+		})
+	}
+}
+
+// TestBackoffJitter checks that retry delays are spread over the whole
+// window instead of a fixed power of two.
+func TestBackoffJitter(t *testing.T) {
+	client := NewMCPClientWithOptions("http://127.0.0.1:1", MCPClientOptions{MaxRetries: 3, BaseBackoff: 100 * time.Millisecond, MaxBackoff: 400 * time.Millisecond})
+	defer client.Close()
+	for attempt, window := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 400 * time.Millisecond} {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 50; i++ {
+			d := client.backoff(attempt, errors.New("boom"))
+			if d < 0 || d > window {
+				t.Fatalf("attempt %d: backoff %s outside [0, %s]", attempt, d, window)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 10 {
+			t.Errorf("attempt %d: only %d distinct delays in 50 draws", attempt, len(seen))
+		}
+	}
+}
+
+// countingTransport wraps a RoundTripper and tracks every response body it
+// hands out.
+type countingTransport struct {
+	base   http.RoundTripper
+	mu     sync.Mutex
+	bodies []*countingBody
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body := &countingBody{ReadCloser: resp.Body}
+	resp.Body = body
+	c.mu.Lock()
+	c.bodies = append(c.bodies, body)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// unclosed counts the bodies not closed or not read to the end.
+func (c *countingTransport) unclosed() (open, undrained, total int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.bodies {
+		if !b.closed.Load() {
+			open++
+		}
+		if !b.eof.Load() {
+			undrained++
+		}
+	}
+	return open, undrained, len(c.bodies)
+}
+
+type countingBody struct {
+	io.ReadCloser
+	closed, eof atomic.Bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof.Store(true)
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.closed.Store(true)
+	return b.ReadCloser.Close()
+}
+
+// TestFailedAttemptsReleaseConnections makes three attempts fail and checks
+// that each response body was drained and closed before the next attempt,
+// so every request reused one connection.
+func TestFailedAttemptsReleaseConnections(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+	}{
+		{"all attempts fail", []int{503, 502, 503}, true},
+		{"third attempt succeeds", []int{503, 502, 200}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			srv, attempts := scriptedStatusServer(t, "", c.statuses...)
+			var conns atomic.Int32
+			ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					if !info.Reused {
+						conns.Add(1)
+					}
+				},
+			})
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+			defer client.Close()
+			counter := &countingTransport{base: client.client.Transport}
+			client.client.Transport = counter
+
+			_, err := client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b1"})
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, want error %t", err, c.wantErr)
+			}
+			if n := attempts.Load(); n != 3 {
+				t.Fatalf("%d attempts, want 3", n)
+			}
+			open, undrained, total := counter.unclosed()
+			if total < 3 || open != 0 || undrained != 0 {
+				t.Errorf("%d of %d bodies left open, %d not drained", open, total, undrained)
+			}
+			if n := conns.Load(); n != 1 {
+				t.Errorf("opened %d connections for %d requests, want 1", n, total)
+			}
+		})
+	}
+}
+
+// slowServer answers initialize at once and tools/call after delay; with
+// stall it instead sends the headers and half the reply, then stalls until
+// the client goes away.
+func slowServer(t *testing.T, delay time.Duration, stall bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		reply, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"id": "b1", "status": "running"}}})
+		if req.Method != "tools/call" {
+			w.Write(reply)
+			return
+		}
+		if stall {
+			w.Write(reply[:len(reply)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		select {
+		case <-time.After(delay):
+			w.Write(reply)
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestPerCallTimeoutFires: the per-call deadline ends a call whose reply is
+// still being written.
+func TestPerCallTimeoutFires(t *testing.T) {
+	client := NewMCPClientWithOptions(slowServer(t, 0, true).URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	started := time.Now()
+	_, err := client.call(context.Background(), "tools/call", map[string]any{"name": "get_branch", "arguments": map[string]any{"branch_id": "b1"}}, 500*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the per-call deadline", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("call returned after %s, want soon after its 500ms timeout", elapsed)
+	}
+}
+
+// TestPerCallTimeoutOutlivesClientDefault: a call given a longer timeout
+// (get_branch's 300s) survives a reply slower than the client's default,
+// so nothing client-wide cuts it short.
+func TestPerCallTimeoutOutlivesClientDefault(t *testing.T) {
+	client := NewMCPClientWithOptions(slowServer(t, time.Second, false).URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	if client.client.Timeout != 0 {
+		t.Fatalf("http.Client.Timeout = %s; a client-wide limit would cut off long calls", client.client.Timeout)
+	}
+	client.timeout = 200 * time.Millisecond
+	state, err := client.GetBranch(context.Background(), "b1", 0)
+	if err != nil {
+		t.Fatalf("GetBranch with a 1s-slow reply and a 200ms client default: %v", err)
+	}
+	if state.Status != "running" {
+		t.Errorf("status = %q", state.Status)
+	}
+	if _, err := client.call(context.Background(), "tools/call", map[string]any{"name": "get_branch", "arguments": map[string]any{"branch_id": "b1"}}, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("call without its own timeout: err = %v, want the 200ms client default to apply", err)
+	}
+}
+
+// rpcErrorServer answers every tools/call with the JSON-RPC error rpcErr,
+// counting the attempts.
+func rpcErrorServer(t *testing.T, rpcErr map[string]any) (*httptest.Server, *atomic.Int32) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{}}
+		if req.Method == "tools/call" {
+			attempts.Add(1)
+			resp = map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": rpcErr}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &attempts
+}
+
+func TestRPCErrors(t *testing.T) {
+	cases := []struct {
+		name         string
+		rpcErr       map[string]any
+		wantAttempts int32
+		wantCode     string
+		wantKind     ErrorKind
+	}{
+		{"unknown tool", map[string]any{"code": RPCMethodNotFound, "message": "Unknown tool: branch_output"}, 1, CodeInvalidArguments, KindInvalidParams},
+		{"invalid params", map[string]any{"code": RPCInvalidParams, "message": "branch_id must be a UUID", "data": map[string]any{"field": "branch_id"}}, 1, CodeInvalidArguments, KindInvalidParams},
+		{"internal error", map[string]any{"code": -32603, "message": "database unavailable"}, 3, CodeToolFailed, KindServerInternal},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, attempts := rpcErrorServer(t, c.rpcErr)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, BreakerThreshold: -1})
+			defer client.Close()
+
+			_, err := client.CallTool(context.Background(), "branch_output", map[string]any{"branch_id": "b1"})
+			var rpcErr MCPRPCError
+			if !errors.As(err, &rpcErr) {
+				t.Fatalf("err = %v, want an MCPRPCError", err)
+			}
+			if float64(rpcErr.Code) != toFloat(c.rpcErr["code"]) || rpcErr.Message != c.rpcErr["message"] || !reflect.DeepEqual(rpcErr.Data, c.rpcErr["data"]) {
+				t.Errorf("MCPRPCError = %+v, want %v", rpcErr, c.rpcErr)
+			}
+			if n := attempts.Load(); n != c.wantAttempts {
+				t.Errorf("%d attempts, want %d", n, c.wantAttempts)
+			}
+
+			h := NewToolHandler(client, "demo", testParent)
+			h.SetResultBudget(0, t.TempDir())
+			result := callTool(h, "branch_output", map[string]any{"branch_id": "b1"})
+			code, details := mustFail(t, result)
+			if code != c.wantCode || details["error_kind"] != c.wantKind {
+				t.Errorf("code %s kind %v, want %s %s", code, details["error_kind"], c.wantCode, c.wantKind)
+			}
+			envelope, _ := result["error"].(map[string]any)
+			if envelope["retryable"] != (c.wantAttempts > 1) {
+				t.Errorf("retryable = %v, want %v", envelope["retryable"], c.wantAttempts > 1)
+			}
+			rpc, _ := details["rpc_error"].(map[string]any)
+			if rpc["message"] != c.rpcErr["message"] || details["hint"] == nil {
+				t.Errorf("details = %v", details)
+			}
+		})
+	}
+}
+
+func toFloat(v any) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// pagedToolsServer serves tools/list in pages, the cursor of page i being
+// "page-i"; with loop set every page carries a cursor. It records the
+// cursors it was sent.
+func pagedToolsServer(t *testing.T, pages [][]string, loop bool) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var cursors []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+			Params struct {
+				Cursor string `json:"cursor"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		result := map[string]any{}
+		if req.Method == "tools/list" {
+			mu.Lock()
+			cursors = append(cursors, req.Params.Cursor)
+			mu.Unlock()
+			page := 0
+			fmt.Sscanf(req.Params.Cursor, "page-%d", &page)
+			var tools []any
+			if page < len(pages) {
+				for _, name := range pages[page] {
+					tools = append(tools, map[string]any{"name": name, "description": name + " tool", "inputSchema": map[string]any{"type": "object"}})
+				}
+			}
+			result["tools"] = tools
+			if loop || page+1 < len(pages) {
+				result["nextCursor"] = fmt.Sprintf("page-%d", page+1)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), cursors...)
+	}
+}
+
+func TestListToolsPaginated(t *testing.T) {
+	srv, cursors := pagedToolsServer(t, [][]string{{"parallel_explore", "get_branch"}, {}, {"branch_read_file"}}, false)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+
+	tools, err := client.ListTools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+		if tool.Description != tool.Name+" tool" || tool.InputSchema["type"] != "object" {
+			t.Errorf("tool %+v lost its description or schema", tool)
+		}
+	}
+	if want := []string{"parallel_explore", "get_branch", "branch_read_file"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tools = %v, want %v", names, want)
+	}
+	if got, want := cursors(), []string{"", "page-1", "page-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cursors sent = %q, want %q", got, want)
+	}
+}
+
+func TestListToolsEndlessCursor(t *testing.T) {
+	srv, cursors := pagedToolsServer(t, [][]string{{"get_branch"}}, true)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+
+	if _, err := client.ListTools(context.Background()); err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("err = %v, want the page limit error", err)
+	}
+	if n := len(cursors()); n != maxToolPages {
+		t.Errorf("%d pages fetched, want %d", n, maxToolPages)
+	}
+}
+
+func TestValidateServerTools(t *testing.T) {
+	cases := []struct {
+		name    string
+		pages   [][]string
+		missing string
+	}{
+		{"all on one page", [][]string{{"parallel_explore", "get_branch", "branch_read_file", "extra"}}, ""},
+		{"spread over pages", [][]string{{"branch_read_file"}, {"get_branch"}, {"parallel_explore"}}, ""},
+		{"missing on every page", [][]string{{"get_branch"}, {"extra"}}, "parallel_explore, branch_read_file"},
+		{"no tools", nil, "parallel_explore, get_branch, branch_read_file"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, _ := pagedToolsServer(t, c.pages, false)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+			defer client.Close()
+
+			err := NewToolHandler(client, "demo", testParent).ValidateServerTools(context.Background())
+			switch {
+			case c.missing == "" && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case c.missing != "" && (err == nil || !strings.HasSuffix(err.Error(), "missing required tools: "+c.missing)):
+				t.Errorf("err = %v, want the missing tools %s", err, c.missing)
+			}
+		})
+	}
+}
+
+// tracedPolls runs n sequential GetBranch polls and counts, via httptrace,
+// the connections that were reused and the ones newly dialled.
+func tracedPolls(tb testing.TB, client *MCPClient, n int) (reused, dialled int) {
+	tb.Helper()
+	var mu sync.Mutex
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if info.Reused {
+				reused++
+			} else {
+				dialled++
+			}
+		},
+	})
+	for i := 0; i < n; i++ {
+		if _, err := client.GetBranch(ctx, "b1", 0); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return reused, dialled
+}
+
+// pollingClient returns a client of a fake server whose branch b1 keeps
+// running; keepAlive false disables connection reuse, like a client that
+// closes every connection.
+func pollingClient(tb testing.TB, keepAlive bool) *MCPClient {
+	srv := mcptest.NewFakeServer()
+	tb.Cleanup(srv.Close)
+	srv.ScriptBranch("b1", "running")
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Minute})
+	tb.Cleanup(func() { client.Close() })
+	if !keepAlive {
+		client.client.Transport.(*http.Transport).DisableKeepAlives = true
+	}
+	return client
+}
+
+func TestPollingReusesConnections(t *testing.T) {
+	client := pollingClient(t, true)
+	tracedPolls(t, client, 1) // the handshake and first poll may dial
+	if reused, dialled := tracedPolls(t, client, 10); dialled != 0 || reused != 10 {
+		t.Errorf("10 polls reused %d connections and dialled %d, want all reused", reused, dialled)
+	}
+}
+
+// BenchmarkGetBranchPolling compares sequential polling with and without
+// keep-alive; dialled/op shows the connection churn.
+func BenchmarkGetBranchPolling(b *testing.B) {
+	for _, c := range []struct {
+		name      string
+		keepAlive bool
+	}{{"keep-alive", true}, {"no-keep-alive", false}} {
+		b.Run(c.name, func(b *testing.B) {
+			client := pollingClient(b, c.keepAlive)
+			tracedPolls(b, client, 1)
+			b.ResetTimer()
+			reused, dialled := tracedPolls(b, client, b.N)
+			b.StopTimer()
+			b.ReportMetric(float64(dialled)/float64(b.N), "dialled/op")
+			if c.keepAlive && dialled != 0 {
+				b.Errorf("%d of %d polls dialled a new connection", dialled, reused+dialled)
+			}
+		})
+	}
+}
+
+func TestParseSSEStream(t *testing.T) {
+	progress := `{"jsonrpc":"2.0","method":"notifications/progress","params":{"progress":1}}`
+	result := `{"jsonrpc":"2.0","id":7,"result":{"ok":true}}`
+	cases := []struct {
+		name       string
+		stream     string
+		id         any
+		want       string
+		notified   int
+		wantErr    string
+		disconnect bool
+	}{
+		{"result only", "data: " + result + "\n\n", 7, result, 0, "", false},
+		{"progress before result", "data: " + progress + "\n\ndata: " + progress + "\n\ndata: " + result + "\n\n", 7, result, 2, "", false},
+		{"other id skipped", `data: {"jsonrpc":"2.0","id":6,"result":{"ok":false}}` + "\n\ndata: " + result + "\n\n", 7, result, 0, "", false},
+		{"string id", `data: {"jsonrpc":"2.0","id":"7","result":{}}` + "\n\n" + `data: {"jsonrpc":"2.0","id":"abc","result":{}}` + "\n\n", "abc", `{"jsonrpc":"2.0","id":"abc","result":{}}`, 0, "", false},
+		{"keepalives and event ids", ": ping\n\nid: 1\nevent: message\ndata: " + progress + "\n\n: ping\nid: 2\ndata: " + result + "\n\n", 7, result, 1, "", false},
+		{"multi-line data", "data: {\"jsonrpc\":\"2.0\",\ndata: \"id\":7,\"result\":{}}\n\n", 7, "{\"jsonrpc\":\"2.0\",\n\"id\":7,\"result\":{}}", 0, "", false},
+		{"bare result", `data: {"structuredContent":{"ok":true}}` + "\n\n", 7, `{"structuredContent":{"ok":true}}`, 0, "", false},
+		{"only notifications", "data: " + progress + "\n\ndata: " + progress + "\n\n", 7, "", 2, "without a response for request id 7 (skipped 2 notification/other events)", true},
+		{"empty stream", ": ping\n\n", 7, "", 0, "no JSON data event", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			notified := 0
+			data, _, err := parseSSEStream(strings.NewReader(c.stream), c.id, func([]byte) { notified++ })
+			if c.wantErr != "" {
+				var disconnect *sseDisconnectError
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) || errors.As(err, &disconnect) != c.disconnect {
+					t.Errorf("err = %v, want %q (disconnect %t)", err, c.wantErr, c.disconnect)
+				}
+			} else if err != nil || strings.TrimSpace(string(data)) != c.want {
+				t.Errorf("data = %s, err = %v, want %s", data, err, c.want)
+			}
+			if notified != c.notified {
+				t.Errorf("%d notifications passed on, want %d", notified, c.notified)
+			}
+		})
+	}
+}
+
+func TestSSEInterleavedNotifications(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID any `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		id, _ := json.Marshal(req.ID)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{\"progress\":%d,\"total\":3}}\n\n", i)
+		}
+		fmt.Fprintf(w, "data: {\"jsonrpc\":\"2.0\",\"id\":%s,\"result\":{\"structuredContent\":{\"id\":\"b1\",\"status\":\"succeed\"}}}\n\n", id)
+	}))
+	defer srv.Close()
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+
+	res, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["status"] != "succeed" || res["id"] != "b1" {
+		t.Errorf("result = %v, want the branch rather than a progress notification", res)
+	}
+}
+
+// droppingSSEServer answers the first tools/call with a keepalive and a
+// progress event, carrying id 1 when eventIDs is set, then ends the stream
+// before the result. With resumable set, a GET carrying Last-Event-ID 1 replays the result;
+// otherwise GETs are refused and later POSTs answered in full.
+type droppingSSEServer struct {
+	*httptest.Server
+	resumable, eventIDs bool
+
+	mu           sync.Mutex
+	posts        int
+	droppedID    []byte
+	lastEventIDs []string
+}
+
+func newDroppingSSEServer(t *testing.T, resumable, eventIDs bool) *droppingSSEServer {
+	s := &droppingSSEServer{resumable: resumable, eventIDs: eventIDs}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *droppingSSEServer) serve(w http.ResponseWriter, r *http.Request) {
+	result := `{"jsonrpc":"2.0","id":%s,"result":{"structuredContent":{"id":"b1","status":"succeed"}}}`
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		s.lastEventIDs = append(s.lastEventIDs, r.Header.Get("Last-Event-ID"))
+		id := s.droppedID
+		s.mu.Unlock()
+		if !s.resumable || r.Header.Get("Last-Event-ID") != "1" {
+			http.Error(w, "resumption not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "id: 2\ndata: "+result+"\n\n", id)
+		return
+	}
+	var req struct {
+		ID     any    `json:"id"`
+		Method string `json:"method"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.ID == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	id, _ := json.Marshal(req.ID)
+	if req.Method != "tools/call" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":{}}`, id)
+		return
+	}
+	s.mu.Lock()
+	s.posts++
+	first := s.posts == 1
+	if first {
+		s.droppedID = id
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/event-stream")
+	if !first {
+		fmt.Fprintf(w, "data: "+result+"\n\n", id)
+		return
+	}
+	fmt.Fprint(w, ": keepalive\n\n")
+	if s.eventIDs {
+		fmt.Fprint(w, "id: 1\n")
+	}
+	fmt.Fprint(w, `data: {"jsonrpc":"2.0","method":"notifications/progress","params":{"progress":1}}`+"\n\n")
+	// The stream ends here, before the result.
+}
+
+func (s *droppingSSEServer) counts() (posts int, resumes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.posts, append([]string(nil), s.lastEventIDs...)
+}
+
+func TestSSEDisconnect(t *testing.T) {
+	cases := []struct {
+		name                string
+		resumable, eventIDs bool
+		tool                string
+		wantUnknown         bool
+		posts               int
+		resumes             []string
+	}{
+		{"resumed", true, true, "cancel_branch", false, 1, []string{"1"}},
+		{"resume refused for a mutation", false, true, "cancel_branch", true, 1, []string{"1"}},
+		{"resume refused for a read", false, true, "get_branch", false, 2, []string{"1"}},
+		{"no event id", true, false, "cancel_branch", true, 1, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newDroppingSSEServer(t, c.resumable, c.eventIDs)
+			client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+			defer client.Close()
+			captureLogs(t)
+
+			res, err := client.CallTool(context.Background(), c.tool, map[string]any{"branch_id": "b1"})
+			if c.wantUnknown {
+				var unknown ResultUnknownError
+				if !errors.As(err, &unknown) || !errors.Is(err, ErrResultUnknown) || unknown.Idempotent {
+					t.Errorf("err = %v, want a non-retryable ResultUnknownError", err)
+				}
+			} else if err != nil || res["status"] != "succeed" {
+				t.Errorf("result = %v, err = %v, want the branch", res, err)
+			}
+			posts, resumes := srv.counts()
+			if posts != c.posts || !reflect.DeepEqual(resumes, c.resumes) {
+				t.Errorf("%d POSTs and resumes %q, want %d and %q", posts, resumes, c.posts, c.resumes)
+			}
+		})
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	// get_branch fails once then succeeds, then succeeds outright;
+	// branch_output is rejected once, then fails on every attempt.
+	srv, _ := scriptedStatusServer(t, "", 503, 200, 200, 400, 503, 503, 503)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, BreakerThreshold: -1})
+	defer client.Close()
+	ctx := context.Background()
+	for _, c := range []struct {
+		tool    string
+		wantErr bool
+	}{{"get_branch", false}, {"get_branch", false}, {"branch_output", true}, {"branch_output", true}} {
+		if _, err := client.CallTool(ctx, c.tool, map[string]any{"branch_id": "b1"}); (err != nil) != c.wantErr {
+			t.Fatalf("%s: err = %v, want error %t", c.tool, err, c.wantErr)
+		}
+	}
+
+	metrics := client.Metrics()
+	for key, want := range map[string]MethodMetrics{
+		"tools/call:get_branch":    {Calls: 2, Errors: 0, Retries: 1},
+		"tools/call:branch_output": {Calls: 2, Errors: 2, Retries: 2},
+	} {
+		got := metrics[key]
+		if got.Calls != want.Calls || got.Errors != want.Errors || got.Retries != want.Retries {
+			t.Errorf("%s = %+v, want calls %d errors %d retries %d", key, got, want.Calls, want.Errors, want.Retries)
+		}
+		var bucketed int64
+		for _, n := range got.LatencyBuckets {
+			bucketed += n
+		}
+		if len(got.LatencyBuckets) != len(LatencyBucketsMS)+1 || bucketed != int64(got.Calls) || got.MaxMS > got.TotalMS {
+			t.Errorf("%s latencies = %+v", key, got)
+		}
+	}
+	if len(metrics) != 2 {
+		t.Errorf("metrics track %d methods, want the 2 tools called", len(metrics))
+	}
+
+	// The snapshot is a copy.
+	metrics["tools/call:get_branch"].LatencyBuckets[0] = 99
+	if client.Metrics()["tools/call:get_branch"].LatencyBuckets[0] == 99 {
+		t.Error("Metrics returned the live histogram")
+	}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// tracedServer records "method request-id user-agent" for every request and
+// fails the first failures tools/call requests with 503.
+type tracedServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	log      [][3]string
+	failures int
+}
+
+func newTracedServer(t *testing.T, failures int) *tracedServer {
+	s := &tracedServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		s.mu.Lock()
+		s.log = append(s.log, [3]string{req.Method, r.Header.Get("X-Request-Id"), r.Header.Get("User-Agent")})
+		fail := req.Method == "tools/call" && s.failures > 0
+		if fail {
+			s.failures--
+		}
+		s.mu.Unlock()
+		switch {
+		case fail:
+			http.Error(w, "scripted failure", http.StatusServiceUnavailable)
+		case req.ID == nil:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"ok": true}}})
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tracedServer) Log() [][3]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][3]string(nil), s.log...)
+}
+
+func TestRequestIDHeaders(t *testing.T) {
+	srv := newTracedServer(t, 1)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []string
+	for _, entry := range srv.Log() {
+		method, id, agent := entry[0], entry[1], entry[2]
+		if !uuidPattern.MatchString(id) {
+			t.Errorf("%s X-Request-Id = %q, want a UUIDv4", method, id)
+		}
+		if agent != defaultUserAgent {
+			t.Errorf("%s User-Agent = %q, want %q", method, agent, defaultUserAgent)
+		}
+		ids = append(ids, method+" "+id)
+	}
+	// The handshake and the retry carry the id of the call that needed them;
+	// the second call has its own.
+	want := []string{"initialize", "notifications/initialized", "tools/call", "tools/call"}
+	if len(ids) != 5 {
+		t.Fatalf("requests = %q, want %v and another tools/call", ids, want)
+	}
+	first := strings.Fields(ids[0])[1]
+	for i, method := range want {
+		if ids[i] != method+" "+first {
+			t.Errorf("request %d = %q, want %s with id %s", i, ids[i], method, first)
+		}
+	}
+	if ids[4] == "tools/call "+first {
+		t.Errorf("the second call reuses the first call's id %s", first)
+	}
+}
+
+func TestUserAgentOption(t *testing.T) {
+	srv := newTracedServer(t, 0)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, UserAgent: "dev-agent-go/1.2.3"})
+	defer client.Close()
+	if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range srv.Log() {
+		if entry[2] != "dev-agent-go/1.2.3" {
+			t.Errorf("%s User-Agent = %q, want the configured one", entry[0], entry[2])
+		}
+	}
+}
+
+// TestRequestIDCorrelation checks a failed call's request id is the one in
+// its log lines, its error and the handler's error payload.
+func TestRequestIDCorrelation(t *testing.T) {
+	logs := captureLogs(t)
+	srv := newTracedServer(t, 2)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	res := callTool(h, "branch_output", map[string]any{"branch_id": fakeBranchID(1)})
+	_, details := mustFail(t, res)
+
+	log := srv.Log()
+	id := log[len(log)-1][1]
+	if details["request_id"] != id {
+		t.Errorf("payload request_id = %v, want %s", details["request_id"], id)
+	}
+	if msg := res["error"].(map[string]any)["message"].(string); !strings.Contains(msg, "(request_id="+id+")") {
+		t.Errorf("error message %q does not quote request_id=%s", msg, id)
+	}
+	label := "tools/call [request_id=" + id + "]"
+	var lines int
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, label) {
+			lines++
+		}
+	}
+	// The HTTP error of each attempt and the retry warning.
+	if lines < 3 {
+		t.Errorf("%d log lines carry %q, want at least 3:\n%s", lines, label, logs)
+	}
+}
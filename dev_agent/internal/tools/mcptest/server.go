@@ -0,0 +1,340 @@
+// Package mcptest provides an in-process fake of the Pantheon MCP server for
+// exercising MCPClient, ToolHandler and the orchestrator without the real
+// backend.
+package mcptest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ToolFunc answers one tools/call. A non-nil error is returned to the client
+// as an isError result carrying the error text.
+type ToolFunc func(args map[string]any) (map[string]any, error)
+
+// Call is one JSON-RPC request the server received.
+type Call struct {
+	Method    string
+	Tool      string
+	Arguments map[string]any
+	SessionID string
+	// ProtocolVersion is the MCP-Protocol-Version header sent.
+	ProtocolVersion string
+	// Header holds all the request headers.
+	Header http.Header
+}
+
+// FakeServer speaks the streamable HTTP MCP transport. Its built-in tools
+// cover branch creation, status polling, file listings and reads; Handle
+// overrides or adds any tool.
+type FakeServer struct {
+	*httptest.Server
+
+	// SSE makes every response a text/event-stream with a progress
+	// notification ahead of the result.
+	SSE bool
+	// StrictSessions assigns a new session id on every initialize and
+	// answers requests with an unknown Mcp-Session-Id with 404, as the
+	// streamable HTTP spec prescribes.
+	StrictSessions bool
+
+	mu            sync.Mutex
+	tools         map[string]ToolFunc
+	schemas       map[string]map[string]any
+	branches      map[string]*fakeBranch
+	defaultScript []string
+	nextBranch    int
+	calls         []Call
+	sessions      map[string]bool
+	nextSession   int
+}
+
+type fakeBranch struct {
+	script []string
+	polls  int
+	files  map[string]string
+}
+
+// NewFakeServer starts a server. New branches run "pending", "running",
+// "succeed" over successive get_branch calls unless SetDefaultScript says
+// otherwise. Close it when done.
+func NewFakeServer() *FakeServer {
+	s := &FakeServer{
+		tools:         map[string]ToolFunc{},
+		schemas:       map[string]map[string]any{},
+		branches:      map[string]*fakeBranch{},
+		defaultScript: []string{"pending", "running", "succeed"},
+		sessions:      map[string]bool{},
+	}
+	s.tools["parallel_explore"] = s.parallelExplore
+	s.tools["get_branch"] = s.getBranch
+	s.tools["branch_read_file"] = s.readFile
+	s.tools["branch_list_files"] = s.listFiles
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Handle registers fn for tool name, replacing any built-in.
+func (s *FakeServer) Handle(name string, fn ToolFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tools[name] = fn
+}
+
+// Respond makes tool name always return result.
+func (s *FakeServer) Respond(name string, result map[string]any) {
+	s.Handle(name, func(map[string]any) (map[string]any, error) { return result, nil })
+}
+
+// SetDefaultScript sets the status sequence of branches created from now on.
+func (s *FakeServer) SetDefaultScript(statuses ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaultScript = statuses
+}
+
+// ScriptBranch creates or rescripts branch id. Each get_branch advances one
+// status; the last one sticks.
+func (s *FakeServer) ScriptBranch(id string, statuses ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.branch(id)
+	b.script, b.polls = statuses, 0
+}
+
+// PutArtifact stores a file served by branch_read_file.
+func (s *FakeServer) PutArtifact(branchID, path, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.branch(branchID).files[path] = content
+}
+
+// SetSchema publishes inputSchema for the named tool in tools/list instead
+// of an empty object schema.
+func (s *FakeServer) SetSchema(name string, inputSchema map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schemas[name] = inputSchema
+}
+
+// ExpireSessions forgets every session, so StrictSessions rejects the next
+// request until the client initializes again.
+func (s *FakeServer) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+// Calls returns every request received so far, in order.
+func (s *FakeServer) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// CallsTo returns the tools/call requests for tool name.
+func (s *FakeServer) CallsTo(name string) []Call {
+	var out []Call
+	for _, c := range s.Calls() {
+		if c.Tool == name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// branch returns id's state, creating it; s.mu must be held.
+func (s *FakeServer) branch(id string) *fakeBranch {
+	b := s.branches[id]
+	if b == nil {
+		b = &fakeBranch{script: s.defaultScript, files: map[string]string{}}
+		s.branches[id] = b
+	}
+	return b
+}
+
+// parallelExplore creates num_branches branches (at least one) with
+// sequential ids.
+func (s *FakeServer) parallelExplore(args map[string]any) (map[string]any, error) {
+	n, _ := args["num_branches"].(float64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	branches := make([]any, 0, max(int(n), 1))
+	for len(branches) < cap(branches) {
+		s.nextBranch++
+		id := fmt.Sprintf("00000000-0000-4000-8000-%012d", s.nextBranch)
+		s.branch(id)
+		branches = append(branches, map[string]any{"branch_id": id, "status": "pending"})
+	}
+	return map[string]any{"branches": branches}, nil
+}
+
+func (s *FakeServer) getBranch(args map[string]any) (map[string]any, error) {
+	id, _ := args["branch_id"].(string)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.branches[id]
+	if !ok {
+		return nil, fmt.Errorf("branch %s not found", id)
+	}
+	status := "succeed"
+	if len(b.script) > 0 {
+		status = b.script[min(b.polls, len(b.script)-1)]
+	}
+	b.polls++
+	return map[string]any{"id": id, "status": status}, nil
+}
+
+func (s *FakeServer) readFile(args map[string]any) (map[string]any, error) {
+	id, _ := args["branch_id"].(string)
+	path, _ := args["file_path"].(string)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.branches[id]
+	if !ok {
+		return nil, fmt.Errorf("branch %s not found", id)
+	}
+	content, ok := b.files[path]
+	if !ok {
+		return nil, fmt.Errorf("file %s not found", path)
+	}
+	return map[string]any{"content": content}, nil
+}
+
+// listFiles lists the artifacts under directory with their size and
+// sha256.
+func (s *FakeServer) listFiles(args map[string]any) (map[string]any, error) {
+	id, _ := args["branch_id"].(string)
+	dir, _ := args["directory"].(string)
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.branches[id]
+	if !ok {
+		return nil, fmt.Errorf("branch %s not found", id)
+	}
+	paths := make([]string, 0, len(b.files))
+	for path := range b.files {
+		if strings.HasPrefix(strings.TrimPrefix(path, "/"), prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	files := make([]any, len(paths))
+	for i, path := range paths {
+		sum := sha256.Sum256([]byte(b.files[path]))
+		files[i] = map[string]any{"path": path, "size": len(b.files[path]), "sha256": hex.EncodeToString(sum[:])}
+	}
+	return map[string]any{"files": files}, nil
+}
+
+type rpcRequest struct {
+	ID     any            `json:"id"`
+	Method string         `json:"method"`
+	Params map[string]any `json:"params"`
+}
+
+func (s *FakeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad JSON", http.StatusBadRequest)
+		return
+	}
+	call := Call{Method: req.Method, SessionID: r.Header.Get("Mcp-Session-Id"), ProtocolVersion: r.Header.Get("MCP-Protocol-Version"), Header: r.Header.Clone()}
+	if req.Method == "tools/call" {
+		call.Tool, _ = req.Params["name"].(string)
+		call.Arguments, _ = req.Params["arguments"].(map[string]any)
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	sessionID := "fake-session"
+	if s.StrictSessions {
+		if req.Method != "initialize" && !s.sessions[call.SessionID] {
+			s.mu.Unlock()
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		if req.Method == "initialize" {
+			s.nextSession++
+			sessionID = fmt.Sprintf("fake-session-%d", s.nextSession)
+			s.sessions[sessionID] = true
+		}
+	}
+	s.mu.Unlock()
+
+	if req.ID == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	result, rpcErr := s.dispatch(req.Method, call)
+	resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+	if rpcErr != nil {
+		resp["error"] = rpcErr
+	} else {
+		resp["result"] = result
+	}
+	if req.Method == "initialize" {
+		w.Header().Set("Mcp-Session-Id", sessionID)
+	}
+	body, _ := json.Marshal(resp)
+	if !s.SSE {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprintf(w, "event: message\ndata: %s\n\n", `{"jsonrpc":"2.0","method":"notifications/progress","params":{"progress":1}}`)
+	fmt.Fprintf(w, "event: message\ndata: %s\n\n", body)
+}
+
+func (s *FakeServer) dispatch(method string, call Call) (map[string]any, map[string]any) {
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"protocolVersion": "2025-03-26",
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "mcptest", "version": "0"},
+		}, nil
+	case "tools/list":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		names := make([]string, 0, len(s.tools))
+		for name := range s.tools {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tools := make([]any, len(names))
+		for i, name := range names {
+			schema := s.schemas[name]
+			if schema == nil {
+				schema = map[string]any{"type": "object"}
+			}
+			tools[i] = map[string]any{"name": name, "inputSchema": schema}
+		}
+		return map[string]any{"tools": tools}, nil
+	case "tools/call":
+		s.mu.Lock()
+		fn := s.tools[call.Tool]
+		s.mu.Unlock()
+		if fn == nil {
+			return nil, map[string]any{"code": -32602, "message": "Unknown tool: " + call.Tool}
+		}
+		out, err := fn(call.Arguments)
+		if err != nil {
+			return map[string]any{"content": []any{map[string]any{"type": "text", "text": err.Error()}}, "isError": true}, nil
+		}
+		text, _ := json.Marshal(out)
+		return map[string]any{"content": []any{map[string]any{"type": "text", "text": string(text)}}}, nil
+	}
+	return nil, map[string]any{"code": -32601, "message": "Method not found: " + method}
+}
@@ -0,0 +1,101 @@
+package mcptest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dev_agent/internal/tools"
+	"dev_agent/internal/tools/mcptest"
+)
+
+// TestFakeServerSmoke drives every built-in tool through a real client,
+// over plain JSON and over SSE.
+func TestFakeServerSmoke(t *testing.T) {
+	for _, sse := range []bool{false, true} {
+		srv := mcptest.NewFakeServer()
+		defer srv.Close()
+		srv.SSE = sse
+		srv.SetDefaultScript("pending", "succeed")
+		client := tools.NewMCPClientWithOptions(srv.URL, tools.MCPClientOptions{MaxRetries: 1, APIToken: "token"})
+		defer client.Close()
+		ctx := context.Background()
+
+		explored, err := client.ParallelExplore(ctx, "demo", "parent", []string{"do it"}, "claude_code", 3)
+		if err != nil {
+			t.Fatalf("sse=%t: parallel_explore: %v", sse, err)
+		}
+		if len(explored.Branches) != 3 || explored.Branches[2].ID != "00000000-0000-4000-8000-000000000003" {
+			t.Fatalf("sse=%t: branches = %+v, want 3 with sequential ids", sse, explored.Branches)
+		}
+		id := explored.Branches[0].ID
+		for _, want := range []string{"pending", "succeed", "succeed"} {
+			b, err := client.GetBranch(ctx, id, 0)
+			if err != nil || b.Status != want {
+				t.Errorf("sse=%t: get_branch = %+v, %v; want status %s", sse, b, err, want)
+			}
+		}
+
+		srv.PutArtifact(id, "notes/worklog.md", "done\n")
+		a, err := client.BranchReadFile(ctx, id, "notes/worklog.md", tools.ReadFileOptions{})
+		if err != nil || a.Content != "done\n" {
+			t.Errorf("sse=%t: branch_read_file = %+v, %v", sse, a, err)
+		}
+		listing, err := client.BranchListFiles(ctx, id, "notes")
+		if files, _ := listing["files"].([]any); err != nil || len(files) != 1 {
+			t.Errorf("sse=%t: branch_list_files = %v, %v", sse, listing, err)
+		}
+
+		srv.Respond("custom", map[string]any{"ok": true})
+		if res, err := client.CallTool(ctx, "custom", map[string]any{}); err != nil || res["ok"] != true {
+			t.Errorf("sse=%t: custom tool = %v, %v", sse, res, err)
+		}
+		var rpcErr tools.MCPRPCError
+		if _, err := client.CallTool(ctx, "missing", map[string]any{}); !errors.As(err, &rpcErr) {
+			t.Errorf("sse=%t: unknown tool: err = %v, want an RPC error", sse, err)
+		}
+		listed, err := client.ListTools(ctx)
+		if err != nil || len(listed) != 5 {
+			t.Errorf("sse=%t: tools/list = %v, %v; want the 4 built-ins and custom", sse, listed, err)
+		}
+
+		calls := srv.Calls()
+		if calls[0].Method != "initialize" || calls[1].Method != "notifications/initialized" {
+			t.Errorf("sse=%t: first calls = %+v, want the handshake", sse, calls[:2])
+		}
+		explore := srv.CallsTo("parallel_explore")
+		if len(explore) != 1 || explore[0].Arguments["num_branches"] != float64(3) || explore[0].SessionID != "fake-session" {
+			t.Errorf("sse=%t: parallel_explore calls = %+v", sse, explore)
+		}
+		if got := explore[0].Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("sse=%t: Authorization header = %q", sse, got)
+		}
+	}
+}
+
+func TestFakeServerStrictSessions(t *testing.T) {
+	srv := mcptest.NewFakeServer()
+	defer srv.Close()
+	srv.StrictSessions = true
+	client := tools.NewMCPClientWithOptions(srv.URL, tools.MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer client.Close()
+	ctx := context.Background()
+	srv.ScriptBranch("b1", "running")
+
+	if _, err := client.GetBranch(ctx, "b1", 0); err != nil {
+		t.Fatal(err)
+	}
+	srv.ExpireSessions()
+	if _, err := client.GetBranch(ctx, "b1", 0); err != nil {
+		t.Fatalf("after expiry: %v", err)
+	}
+	var sessions []string
+	for _, c := range srv.CallsTo("get_branch") {
+		sessions = append(sessions, c.SessionID)
+	}
+	want := []string{"fake-session-1", "fake-session-1", "fake-session-2"}
+	if len(sessions) != len(want) || sessions[0] != want[0] || sessions[1] != want[1] || sessions[2] != want[2] {
+		t.Errorf("get_branch sessions = %q, want %q", sessions, want)
+	}
+}
@@ -0,0 +1,85 @@
+package tools
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBucketsMS are the upper bounds of the latency histogram; the last
+// bucket of MethodMetrics.LatencyBuckets counts everything slower.
+var LatencyBucketsMS = []int64{50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// MethodMetrics are the counters kept for one MCP method. Tool calls are
+// keyed "tools/call:<tool>" so each server tool is tracked on its own.
+type MethodMetrics struct {
+	Calls          int     `json:"calls"`
+	Errors         int     `json:"errors"`
+	Retries        int     `json:"retries"`
+	TotalMS        int64   `json:"total_ms"`
+	MaxMS          int64   `json:"max_ms"`
+	LatencyBuckets []int64 `json:"latency_buckets"`
+}
+
+type clientMetrics struct {
+	mu      sync.Mutex
+	methods map[string]*MethodMetrics
+}
+
+func (m *clientMetrics) entry(key string) *MethodMetrics {
+	if m.methods == nil {
+		m.methods = map[string]*MethodMetrics{}
+	}
+	mm := m.methods[key]
+	if mm == nil {
+		mm = &MethodMetrics{LatencyBuckets: make([]int64, len(LatencyBucketsMS)+1)}
+		m.methods[key] = mm
+	}
+	return mm
+}
+
+// observe records one finished call, retries included in its latency.
+func (m *clientMetrics) observe(key string, elapsed time.Duration, err error) {
+	ms := elapsed.Milliseconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm := m.entry(key)
+	mm.Calls++
+	if err != nil {
+		mm.Errors++
+	}
+	mm.TotalMS += ms
+	mm.MaxMS = max(mm.MaxMS, ms)
+	bucket := len(LatencyBucketsMS)
+	for i, bound := range LatencyBucketsMS {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+	mm.LatencyBuckets[bucket]++
+}
+
+func (m *clientMetrics) retry(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entry(key).Retries++
+}
+
+func (m *clientMetrics) snapshot() map[string]MethodMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]MethodMetrics, len(m.methods))
+	for key, mm := range m.methods {
+		cp := *mm
+		cp.LatencyBuckets = append([]int64(nil), mm.LatencyBuckets...)
+		out[key] = cp
+	}
+	return out
+}
+
+func metricKey(method string, params map[string]any) string {
+	if name, _ := params["name"].(string); method == "tools/call" && name != "" {
+		return method + ":" + name
+	}
+	return method
+}
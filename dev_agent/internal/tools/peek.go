@@ -0,0 +1,83 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// peekBranch is the non-blocking check_status: one get_branch call, whose
+// reply comes back with terminal set whatever the status. A terminal branch
+// is handled exactly as awaitBranch would.
+func (h *ToolHandler) peekBranch(ctx context.Context, arguments map[string]any) (BranchInfo, map[string]any, error) {
+	branchID, _ := arguments["branch_id"].(string)
+	if branchID == "" {
+		return BranchInfo{}, nil, ToolExecutionError{Code: CodeInvalidArguments, Msg: "`branch_id` is required"}
+	}
+	started := time.Now()
+	state, err := h.client.GetBranch(ctx, branchID, 0)
+	if err != nil {
+		return BranchInfo{}, nil, err
+	}
+	h.branchTracker.RecordBranch(BranchRecord{BranchID: state.ID, Tool: "check_status", Agent: state.Agent, Parent: state.ParentID})
+	h.reportPoll(branchID, state.Status, 1, time.Since(started))
+	logx.Infof("Branch %s is %s (single poll)", branchID, firstNonEmpty(state.Status, "of unknown status"))
+
+	if terminal := terminalStatus(state.Status); terminal != "" {
+		out := h.branchFinished(ctx, branchID, state, terminal)
+		out["terminal"] = true
+		return state, out, nil
+	}
+	out := make(map[string]any, len(state.Raw)+2)
+	for k, v := range state.Raw {
+		out[k] = v
+	}
+	if _, ok := out["status"].(string); !ok && state.Status != "" {
+		out["status"] = state.Status
+	}
+	out["terminal"] = false
+	return state, out, nil
+}
+
+// peekBranches polls each of ids once, like peekBranch, and reports them the
+// way awaitBranches does, plus whether all of them are terminal.
+func (h *ToolHandler) peekBranches(ctx context.Context, ids []string) (map[string]any, error) {
+	results := make([]any, 0, len(ids))
+	counts := map[string]int{}
+	terminal := 0
+	for _, id := range ids {
+		state, resp, err := h.peekBranch(ctx, map[string]any{"branch_id": id})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			entry := map[string]any{"branch_id": id, "error": err.Error(), "terminal": false}
+			var te ToolExecutionError
+			if errors.As(err, &te) && te.Code != "" {
+				entry["code"] = te.Code
+			}
+			results = append(results, entry)
+			counts["unresolved"]++
+			continue
+		}
+		summary := summariseBranch(state, resp)
+		summary["branch_id"] = id
+		summary["terminal"] = resp["terminal"]
+		results = append(results, summary)
+		if t, _ := summary["terminal_status"].(string); t != "" {
+			counts[t]++
+			terminal++
+		} else {
+			counts["active"]++
+		}
+	}
+	return map[string]any{
+		"branch_ids":     ids,
+		"branch_results": results,
+		"counts":         counts,
+		"all_terminal":   terminal == len(ids),
+		"all_succeeded":  counts[TerminalSucceeded] == len(ids),
+	}, nil
+}
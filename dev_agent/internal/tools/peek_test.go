@@ -0,0 +1,91 @@
+package tools
+
+import "testing"
+
+func TestCheckStatusNonBlocking(t *testing.T) {
+	cases := []struct {
+		name     string
+		script   []string
+		terminal bool
+		status   string
+	}{
+		{"running", []string{"running", "succeed"}, false, "running"},
+		{"pending", []string{"pending", "running"}, false, "pending"},
+		{"succeeded", []string{"succeed"}, true, "succeed"},
+		{"cancelled", []string{"cancelled"}, true, "cancelled"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			fastPolls(h)
+			srv.ScriptBranch("b-1", c.script...)
+			data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "blocking": false}))
+			if data["terminal"] != c.terminal || data["status"] != c.status {
+				t.Errorf("data = %v, want status %s with terminal %v", data, c.status, c.terminal)
+			}
+			if _, has := data["terminal_status"]; has != c.terminal {
+				t.Errorf("terminal_status = %v, want it only on a terminal branch", data["terminal_status"])
+			}
+			if n := len(srv.CallsTo("get_branch")); n != 1 {
+				t.Errorf("%d polls, want exactly 1", n)
+			}
+		})
+	}
+}
+
+func TestCheckStatusNonBlockingFailed(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.ScriptBranch("b-1", "failed")
+	code, details := mustFail(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "blocking": false}))
+	if code != CodeAgentFailed || details["branch_id"] != "b-1" {
+		t.Errorf("code %s, details %v; want %s for b-1", code, details, CodeAgentFailed)
+	}
+	if n := len(srv.CallsTo("get_branch")); n != 1 {
+		t.Errorf("%d polls, want exactly 1", n)
+	}
+}
+
+func TestCheckStatusBlocking(t *testing.T) {
+	for _, args := range []map[string]any{
+		{"branch_id": "b-1"},
+		{"branch_id": "b-1", "blocking": true},
+	} {
+		h, srv := newTestHandler(t)
+		fastPolls(h)
+		srv.ScriptBranch("b-1", "pending", "running", "succeed")
+		data := mustSucceed(t, callTool(h, "check_status", args))
+		if data["terminal_status"] != TerminalSucceeded || data["terminal"] != nil {
+			t.Errorf("%v: data = %v, want the blocking result", args, data)
+		}
+		if n := len(srv.CallsTo("get_branch")); n != 3 {
+			t.Errorf("%v: %d polls, want a wait through all 3 statuses", args, n)
+		}
+	}
+}
+
+func TestCheckStatusNonBlockingBranchIDs(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.ScriptBranch("b-1", "succeed")
+	srv.ScriptBranch("b-2", "running", "succeed")
+	data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_ids": []any{"b-1", "b-2", "ghost"}, "blocking": false}))
+	counts, _ := data["counts"].(map[string]int)
+	if counts[TerminalSucceeded] != 1 || counts["active"] != 1 || counts["unresolved"] != 1 {
+		t.Errorf("counts = %v, want one succeeded, one active and one unresolved", data["counts"])
+	}
+	if data["all_terminal"] != false || data["all_succeeded"] != false {
+		t.Errorf("data = %v, want neither all terminal nor all succeeded", data)
+	}
+	results, _ := data["branch_results"].([]any)
+	if len(results) != 3 {
+		t.Fatalf("branch_results = %v, want 3", results)
+	}
+	for i, want := range []bool{true, false, false} {
+		r, _ := results[i].(map[string]any)
+		if r["terminal"] != want {
+			t.Errorf("result %d = %v, want terminal %v", i, r, want)
+		}
+	}
+	if n := len(srv.CallsTo("get_branch")); n != 3 {
+		t.Errorf("%d polls, want one per branch", n)
+	}
+}
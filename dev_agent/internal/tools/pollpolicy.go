@@ -0,0 +1,72 @@
+package tools
+
+import "time"
+
+// PollPolicy is how check_status (and the wait of execute_agent) polls a
+// branch when the call names no poll_interval_seconds,
+// max_poll_interval_seconds or timeout_seconds.
+type PollPolicy struct {
+	Initial time.Duration
+	Max     time.Duration
+	Timeout time.Duration
+}
+
+// defaultPollPolicy applies unless SetPollPolicy overrides it.
+var defaultPollPolicy = PollPolicy{Initial: 3 * time.Second, Max: 30 * time.Second, Timeout: defaultStatusTimeout}
+
+// maxPollOverride bounds per-call overrides: a call may ask for at most this
+// many times the policy's Max interval and Timeout, so one call cannot park
+// the run for hours.
+const maxPollOverride = 2
+
+// SetPollPolicy replaces the poll defaults; zero fields keep the current
+// ones.
+func (h *ToolHandler) SetPollPolicy(p PollPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p.Initial > 0 {
+		h.pollPolicy.Initial = p.Initial
+	}
+	if p.Max > 0 {
+		h.pollPolicy.Max = p.Max
+	}
+	if p.Timeout > 0 {
+		h.pollPolicy.Timeout = p.Timeout
+	}
+}
+
+// resolve returns the timeout, initial and maximum poll interval, in
+// seconds, of one wait with the given arguments. Arguments take precedence
+// over the policy, within maxPollOverride times its bounds; limit, when
+// set, replaces the policy's Timeout.
+func (p PollPolicy) resolve(limit time.Duration, arguments map[string]any) (timeout, poll, maxPoll float64, err error) {
+	timeout = p.Timeout.Seconds()
+	if limit > 0 {
+		timeout = limit.Seconds()
+	}
+	if v, ok, err := numberArg(arguments, "timeout_seconds"); err != nil {
+		return 0, 0, 0, err
+	} else if ok && v > 0 {
+		timeout = min(v, maxPollOverride*p.Timeout.Seconds())
+	}
+	pollBound := maxPollOverride * p.Max.Seconds()
+	poll = p.Initial.Seconds()
+	if v, ok, err := numberArg(arguments, "poll_interval_seconds"); err != nil {
+		return 0, 0, 0, err
+	} else if ok && v > 0 {
+		poll = min(v, pollBound)
+	}
+	maxPoll = p.Max.Seconds()
+	if v, ok, err := numberArg(arguments, "max_poll_interval_seconds"); err != nil {
+		return 0, 0, 0, err
+	} else if ok && v >= poll {
+		maxPoll = min(v, pollBound)
+	}
+	return timeout, poll, maxPoll, nil
+}
+
+func (h *ToolHandler) currentPollPolicy() PollPolicy {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pollPolicy
+}
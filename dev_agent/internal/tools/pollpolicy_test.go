@@ -0,0 +1,50 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPollPolicyPrecedence checks call arguments win over the configured
+// policy, within maxPollOverride times its bounds, and the configured
+// policy over the built-in defaults.
+func TestPollPolicyPrecedence(t *testing.T) {
+	configured := PollPolicy{Initial: 10 * time.Second, Max: 60 * time.Second, Timeout: 600 * time.Second}
+	cases := []struct {
+		name                   string
+		policy                 *PollPolicy
+		limit                  time.Duration
+		args                   map[string]any
+		timeout, poll, maxPoll float64
+	}{
+		{"built-in defaults", nil, 0, nil, 1800, 3, 30},
+		{"configured", &configured, 0, nil, 600, 10, 60},
+		{"partly configured", &PollPolicy{Max: 45 * time.Second}, 0, nil, 1800, 3, 45},
+		{"arguments", &configured, 0, map[string]any{"timeout_seconds": 900, "poll_interval_seconds": 2, "max_poll_interval_seconds": 90}, 900, 2, 90},
+		{"arguments over built-in defaults", nil, 0, map[string]any{"timeout_seconds": 60, "poll_interval_seconds": 1}, 60, 1, 30},
+		{"arguments capped", &configured, 0, map[string]any{"timeout_seconds": 5000, "poll_interval_seconds": 500, "max_poll_interval_seconds": 500}, 1200, 120, 120},
+		{"max below the interval ignored", &configured, 0, map[string]any{"poll_interval_seconds": 20, "max_poll_interval_seconds": 15}, 600, 20, 60},
+		{"tool timeout replaces the policy's", &configured, 300 * time.Second, nil, 300, 10, 60},
+		{"arguments win over the tool timeout", &configured, 300 * time.Second, map[string]any{"timeout_seconds": 450}, 450, 10, 60},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := NewToolHandler(nil, "demo", testParent)
+			if c.policy != nil {
+				h.SetPollPolicy(*c.policy)
+			}
+			timeout, poll, maxPoll, err := h.currentPollPolicy().resolve(c.limit, c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if timeout != c.timeout || poll != c.poll || maxPoll != c.maxPoll {
+				t.Errorf("timeout, poll, max = %v, %v, %v; want %v, %v, %v", timeout, poll, maxPoll, c.timeout, c.poll, c.maxPoll)
+			}
+		})
+	}
+
+	h := NewToolHandler(nil, "demo", testParent)
+	if _, _, _, err := h.currentPollPolicy().resolve(0, map[string]any{"timeout_seconds": "soon"}); err == nil {
+		t.Error("a non-numeric timeout_seconds was accepted")
+	}
+}
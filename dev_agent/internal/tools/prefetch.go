@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"dev_agent/internal/logx"
+)
+
+// Prefetch sends the text reads among calls, typically one assistant turn,
+// as a single MCP batch when there are at least two. The results are kept
+// for the matching Handle calls that follow; anything else is untouched and
+// a failed batch simply leaves Handle to make the calls itself.
+func (h *ToolHandler) Prefetch(ctx context.Context, calls []ToolCall) {
+	type read struct {
+		branchID, path string
+		opts           ReadFileOptions
+	}
+	var reads []read
+	for _, call := range calls {
+		if call.Function.Name != "read_artifact" {
+			continue
+		}
+		var args map[string]any
+		if json.Unmarshal([]byte(call.Function.Arguments), &args) != nil {
+			continue
+		}
+		branchID, _ := args["branch_id"].(string)
+		path, _ := args["path"].(string)
+		requested, _ := args["encoding"].(string)
+		if branchID == "" || path == "" || artifactEncoding(path, requested) != EncodingText {
+			continue
+		}
+		offset, maxBytes, err := h.textReadRange(args)
+		if err != nil {
+			continue
+		}
+		reads = append(reads, read{branchID, path, ReadFileOptions{Offset: offset, MaxBytes: maxBytes}})
+	}
+	if len(reads) < 2 {
+		return
+	}
+	reqs := make([]Request, len(reads))
+	for i, r := range reads {
+		reqs[i] = ToolRequest(ctx, "branch_read_file", readFileArgs(r.branchID, r.path, r.opts))
+	}
+	logx.Infof("Prefetching %d artifacts in one MCP batch", len(reqs))
+	resps, err := h.client.CallBatch(ctx, reqs)
+	if err != nil {
+		logx.Warningf("Artifact prefetch failed: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.prefetched == nil {
+		h.prefetched = map[string]map[string]any{}
+	}
+	for i, r := range reads {
+		if resps[i].Err == nil && resps[i].Result != nil {
+			h.prefetched[prefetchKey(r.branchID, r.path, r.opts)] = resps[i].Result
+		}
+	}
+}
+
+// takePrefetched returns and forgets a result stored by Prefetch.
+func (h *ToolHandler) takePrefetched(branchID, path string, opts ReadFileOptions) (map[string]any, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := prefetchKey(branchID, path, opts)
+	resp, ok := h.prefetched[key]
+	delete(h.prefetched, key)
+	return resp, ok
+}
+
+func prefetchKey(branchID, path string, opts ReadFileOptions) string {
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d", branchID, path, opts.Offset, opts.MaxBytes)
+}
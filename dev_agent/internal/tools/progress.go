@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ProgressFunc receives MCP progress notifications. pct is 0-100 when the
+// server reports a total, otherwise the raw progress value.
+type ProgressFunc func(token string, pct float64, message string)
+
+type progressLabelKey struct{}
+
+// WithProgressLabel names the work done under ctx; progress tokens of tool
+// calls made with it start with label, see ProgressLabel.
+func WithProgressLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, progressLabelKey{}, label)
+}
+
+// ProgressLabel returns the label a progress token was minted with.
+func ProgressLabel(token string) string {
+	label, _, _ := strings.Cut(token, "#")
+	return label
+}
+
+var progressSeq atomic.Int64
+
+// progressMeta returns the _meta object requesting progress for one call.
+func progressMeta(ctx context.Context, tool string) map[string]any {
+	label, _ := ctx.Value(progressLabelKey{}).(string)
+	if label == "" {
+		label = tool
+	}
+	return map[string]any{"progressToken": fmt.Sprintf("%s#%d", label, progressSeq.Add(1))}
+}
+
+type notifyKey struct{}
+
+// withNotify lets transports hand server notifications received while a
+// call is in flight back to the client.
+func withNotify(ctx context.Context, fn func(data []byte)) context.Context {
+	return context.WithValue(ctx, notifyKey{}, fn)
+}
+
+func notifyFrom(ctx context.Context) func(data []byte) {
+	fn, _ := ctx.Value(notifyKey{}).(func(data []byte))
+	return fn
+}
+
+// OnProgress registers fn for notifications/progress; nil disables it.
+func (c *MCPClient) OnProgress(fn ProgressFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onProgress = fn
+}
+
+func (c *MCPClient) handleNotification(data []byte) {
+	var msg struct {
+		Method string `json:"method"`
+		Params struct {
+			Token    any     `json:"progressToken"`
+			Progress float64 `json:"progress"`
+			Total    float64 `json:"total"`
+			Message  string  `json:"message"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(data, &msg) != nil || msg.Method != "notifications/progress" {
+		return
+	}
+	c.mu.Lock()
+	fn := c.onProgress
+	c.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	pct := msg.Params.Progress
+	if msg.Params.Total > 0 {
+		pct = 100 * msg.Params.Progress / msg.Params.Total
+	}
+	fn(fmt.Sprint(msg.Params.Token), pct, msg.Params.Message)
+}
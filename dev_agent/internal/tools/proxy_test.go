@@ -0,0 +1,117 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// proxyChildEnv makes the test binary run TestProxyFromEnvironment as the
+// child that talks through the proxy.
+const proxyChildEnv = "DEV_AGENT_PROXY_CHILD"
+
+// recordingProxy is a forward proxy that records each request line. It
+// answers plain HTTP requests as an MCP server itself and refuses CONNECT
+// tunnels after recording them.
+type recordingProxy struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+}
+
+func newRecordingProxy(t *testing.T) *recordingProxy {
+	p := &recordingProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.requests = append(p.requests, r.Method+" "+r.RequestURI)
+		p.mu.Unlock()
+		if r.Method == http.MethodConnect {
+			http.Error(w, "tunnels are not allowed", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			ID any `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"id": "b1", "status": "running"}}})
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *recordingProxy) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.requests)
+}
+
+func proxyCall(rawURL string, proxy *url.URL) error {
+	client := NewMCPClientWithOptions(rawURL, MCPClientOptions{MaxRetries: 1, Proxy: proxy})
+	defer client.Close()
+	_, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+	return err
+}
+
+func TestProxyOverride(t *testing.T) {
+	proxy := newRecordingProxy(t)
+	proxyURL, _ := url.Parse(proxy.URL)
+	captureLogs(t)
+
+	// The override wins even for hosts the environment would exempt.
+	t.Setenv("NO_PROXY", "*")
+	if err := proxyCall("http://mcp.internal.test/mcp", proxyURL); err != nil {
+		t.Fatalf("call through the proxy: %v", err)
+	}
+	seen := proxy.seen()
+	if len(seen) == 0 || !slices.Contains(seen, "POST http://mcp.internal.test/mcp") {
+		t.Errorf("proxy saw %q, want absolute-URI POSTs to the MCP server", seen)
+	}
+
+	if err := proxyCall("https://mcp.internal.test/mcp", proxyURL); err == nil {
+		t.Error("HTTPS call succeeded although the proxy refused the tunnel")
+	}
+	if got := proxy.seen(); !slices.Contains(got, "CONNECT mcp.internal.test:443") {
+		t.Errorf("proxy saw %q, want a CONNECT for the HTTPS server", got)
+	}
+}
+
+// TestProxyFromEnvironment runs in a child process because net/http reads
+// the proxy environment only once per process.
+func TestProxyFromEnvironment(t *testing.T) {
+	if target := os.Getenv(proxyChildEnv); target != "" {
+		if err := proxyCall(target, nil); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	proxy := newRecordingProxy(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestProxyFromEnvironment$")
+	cmd.Env = append(os.Environ(),
+		proxyChildEnv+"=http://mcp.internal.test/mcp",
+		"HTTP_PROXY="+proxy.URL, "http_proxy=", "NO_PROXY=", "no_proxy=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+	seen := proxy.seen()
+	if len(seen) == 0 {
+		t.Fatal("the proxy saw no requests")
+	}
+	for _, line := range seen {
+		if !strings.HasPrefix(line, "POST http://mcp.internal.test/") {
+			t.Errorf("proxy saw %q, want absolute-URI POSTs", line)
+		}
+	}
+}
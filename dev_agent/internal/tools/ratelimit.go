@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces MCP requests with token buckets: one for all traffic and
+// optional ones per method key (see metricKey). A 429 pauses everything for
+// its Retry-After. A zero rate means unlimited.
+type rateLimiter struct {
+	mu          sync.Mutex
+	global      *bucket
+	methods     map[string]*bucket
+	pausedUntil time.Time
+
+	// now and sleep are swapped out to test pacing without real time.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rps float64, methodRPS map[string]float64) *rateLimiter {
+	l := &rateLimiter{methods: map[string]*bucket{}, now: time.Now, sleep: sleepCtx}
+	l.global = newBucket(rps)
+	for method, r := range methodRPS {
+		l.methods[methodKey(method)] = newBucket(r)
+	}
+	return l
+}
+
+// methodKey lets overrides name a tool ("get_branch") or a method
+// ("tools/list").
+func methodKey(name string) string {
+	if strings.Contains(name, "/") || strings.Contains(name, ":") {
+		return name
+	}
+	return "tools/call:" + name
+}
+
+func newBucket(rps float64) *bucket {
+	if rps <= 0 {
+		return nil
+	}
+	burst := max(rps, 1)
+	return &bucket{rate: rps, burst: burst, tokens: burst}
+}
+
+// reserve takes a token and returns how long to wait until it is valid.
+// Tokens may go negative so that concurrent waiters queue up fairly.
+func (b *bucket) reserve(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until a request for key may be sent.
+func (l *rateLimiter) wait(ctx context.Context, key string) error {
+	l.mu.Lock()
+	now := l.now()
+	d := max(l.pausedUntil.Sub(now), 0)
+	d = max(d, l.global.reserve(now))
+	if b := l.methods[key]; b != nil {
+		d = max(d, b.reserve(now))
+	}
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	return l.sleep(ctx, d)
+}
+
+// pause holds all requests for d, e.g. after a 429.
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := l.now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
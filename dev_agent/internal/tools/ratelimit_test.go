@@ -0,0 +1,140 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for a rateLimiter's now and sleep: sleeping advances
+// the clock at once and records the duration.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func useFakeClock(l *rateLimiter) *fakeClock {
+	c := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l.now = func() time.Time { return c.now }
+	l.sleep = func(_ context.Context, d time.Duration) error {
+		c.sleeps = append(c.sleeps, d)
+		c.now = c.now.Add(d)
+		return nil
+	}
+	return c
+}
+
+// waits runs n waits for key and returns the fake time they took.
+func (c *fakeClock) waits(t *testing.T, l *rateLimiter, key string, n int) time.Duration {
+	t.Helper()
+	start := c.now
+	for i := 0; i < n; i++ {
+		if err := l.wait(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c.now.Sub(start)
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l := newRateLimiter(5, nil)
+	clock := useFakeClock(l)
+
+	// The burst of 5 goes out at once; the next 5 are paced at 5 per second.
+	if took := clock.waits(t, l, "tools/call:get_branch", 5); took != 0 {
+		t.Errorf("burst took %v, want 0", took)
+	}
+	if took := clock.waits(t, l, "tools/call:get_branch", 5); took != time.Second {
+		t.Errorf("5 requests past the burst took %v, want 1s", took)
+	}
+	for _, d := range clock.sleeps {
+		if d != 200*time.Millisecond {
+			t.Errorf("slept %v between requests, want 200ms", d)
+		}
+	}
+
+	// An idle second refills the whole burst, and no more.
+	clock.now = clock.now.Add(10 * time.Second)
+	if took := clock.waits(t, l, "tools/list", 5); took != 0 {
+		t.Errorf("refilled burst took %v, want 0", took)
+	}
+	if took := clock.waits(t, l, "tools/list", 1); took != 200*time.Millisecond {
+		t.Errorf("request past the refilled burst took %v, want 200ms", took)
+	}
+}
+
+func TestRateLimiterFractionalRate(t *testing.T) {
+	l := newRateLimiter(0.5, nil)
+	clock := useFakeClock(l)
+	// The burst is at least one request.
+	if took := clock.waits(t, l, "tools/list", 3); took != 4*time.Second {
+		t.Errorf("3 requests at 0.5/s took %v, want 4s", took)
+	}
+}
+
+func TestRateLimiterMethodOverride(t *testing.T) {
+	l := newRateLimiter(0, map[string]float64{"get_branch": 1, "tools/list": 2})
+	clock := useFakeClock(l)
+
+	if took := clock.waits(t, l, "tools/call:parallel_explore", 20); took != 0 {
+		t.Errorf("unthrottled tool took %v, want 0", took)
+	}
+	if took := clock.waits(t, l, "tools/call:get_branch", 4); took != 3*time.Second {
+		t.Errorf("4 get_branch polls at 1/s took %v, want 3s", took)
+	}
+	if took := clock.waits(t, l, "tools/list", 4); took != time.Second {
+		t.Errorf("4 tools/list at 2/s took %v, want 1s", took)
+	}
+
+	// With a global rate too, the stricter of the two applies.
+	l = newRateLimiter(10, map[string]float64{"get_branch": 1})
+	clock = useFakeClock(l)
+	if took := clock.waits(t, l, "tools/call:get_branch", 3); took != 2*time.Second {
+		t.Errorf("3 get_branch polls took %v, want 2s", took)
+	}
+	if took := clock.waits(t, l, "tools/call:branch_read_file", 10); took != 0 {
+		t.Errorf("other tools within the global burst took %v, want 0", took)
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	l := newRateLimiter(0, nil)
+	clock := useFakeClock(l)
+
+	l.pause(3 * time.Second)
+	l.pause(time.Second) // a shorter pause does not cut the longer one
+	if took := clock.waits(t, l, "tools/call:get_branch", 1); took != 3*time.Second {
+		t.Errorf("request during a 3s pause waited %v", took)
+	}
+	if took := clock.waits(t, l, "tools/call:get_branch", 5); took != 0 {
+		t.Errorf("requests after the pause waited %v, want 0", took)
+	}
+}
+
+// TestRateLimiterPausesOn429 checks that a 429's Retry-After holds the
+// client's next request.
+func TestRateLimiterPausesOn429(t *testing.T) {
+	srv, attempts := scriptedStatusServer(t, "7", http.StatusTooManyRequests)
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1})
+	defer client.Close()
+	clock := useFakeClock(client.limiter)
+	captureLogs(t)
+
+	if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err == nil {
+		t.Fatal("rate limited call succeeded")
+	}
+	if len(clock.sleeps) != 0 {
+		t.Fatalf("limiter slept %v before the 429", clock.sleeps)
+	}
+	if _, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("server saw %d attempts, want 2", n)
+	}
+	if !slices.Equal(clock.sleeps, []time.Duration{7 * time.Second}) {
+		t.Errorf("limiter slept %v, want the 7s Retry-After", clock.sleeps)
+	}
+}
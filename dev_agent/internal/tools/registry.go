@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tool is a function the model can call through a ToolHandler. Schema is
+// the JSON Schema of its arguments, which Handle coerces and validates
+// calls against before Run sees them. Run's result becomes the data of a
+// success payload; an error is reported like any built-in tool's, so a
+// ToolExecutionError can carry a code and details.
+type Tool struct {
+	Name        string
+	Description string
+	Schema      map[string]any
+	Run         func(ctx context.Context, args map[string]any) (map[string]any, error)
+}
+
+// Definition is the tool as offered to the LLM.
+func (t Tool) Definition() map[string]any {
+	fn := map[string]any{"name": t.Name, "parameters": t.Schema}
+	if t.Description != "" {
+		fn["description"] = t.Description
+	}
+	return map[string]any{"type": "function", "function": fn}
+}
+
+// Register adds a tool, e.g. a local shell tool of a program embedding the
+// package. Names are unique: a tool already registered, built-in or not,
+// is not replaced.
+func (h *ToolHandler) Register(tool Tool) error {
+	if tool.Name == "" {
+		return fmt.Errorf("tool has no name")
+	}
+	if tool.Run == nil {
+		return fmt.Errorf("tool %s has no Run function", tool.Name)
+	}
+	if tool.Schema == nil {
+		tool.Schema = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, dup := h.tools[tool.Name]; dup {
+		return fmt.Errorf("tool %s is already registered", tool.Name)
+	}
+	if h.tools == nil {
+		h.tools = map[string]Tool{}
+	}
+	h.tools[tool.Name] = tool
+	h.toolOrder = append(h.toolOrder, tool.Name)
+	return nil
+}
+
+// ToolDefinitions lists the registered tools, in registration order, as
+// offered to the LLM.
+func (h *ToolHandler) ToolDefinitions() []map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defs := make([]map[string]any, len(h.toolOrder))
+	for i, name := range h.toolOrder {
+		defs[i] = h.tools[name].Definition()
+	}
+	return defs
+}
+
+func (h *ToolHandler) tool(name string) (Tool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tools[name]
+	return t, ok
+}
+
+// GetToolDefinitions lists the built-in tools. Tools added with Register
+// are only in the handler's own ToolDefinitions.
+func GetToolDefinitions() []map[string]any {
+	return NewToolHandler(nil, "", "").ToolDefinitions()
+}
+
+// registerBuiltins registers the tools of builtinToolDefinitions.
+func (h *ToolHandler) registerBuiltins() {
+	runs := map[string]func(context.Context, map[string]any) (map[string]any, error){
+		"execute_agent":   h.executeAgent,
+		"check_status":    h.checkStatus,
+		"read_artifact":   h.readArtifact,
+		"branch_output":   h.branchOutput,
+		"write_artifact":  h.writeArtifact,
+		"list_artifacts":  h.listArtifacts,
+		"cancel_agent":    h.cancelAgent,
+		"branch_diff":     h.branchDiff,
+		"branch_logs":     h.branchLogs,
+		"branch_ancestry": h.branchAncestry,
+		"grep_artifact":   h.grepArtifact,
+		"run_tests":       h.runTests,
+	}
+	for _, def := range builtinToolDefinitions() {
+		fn, _ := def["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		desc, _ := fn["description"].(string)
+		schema, _ := fn["parameters"].(map[string]any)
+		if err := h.Register(Tool{Name: name, Description: desc, Schema: schema, Run: runs[name]}); err != nil {
+			panic("tools: built-in " + err.Error())
+		}
+	}
+	h.mu.Lock()
+	h.describeAgents()
+	h.mu.Unlock()
+}
@@ -0,0 +1,132 @@
+package tools
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// echoTool is a custom tool returning its arguments.
+func echoTool(name string) Tool {
+	return Tool{
+		Name:        name,
+		Description: "Echo the arguments back. For tests.",
+		Schema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"text":  map[string]any{"type": "string"},
+				"times": map[string]any{"type": "integer", "minimum": 1},
+			},
+			"required": []any{"text"},
+		},
+		Run: func(_ context.Context, args map[string]any) (map[string]any, error) {
+			return map[string]any{"echo": args}, nil
+		},
+	}
+}
+
+func toolNames(defs []map[string]any) []string {
+	names := make([]string, len(defs))
+	for i, def := range defs {
+		fn, _ := def["function"].(map[string]any)
+		names[i], _ = fn["name"].(string)
+	}
+	return names
+}
+
+func TestRegisterConflicts(t *testing.T) {
+	h, srv := newTestHandler(t)
+	if err := h.Register(echoTool("echo")); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		tool Tool
+		err  string
+	}{
+		{"built-in name", echoTool("check_status"), "tool check_status is already registered"},
+		{"custom name", echoTool("echo"), "tool echo is already registered"},
+		{"no name", echoTool(""), "tool has no name"},
+		{"no Run", Tool{Name: "idle"}, "tool idle has no Run function"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := h.Register(c.tool); err == nil || err.Error() != c.err {
+				t.Errorf("Register = %v, want %q", err, c.err)
+			}
+		})
+	}
+
+	// The rejected registrations changed nothing.
+	if names := toolNames(h.ToolDefinitions()); len(names) != len(GetToolDefinitions())+1 || names[len(names)-1] != "echo" {
+		t.Errorf("tools = %v, want the built-ins and echo once", names)
+	}
+	fastPolls(h)
+	srv.ScriptBranch("b-1", "succeed")
+	if data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"})); data["echo"] != nil {
+		t.Errorf("check_status = %v, want the built-in", data)
+	}
+}
+
+func TestRegisteredToolCall(t *testing.T) {
+	h, _ := newTestHandler(t)
+	if err := h.Register(echoTool("echo")); err != nil {
+		t.Fatal(err)
+	}
+	data := mustSucceed(t, callTool(h, "echo", map[string]any{"text": "hi", "times": "2"}))
+	if want := map[string]any{"text": "hi", "times": 2.0}; !reflect.DeepEqual(data["echo"], want) {
+		t.Errorf("echo = %v, want %v coerced by the schema", data["echo"], want)
+	}
+
+	violations := validationErrors(t, callTool(h, "echo", map[string]any{"times": 0}))
+	if len(violations) != 2 || violations["text"] == "" || violations["times"] != "must be >= 1, got 0" {
+		t.Errorf("violations = %v, want text missing and times below its minimum", violations)
+	}
+
+	code, details := mustFail(t, callTool(h, "ech", nil))
+	hint, _ := details["did_you_mean"].(map[string]any)
+	if code != CodeUnknownTool || hint["name"] != "echo" {
+		t.Errorf("code %s, details %v; want unknown with echo suggested", code, details)
+	}
+	supported, _ := details["supported_tools"].([]any)
+	if len(supported) == 0 || supported[len(supported)-1] != "echo" {
+		t.Errorf("supported_tools = %v, want echo listed", supported)
+	}
+}
+
+func TestToolDefinitionsFromRegistry(t *testing.T) {
+	builtins := GetToolDefinitions()
+	if got, want := toolNames(builtins), toolNames(builtinToolDefinitions()); !reflect.DeepEqual(got, want) {
+		t.Errorf("built-ins = %v, want %v", got, want)
+	}
+	for _, def := range builtins {
+		fn, _ := def["function"].(map[string]any)
+		params, _ := fn["parameters"].(map[string]any)
+		if def["type"] != "function" || params["type"] != "object" || fn["description"] == "" {
+			t.Errorf("definition %v lacks its type, schema or description", def)
+		}
+	}
+
+	h, _ := newTestHandler(t)
+	bare := Tool{Name: "bare", Run: func(context.Context, map[string]any) (map[string]any, error) { return nil, nil }}
+	for _, tool := range []Tool{echoTool("echo"), bare} {
+		if err := h.Register(tool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defs := h.ToolDefinitions()
+	if got := toolNames(defs[len(builtins):]); !reflect.DeepEqual(got, []string{"echo", "bare"}) {
+		t.Fatalf("custom tools = %v, want echo and bare in registration order", got)
+	}
+	echo := defs[len(builtins)]["function"].(map[string]any)
+	if echo["description"] != "Echo the arguments back. For tests." || !reflect.DeepEqual(echo["parameters"], echoTool("echo").Schema) {
+		t.Errorf("echo definition = %v", echo)
+	}
+	plain := defs[len(builtins)+1]["function"].(map[string]any)
+	if _, has := plain["description"]; has || !reflect.DeepEqual(plain["parameters"], map[string]any{"type": "object", "properties": map[string]any{}}) {
+		t.Errorf("bare definition = %v, want no description and an empty object schema", plain)
+	}
+	if n := len(GetToolDefinitions()); n != len(builtins) {
+		t.Errorf("GetToolDefinitions has %d tools after Register, want the %d built-ins", n, len(builtins))
+	}
+}
@@ -0,0 +1,71 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"dev_agent/internal/logx"
+)
+
+// CodeInvalidResponse marks an MCP reply that does not have the expected
+// shape.
+const CodeInvalidResponse = "invalid_response"
+
+// maxSchemaDumpBytes bounds the raw response quoted in schema errors.
+const maxSchemaDumpBytes = 1000
+
+// ResponseSchemaError names the field of an MCP tool reply that was missing
+// or had the wrong type.
+type ResponseSchemaError struct {
+	Tool    string
+	Field   string
+	Problem string
+	Raw     string
+}
+
+func (e *ResponseSchemaError) Error() string {
+	return fmt.Sprintf("%s response: %s %s (raw: %s)", e.Tool, e.Field, e.Problem, e.Raw)
+}
+
+func (e *ResponseSchemaError) toolError() ToolExecutionError {
+	return ToolExecutionError{
+		Code: CodeInvalidResponse,
+		Msg:  fmt.Sprintf("Unexpected %s response: %s %s", e.Tool, e.Field, e.Problem),
+		Details: map[string]any{
+			"tool":         e.Tool,
+			"field":        e.Field,
+			"problem":      e.Problem,
+			"raw_response": e.Raw,
+		},
+	}
+}
+
+func unwrapStructured(resp map[string]any) map[string]any {
+	if sc, ok := resp["structuredContent"].(map[string]any); ok {
+		return sc
+	}
+	return resp
+}
+
+func decodeInto(body map[string]any, v any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// schemaError turns a decode failure into a ResponseSchemaError naming the
+// offending field.
+func schemaError(tool, prefix string, err error, resp map[string]any) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ResponseSchemaError{Tool: tool, Field: prefix + typeErr.Field, Problem: fmt.Sprintf("has type %s, want %s", typeErr.Value, typeErr.Type), Raw: rawDump(resp)}
+	}
+	return &ResponseSchemaError{Tool: tool, Field: "(body)", Problem: err.Error(), Raw: rawDump(resp)}
+}
+
+func rawDump(resp map[string]any) string {
+	return logx.Truncate(toJSON(resp), maxSchemaDumpBytes)
+}
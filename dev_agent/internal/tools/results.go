@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+// Tool result budget defaults; see SetResultBudget.
+const (
+	defaultResultMaxBytes = 16 * 1024
+	defaultResultDir      = "dev-agent-artifacts"
+	// resultExcerptBytes bounds each of the head and tail kept in the stub
+	// of a spilled result.
+	resultExcerptBytes = 2048
+)
+
+// SetResultBudget bounds the JSON of every Handle result to maxBytes; a
+// bigger result is saved under dir and replaced by a stub (see fitResult).
+// HandleFull results are not bounded. maxBytes <= 0 and dir "" keep the
+// defaults.
+func (h *ToolHandler) SetResultBudget(maxBytes int, dir string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if maxBytes > 0 {
+		h.resultMax = maxBytes
+	}
+	if dir != "" {
+		h.resultDir = dir
+	}
+}
+
+// fitResult returns payload unchanged when its JSON fits the budget.
+// Otherwise the largest text field of its data (or the whole payload when
+// there is none) is written to <dir>/<branch>/<path> and the model gets a
+// stub with the local path, the total size and the first and last bytes,
+// so one large read cannot overflow the conversation.
+func (h *ToolHandler) fitResult(tool string, args, payload map[string]any) map[string]any {
+	h.mu.Lock()
+	budget, dir := h.resultMax, h.resultDir
+	h.mu.Unlock()
+	text := toJSON(payload)
+	if len(text) <= budget {
+		return payload
+	}
+	data, _ := payload["data"].(map[string]any)
+	field, content := largestString(data)
+	if len(content) < len(text)/2 {
+		// No single field dominates: keep the payload whole.
+		field, content = "", text
+	}
+	branchID := firstNonEmpty(str(args["branch_id"]), str(data["branch_id"]), "run")
+	stub := map[string]any{
+		"status":     payload["status"],
+		"spilled":    true,
+		"tool":       tool,
+		"branch_id":  branchID,
+		"total_size": len(content),
+	}
+	if p := str(args["path"]); p != "" {
+		stub["path"] = p
+	}
+	if field != "" {
+		stub["field"] = field
+	}
+	for _, k := range []string{"error", "code", "retryable", "error_kind", "truncated", "total_bytes"} {
+		if v, ok := payload[k]; ok {
+			stub[k] = v
+		} else if v, ok := data[k]; ok {
+			stub[k] = v
+		}
+	}
+	stub["head"] = trimRunes([]byte(content[:min(resultExcerptBytes, len(content))]), false)
+	if len(content) > resultExcerptBytes {
+		stub["tail"] = trimRunes([]byte(content[max(len(content)-resultExcerptBytes, resultExcerptBytes):]), true)
+	}
+	local, err := h.saveResult(dir, tool, branchID, str(args["path"]), field == "", content)
+	if err != nil {
+		logx.Warningf("Could not save the %d-byte %s result locally: %v", len(content), tool, err)
+		stub["note"] = fmt.Sprintf("Result of %d bytes exceeds the %d-byte budget and could not be saved locally; only its head and tail are shown.", len(text), budget)
+		return stub
+	}
+	logx.Infof("%s result of %d bytes exceeds the %d-byte budget; saved to %s", tool, len(text), budget, local)
+	stub["local_path"] = local
+	stub["note"] = fmt.Sprintf("Result of %d bytes exceeds the %d-byte budget; the full content is in local_path and only its head and tail are shown.", len(text), budget)
+	if tool == "read_artifact" {
+		stub["note"] = stub["note"].(string) + " Read it in smaller ranges (offset/max_bytes) to see the rest."
+	}
+	return stub
+}
+
+// saveResult writes a spilled result to dir/<branch>/<path> for artifact
+// reads and dir/<branch>/<tool>-<n>.<ext> otherwise. Paths are cleaned so
+// they cannot leave dir.
+func (h *ToolHandler) saveResult(dir, tool, branchID, artifact string, whole bool, content string) (string, error) {
+	name := strings.TrimPrefix(filepath.Clean("/"+filepath.FromSlash(artifact)), string(filepath.Separator))
+	if artifact == "" || whole {
+		h.mu.Lock()
+		h.resultSeq++
+		seq := h.resultSeq
+		h.mu.Unlock()
+		ext := ".txt"
+		if whole {
+			ext = ".json"
+		}
+		name = fmt.Sprintf("%s-%d%s", tool, seq, ext)
+	}
+	local := filepath.Join(dir, filepath.Base(filepath.Clean("/"+branchID)), name)
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(local, []byte(content), 0o644); err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// largestString returns the longest string field of m.
+func largestString(m map[string]any) (string, string) {
+	var field, value string
+	for k, v := range m {
+		if s, ok := v.(string); ok && len(s) > len(value) {
+			field, value = k, s
+		}
+	}
+	return field, value
+}
@@ -0,0 +1,137 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFitResultWithinBudget(t *testing.T) {
+	h, _ := newTestHandler(t)
+	dir := t.TempDir()
+	h.SetResultBudget(1024, dir)
+	payload := map[string]any{"status": "success", "data": map[string]any{"content": strings.Repeat("x", 900)}}
+	if got := h.fitResult("read_artifact", map[string]any{"branch_id": "b-1"}, payload); !reflect.DeepEqual(got, payload) {
+		t.Errorf("result = %v, want the payload unchanged", got)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("saved %v for a result within budget", files)
+	}
+}
+
+// TestFitResultStub reads an artifact over the budget and checks the stub
+// the model gets and that the saved file holds the whole artifact.
+func TestFitResultStub(t *testing.T) {
+	const path = "/home/dev/workspace/review.log"
+	h, srv := newTestHandler(t)
+	dir := t.TempDir()
+	h.SetResultBudget(8*1024, dir)
+	content := "P0: first finding\n" + strings.Repeat("context line\n", 3000) + "P1: last finding ✓\n"
+	srv.PutArtifact("b-1", path, content)
+
+	stub := callTool(h, "read_artifact", map[string]any{"branch_id": "b-1", "path": path})
+	want := map[string]any{"status": "success", "spilled": true, "tool": "read_artifact", "branch_id": "b-1", "path": path, "field": "content", "total_size": len(content)}
+	for k, v := range want {
+		if stub[k] != v {
+			t.Errorf("stub[%s] = %v, want %v", k, stub[k], v)
+		}
+	}
+	head, _ := stub["head"].(string)
+	tail, _ := stub["tail"].(string)
+	if len(head) > resultExcerptBytes || !strings.HasPrefix(content, head) || !strings.HasPrefix(head, "P0: first finding\n") {
+		t.Errorf("head = %d bytes %.40q, want the first %d bytes", len(head), head, resultExcerptBytes)
+	}
+	if len(tail) > resultExcerptBytes || !strings.HasSuffix(content, tail) || !strings.HasSuffix(tail, "P1: last finding ✓\n") {
+		t.Errorf("tail = %d bytes, want the last %d bytes", len(tail), resultExcerptBytes)
+	}
+	if note, _ := stub["note"].(string); !strings.Contains(note, "offset/max_bytes") {
+		t.Errorf("note = %q, want a hint to read in ranges", note)
+	}
+	if n := len(toJSON(stub)); n > 8*1024 {
+		t.Errorf("stub is %d bytes, over the budget", n)
+	}
+
+	local, _ := stub["local_path"].(string)
+	if want := filepath.Join(dir, "b-1", "home", "dev", "workspace", "review.log"); local != want {
+		t.Errorf("local_path = %q, want %q", local, want)
+	}
+	if got, err := os.ReadFile(local); err != nil || string(got) != content {
+		t.Errorf("saved file holds %d bytes (%v), want the artifact", len(got), err)
+	}
+}
+
+// TestHandleFullUnbudgeted checks HandleFull returns a result over the
+// budget whole, without saving it, while Handle spills it.
+func TestHandleFullUnbudgeted(t *testing.T) {
+	const path = "/home/dev/workspace/worklog.md"
+	h, srv := newTestHandler(t)
+	dir := t.TempDir()
+	h.SetResultBudget(1024, dir)
+	content := strings.Repeat("pushing\n", 1000)
+	srv.PutArtifact("b-1", path, content)
+	call := ToolCall{Type: "function"}
+	call.Function.Name = "read_artifact"
+	call.Function.Arguments = toJSON(map[string]any{"branch_id": "b-1", "path": path})
+
+	data := mustSucceed(t, h.HandleFull(context.Background(), call))
+	if data["content"] != content {
+		t.Errorf("content = %d bytes, want the whole %d-byte artifact", len(str(data["content"])), len(content))
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("HandleFull saved %v", files)
+	}
+	if stub := h.Handle(context.Background(), call); stub["spilled"] != true {
+		t.Errorf("Handle = %v, want the same result spilled", stub)
+	}
+}
+
+// TestFitResultWholePayload checks a result without a dominant text field
+// is saved whole as JSON that decodes back to the payload.
+func TestFitResultWholePayload(t *testing.T) {
+	h, _ := newTestHandler(t)
+	dir := t.TempDir()
+	h.SetResultBudget(1024, dir)
+	var entries []any
+	for i := 0; i < 100; i++ {
+		entries = append(entries, map[string]any{"path": "docs/page.md", "size": float64(i)})
+	}
+	payload := map[string]any{"status": "success", "data": map[string]any{"branch_id": "b-2", "entries": entries}}
+
+	stub := h.fitResult("list_artifacts", map[string]any{}, payload)
+	if stub["branch_id"] != "b-2" || stub["field"] != nil || stub["spilled"] != true {
+		t.Errorf("stub = %v, want the whole payload of b-2 spilled", stub)
+	}
+	local, _ := stub["local_path"].(string)
+	if filepath.Dir(local) != filepath.Join(dir, "b-2") || !strings.HasSuffix(local, ".json") {
+		t.Errorf("local_path = %q, want a .json file under %s/b-2", local, dir)
+	}
+	raw, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]any
+	if err := json.Unmarshal(raw, &saved); err != nil || !reflect.DeepEqual(saved, payload) {
+		t.Errorf("saved JSON = %v (%v), want the payload", saved, err)
+	}
+}
+
+func TestSaveResultStaysInDir(t *testing.T) {
+	h, _ := newTestHandler(t)
+	dir := t.TempDir()
+	for _, c := range []struct{ branch, path string }{
+		{"b-1", "../../etc/passwd"},
+		{"../../b-1", "/etc/passwd"},
+	} {
+		local, err := h.saveResult(dir, "read_artifact", c.branch, c.path, false, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, "b-1", "etc", "passwd"); local != want {
+			t.Errorf("branch %q, path %q saved to %q, want %q", c.branch, c.path, local, want)
+		}
+	}
+}
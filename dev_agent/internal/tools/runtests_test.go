@@ -0,0 +1,107 @@
+package tools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// TestRunTests drives run_tests against the fake server: the test branch
+// is launched off the Fix branch, its canned summary is parsed, and the
+// Fix branch stays the latest.
+func TestRunTests(t *testing.T) {
+	h, srv := newTestHandler(t)
+	fixBranch := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Fix the P0 issues.", "parent_branch_id": testParent}))["branch_id"].(string)
+	testBranch := fakeBranchID(2)
+	srv.PutArtifact(testBranch, "test_results.json", `{"command": "go test ./...", "passed": 41, "failed": 2, "skipped": 1,
+		"failing_tests": [{"name": "TestParse", "message": "  want 3, got 4\n"}, "TestServe"]}`)
+
+	data := mustSucceed(t, callTool(h, "run_tests", map[string]any{"branch_id": fixBranch, "command": "go test ./..."}))
+	want := map[string]any{
+		"passed": 41, "failed": 2, "skipped": 1, "errors": 0, "total": 44,
+		"failing_tests":    []string{"TestParse", "TestServe"},
+		"failures":         []any{map[string]any{"name": "TestParse", "message": "want 3, got 4"}},
+		"command":          "go test ./...",
+		"all_passed":       false,
+		"branch_id":        testBranch,
+		"parent_branch_id": fixBranch,
+		"results_path":     "test_results.json",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("data =\n%v\nwant\n%v", data, want)
+	}
+
+	launch := srv.CallsTo("parallel_explore")[1].Arguments
+	prompt := toJSON(launch["shared_prompt_sequence"])
+	if launch["parent_branch_id"] != fixBranch || launch["agent"] != "claude_code" || !strings.Contains(prompt, "Use this command: go test ./...") || !strings.Contains(prompt, "'test_results.json'") {
+		t.Errorf("launch = %v, want a test-only prompt off the Fix branch", launch)
+	}
+	if latest := h.BranchRange()["latest_branch_id"]; latest != fixBranch {
+		t.Errorf("latest branch = %s, want the Fix branch %s", latest, fixBranch)
+	}
+	lineage := h.BranchLineage()
+	if got := lineage[len(lineage)-1]; got.BranchID != testBranch || got.Phase != "test" || got.Parent != fixBranch {
+		t.Errorf("test branch record = %+v, want phase test off %s", got, fixBranch)
+	}
+}
+
+func TestRunTestsFailures(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(srv *mcptest.FakeServer)
+		code  string
+		msg   string
+	}{
+		{"no results file", func(srv *mcptest.FakeServer) {}, CodeToolFailed, "test_results.json could not be read"},
+		{"unparsable results", func(srv *mcptest.FakeServer) {
+			srv.PutArtifact(fakeBranchID(1), "test_results.json", "41 passed")
+		}, CodeToolFailed, "test_results.json could not be read"},
+		{"failed run", func(srv *mcptest.FakeServer) {
+			srv.ScriptBranch(fakeBranchID(1), "failed")
+		}, CodeAgentFailed, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			fastPolls(h)
+			c.setup(srv)
+			res := callTool(h, "run_tests", map[string]any{"branch_id": testParent})
+			code, msg, details, _ := ErrorInfo(res)
+			if code != c.code || !strings.Contains(msg, c.msg) {
+				t.Errorf("code %s, message %q; want %s containing %q", code, msg, c.code, c.msg)
+			}
+			if details["branch_id"] != fakeBranchID(1) {
+				t.Errorf("details = %v, want the test branch", details)
+			}
+			if lineage := h.BranchLineage(); len(lineage) != 1 || lineage[0].Phase != "test" {
+				t.Errorf("lineage = %+v, want the test branch recorded", lineage)
+			}
+		})
+	}
+}
+
+func TestParseTestSummary(t *testing.T) {
+	cases := []struct {
+		name    string
+		summary map[string]any
+		want    map[string]any
+	}{
+		{"all passed", map[string]any{"passed": 10.0, "failed": 0.0},
+			map[string]any{"passed": 10, "failed": 0, "skipped": 0, "errors": 0, "total": 10, "failing_tests": []string{}, "all_passed": true}},
+		{"num_ names and total", map[string]any{"num_passed": 3.0, "num_failed": 1.0, "num_tests": 5.0, "failures": []any{map[string]any{"nodeid": "t.py::x"}}},
+			map[string]any{"passed": 3, "failed": 1, "skipped": 0, "errors": 0, "total": 5, "failing_tests": []string{"t.py::x"}, "all_passed": false}},
+		{"could not run", map[string]any{"passed": 0.0, "error": "no go toolchain"},
+			map[string]any{"passed": 0, "failed": 0, "skipped": 0, "errors": 0, "total": 0, "failing_tests": []string{}, "run_error": "no go toolchain", "all_passed": false}},
+		{"errors only", map[string]any{"passed": 4.0, "errors": 1.0},
+			map[string]any{"passed": 4, "failed": 0, "skipped": 0, "errors": 1, "total": 5, "failing_tests": []string{}, "all_passed": false}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := parseTestSummary(c.summary); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseTestSummary =\n%v\nwant\n%v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+// coerceArgs rewrites the values the model gets obviously wrong into the
+// type the tool's schema declares: numeric strings for number and integer
+// fields, "true"/"false" for boolean ones. Anything else is left for
+// validateArgs to report.
+func coerceArgs(name string, schema, args map[string]any) {
+	props, _ := schema["properties"].(map[string]any)
+	for field, v := range args {
+		prop, _ := props[field].(map[string]any)
+		s, isString := v.(string)
+		if prop == nil || !isString {
+			continue
+		}
+		switch prop["type"] {
+		case "number", "integer":
+			if f, ok := asNumber(s); ok {
+				logx.Infof("Coerced %s argument %s from string %q to %v", name, field, s, f)
+				args[field] = f
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+				logx.Infof("Coerced %s argument %s from string %q to %t", name, field, s, b)
+				args[field] = b
+			}
+		}
+	}
+}
+
+// validateArgs checks args against the tool's schema: required
+// fields, JSON types, numeric ranges and enums. Run coerceArgs first; the
+// numeric strings it leaves are still accepted because the tools parse
+// them. The returned error lists every violation as validation_errors
+// ({field, problem}) and carries the relevant schema snippet so the model
+// can fix all of them in one retry.
+func validateArgs(name string, schema, args map[string]any) error {
+	props, _ := schema["properties"].(map[string]any)
+	var violations []string
+	var errs []map[string]any
+	bad := map[string]any{}
+	violate := func(field, problem string) {
+		violations = append(violations, fmt.Sprintf("%s: %s", field, problem))
+		errs = append(errs, map[string]any{"field": field, "problem": problem})
+		bad[field] = props[field]
+	}
+
+	required, _ := schema["required"].([]any)
+	for _, r := range required {
+		field, _ := r.(string)
+		v, present := args[field]
+		if !present || v == nil || v == "" {
+			violate(field, "required field is missing")
+		}
+	}
+
+	fields := make([]string, 0, len(args))
+	for field := range args {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		prop, _ := props[field].(map[string]any)
+		if prop == nil || args[field] == nil {
+			continue
+		}
+		for _, problem := range checkProperty(prop, args[field]) {
+			violate(field, problem)
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return ToolExecutionError{
+		Code: CodeInvalidArguments,
+		Msg:  fmt.Sprintf("Invalid arguments for %s: %s", name, strings.Join(violations, "; ")),
+		Details: map[string]any{
+			"validation_errors": errs,
+			"schema":            map[string]any{"properties": bad, "required": required},
+		},
+	}
+}
+
+func checkProperty(prop map[string]any, v any) []string {
+	typ, _ := prop["type"].(string)
+	var problems []string
+	switch typ {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("expected string, got %s", jsonType(v))}
+		}
+		if enum, ok := prop["enum"].([]any); ok && !enumContains(enum, s) {
+			problems = append(problems, fmt.Sprintf("must be one of %s, got %q", toJSON(enum), s))
+		}
+	case "number", "integer":
+		f, ok := asNumber(v)
+		if !ok {
+			return []string{fmt.Sprintf("expected %s, got %s", typ, jsonType(v))}
+		}
+		if typ == "integer" && f != math.Trunc(f) {
+			problems = append(problems, fmt.Sprintf("expected integer, got %v", f))
+		}
+		if minV, ok := prop["minimum"]; ok {
+			if m, ok := asNumber(minV); ok && f < m {
+				problems = append(problems, fmt.Sprintf("must be >= %v, got %v", m, f))
+			}
+		}
+		if maxV, ok := prop["maximum"]; ok {
+			if m, ok := asNumber(maxV); ok && f > m {
+				problems = append(problems, fmt.Sprintf("must be <= %v, got %v", m, f))
+			}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("expected boolean, got %s", jsonType(v))}
+		}
+	case "array":
+		if _, ok := v.([]any); !ok {
+			return []string{fmt.Sprintf("expected array, got %s", jsonType(v))}
+		}
+	case "object":
+		if _, ok := v.(map[string]any); !ok {
+			return []string{fmt.Sprintf("expected object, got %s", jsonType(v))}
+		}
+	}
+	return problems
+}
+
+func asNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+func enumContains(enum []any, s string) bool {
+	for _, e := range enum {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64, int:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
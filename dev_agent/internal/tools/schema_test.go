@@ -0,0 +1,295 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// validationErrors returns the {field, problem} pairs of an INVALID_ARGS
+// result.
+func validationErrors(t *testing.T, result map[string]any) map[string]string {
+	t.Helper()
+	code, details := mustFail(t, result)
+	if code != CodeInvalidArguments {
+		t.Fatalf("code = %s, want %s", code, CodeInvalidArguments)
+	}
+	errs, _ := details["validation_errors"].([]map[string]any)
+	out := map[string]string{}
+	for _, e := range errs {
+		out[e["field"].(string)] = e["problem"].(string)
+	}
+	return out
+}
+
+func TestValidateArgsMissingRequired(t *testing.T) {
+	h, srv := newTestHandler(t)
+	got := validationErrors(t, callTool(h, "execute_agent", map[string]any{"prompt": "Implement it"}))
+	want := map[string]string{"agent": "required field is missing", "parent_branch_id": "required field is missing"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("violations = %v, want %v", got, want)
+	}
+	if n := len(srv.CallsTo("parallel_explore")); n != 0 {
+		t.Errorf("an invalid call was dispatched %d times", n)
+	}
+}
+
+func TestValidateArgsWrongTypes(t *testing.T) {
+	h, _ := newTestHandler(t)
+	result := callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": 42, "parent_branch_id": testParent, "timeout_seconds": "soon", "prompts": "one"})
+	got := validationErrors(t, result)
+	want := map[string]string{
+		"prompt":          "expected string, got number",
+		"timeout_seconds": "expected number, got string",
+		"prompts":         "expected array, got string",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("violations = %v, want %v", got, want)
+	}
+	_, msg, details, _ := ErrorInfo(result)
+	for field := range want {
+		if !strings.Contains(msg, field+": ") {
+			t.Errorf("message does not name %s: %s", field, msg)
+		}
+	}
+	schema, _ := details["schema"].(map[string]any)
+	props, _ := schema["properties"].(map[string]any)
+	if len(props) != 3 || props["prompt"] == nil {
+		t.Errorf("schema snippet = %v, want just the violated properties", schema)
+	}
+}
+
+func TestValidateArgsNumBranchesRange(t *testing.T) {
+	h, _ := newTestHandler(t)
+	for _, n := range []any{0.0, -1.0, "0"} {
+		got := validationErrors(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "p", "parent_branch_id": testParent, "num_branches": n}))
+		if !strings.HasPrefix(got["num_branches"], "must be >= 1") {
+			t.Errorf("num_branches %v: violations = %v", n, got)
+		}
+	}
+	got := validationErrors(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "p", "parent_branch_id": testParent, "num_branches": 1.5}))
+	if got["num_branches"] != "expected integer, got 1.5" {
+		t.Errorf("violations = %v", got)
+	}
+}
+
+// TestValidateArgsPerTool calls each tool without arguments and checks
+// every required field it does not default is reported.
+func TestValidateArgsPerTool(t *testing.T) {
+	missing := map[string][]string{
+		"execute_agent":   {"agent", "parent_branch_id"},
+		"run_tests":       {"branch_id"},
+		"branch_diff":     {"branch_id"},
+		"cancel_agent":    {"branch_id"},
+		"read_artifact":   {"branch_id", "path"},
+		"grep_artifact":   {"branch_id", "path", "pattern"},
+		"list_artifacts":  {"branch_id"},
+		"write_artifact":  {"branch_id", "path", "content"},
+		"branch_output":   {"branch_id"},
+		"branch_logs":     {"branch_id"},
+		"branch_ancestry": {"branch_id"},
+	}
+	h, srv := newTestHandler(t)
+	for _, def := range h.ToolDefinitions() {
+		fn, _ := def["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		params, _ := fn["parameters"].(map[string]any)
+		if _, ok := missing[name]; !ok && params["required"] != nil {
+			t.Errorf("%s has required fields but no case", name)
+		}
+	}
+	for name, fields := range missing {
+		t.Run(name, func(t *testing.T) {
+			got := validationErrors(t, callTool(h, name, map[string]any{}))
+			want := map[string]string{}
+			for _, f := range fields {
+				want[f] = "required field is missing"
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("violations = %v, want %v", got, want)
+			}
+		})
+	}
+	if calls := srv.Calls(); len(calls) != 0 {
+		t.Errorf("invalid calls reached the server: %v", calls)
+	}
+}
+
+// TestValidateArgsViolationTypes checks each kind of violation through the
+// tool that declares it.
+func TestValidateArgsViolationTypes(t *testing.T) {
+	cases := []struct {
+		name    string
+		tool    string
+		args    map[string]any
+		field   string
+		problem string
+	}{
+		{"string", "grep_artifact", map[string]any{"branch_id": "b-1", "path": "worklog.md", "pattern": 5.0}, "pattern", "expected string, got number"},
+		{"number", "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": true}, "timeout_seconds", "expected number, got boolean"},
+		{"integer", "read_artifact", map[string]any{"branch_id": "b-1", "path": "worklog.md", "max_bytes": 2.5}, "max_bytes", "expected integer, got 2.5"},
+		{"minimum", "branch_logs", map[string]any{"branch_id": "b-1", "tail_lines": 0.0}, "tail_lines", "must be >= 1, got 0"},
+		{"maximum", "grep_artifact", map[string]any{"branch_id": "b-1", "path": "worklog.md", "pattern": "P0", "max_matches": 501.0}, "max_matches", "must be <= 500, got 501"},
+		{"enum", "read_artifact", map[string]any{"branch_id": "b-1", "path": "worklog.md", "encoding": "hex"}, "encoding", `must be one of ["text","base64"], got "hex"`},
+		{"boolean", "branch_output", map[string]any{"branch_id": "b-1", "full_output": "maybe"}, "full_output", "expected boolean, got string"},
+		{"array", "check_status", map[string]any{"branch_ids": "b-1"}, "branch_ids", "expected array, got string"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, srv := newTestHandler(t)
+			got := validationErrors(t, callTool(h, c.tool, c.args))
+			if want := map[string]string{c.field: c.problem}; !reflect.DeepEqual(got, want) {
+				t.Errorf("violations = %v, want %v", got, want)
+			}
+			if calls := srv.Calls(); len(calls) != 0 {
+				t.Errorf("an invalid call reached the server: %v", calls)
+			}
+		})
+	}
+
+	t.Run("coerced", func(t *testing.T) {
+		h, srv := newTestHandler(t)
+		srv.Respond("branch_output", map[string]any{"output": "done"})
+		mustSucceed(t, callTool(h, "branch_output", map[string]any{"branch_id": "b-1", "full_output": "true"}))
+		if calls := srv.CallsTo("branch_output"); len(calls) != 1 || calls[0].Arguments["full_output"] != true {
+			t.Errorf("calls = %v, want full_output coerced to true", calls)
+		}
+	})
+}
+
+func TestCheckProperty(t *testing.T) {
+	enum := map[string]any{"type": "string", "enum": []any{"head", "tail"}}
+	if p := checkProperty(enum, "middle"); len(p) != 1 || !strings.Contains(p[0], `must be one of ["head","tail"]`) {
+		t.Errorf("enum problems = %v", p)
+	}
+	if p := checkProperty(enum, "tail"); len(p) != 0 {
+		t.Errorf("valid enum value rejected: %v", p)
+	}
+	bounded := map[string]any{"type": "number", "minimum": 1, "maximum": 10}
+	if p := checkProperty(bounded, 11.0); len(p) != 1 || p[0] != "must be <= 10, got 11" {
+		t.Errorf("maximum problems = %v", p)
+	}
+	if p := checkProperty(map[string]any{"type": "boolean"}, "yes"); len(p) != 1 {
+		t.Errorf("boolean problems = %v", p)
+	}
+	if p := checkProperty(map[string]any{"type": "object"}, []any{}); len(p) != 1 || p[0] != "expected object, got array" {
+		t.Errorf("object problems = %v", p)
+	}
+}
+
+func TestCoerceArgs(t *testing.T) {
+	schema := map[string]any{"properties": map[string]any{
+		"n":    map[string]any{"type": "integer"},
+		"full": map[string]any{"type": "boolean"},
+		"name": map[string]any{"type": "string"},
+	}}
+	args := map[string]any{"n": " 3 ", "full": "true", "name": "7", "extra": "1"}
+	coerceArgs("tool", schema, args)
+	want := map[string]any{"n": 3.0, "full": true, "name": "7", "extra": "1"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("coerced = %v, want %v", args, want)
+	}
+}
+
+// renamedReadSchema is a branch_read_file schema from a server that renamed
+// file_path to path.
+var renamedReadSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"branch_id": map[string]any{"type": "string"},
+		"path":      map[string]any{"type": "string"},
+	},
+	"required": []any{"branch_id", "path"},
+}
+
+func TestServerSchemaChecks(t *testing.T) {
+	closed := map[string]any{
+		"type":                 "object",
+		"properties":           map[string]any{"branch_id": map[string]any{"type": "string"}},
+		"additionalProperties": false,
+	}
+	cases := []struct {
+		name     string
+		schema   map[string]any
+		args     map[string]any
+		property string // "" when the call should reach the server
+		problem  string
+	}{
+		{"missing required", renamedReadSchema, map[string]any{"branch_id": "b-1", "file_path": "/w/a.md"}, "path", "is required but missing"},
+		{"unexpected property", closed, map[string]any{"branch_id": "b-1", "file_path": "/w/a.md"}, "file_path", "is not accepted (expected one of branch_id)"},
+		{"wrong type", renamedReadSchema, map[string]any{"branch_id": "b-1", "path": 7}, "path", "expected string"},
+		{"unknown property of an open schema", renamedReadSchema, map[string]any{"branch_id": "b-1", "path": "/w/a.md", "extra": true}, "", ""},
+		{"matching", renamedReadSchema, map[string]any{"branch_id": "b-1", "path": "/w/a.md"}, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := mcptest.NewFakeServer()
+			t.Cleanup(srv.Close)
+			srv.SetSchema("branch_read_file", c.schema)
+			client := newTestClient(t, srv)
+			if _, err := client.ListTools(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			_, err := client.CallTool(context.Background(), "branch_read_file", c.args)
+			sent := len(srv.CallsTo("branch_read_file"))
+			var ae ArgumentError
+			if c.property == "" {
+				if errors.As(err, &ae) || sent != 1 {
+					t.Errorf("err = %v with %d calls sent, want the call to reach the server", err, sent)
+				}
+				return
+			}
+			if !errors.As(err, &ae) || ae.Tool != "branch_read_file" || ae.Property != c.property || !strings.Contains(ae.Problem, c.problem) {
+				t.Fatalf("err = %#v, want an ArgumentError on %q (%s)", err, c.property, c.problem)
+			}
+			if sent != 0 {
+				t.Errorf("rejected arguments were sent %d times", sent)
+			}
+		})
+	}
+}
+
+func TestServerSchemaCheckSkipped(t *testing.T) {
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	srv.SetSchema("branch_read_file", renamedReadSchema)
+	args := map[string]any{"branch_id": "b-1", "file_path": "/w/a.md"}
+
+	// Nothing is checked before tools/list has been fetched.
+	client := newTestClient(t, srv)
+	if _, err := client.CallTool(context.Background(), "branch_read_file", args); errors.As(err, new(ArgumentError)) {
+		t.Errorf("call before tools/list: err = %v, want no schema check", err)
+	}
+
+	skipping := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, SkipArgValidation: true})
+	defer skipping.Close()
+	if _, err := skipping.ListTools(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := skipping.CallTool(context.Background(), "branch_read_file", args); errors.As(err, new(ArgumentError)) {
+		t.Errorf("SkipArgValidation: err = %v, want no schema check", err)
+	}
+	if n := len(srv.CallsTo("branch_read_file")); n != 2 {
+		t.Errorf("%d calls reached the server, want 2", n)
+	}
+}
+
+func TestServerSchemaErrorPayload(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.SetSchema("branch_read_file", renamedReadSchema)
+	if _, err := h.client.ListTools(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	code, details := mustFail(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b-1", "path": "/home/dev/workspace/worklog.md"}))
+	hint, _ := details["hint"].(string)
+	if code != CodeInvalidArguments || details["property"] != "path" || !strings.Contains(hint, "schema for branch_read_file") {
+		t.Errorf("code %s, details %v; want INVALID_ARGS naming path", code, details)
+	}
+	if n := len(srv.CallsTo("branch_read_file")); n != 0 {
+		t.Errorf("rejected arguments were sent %d times", n)
+	}
+}
@@ -0,0 +1,392 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"dev_agent/internal/logx"
+)
+
+// defaultMaxResponseBytes is the largest reply body decoded in memory unless
+// configured; bigger ones are spilled to a file.
+const defaultMaxResponseBytes = 32 << 20
+
+// spillExcerptBytes bounds each of the head and tail excerpts read back from
+// a spilled reply, so both fit the default result budget once escaped.
+const spillExcerptBytes = 4 * 1024
+
+// spillKeys are the result fields whose string value is the payload of a
+// spilled reply: the text of a tools/call envelope, then the content of
+// the tool's own JSON.
+var spillKeys = []string{"content", "text", "content_base64", "logs", "log", "output", "diff"}
+
+// spilledResult is what call returns for a reply over the size limit:
+// response_file holds the payload (or the raw reply when it could not be
+// unwrapped) and response_bytes its size.
+func spilledResult(path string, size int64, isError bool) map[string]any {
+	res := map[string]any{"spilled": true, "response_file": path, "response_bytes": size}
+	if isError {
+		res["isError"] = true
+	}
+	return res
+}
+
+// readBody reads a plain JSON reply. Up to maxResponse bytes stay in
+// memory; a bigger body is streamed to a file under spillDir and a
+// spilledResult is returned instead. A negative limit disables spilling.
+// SSE replies are not spilled: their lines are already capped by the
+// scanner in parseSSEStream.
+func (c *MCPClient) readBody(method string, body io.Reader) ([]byte, map[string]any, error) {
+	if c.maxResponse < 0 {
+		data, err := io.ReadAll(body)
+		return data, nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, c.maxResponse+1))
+	if err != nil || int64(len(data)) <= c.maxResponse {
+		return data, nil, err
+	}
+	res, err := c.spill(io.MultiReader(bytes.NewReader(data), body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("MCP %s reply exceeds %d bytes and could not be spilled: %w", method, c.maxResponse, err)
+	}
+	logx.Warningf("MCP %s reply exceeds %d bytes; spilled %d bytes to %s", method, c.maxResponse, res["response_bytes"], res["response_file"])
+	return nil, res, nil
+}
+
+// spill writes the reply to a temp file, then unwraps the payload string
+// from the JSON-RPC envelope (and from the tool's JSON inside it) into the
+// file so excerpts read as the artifact itself rather than escaped JSON.
+func (c *MCPClient) spill(r io.Reader) (map[string]any, error) {
+	if err := os.MkdirAll(c.spillDir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(c.spillDir, "mcp-response-*.json")
+	if err != nil {
+		return nil, err
+	}
+	c.trackSpill(f.Name())
+	size, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	isError := spilledIsError(f.Name(), size)
+	path := f.Name()
+	for pass := 0; pass < 2; pass++ {
+		next, n, ok := c.unwrapSpill(path)
+		if !ok {
+			break
+		}
+		path, size = next, n
+		if !startsWithObject(path) {
+			break
+		}
+	}
+	return spilledResult(path, size, isError), nil
+}
+
+// unwrapSpill extracts the first string value of a spillKeys field of the
+// JSON in path into a new spill file.
+func (c *MCPClient) unwrapSpill(path string) (string, int64, bool) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", 0, false
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(c.spillDir, "mcp-response-*.txt")
+	if err != nil {
+		return "", 0, false
+	}
+	c.trackSpill(out.Name())
+	w := bufio.NewWriter(out)
+	found, err := copyJSONString(bufio.NewReader(in), w, spillKeys)
+	if err == nil {
+		err = w.Flush()
+	}
+	out.Close()
+	if err != nil || !found {
+		return "", 0, false
+	}
+	info, err := os.Stat(out.Name())
+	if err != nil {
+		return "", 0, false
+	}
+	os.Remove(path)
+	return out.Name(), info.Size(), true
+}
+
+func (c *MCPClient) trackSpill(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spilled = append(c.spilled, path)
+}
+
+// removeSpills deletes every spill file of this client; Close calls it.
+func (c *MCPClient) removeSpills() {
+	c.mu.Lock()
+	paths := c.spilled
+	c.spilled = nil
+	c.mu.Unlock()
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			logx.Debugf("Could not remove MCP spill file %s: %v", p, err)
+		}
+	}
+}
+
+// spilledIsError looks for the envelope's isError flag, which the server
+// writes after the content, in the last bytes of the file.
+func spilledIsError(path string, size int64) bool {
+	const window = 512
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, window)
+	n, _ := f.ReadAt(buf, max(size-window, 0))
+	tail := bytes.ReplaceAll(buf[:n], []byte(" "), nil)
+	return bytes.Contains(tail, []byte(`"isError":true`))
+}
+
+func startsWithObject(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 64)
+	n, _ := f.Read(buf)
+	trimmed := bytes.TrimSpace(buf[:n])
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// copyJSONString finds the first field named one of keys whose value is a
+// string and writes the value, unescaped, to w. It scans rather than
+// parses, so it works on documents too large to decode; a key spelled
+// inside another string could be matched, which is harmless for the MCP
+// envelopes it is used on.
+func copyJSONString(r *bufio.Reader, w io.Writer, keys []string) (bool, error) {
+	want := make(map[string]bool, len(keys))
+	longest := 0
+	for _, k := range keys {
+		want[k] = true
+		longest = max(longest, len(k))
+	}
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if b != '"' {
+			continue
+		}
+		// Read a short string and see whether it is a wanted key.
+		name, ok, err := readShortString(r, longest)
+		if err != nil {
+			return false, err
+		}
+		if !ok || !want[name] {
+			continue
+		}
+		if next, err := skipSpace(r); err != nil || next != ':' {
+			r.UnreadByte()
+			continue
+		}
+		next, err := skipSpace(r)
+		if err != nil {
+			return false, err
+		}
+		if next != '"' {
+			r.UnreadByte()
+			continue
+		}
+		return true, unescapeJSONString(r, w)
+	}
+}
+
+// readShortString reads the rest of a string, returning it when it is at
+// most limit bytes without escapes. Longer strings are consumed to their
+// closing quote so the scan stays aligned on string boundaries.
+func readShortString(r *bufio.Reader, limit int) (string, bool, error) {
+	var buf []byte
+	short := true
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		switch b {
+		case '"':
+			return string(buf), short, nil
+		case '\\':
+			short = false
+			if _, err := r.ReadByte(); err != nil {
+				return "", false, nil
+			}
+			continue
+		}
+		if short {
+			if len(buf) == limit {
+				short, buf = false, nil
+				continue
+			}
+			buf = append(buf, b)
+		}
+	}
+}
+
+func skipSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return b, nil
+	}
+}
+
+// unescapeJSONString copies a JSON string body, after its opening quote,
+// to w up to the closing quote.
+func unescapeJSONString(r *bufio.Reader, w io.Writer) error {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+		defer bw.Flush()
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("unterminated JSON string: %w", err)
+		}
+		if b == '"' {
+			return nil
+		}
+		if b != '\\' {
+			bw.WriteByte(b)
+			continue
+		}
+		esc, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("unterminated JSON string: %w", err)
+		}
+		switch esc {
+		case 'n':
+			bw.WriteByte('\n')
+		case 't':
+			bw.WriteByte('\t')
+		case 'r':
+			bw.WriteByte('\r')
+		case 'b':
+			bw.WriteByte('\b')
+		case 'f':
+			bw.WriteByte('\f')
+		case 'u':
+			rn, err := readHexRune(r)
+			if err != nil {
+				return err
+			}
+			if utf16.IsSurrogate(rn) {
+				if lo, err := readSurrogate(r); err == nil {
+					rn = utf16.DecodeRune(rn, lo)
+				} else {
+					rn = utf8.RuneError
+				}
+			}
+			bw.WriteRune(rn)
+		default:
+			// \" \\ \/ stand for themselves.
+			bw.WriteByte(esc)
+		}
+	}
+}
+
+func readHexRune(r *bufio.Reader) (rune, error) {
+	var hex [4]byte
+	if _, err := io.ReadFull(r, hex[:]); err != nil {
+		return 0, fmt.Errorf("truncated \\u escape: %w", err)
+	}
+	v, err := strconv.ParseUint(string(hex[:]), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad \\u escape %q", hex[:])
+	}
+	return rune(v), nil
+}
+
+// readSurrogate reads the \uXXXX low half that follows a high surrogate.
+func readSurrogate(r *bufio.Reader) (rune, error) {
+	prefix, err := r.Peek(2)
+	if err != nil || prefix[0] != '\\' || prefix[1] != 'u' {
+		return 0, fmt.Errorf("lone surrogate")
+	}
+	r.Discard(2)
+	return readHexRune(r)
+}
+
+// spillExcerpt returns up to n bytes from the start and from the end of a
+// spill file, cut at rune and line boundaries where possible.
+func spillExcerpt(path string, size int64, n int) (head, tail string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	buf := make([]byte, min(int64(n), size))
+	k, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	head = trimRunes(buf[:k], false)
+	if size <= int64(n) {
+		return head, "", nil
+	}
+	k, err = f.ReadAt(buf, max(size-int64(n), int64(n)))
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	tail = trimRunes(buf[:k], true)
+	return head, tail, nil
+}
+
+// trimRunes drops a partial rune, and for a tail the partial first line,
+// at the cut edge of an excerpt.
+func trimRunes(b []byte, fromStart bool) string {
+	if fromStart {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 && i < len(b)-1 {
+			return string(b[i+1:])
+		}
+		for len(b) > 0 && !utf8.RuneStart(b[0]) {
+			b = b[1:]
+		}
+		return string(b)
+	}
+	for i := 0; i < utf8.UTFMax-1 && len(b) > 0 && !utf8.Valid(b); i++ {
+		b = b[:len(b)-1]
+	}
+	return string(b)
+}
+
+// defaultSpillDir holds spilled replies unless MCPClientOptions.SpillDir
+// says otherwise.
+func defaultSpillDir() string {
+	return filepath.Join(os.TempDir(), "dev_agent_responses")
+}
@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// spillFiles lists the files left in dir.
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestReadBodyThreshold(t *testing.T) {
+	const limit = 64
+	cases := []struct {
+		name    string
+		limit   int64
+		size    int
+		spilled bool
+	}{
+		{"below", limit, limit - 1, false},
+		{"at the limit", limit, limit, false},
+		{"one over", limit, limit + 1, true},
+		{"far over", limit, 10 * limit, true},
+		{"disabled", -1, 10 * limit, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			client := NewMCPClientWithOptions("http://mcp.invalid", MCPClientOptions{MaxResponseBytes: c.limit, SpillDir: dir})
+			body := strings.Repeat("x", c.size)
+			data, res, err := client.readBody("tools/call", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.spilled {
+				if res != nil || string(data) != body {
+					t.Fatalf("got %d inline bytes and result %v, want the body inline", len(data), res)
+				}
+				if files := spillFiles(t, dir); len(files) != 0 {
+					t.Errorf("spill files %v left for an inline reply", files)
+				}
+				return
+			}
+			if data != nil || res["spilled"] != true || res["response_bytes"] != int64(c.size) {
+				t.Fatalf("result = %v, want %d bytes spilled", res, c.size)
+			}
+			file, _ := res["response_file"].(string)
+			if got, err := os.ReadFile(file); err != nil || string(got) != body {
+				t.Errorf("spill file holds %d bytes (%v), want the whole body", len(got), err)
+			}
+			client.Close()
+			if files := spillFiles(t, dir); len(files) != 0 {
+				t.Errorf("Close left spill files %v", files)
+			}
+		})
+	}
+}
+
+// TestSpillUnwrapsArtifact checks a spilled branch_read_file reply is
+// unwrapped to the artifact text and that read_artifact relays its local
+// path with head and tail excerpts, until Close removes it.
+func TestSpillUnwrapsArtifact(t *testing.T) {
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	const path = "/home/dev/workspace/build.log"
+	content := "first line \"quoted\"\n" + strings.Repeat("progress\tok\n", 2000) + "last line ✓\n"
+	srv.PutArtifact("b-1", path, content)
+
+	dir := t.TempDir()
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxResponseBytes: 4096, SpillDir: dir})
+	res, err := client.CallTool(context.Background(), "branch_read_file", map[string]any{"branch_id": "b-1", "file_path": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, _ := res["response_file"].(string)
+	if got, err := os.ReadFile(file); err != nil || string(got) != content {
+		t.Fatalf("spill file holds %d bytes (%v), want the artifact unescaped", len(got), err)
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Errorf("spill dir holds %v, want only the unwrapped file", files)
+	}
+
+	h := NewToolHandler(client, "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	data := mustSucceed(t, callTool(h, "read_artifact", map[string]any{"branch_id": "b-1", "path": path}))
+	head, _ := data["head"].(string)
+	tail, _ := data["tail"].(string)
+	if data["local_path"] == nil || data["truncated"] != true || data["total_size"] != int64(len(content)) {
+		t.Errorf("read_artifact local_path %v, truncated %v, total_size %v; want the spill file and size %d", data["local_path"], data["truncated"], data["total_size"], len(content))
+	}
+	if !strings.HasPrefix(head, "first line \"quoted\"\n") || !strings.HasSuffix(tail, "last line ✓\n") || len(head)+len(tail) >= len(content) {
+		t.Errorf("head %q / tail %q, want excerpts of both ends", head, tail)
+	}
+
+	client.Close()
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("Close left spill files %v", files)
+	}
+}
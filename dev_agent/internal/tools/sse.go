@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// ErrResultUnknown is matched by errors.Is when a request reached the server
+// but its reply was lost, so whether it took effect is unknown.
+var ErrResultUnknown = errors.New("MCP result unknown")
+
+// CodeResultUnknown marks a tool result whose effect could not be confirmed.
+const CodeResultUnknown = "result_unknown"
+
+// ResultUnknownError is returned when a request was sent but its reply was
+// lost: an SSE reply broke off and could not be resumed, or a mutation
+// timed out or lost its connection after being written (see lostReply).
+// Method is the metrics key, e.g. "tools/call:parallel_explore". Only
+// idempotent calls are retried; callers of mutations should check the
+// server state instead (list the branches, poll get_branch) before sending
+// the request again.
+type ResultUnknownError struct {
+	Method     string
+	Idempotent bool
+	Cause      error
+}
+
+func (e ResultUnknownError) Error() string {
+	return fmt.Sprintf("MCP %s result unknown: the request was sent but its reply was lost (%v)", e.Method, e.Cause)
+}
+
+func (e ResultUnknownError) Is(target error) bool { return target == ErrResultUnknown }
+
+func (e ResultUnknownError) Unwrap() error { return e.Cause }
+
+func (e ResultUnknownError) Retryable() bool { return e.Idempotent }
+
+// sseDisconnectError is a reply stream that ended before the response event.
+type sseDisconnectError struct {
+	LastEventID string
+	Cause       error
+}
+
+func (e *sseDisconnectError) Error() string {
+	if e.LastEventID == "" {
+		return fmt.Sprintf("SSE stream disconnected: %v", e.Cause)
+	}
+	return fmt.Sprintf("SSE stream disconnected after event %s: %v", e.LastEventID, e.Cause)
+}
+
+func (e *sseDisconnectError) Unwrap() error { return e.Cause }
+
+// maxSSEResumes bounds reconnects for one reply.
+const maxSSEResumes = 3
+
+// readSSE reads the reply to payload from an SSE body. When the stream
+// drops after an event with an id, it reconnects with Last-Event-ID so the
+// server can replay the rest instead of the request being sent again. A
+// drop that cannot be resumed becomes a ResultUnknownError.
+func (c *MCPClient) readSSE(ctx context.Context, method string, payload map[string]any, body io.Reader, timeout time.Duration) ([]byte, error) {
+	params, _ := payload["params"].(map[string]any)
+	lastEventID := ""
+	for resumes := 0; ; resumes++ {
+		data, preview, err := parseSSEStream(body, payload["id"], notifyFrom(ctx))
+		if preview != "" {
+			logx.Debugf("MCP SSE preview for %s: %q", callLabel(ctx, method), preview)
+		}
+		var disc *sseDisconnectError
+		if !errors.As(err, &disc) {
+			return data, err
+		}
+		if disc.LastEventID != "" {
+			lastEventID = disc.LastEventID
+		}
+		unknown := ResultUnknownError{Method: metricKey(method, params), Idempotent: idempotentCall(method, params), Cause: err}
+		if lastEventID == "" || resumes == maxSSEResumes || ctx.Err() != nil {
+			return nil, unknown
+		}
+		logx.Warningf("MCP SSE stream for %s dropped after event %s; resuming (%d/%d).", callLabel(ctx, method), lastEventID, resumes+1, maxSSEResumes)
+		resp, cancel, err := c.resumeSSE(ctx, lastEventID, timeout)
+		if err != nil {
+			logx.Warningf("Could not resume MCP SSE stream for %s: %v", callLabel(ctx, method), err)
+			unknown.Cause = fmt.Errorf("%v; resume failed: %w", disc, err)
+			return nil, unknown
+		}
+		defer cancel()
+		defer func() {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+		body = resp.Body
+	}
+}
+
+// resumeSSE reopens the session's event stream after lastEventID, as the
+// streamable HTTP transport allows. Servers without resumption answer with
+// an error status or a non-SSE body.
+func (c *MCPClient) resumeSSE(ctx context.Context, lastEventID string, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.rpcURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Last-Event-ID", lastEventID)
+	c.setHeaders(req, true)
+	resp, cancel, err := c.do(ctx, req, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		cancel()
+		return nil, nil, MCPHTTPError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "text/event-stream") {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("server answered the resume with %q instead of an event stream", ct)
+	}
+	return resp, cancel, nil
+}
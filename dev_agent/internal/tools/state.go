@@ -0,0 +1,298 @@
+package tools
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// stateVersion is the format of the state file; LoadState rejects others.
+const stateVersion = 1
+
+// RunState is a run's saved progress: the lineage and read offsets it had
+// reached and every tool call it completed, oldest first. A run resumed
+// from it can tell which phases already produced a branch instead of
+// running them again. The calls are kept in the state file's journal, not
+// in the state file itself.
+type RunState struct {
+	Version        int            `json:"version"`
+	RunID          string         `json:"run_id,omitempty"`
+	Updated        time.Time      `json:"updated"`
+	StartBranchID  string         `json:"start_branch_id"`
+	LatestBranchID string         `json:"latest_branch_id,omitempty"`
+	Lineage        []BranchRecord `json:"branch_lineage"`
+	ReadOffsets    []ReadOffset   `json:"read_offsets,omitempty"`
+	Calls          []StateCall    `json:"-"`
+}
+
+// ReadOffset is where the last incremental read_artifact of a file ended.
+type ReadOffset struct {
+	BranchID string `json:"branch_id"`
+	Path     string `json:"path"`
+	Offset   int    `json:"offset"`
+}
+
+// StateCall is one completed Handle call. Arguments are kept as a hash so
+// a resumed run can recognise a repeated call; results over
+// maxAuditResultBytes are kept by hash and size, like in the audit log.
+type StateCall struct {
+	Time         time.Time `json:"ts"`
+	Tool         string    `json:"tool"`
+	CallID       string    `json:"call_id,omitempty"`
+	ArgsSHA256   string    `json:"args_sha256"`
+	Status       string    `json:"status"`
+	BranchIDs    []string  `json:"branch_ids,omitempty"`
+	Result       any       `json:"result,omitempty"`
+	ResultBytes  int       `json:"result_bytes"`
+	ResultSHA256 string    `json:"result_sha256,omitempty"`
+}
+
+// stateFile saves a RunState after every call: the call is appended to the
+// journal, then the rest of the state, which stays small however many
+// calls the run makes, replaces path. mu serializes the saves.
+type stateFile struct {
+	mu    sync.Mutex
+	path  string
+	runID string
+	// appending is set once the journal belongs to this run: after the
+	// first save, or after LoadState read it. Until then the first save
+	// truncates whatever journal a previous run left.
+	appending bool
+}
+
+// stateJournal is where the calls of the state file at path are appended,
+// one JSON line each: path with a .json suffix replaced by .calls.jsonl.
+func stateJournal(path string) string {
+	return strings.TrimSuffix(path, ".json") + ".calls.jsonl"
+}
+
+// SetStateFile makes Handle save the run's state, tagged with runID, to
+// path after every call; "" stops saving. The file is replaced atomically
+// (temporary file, then rename), so a crash mid-write leaves the previous
+// snapshot intact; the calls go to a journal next to it (see stateJournal)
+// so a save does not rewrite every earlier call.
+func (h *ToolHandler) SetStateFile(path, runID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if path == "" {
+		h.state = nil
+		return
+	}
+	h.state = &stateFile{path: path, runID: runID}
+}
+
+func (h *ToolHandler) currentStateFile() *stateFile {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// saveState appends one completed call to the journal and rewrites the
+// state file. A failed write is logged, not returned: the call itself
+// succeeded.
+func (h *ToolHandler) saveState(call ToolCall, result map[string]any, started time.Time) {
+	s := h.currentStateFile()
+	if s == nil {
+		return
+	}
+	var args map[string]any
+	_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
+	canonical, _ := json.Marshal(args)
+	sum := sha256.Sum256(canonical)
+	c := StateCall{
+		Time:       started.UTC(),
+		Tool:       call.Function.Name,
+		CallID:     call.ID,
+		ArgsSHA256: hex.EncodeToString(sum[:]),
+	}
+	c.Status, _ = result["status"].(string)
+	_, _, details, _ := ErrorInfo(result)
+	c.BranchIDs = auditBranchIDs(args, result, details)
+	raw := toJSON(result)
+	c.ResultBytes = len(raw)
+	if len(raw) <= maxAuditResultBytes {
+		c.Result = result
+	} else {
+		sum := sha256.Sum256([]byte(raw))
+		c.ResultSHA256 = hex.EncodeToString(sum[:])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := appendStateCall(stateJournal(s.path), c, !s.appending); err != nil {
+		logx.Warningf("State journal write to %s failed: %v", stateJournal(s.path), err)
+		return
+	}
+	s.appending = true
+	state := h.snapshotState()
+	state.RunID = s.runID
+	if err := writeStateFile(s.path, state); err != nil {
+		logx.Warningf("State file write to %s failed: %v", s.path, err)
+	}
+}
+
+// appendStateCall appends c to the journal at path as one JSON line,
+// emptying the journal first when truncate is set.
+func appendStateCall(path string, c StateCall, truncate bool) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(logx.Redact(string(data)) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readStateCalls reads the journal at path. A last line cut short by a
+// crash mid-append is dropped, and cut from the file so later appends
+// start on a line of their own; a missing journal holds no calls.
+func readStateCalls(path string) ([]StateCall, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var calls []StateCall
+	complete := 0
+	for complete < len(data) {
+		end := bytes.IndexByte(data[complete:], '\n')
+		if end < 0 {
+			logx.Warningf("Dropping the partial last line of state journal %s", path)
+			if err := os.Truncate(path, int64(complete)); err != nil {
+				return nil, err
+			}
+			break
+		}
+		var c StateCall
+		if err := json.Unmarshal(data[complete:complete+end], &c); err != nil {
+			return nil, fmt.Errorf("state journal %s is corrupt at byte %d: %w", path, complete, err)
+		}
+		calls = append(calls, c)
+		complete += end + 1
+	}
+	return calls, nil
+}
+
+// snapshotState is the handler's current RunState, without its calls.
+func (h *ToolHandler) snapshotState() RunState {
+	r := h.branchTracker.Range()
+	state := RunState{
+		Version:        stateVersion,
+		Updated:        time.Now().UTC(),
+		StartBranchID:  r["start_branch_id"],
+		LatestBranchID: r["latest_branch_id"],
+		Lineage:        h.branchTracker.Lineage(),
+	}
+	h.mu.Lock()
+	for k, off := range h.tailOffsets {
+		state.ReadOffsets = append(state.ReadOffsets, ReadOffset{BranchID: k.branchID, Path: k.path, Offset: off})
+	}
+	h.mu.Unlock()
+	sort.Slice(state.ReadOffsets, func(i, j int) bool {
+		a, b := state.ReadOffsets[i], state.ReadOffsets[j]
+		if a.BranchID != b.BranchID {
+			return a.BranchID < b.BranchID
+		}
+		return a.Path < b.Path
+	})
+	return state
+}
+
+// writeStateFile writes state next to path and renames it into place.
+func writeStateFile(path string, state RunState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = []byte(logx.Redact(string(data)))
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState reads a state file written through SetStateFile, with its
+// journal, and restores the branch lineage and read offsets it holds, so a
+// resumed run builds on the branches it already produced; with
+// SetStateFile set to the same path, later calls are appended to the
+// loaded ones. Call it before the run's first Handle.
+//
+// Left-over temporary files of an interrupted write are ignored. The
+// handler's start branch, when it has one, must be the state's. The state
+// is returned for the caller to decide which calls need not run again; a
+// missing file is an error satisfying errors.Is(err, fs.ErrNotExist).
+func (h *ToolHandler) LoadState(path string) (*RunState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state RunState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("state file %s is corrupt: %w", path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("state file %s has version %d; this dev-agent reads version %d", path, state.Version, stateVersion)
+	}
+	if state.Calls, err = readStateCalls(stateJournal(path)); err != nil {
+		return nil, err
+	}
+	if err := h.branchTracker.restore(state.StartBranchID, state.LatestBranchID, state.Lineage); err != nil {
+		return nil, fmt.Errorf("state file %s: %w", path, err)
+	}
+	h.mu.Lock()
+	if h.tailOffsets == nil {
+		h.tailOffsets = map[artifactKey]int{}
+	}
+	for _, o := range state.ReadOffsets {
+		h.tailOffsets[artifactKey{o.BranchID, o.Path}] = o.Offset
+	}
+	s := h.state
+	h.mu.Unlock()
+	if s != nil && s.path == path {
+		s.mu.Lock()
+		s.appending = true
+		s.mu.Unlock()
+	}
+	logx.Infof("Restored %d branches and %d completed tool calls from %s", len(state.Lineage), len(state.Calls), path)
+	return &state, nil
+}
@@ -0,0 +1,210 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/tools/mcptest"
+)
+
+// stateRun makes three calls through a handler saving to path: a launch,
+// an incremental read of reviewLog and a status check. It returns the
+// handler and its fake server.
+func stateRun(t *testing.T, path string) (*ToolHandler, *mcptest.FakeServer) {
+	t.Helper()
+	h, srv := newTestHandler(t)
+	h.SetStateFile(path, "run-1")
+	data := mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement the task.", "parent_branch_id": testParent}))
+	id, _ := data["branch_id"].(string)
+	srv.PutArtifact(id, reviewLog, "finding 1\n")
+	readTail(t, h, id, map[string]any{"since_offset": -1})
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": id}))
+	return h, srv
+}
+
+// resumedHandler is a fresh handler on srv saving to path, as a restarted
+// run would build it.
+func resumedHandler(t *testing.T, srv *mcptest.FakeServer, path string) *ToolHandler {
+	t.Helper()
+	h := NewToolHandler(newTestClient(t, srv), "demo", testParent)
+	h.SetResultBudget(0, t.TempDir())
+	h.SetStateFile(path, "run-1")
+	return h
+}
+
+func stateTools(calls []StateCall) []string {
+	var tools []string
+	for _, c := range calls {
+		tools = append(tools, c.Tool)
+	}
+	return tools
+}
+
+func TestStateFileSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	h, _ := stateRun(t, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]any
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["run_id"] != "run-1" || saved["latest_branch_id"] != fakeBranchID(1) || saved["calls"] != nil {
+		t.Errorf("state file = %s, want the run's lineage without its calls", data)
+	}
+	entries := readJSONL(t, stateJournal(path))
+	if len(entries) != 3 || entries[0]["tool"] != "execute_agent" || entries[2]["tool"] != "check_status" {
+		t.Fatalf("journal = %v, want the three calls in order", entries)
+	}
+	if ids, _ := entries[0]["branch_ids"].([]any); len(ids) == 0 || ids[0] != fakeBranchID(1) || entries[0]["args_sha256"] == "" {
+		t.Errorf("launch entry = %v, want its branch and arguments hash", entries[0])
+	}
+
+	// Only the journal grows with the calls.
+	for i := 0; i < 5; i++ {
+		mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": fakeBranchID(1)}))
+	}
+	if n := len(readJSONL(t, stateJournal(path))); n != 8 {
+		t.Errorf("journal has %d calls, want 8", n)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resaved map[string]any
+	if err := json.Unmarshal(after, &resaved); err != nil {
+		t.Fatal(err)
+	}
+	delete(saved, "updated")
+	delete(resaved, "updated")
+	if !reflect.DeepEqual(resaved, saved) {
+		t.Errorf("state file changed with calls that changed no branch:\n%s\nwas\n%s", after, data)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	first, srv := stateRun(t, path)
+
+	h := resumedHandler(t, srv, path)
+	state, err := h.LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"execute_agent", "read_artifact", "check_status"}; !reflect.DeepEqual(stateTools(state.Calls), want) {
+		t.Errorf("calls = %v, want %v", stateTools(state.Calls), want)
+	}
+	if state.RunID != "run-1" || !reflect.DeepEqual(state.ReadOffsets, []ReadOffset{{fakeBranchID(1), reviewLog, len("finding 1\n")}}) {
+		t.Errorf("state = %+v", state)
+	}
+	if !reflect.DeepEqual(h.BranchLineage(), first.BranchLineage()) || !reflect.DeepEqual(h.BranchRange(), first.BranchRange()) {
+		t.Errorf("lineage %v, range %v; want %v, %v", h.BranchLineage(), h.BranchRange(), first.BranchLineage(), first.BranchRange())
+	}
+
+	// The restored offset carries on where the first run stopped reading,
+	// and later calls are appended to the loaded ones.
+	srv.PutArtifact(fakeBranchID(1), reviewLog, "finding 1\nfinding 2\n")
+	if data := readTail(t, h, fakeBranchID(1), map[string]any{"since_offset": -1}); data["content"] != "finding 2\n" {
+		t.Errorf("continued read = %v, want only finding 2", data)
+	}
+	if n := len(readJSONL(t, stateJournal(path))); n != 4 {
+		t.Errorf("journal has %d calls after the resumed read, want 4", n)
+	}
+}
+
+// TestLoadStateInterruptedWrite reloads after a crash mid-write: a
+// temporary snapshot never renamed into place and a journal line cut short.
+func TestLoadStateInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	_, srv := stateRun(t, path)
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".tmp-123", saved[:len(saved)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := os.OpenFile(stateJournal(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.WriteString(`{"ts":"2026-01-01T00:00:00Z","tool":"check_st`)
+	journal.Close()
+
+	h := resumedHandler(t, srv, path)
+	logs := captureLogs(t)
+	state, err := h.LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Calls) != 3 || state.LatestBranchID != fakeBranchID(1) {
+		t.Errorf("state = %+v, want the last complete snapshot and its 3 calls", state)
+	}
+	if !strings.Contains(logs.String(), "Dropping the partial last line") {
+		t.Errorf("log does not mention the dropped line:\n%s", logs.String())
+	}
+
+	// The next call starts a line of its own, and saving replaces the
+	// snapshot without tripping over the leftover.
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": fakeBranchID(1)}))
+	if entries := readJSONL(t, stateJournal(path)); len(entries) != 4 || entries[3]["tool"] != "check_status" {
+		t.Errorf("journal = %v, want the 3 loaded calls and the new one", entries)
+	}
+	if _, err := h.LoadState(path); err != nil {
+		t.Errorf("reload after the resumed call: %v", err)
+	}
+}
+
+func TestStateFileFreshRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	_, srv := stateRun(t, path)
+
+	// A run that did not load the state starts its journal afresh.
+	h := resumedHandler(t, srv, path)
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": fakeBranchID(1)}))
+	if entries := readJSONL(t, stateJournal(path)); len(entries) != 1 {
+		t.Errorf("journal = %v, want only the new run's call", entries)
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	h, _ := newTestHandler(t)
+
+	if _, err := h.LoadState(filepath.Join(dir, "missing.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: err = %v, want fs.ErrNotExist", err)
+	}
+	cases := []struct {
+		name, path, err string
+	}{
+		{"corrupt", write("corrupt.json", `{"version": 1, "branch_lin`), "is corrupt"},
+		{"version", write("v2.json", `{"version": 2}`), "has version 2; this dev-agent reads version 1"},
+		{"other start", write("other.json", `{"version": 1, "start_branch_id": "22222222-2222-4222-8222-222222222222"}`), "started from branch 22222222-2222-4222-8222-222222222222"},
+		{"corrupt journal", write("journal.json", `{"version": 1}`), "state journal"},
+	}
+	write("journal.calls.jsonl", "not json\n{}\n")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := h.LoadState(c.path); err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("err = %v, want it to mention %q", err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package tools
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ToolStat aggregates the Handle calls of one tool: how many there were,
+// how many returned an error payload and their summed wall-clock time.
+// ByAgent breaks execute_agent calls down by agent name.
+type ToolStat struct {
+	Calls      int                 `json:"calls"`
+	Errors     int                 `json:"errors"`
+	DurationMS int64               `json:"duration_ms"`
+	ByAgent    map[string]ToolStat `json:"by_agent,omitempty"`
+}
+
+// HandlerStats is a snapshot of a handler's per-tool metrics.
+type HandlerStats struct {
+	Tools map[string]ToolStat `json:"tools"`
+}
+
+func (s *ToolStat) add(failed bool, d time.Duration) {
+	s.Calls++
+	if failed {
+		s.Errors++
+	}
+	s.DurationMS += d.Milliseconds()
+}
+
+// Stats returns the per-tool call counts, error counts and durations of
+// every Handle call so far.
+func (h *ToolHandler) Stats() HandlerStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := HandlerStats{Tools: make(map[string]ToolStat, len(h.stats))}
+	for name, s := range h.stats {
+		if s.ByAgent != nil {
+			agents := make(map[string]ToolStat, len(s.ByAgent))
+			for a, as := range s.ByAgent {
+				agents[a] = as
+			}
+			s.ByAgent = agents
+		}
+		out.Tools[name] = s
+	}
+	return out
+}
+
+// recordStats counts one Handle call of call's tool.
+func (h *ToolHandler) recordStats(call ToolCall, result map[string]any, started time.Time) {
+	name := call.Function.Name
+	if name == "" {
+		return
+	}
+	d := time.Since(started)
+	failed := result["status"] == "error"
+	var agent string
+	if name == "execute_agent" {
+		var args struct {
+			Agent string `json:"agent"`
+		}
+		_ = json.Unmarshal([]byte(call.Function.Arguments), &args)
+		agent = args.Agent
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stats == nil {
+		h.stats = map[string]ToolStat{}
+	}
+	s := h.stats[name]
+	s.add(failed, d)
+	if agent != "" {
+		if s.ByAgent == nil {
+			s.ByAgent = map[string]ToolStat{}
+		}
+		as := s.ByAgent[agent]
+		as.add(failed, d)
+		s.ByAgent[agent] = as
+	}
+	h.stats[name] = s
+}
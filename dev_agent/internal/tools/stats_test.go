@@ -0,0 +1,77 @@
+package tools
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetMaxConcurrentBranches(0)
+	srv.Handle("branch_output", func(args map[string]any) (map[string]any, error) {
+		time.Sleep(20 * time.Millisecond)
+		return map[string]any{"branch_id": args["branch_id"], "output": "ok"}, nil
+	})
+	launch := func(agent string) map[string]any {
+		return callTool(h, "execute_agent", map[string]any{"agent": agent, "prompt": "Work.", "parent_branch_id": testParent})
+	}
+	mustSucceed(t, launch("claude_code"))
+	mustSucceed(t, launch("codex"))
+	mustSucceed(t, launch("claude_code"))
+	mustFail(t, launch("tester"))
+	mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": fakeBranchID(1)}))
+	mustFail(t, callTool(h, "check_status", map[string]any{}))
+	mustSucceed(t, callTool(h, "branch_output", map[string]any{"branch_id": fakeBranchID(2)}))
+	mustFail(t, callTool(h, "summon_unicorn", map[string]any{}))
+
+	stats := h.Stats().Tools
+	counts := map[string][2]int{}
+	for name, s := range stats {
+		counts[name] = [2]int{s.Calls, s.Errors}
+	}
+	want := map[string][2]int{
+		"execute_agent":  {4, 1},
+		"check_status":   {2, 1},
+		"branch_output":  {1, 0},
+		"summon_unicorn": {1, 1},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("calls and errors per tool = %v, want %v", counts, want)
+	}
+
+	agents := map[string][2]int{}
+	for name, s := range stats["execute_agent"].ByAgent {
+		agents[name] = [2]int{s.Calls, s.Errors}
+	}
+	if want := map[string][2]int{"claude_code": {2, 0}, "codex": {1, 0}, "tester": {1, 1}}; !reflect.DeepEqual(agents, want) {
+		t.Errorf("execute_agent by agent = %v, want %v", agents, want)
+	}
+	if stats["check_status"].ByAgent != nil {
+		t.Errorf("check_status has a by-agent breakdown: %v", stats["check_status"].ByAgent)
+	}
+	if d := stats["branch_output"].DurationMS; d < 20 {
+		t.Errorf("branch_output took %dms, want at least the server's 20ms", d)
+	}
+	var agentMS int64
+	for _, s := range stats["execute_agent"].ByAgent {
+		agentMS += s.DurationMS
+	}
+	if agentMS != stats["execute_agent"].DurationMS {
+		t.Errorf("by-agent durations sum to %dms, want the tool's %dms", agentMS, stats["execute_agent"].DurationMS)
+	}
+
+	// Stats is a snapshot.
+	stats["execute_agent"].ByAgent["codex"] = ToolStat{Calls: 99}
+	if got := h.Stats().Tools["execute_agent"].ByAgent["codex"].Calls; got != 1 {
+		t.Errorf("codex calls = %d after editing a snapshot, want 1", got)
+	}
+}
+
+func TestStatsEmpty(t *testing.T) {
+	h, _ := newTestHandler(t)
+	if raw, _ := json.Marshal(h.Stats()); string(raw) != `{"tools":{}}` {
+		t.Errorf("stats of an unused handler = %s", raw)
+	}
+}
@@ -0,0 +1,211 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// StdioTransport speaks MCP to a subprocess over stdin/stdout using the
+// spec's newline-delimited JSON framing. The process is started lazily and
+// restarted, with a fresh handshake, when it dies. Calls are serialized.
+type StdioTransport struct {
+	command []string
+
+	mu      sync.Mutex
+	proc    *exec.Cmd
+	stdin   io.WriteCloser
+	lines   chan []byte
+	exited  chan struct{}
+	nextID  int
+	started bool
+}
+
+// maxStdioRestarts bounds how often one call restarts a crashed server.
+const maxStdioRestarts = 1
+
+func NewStdioTransport(command []string) (*StdioTransport, error) {
+	if len(command) == 0 {
+		return nil, errors.New("MCP stdio command is empty")
+	}
+	return &StdioTransport{command: command}, nil
+}
+
+func (t *StdioTransport) Call(ctx context.Context, method string, params map[string]any) (map[string]any, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for restart := 0; ; restart++ {
+		if !t.started {
+			if err := t.start(ctx); err != nil {
+				return nil, err
+			}
+		}
+		res, err := t.roundTrip(ctx, method, params)
+		if !errors.Is(err, errStdioExited) || restart == maxStdioRestarts {
+			return res, err
+		}
+		logx.Warningf("MCP stdio server exited; restarting before retrying %s", method)
+		t.stop()
+	}
+}
+
+var errStdioExited = errors.New("MCP stdio server exited")
+
+// start launches the process and performs the initialize handshake.
+func (t *StdioTransport) start(ctx context.Context) error {
+	cmd := exec.Command(t.command[0], t.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start MCP server %q: %w", t.command[0], err)
+	}
+	t.proc, t.stdin = cmd, stdin
+	t.lines = make(chan []byte, 64)
+	t.exited = make(chan struct{})
+	t.started = true
+	go t.readLoop(stdout, t.lines, t.exited)
+
+	_, err = t.roundTrip(ctx, "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": clientName, "version": "0"},
+	})
+	if err != nil {
+		t.stop()
+		return fmt.Errorf("MCP initialize failed: %w", err)
+	}
+	return t.write(map[string]any{"jsonrpc": "2.0", "method": "notifications/initialized"})
+}
+
+func (t *StdioTransport) readLoop(r io.Reader, lines chan<- []byte, exited chan<- struct{}) {
+	defer close(exited)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		lines <- append([]byte(nil), line...)
+	}
+}
+
+func (t *StdioTransport) write(msg map[string]any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := t.stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("%w: %v", errStdioExited, err)
+	}
+	return nil
+}
+
+// roundTrip sends one request and waits for the response with its id,
+// skipping notifications and stale responses to abandoned requests.
+func (t *StdioTransport) roundTrip(ctx context.Context, method string, params map[string]any) (map[string]any, error) {
+	t.nextID++
+	id := t.nextID
+	if err := t.write(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}); err != nil {
+		return nil, err
+	}
+	notify := notifyFrom(ctx)
+	timeout := time.NewTimer(callTimeout(ctx, 30*time.Second))
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout.C:
+			return nil, fmt.Errorf("MCP stdio %s timed out", method)
+		case line := <-t.lines:
+			if res, err, ok := matchStdioResponse(line, id, notify); ok {
+				return res, err
+			}
+		case <-t.exited:
+			// Output written just before the exit may still be queued.
+			for {
+				select {
+				case line := <-t.lines:
+					if res, err, ok := matchStdioResponse(line, id, notify); ok {
+						return res, err
+					}
+				default:
+					return nil, errStdioExited
+				}
+			}
+		}
+	}
+}
+
+// matchStdioResponse decodes line and reports whether it answers request id.
+// Notifications go to notify when set.
+func matchStdioResponse(line []byte, id int, notify func([]byte)) (map[string]any, error, bool) {
+	var msg struct {
+		ID     *int            `json:"id"`
+		Method string          `json:"method"`
+		Result map[string]any  `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		logx.Debugf("MCP stdio: ignoring non-JSON line %q", logx.Truncate(string(line), 200))
+		return nil, nil, false
+	}
+	if msg.ID == nil || *msg.ID != id {
+		if msg.Method != "" {
+			logx.Debugf("MCP stdio notification %s", msg.Method)
+			if notify != nil {
+				notify(line)
+			}
+		}
+		return nil, nil, false
+	}
+	if len(msg.Error) > 0 && string(msg.Error) != "null" {
+		var raw any
+		_ = json.Unmarshal(msg.Error, &raw)
+		if rpcErr, ok := parseRPCError(raw); ok {
+			return nil, rpcErr, true
+		}
+	}
+	if msg.Result == nil {
+		return map[string]any{}, nil, true
+	}
+	return normalizeToolResult(msg.Result), nil, true
+}
+
+func (t *StdioTransport) stop() {
+	if !t.started {
+		return
+	}
+	t.started = false
+	t.stdin.Close()
+	if t.proc.Process != nil {
+		t.proc.Process.Kill()
+	}
+	t.proc.Wait()
+}
+
+// Close terminates the subprocess.
+func (t *StdioTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+	return nil
+}
@@ -0,0 +1,93 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stdioServer builds testdata/stdioserver and returns a client running it,
+// plus a function returning the methods the server processes received.
+func stdioServer(t *testing.T) (*MCPClient, func() []string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds a helper binary")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "stdioserver")
+	if out, err := exec.Command("go", "build", "-o", bin, "./testdata/stdioserver").CombinedOutput(); err != nil {
+		t.Fatalf("building the stdio server: %v\n%s", err, out)
+	}
+	logFile := filepath.Join(dir, "methods.log")
+	t.Setenv("STDIO_LOG", logFile)
+	t.Setenv("STDIO_CRASHED", filepath.Join(dir, "crashed"))
+
+	stdio, err := NewStdioTransport([]string{bin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewMCPClientWithOptions("", MCPClientOptions{MaxRetries: 1, Transport: stdio})
+	t.Cleanup(func() {
+		client.Close()
+		stdio.Close()
+	})
+	return client, func() []string {
+		data, _ := os.ReadFile(logFile)
+		return strings.Fields(string(data))
+	}
+}
+
+func TestStdioTransport(t *testing.T) {
+	client, methods := stdioServer(t)
+	ctx := context.Background()
+	var notified int
+	client.OnProgress(func(string, float64, string) { notified++ })
+	res, err := client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["id"] != "b1" || res["status"] != "succeed" {
+		t.Errorf("result = %v", res)
+	}
+	if notified != 1 {
+		t.Errorf("%d progress notifications passed on, want 1", notified)
+	}
+	pid := res["pid"]
+	if res, err = client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b2"}); err != nil || res["pid"] != pid {
+		t.Errorf("second call: %v, %v; want it served by the same process", res, err)
+	}
+
+	_, err = client.CallTool(ctx, "missing_tool", map[string]any{})
+	var rpcErr MCPRPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RPCMethodNotFound {
+		t.Errorf("unknown tool: err = %v, want a method-not-found RPC error", err)
+	}
+
+	want := []string{"initialize", "notifications/initialized", "tools/call", "tools/call", "tools/call"}
+	if got := methods(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+}
+
+func TestStdioTransportRestartsCrashedServer(t *testing.T) {
+	client, methods := stdioServer(t)
+	res, err := client.CallTool(context.Background(), "crash_once", map[string]any{"branch_id": "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["status"] != "succeed" {
+		t.Errorf("result = %v", res)
+	}
+	want := []string{
+		"initialize", "notifications/initialized", "tools/call", // the process exits here
+		"initialize", "notifications/initialized", "tools/call",
+	}
+	if got := methods(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+}
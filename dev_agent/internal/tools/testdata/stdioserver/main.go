@@ -0,0 +1,64 @@
+// Command stdioserver is a minimal MCP server speaking newline-delimited
+// JSON-RPC on stdin/stdout, built by the stdio transport tests. Every
+// message it receives is appended, one method per line, to $STDIO_LOG.
+// tools/call get_branch answers after a progress notification; crash_once
+// exits mid-call the first time, recording that in $STDIO_CRASHED.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func main() {
+	out := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req struct {
+			ID     any            `json:"id"`
+			Method string         `json:"method"`
+			Params map[string]any `json:"params"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &req) != nil {
+			continue
+		}
+		logLine(req.Method)
+		if req.ID == nil {
+			continue
+		}
+		switch req.Method {
+		case "initialize":
+			out.Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"protocolVersion": "2025-03-26", "capabilities": map[string]any{}}})
+		case "tools/call":
+			name, _ := req.Params["name"].(string)
+			args, _ := req.Params["arguments"].(map[string]any)
+			if name == "crash_once" {
+				if _, err := os.Stat(os.Getenv("STDIO_CRASHED")); err != nil {
+					os.WriteFile(os.Getenv("STDIO_CRASHED"), nil, 0o600)
+					os.Exit(1)
+				}
+			}
+			if name != "get_branch" && name != "crash_once" {
+				out.Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": -32601, "message": "Unknown tool: " + name}})
+				continue
+			}
+			out.Encode(map[string]any{"jsonrpc": "2.0", "method": "notifications/progress", "params": map[string]any{"progress": 1}})
+			out.Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{
+				"structuredContent": map[string]any{"id": args["branch_id"], "status": "succeed", "pid": os.Getpid()},
+			}})
+		default:
+			out.Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{}})
+		}
+	}
+}
+
+func logLine(method string) {
+	f, err := os.OpenFile(os.Getenv("STDIO_LOG"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, method)
+}
@@ -0,0 +1,48 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Transport timeouts used when MCPClientOptions leaves them zero; they match
+// net/http's defaults. No response-header timeout is set by default because
+// long-polling get_branch calls may hold the headers back for minutes.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// MCPTimeoutError is a request that hit one of the transport timeouts:
+// Phase is "connect", "TLS handshake" or "response headers". The overall
+// per-call deadline is reported as context.DeadlineExceeded instead.
+type MCPTimeoutError struct {
+	Phase string
+	Limit time.Duration
+	Err   error
+}
+
+func (e MCPTimeoutError) Error() string {
+	return fmt.Sprintf("MCP %s timed out after %s: %v", e.Phase, e.Limit, e.Err)
+}
+
+func (e MCPTimeoutError) Unwrap() error { return e.Err }
+
+// transportTimeout names the phase of a transport timeout in err, or
+// returns err unchanged.
+func (c *MCPClient) transportTimeout(err error) error {
+	var opErr *net.OpError
+	msg := err.Error()
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return MCPTimeoutError{Phase: "connect", Limit: c.dialTimeout, Err: err}
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return MCPTimeoutError{Phase: "TLS handshake", Limit: c.tlsTimeout, Err: err}
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return MCPTimeoutError{Phase: "response headers", Limit: c.headerTimeout, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blackHoleAddr returns a local address that drops connection attempts: a
+// socket listening with a zero backlog whose single queue slot is taken,
+// so the kernel ignores further SYNs as a black-holed host would.
+func blackHoleAddr(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	// Fill the accept queue; nothing ever accepts.
+	for i := 0; i < 2; i++ {
+		if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}
+	return addr
+}
+
+func TestConnectTimeout(t *testing.T) {
+	addr := blackHoleAddr(t)
+	started := time.Now()
+	err := timeoutCall(context.Background(), "http://"+addr, MCPClientOptions{DialTimeout: 200 * time.Millisecond})
+	wantPhase(t, err, "connect", 200*time.Millisecond)
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("connect failed after %s, want about the 200ms dial timeout", elapsed)
+	}
+}
@@ -0,0 +1,120 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// timeoutCall makes one non-retried get_branch call to url with opts.
+func timeoutCall(ctx context.Context, url string, opts MCPClientOptions) error {
+	opts.MaxRetries = 1
+	client := NewMCPClientWithOptions(url, opts)
+	defer client.Close()
+	_, err := client.CallTool(ctx, "get_branch", map[string]any{"branch_id": "b1"})
+	return err
+}
+
+// wantPhase checks err is an MCPTimeoutError for phase with limit.
+func wantPhase(t *testing.T, err error, phase string, limit time.Duration) {
+	t.Helper()
+	var te MCPTimeoutError
+	if !errors.As(err, &te) || te.Phase != phase || te.Limit != limit {
+		t.Fatalf("err = %v, want an MCPTimeoutError for %s after %s", err, phase, limit)
+	}
+	if KindOf(err) != KindTransport || !isRetryable(err) {
+		t.Errorf("kind %q, retryable %v; want a retryable transport failure", KindOf(err), isRetryable(err))
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// A listener that accepts and never answers the ClientHello.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	err = timeoutCall(context.Background(), "https://"+ln.Addr().String(), MCPClientOptions{TLSHandshakeTimeout: 100 * time.Millisecond})
+	wantPhase(t, err, "TLS handshake", 100*time.Millisecond)
+}
+
+// slowBodyServer answers tools/call with its headers after headerDelay and
+// then trickles the body over bodyDelay.
+func slowBodyServer(t *testing.T, headerDelay, bodyDelay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		body, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"ok": true}}})
+		if req.Method != "tools/call" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+		select {
+		case <-time.After(headerDelay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		half := len(body) / 2
+		w.Write(body[:half])
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(bodyDelay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(body[half:])
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	srv := slowBodyServer(t, time.Second, 0)
+	err := timeoutCall(context.Background(), srv.URL, MCPClientOptions{ResponseHeaderTimeout: 100 * time.Millisecond})
+	wantPhase(t, err, "response headers", 100*time.Millisecond)
+}
+
+// TestSlowBody checks the response-header timeout does not cut a body that
+// takes longer, while the per-call deadline still covers the whole exchange.
+func TestSlowBody(t *testing.T) {
+	srv := slowBodyServer(t, 0, 300*time.Millisecond)
+	opts := MCPClientOptions{ResponseHeaderTimeout: 100 * time.Millisecond}
+	if err := timeoutCall(context.Background(), srv.URL, opts); err != nil {
+		t.Errorf("slow body after prompt headers: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	err := timeoutCall(ctx, srv.URL, opts)
+	var te MCPTimeoutError
+	if errors.As(err, &te) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the per-call deadline, not a transport timeout", err)
+	}
+}
@@ -0,0 +1,212 @@
+package tools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// pemFile holds the CA certificate.
+	pemFile string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, pemFile: filepath.Join(t.TempDir(), name+".pem")}
+	writePEM(t, ca.pemFile, "CERTIFICATE", der)
+	return ca
+}
+
+// issue signs a leaf certificate for 127.0.0.1 usable by servers and
+// clients.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeKeyPair stores cert and its key as PEM files and returns their paths.
+func writeKeyPair(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// newTLSMCP starts an MCP endpoint answering every request with an empty
+// result, serving cert; clientCAs, when set, requires client certificates
+// signed by it.
+func newTLSMCP(t *testing.T, cert tls.Certificate, clientCAs *testCA) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID any `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{"structuredContent": map[string]any{"ok": true}}})
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // rejected handshakes are expected
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCAs.cert)
+		srv.TLS.ClientCAs = pool
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// callOverTLS makes one tool call to url with conf.
+func callOverTLS(url string, conf *tls.Config) error {
+	client := NewMCPClientWithOptions(url, MCPClientOptions{MaxRetries: 1, TLS: conf})
+	defer client.Close()
+	_, err := client.CallTool(context.Background(), "get_branch", map[string]any{"branch_id": "b1"})
+	return err
+}
+
+func TestTLSCustomCA(t *testing.T) {
+	ca := newTestCA(t, "private-ca")
+	srv := newTLSMCP(t, ca.issue(t, "mcp"), nil)
+
+	conf, err := LoadTLSConfig(ca.pemFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callOverTLS(srv.URL, conf); err != nil {
+		t.Errorf("call with the private CA trusted: %v", err)
+	}
+
+	other := newTestCA(t, "other-ca")
+	conf, err = LoadTLSConfig(other.pemFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unknown x509.UnknownAuthorityError
+	if err := callOverTLS(srv.URL, conf); !errors.As(err, &unknown) {
+		t.Errorf("call trusting another CA: err = %v, want an unknown authority error", err)
+	}
+
+	conf, err = LoadTLSConfig("", "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callOverTLS(srv.URL, conf); err != nil {
+		t.Errorf("call with verification skipped: %v", err)
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t, "private-ca")
+	srv := newTLSMCP(t, ca.issue(t, "mcp"), ca)
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, "dev-agent"))
+
+	conf, err := LoadTLSConfig(ca.pemFile, certFile, keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callOverTLS(srv.URL, conf); err != nil {
+		t.Errorf("call with a client certificate: %v", err)
+	}
+
+	conf, err = LoadTLSConfig(ca.pemFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callOverTLS(srv.URL, conf); err == nil {
+		t.Error("call without a client certificate succeeded against a server requiring one")
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	ca := newTestCA(t, "private-ca")
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, "dev-agent"))
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	for _, c := range []struct {
+		name          string
+		ca, cert, key string
+	}{
+		{"cert without key", "", certFile, ""},
+		{"key without cert", "", "", keyFile},
+		{"missing CA file", filepath.Join(t.TempDir(), "missing.pem"), "", ""},
+		{"CA file without PEM", notPEM, "", ""},
+		{"mismatched pair", "", ca.pemFile, keyFile},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := LoadTLSConfig(c.ca, c.cert, c.key, false); err == nil {
+				t.Error("LoadTLSConfig succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"dev_agent/internal/logx"
+)
+
+// ArgumentError reports tools/call arguments that the tool's published
+// inputSchema rejects. It is raised before the request is sent, so it
+// usually means the client and the server disagree on a parameter name.
+type ArgumentError struct {
+	Tool     string
+	Property string
+	Problem  string
+}
+
+func (e ArgumentError) Error() string {
+	return fmt.Sprintf("%s arguments do not match the server schema: property %q %s", e.Tool, e.Property, e.Problem)
+}
+
+// cacheSchemas remembers the inputSchema of every listed tool for
+// checkServerArgs. A tool without a schema is not validated.
+func (c *MCPClient) cacheSchemas(tools []ServerTool) {
+	schemas := make(map[string]map[string]any, len(tools))
+	for _, t := range tools {
+		if t.InputSchema != nil {
+			schemas[t.Name] = t.InputSchema
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas = schemas
+}
+
+func (c *MCPClient) serverSchema(name string) map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.schemas[name]
+}
+
+// checkServerArgs checks tools/call arguments against the tool's published
+// inputSchema with the same per-property rules as validateArgs: required
+// properties, types, ranges and enums. Unknown properties are an error
+// only when the schema sets additionalProperties to false; otherwise they
+// are logged, since servers often publish incomplete schemas.
+func checkServerArgs(tool string, schema, arguments map[string]any) error {
+	// Round-trip through JSON so the values have the types the server sees
+	// ([]string becomes []any, int64 becomes float64).
+	var args map[string]any
+	if err := json.Unmarshal([]byte(toJSON(arguments)), &args); err != nil {
+		return nil
+	}
+	props, _ := schema["properties"].(map[string]any)
+	required, _ := schema["required"].([]any)
+	for _, r := range required {
+		name, _ := r.(string)
+		if v, ok := args[name]; name != "" && (!ok || v == nil) {
+			return ArgumentError{Tool: tool, Property: name, Problem: "is required but missing"}
+		}
+	}
+	closed := schema["additionalProperties"] == false
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw, known := props[name]
+		if !known {
+			if props == nil {
+				continue
+			}
+			if closed {
+				return ArgumentError{Tool: tool, Property: name, Problem: fmt.Sprintf("is not accepted (expected one of %s)", strings.Join(sortedKeys(props), ", "))}
+			}
+			logx.Debugf("MCP %s: argument %q is not in the server schema", tool, name)
+			continue
+		}
+		prop, _ := raw.(map[string]any)
+		if prop == nil || args[name] == nil {
+			continue
+		}
+		if problems := checkProperty(prop, args[name]); len(problems) > 0 {
+			return ArgumentError{Tool: tool, Property: name, Problem: strings.Join(problems, "; ")}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,85 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultStatusTimeout is check_status's polling timeout when neither the
+// call, ToolTimeouts.CheckStatus nor SetPollPolicy sets one.
+const defaultStatusTimeout = 1800 * time.Second
+
+// ToolTimeouts bounds whole tool calls, MCP requests and status polling
+// included, through a context deadline. Zero leaves a tool without a limit
+// of its own. CheckStatus is also check_status's default polling timeout,
+// so a branch still running at the limit is reported with its status
+// history.
+type ToolTimeouts struct {
+	ExecuteAgent time.Duration
+	CheckStatus  time.Duration
+	ReadArtifact time.Duration
+}
+
+func (tt ToolTimeouts) forTool(name string) time.Duration {
+	switch name {
+	case "execute_agent":
+		return tt.ExecuteAgent
+	case "check_status":
+		return tt.CheckStatus
+	case "read_artifact":
+		return tt.ReadArtifact
+	}
+	return 0
+}
+
+// SetToolTimeouts replaces the per-tool limits.
+func (h *ToolHandler) SetToolTimeouts(tt ToolTimeouts) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timeouts = tt
+}
+
+func (h *ToolHandler) toolTimeouts() ToolTimeouts {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.timeouts
+}
+
+// withToolTimeout applies the limit of tool name to ctx. The returned check
+// turns a failure caused by that deadline, rather than by the caller, into a
+// timeout error naming the tool and the limit.
+func (h *ToolHandler) withToolTimeout(ctx context.Context, name string) (context.Context, context.CancelFunc, func(error) error) {
+	limit := h.toolTimeouts().forTool(name)
+	if limit <= 0 {
+		return ctx, func() {}, func(err error) error { return err }
+	}
+	tctx, cancel := context.WithTimeout(ctx, limit)
+	check := func(err error) error {
+		if err == nil || ctx.Err() != nil || !errors.Is(tctx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+		var te ToolExecutionError
+		if errors.As(err, &te) && te.Code == CodeTimeout {
+			return err
+		}
+		details := map[string]any{
+			"tool":          name,
+			"limit_seconds": int(limit.Seconds()),
+			"cause":         err.Error(),
+		}
+		if name == "execute_agent" {
+			if latest := h.BranchRange()["latest_branch_id"]; latest != "" {
+				details["latest_branch_id"] = latest
+			}
+			details["hint"] = "A launched branch keeps running on the server; follow it with check_status or stop it with cancel_agent."
+		}
+		return ToolExecutionError{
+			Code:    CodeTimeout,
+			Msg:     fmt.Sprintf("%s exceeded its tool timeout of %s", name, limit),
+			Details: details,
+		}
+	}
+	return tctx, cancel, check
+}
@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowTool makes tool on the handler's fake server block until the test
+// ends, as a server that never answers it.
+func slowTool(t *testing.T, tool string) *ToolHandler {
+	h, srv := newTestHandler(t)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	srv.Handle(tool, func(map[string]any) (map[string]any, error) {
+		<-release
+		return map[string]any{}, nil
+	})
+	return h
+}
+
+func TestToolTimeouts(t *testing.T) {
+	const limit = 200 * time.Millisecond
+	cases := []struct {
+		tool     string
+		mcpTool  string
+		args     map[string]any
+		timeouts ToolTimeouts
+	}{
+		{"execute_agent", "parallel_explore", map[string]any{"agent": "claude_code", "prompt": "Implement it", "parent_branch_id": testParent}, ToolTimeouts{ExecuteAgent: limit}},
+		{"check_status", "get_branch", map[string]any{"branch_id": "b-1", "timeout_seconds": 60}, ToolTimeouts{CheckStatus: limit}},
+		{"read_artifact", "branch_read_file", map[string]any{"branch_id": "b-1", "path": "/home/dev/workspace/worklog.md"}, ToolTimeouts{ReadArtifact: limit}},
+	}
+	for _, c := range cases {
+		t.Run(c.tool, func(t *testing.T) {
+			h := slowTool(t, c.mcpTool)
+			h.SetToolTimeouts(c.timeouts)
+			start := time.Now()
+			result := callTool(h, c.tool, c.args)
+			if elapsed := time.Since(start); elapsed > limit+2*time.Second {
+				t.Errorf("returned after %s, want about %s", elapsed, limit)
+			}
+			code, details := mustFail(t, result)
+			_, msg, _, _ := ErrorInfo(result)
+			if code != CodeTimeout || details["tool"] != c.tool || details["limit_seconds"] != int(limit.Seconds()) {
+				t.Errorf("code %s, details %v; want a timeout naming %s", code, details, c.tool)
+			}
+			if want := c.tool + " exceeded its tool timeout of 200ms"; !strings.Contains(msg, want) {
+				t.Errorf("message %q, want %q", msg, want)
+			}
+			if cause, _ := details["cause"].(string); cause == "" {
+				t.Errorf("details %v carry no cause", details)
+			}
+		})
+	}
+}
+
+// TestToolTimeoutOnlyItsTool checks a limit applies to its own tool only
+// and that a caller's cancellation is not reported as a tool timeout.
+func TestToolTimeoutOnlyItsTool(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.SetToolTimeouts(ToolTimeouts{ReadArtifact: time.Nanosecond})
+	mustSucceed(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement it", "parent_branch_id": testParent}))
+
+	h = slowTool(t, "branch_read_file")
+	h.SetToolTimeouts(ToolTimeouts{ReadArtifact: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result := callToolCtx(ctx, h, "read_artifact", map[string]any{"branch_id": "b-1", "path": "/home/dev/workspace/worklog.md"})
+	if _, details := mustFail(t, result); details["tool"] != nil {
+		t.Errorf("details %v, want the caller's deadline rather than the tool timeout", details)
+	}
+}
+
+// TestCheckStatusDefaultTimeout checks ToolTimeouts.CheckStatus becomes the
+// polling timeout, which reports the branch's status history.
+func TestCheckStatusDefaultTimeout(t *testing.T) {
+	h, srv := newTestHandler(t)
+	srv.ScriptBranch("b-1", "running", "running", "running", "running", "running", "running", "running", "running", "running", "running")
+	h.SetToolTimeouts(ToolTimeouts{CheckStatus: 2 * time.Second})
+	start := time.Now()
+	code, details := mustFail(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "poll_interval_seconds": 1.5}))
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("returned after %s, want about 2s", elapsed)
+	}
+	if code != CodeTimeout || details["status_history"] == nil || details["tool"] != nil {
+		t.Errorf("code %s, details %v; want the polling timeout with its history", code, details)
+	}
+}
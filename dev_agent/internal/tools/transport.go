@@ -0,0 +1,64 @@
+package tools
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// MCPTransport carries JSON-RPC calls to an MCP server. Implementations own
+// the handshake and session handling and return the decoded result, or an
+// MCPRPCError for JSON-RPC error objects.
+type MCPTransport interface {
+	Call(ctx context.Context, method string, params map[string]any) (map[string]any, error)
+}
+
+type callTimeoutKey struct{}
+
+// withCallTimeout attaches a per-attempt timeout for transports that retry.
+// It is a value rather than a deadline so each attempt gets the full budget.
+func withCallTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, callTimeoutKey{}, d)
+}
+
+func callTimeout(ctx context.Context, def time.Duration) time.Duration {
+	if d, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok {
+		return d
+	}
+	return def
+}
+
+type requestIDKey struct{}
+
+// withRequestID attaches the id sent as X-Request-Id for one MCP call; its
+// retries, SSE resumes and any handshake it triggers reuse it.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// callLabel names method with its request id for log lines, e.g.
+// "tools/call [request_id=0f8e...]", so they can be matched to server logs.
+func callLabel(ctx context.Context, method string) string {
+	if id := requestIDFrom(ctx); id != "" {
+		return fmt.Sprintf("%s [request_id=%s]", method, id)
+	}
+	return method
+}
+
+// newUUID returns a random UUIDv4.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
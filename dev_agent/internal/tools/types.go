@@ -0,0 +1,276 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"dev_agent/internal/logx"
+)
+
+// MCPToolError is a tools/call result flagged isError: the server ran the
+// tool and the tool failed. Result is the normalized reply.
+type MCPToolError struct {
+	Tool   string
+	Result map[string]any
+}
+
+func (e MCPToolError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Tool, logx.Truncate(toJSON(e.Result), 300))
+}
+
+// toolFailed returns an MCPToolError when res is flagged isError.
+func toolFailed(tool string, res map[string]any) error {
+	if isErr, _ := res["isError"].(bool); isErr {
+		return MCPToolError{Tool: tool, Result: res}
+	}
+	return nil
+}
+
+// BranchInfo is a branch as reported by get_branch, parallel_explore or
+// list_branches. Status is lower-cased and empty when the server sent none.
+// Raw keeps the reply for fields not modelled here.
+type BranchInfo struct {
+	ID        string
+	ParentID  string
+	Agent     string
+	Status    string
+	Project   string
+	CreatedAt string
+	// IdempotencyKey is the key of the parallel_explore that created the
+	// branch, when the server records it.
+	IdempotencyKey string
+	Raw            map[string]any
+}
+
+// UnmarshalJSON accepts every branch shape seen so far (see branchWire).
+func (b *BranchInfo) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var w branchWire
+	if err := decodeInto(unwrapStructured(raw), &w); err != nil {
+		return err
+	}
+	*b = w.info()
+	b.Raw = raw
+	return nil
+}
+
+// ExploreResult is the decoded reply of parallel_explore. Raw keeps the
+// reply as sent.
+type ExploreResult struct {
+	Branches []BranchInfo
+	Raw      map[string]any
+}
+
+// UnmarshalJSON decodes and validates a reply like DecodeExploreResult.
+func (r *ExploreResult) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	out, err := DecodeExploreResult(raw)
+	if err != nil {
+		return err
+	}
+	*r = out
+	return nil
+}
+
+// ArtifactContent is a branch_read_file reply. Content is the text, from
+// "content" or "text" as named by Field; Base64 is content_base64 for binary
+// reads. TotalSize is the file size when the server reported one, and
+// Ranged reports whether it honoured offset/max_bytes. A reply too large to
+// hold in memory was spilled: File is then the local file with the content
+// and FileSize its size.
+type ArtifactContent struct {
+	Content   string
+	Field     string
+	Base64    string
+	TotalSize int
+	Ranged    bool
+	File      string
+	FileSize  int64
+	Raw       map[string]any
+}
+
+// UnmarshalJSON accepts the content under content, text or content_base64
+// and the size as total_size or size.
+func (a *ArtifactContent) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*a = artifactContent(raw)
+	return nil
+}
+
+func artifactContent(raw map[string]any) ArtifactContent {
+	a := ArtifactContent{Raw: raw}
+	if file, ok := raw["response_file"].(string); ok {
+		a.File = file
+		switch n := raw["response_bytes"].(type) {
+		case int64:
+			a.FileSize = n
+		case float64:
+			a.FileSize = int64(n)
+		}
+		return a
+	}
+	for _, k := range []string{"content", "text"} {
+		if s, ok := raw[k].(string); ok {
+			a.Content, a.Field = s, k
+			break
+		}
+	}
+	a.Base64, _ = raw["content_base64"].(string)
+	a.TotalSize, a.Ranged = sizeField(raw)
+	if _, has := raw["offset"]; has {
+		a.Ranged = true
+	}
+	return a
+}
+
+// branchWire accepts every branch shape seen so far: the id as branch_id or
+// id, the status as a string or a {state|value} object, and the fields
+// either inline or under "branch". Only the id is type-checked; the other
+// fields are taken when they are strings.
+type branchWire struct {
+	BranchID       string         `json:"branch_id"`
+	ID             string         `json:"id"`
+	Status         any            `json:"status"`
+	ParentBranchID any            `json:"parent_branch_id"`
+	ParentID       any            `json:"parent_id"`
+	Agent          any            `json:"agent"`
+	ProjectName    any            `json:"project_name"`
+	Project        any            `json:"project"`
+	CreatedAt      any            `json:"created_at"`
+	CreatedAtCamel any            `json:"createdAt"`
+	IdempotencyKey any            `json:"idempotency_key"`
+	Metadata       map[string]any `json:"metadata"`
+	Branch         *branchWire    `json:"branch"`
+}
+
+func (w *branchWire) info() BranchInfo {
+	b := BranchInfo{
+		ID:             firstNonEmpty(w.BranchID, w.ID),
+		Status:         normalizeStatus(w.Status),
+		ParentID:       firstNonEmpty(str(w.ParentBranchID), str(w.ParentID)),
+		Agent:          str(w.Agent),
+		Project:        firstNonEmpty(str(w.ProjectName), str(w.Project)),
+		CreatedAt:      firstNonEmpty(str(w.CreatedAt), str(w.CreatedAtCamel)),
+		IdempotencyKey: firstNonEmpty(str(w.IdempotencyKey), str(w.Metadata["idempotency_key"])),
+	}
+	if w.Branch != nil {
+		nested := w.Branch.info()
+		fill := func(dst *string, src string) {
+			if *dst == "" {
+				*dst = src
+			}
+		}
+		fill(&b.ID, nested.ID)
+		fill(&b.Status, nested.Status)
+		fill(&b.ParentID, nested.ParentID)
+		fill(&b.Agent, nested.Agent)
+		fill(&b.Project, nested.Project)
+		fill(&b.CreatedAt, nested.CreatedAt)
+		fill(&b.IdempotencyKey, nested.IdempotencyKey)
+	}
+	return b
+}
+
+// normalizeStatus lower-cases a status sent as a plain string or as an
+// object with a state/value member.
+func normalizeStatus(v any) string {
+	switch s := v.(type) {
+	case string:
+		return stringsTrimLower(s)
+	case map[string]any:
+		for _, k := range []string{"state", "value"} {
+			if st := stringsTrimLower(str(s[k])); st != "" {
+				return st
+			}
+		}
+	}
+	return ""
+}
+
+func str(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// DecodeExploreResult validates a parallel_explore reply. The branches may
+// be listed at the top level, under "parallel_explore", or the reply may be
+// a single branch; a structuredContent wrapper is unwrapped first.
+func DecodeExploreResult(resp map[string]any) (ExploreResult, error) {
+	const tool = "parallel_explore"
+	body := unwrapStructured(resp)
+	prefix := ""
+	if pe, ok := body["parallel_explore"].(map[string]any); ok {
+		body, prefix = pe, "parallel_explore."
+	}
+	var wire struct {
+		Branches []branchWire `json:"branches"`
+		branchWire
+	}
+	if err := decodeInto(body, &wire); err != nil {
+		return ExploreResult{}, schemaError(tool, prefix, err, resp)
+	}
+	out := ExploreResult{Raw: resp}
+	if len(wire.Branches) == 0 {
+		single := wire.branchWire.info()
+		if single.ID == "" {
+			return ExploreResult{}, &ResponseSchemaError{Tool: tool, Field: prefix + "branches", Problem: "is missing or empty", Raw: rawDump(resp)}
+		}
+		single.Raw = body
+		out.Branches = []BranchInfo{single}
+		return out, nil
+	}
+	items, _ := body["branches"].([]any)
+	for i := range wire.Branches {
+		b := wire.Branches[i].info()
+		if b.ID == "" {
+			return ExploreResult{}, &ResponseSchemaError{Tool: tool, Field: fmt.Sprintf("%sbranches[%d].branch_id", prefix, i), Problem: "is missing", Raw: rawDump(resp)}
+		}
+		if i < len(items) {
+			b.Raw, _ = items[i].(map[string]any)
+		}
+		out.Branches = append(out.Branches, b)
+	}
+	return out, nil
+}
+
+// DecodeBranch validates a get_branch reply: the id is required, at the top
+// level or under "branch".
+func DecodeBranch(resp map[string]any) (BranchInfo, error) {
+	const tool = "get_branch"
+	var wire branchWire
+	if err := decodeInto(unwrapStructured(resp), &wire); err != nil {
+		return BranchInfo{}, schemaError(tool, "", err, resp)
+	}
+	b := wire.info()
+	if b.ID == "" {
+		return BranchInfo{}, &ResponseSchemaError{Tool: tool, Field: "branch_id", Problem: "is missing (looked for branch_id, id and branch.id)", Raw: rawDump(resp)}
+	}
+	b.Raw = resp
+	return b, nil
+}
+
+// decodeArtifact turns a branch_read_file result into ArtifactContent.
+func decodeArtifact(res map[string]any) (ArtifactContent, error) {
+	if err := toolFailed("branch_read_file", res); err != nil {
+		return ArtifactContent{}, err
+	}
+	return artifactContent(res), nil
+}
@@ -0,0 +1,298 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// captureLogs collects logx output for the rest of the test.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	var buf syncBuffer
+	logx.SetOutput(&buf, &buf)
+	t.Cleanup(func() { logx.SetOutput(os.Stdout, os.Stderr) })
+	return &buf
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestDecodeBranchStatusShapes(t *testing.T) {
+	cases := []struct {
+		name   string
+		reply  map[string]any
+		id     string
+		status string
+	}{
+		{"flat string", map[string]any{"branch_id": "b-1", "status": "Running"}, "b-1", "running"},
+		{"nested branch", map[string]any{"branch": map[string]any{"id": "b-1", "status": "running", "parent_id": "p"}}, "b-1", "running"},
+		{"status object state", map[string]any{"id": "b-1", "status": map[string]any{"state": "RUNNING", "detail": "step 3/5"}}, "b-1", "running"},
+		{"status object value", map[string]any{"id": "b-1", "status": map[string]any{"value": "succeed"}}, "b-1", "succeed"},
+		{"inline wins over nested", map[string]any{"id": "b-1", "status": "failed", "branch": map[string]any{"status": "running"}}, "b-1", "failed"},
+		{"structured content", map[string]any{"structuredContent": map[string]any{"id": "b-1", "status": "pending"}}, "b-1", "pending"},
+		{"unrecognised status", map[string]any{"id": "b-1", "status": 3}, "b-1", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := DecodeBranch(c.reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.ID != c.id || b.Status != c.status {
+				t.Errorf("got id %q status %q, want %q %q", b.ID, b.Status, c.id, c.status)
+			}
+		})
+	}
+}
+
+// TestBranchInfoUnmarshal decodes every observed branch payload through
+// json.Unmarshal.
+func TestBranchInfoUnmarshal(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		want    BranchInfo
+	}{
+		{"flat", `{"branch_id": "b-1", "status": "Running", "parent_branch_id": "p-1", "agent": "codex", "project_name": "demo", "created_at": "2026-01-01T00:00:00Z"}`,
+			BranchInfo{ID: "b-1", Status: "running", ParentID: "p-1", Agent: "codex", Project: "demo", CreatedAt: "2026-01-01T00:00:00Z"}},
+		{"id variants", `{"id": "b-1", "parent_id": "p-1", "project": "demo", "createdAt": "2026-01-01T00:00:00Z"}`,
+			BranchInfo{ID: "b-1", ParentID: "p-1", Project: "demo", CreatedAt: "2026-01-01T00:00:00Z"}},
+		{"nested branch", `{"branch": {"id": "b-1", "status": {"state": "SUCCEED"}, "parent_branch_id": "p-1", "agent": "claude_code"}}`,
+			BranchInfo{ID: "b-1", Status: "succeed", ParentID: "p-1", Agent: "claude_code"}},
+		{"inline over nested", `{"branch_id": "b-1", "agent": "codex", "branch": {"id": "b-2", "agent": "claude_code", "project_name": "demo"}}`,
+			BranchInfo{ID: "b-1", Agent: "codex", Project: "demo"}},
+		{"structured content", `{"structuredContent": {"id": "b-1", "status": "pending"}}`,
+			BranchInfo{ID: "b-1", Status: "pending"}},
+		{"idempotency key", `{"id": "b-1", "idempotency_key": "k-1"}`, BranchInfo{ID: "b-1", IdempotencyKey: "k-1"}},
+		{"idempotency key in metadata", `{"id": "b-1", "metadata": {"idempotency_key": "k-1"}}`, BranchInfo{ID: "b-1", IdempotencyKey: "k-1"}},
+		{"non-string fields", `{"id": "b-1", "agent": 3, "parent_id": null, "status": ["running"]}`, BranchInfo{ID: "b-1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var b BranchInfo
+			if err := json.Unmarshal([]byte(c.payload), &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.Raw == nil {
+				t.Error("Raw is nil")
+			}
+			b.Raw = nil
+			if !reflect.DeepEqual(b, c.want) {
+				t.Errorf("got %+v, want %+v", b, c.want)
+			}
+		})
+	}
+}
+
+func TestExploreResultUnmarshal(t *testing.T) {
+	var res ExploreResult
+	if err := json.Unmarshal([]byte(`{"structuredContent": {"branches": [{"branch_id": "b-1"}, {"branch": {"id": "b-2", "status": "pending"}}]}}`), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Branches) != 2 || res.Branches[0].ID != "b-1" || res.Branches[1].ID != "b-2" || res.Branches[1].Status != "pending" {
+		t.Errorf("branches = %+v", res.Branches)
+	}
+	var schemaErr *ResponseSchemaError
+	if err := json.Unmarshal([]byte(`{"branches": []}`), &res); !errors.As(err, &schemaErr) {
+		t.Errorf("err = %v, want a ResponseSchemaError for an empty list", err)
+	}
+}
+
+func TestArtifactContentUnmarshal(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		want    ArtifactContent
+	}{
+		{"content", `{"content": "hello"}`, ArtifactContent{Content: "hello", Field: "content"}},
+		{"text", `{"text": "hello"}`, ArtifactContent{Content: "hello", Field: "text"}},
+		{"content wins over text", `{"content": "a", "text": "b"}`, ArtifactContent{Content: "a", Field: "content"}},
+		{"empty content", `{"content": ""}`, ArtifactContent{Field: "content"}},
+		{"base64", `{"content_base64": "aGk=", "size": 2}`, ArtifactContent{Base64: "aGk=", TotalSize: 2, Ranged: true}},
+		{"ranged", `{"content": "ell", "total_size": 5, "offset": 1}`, ArtifactContent{Content: "ell", Field: "content", TotalSize: 5, Ranged: true}},
+		{"offset only", `{"content": "ell", "offset": 1}`, ArtifactContent{Content: "ell", Field: "content", Ranged: true}},
+		{"spilled", `{"response_file": "/tmp/mcp-response-1.json", "response_bytes": 1048576, "content": "ignored"}`, ArtifactContent{File: "/tmp/mcp-response-1.json", FileSize: 1 << 20}},
+		{"no content", `{"path": "worklog.md"}`, ArtifactContent{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var a ArtifactContent
+			if err := json.Unmarshal([]byte(c.payload), &a); err != nil {
+				t.Fatal(err)
+			}
+			if a.Raw == nil {
+				t.Error("Raw is nil")
+			}
+			a.Raw = nil
+			if !reflect.DeepEqual(a, c.want) {
+				t.Errorf("got %+v, want %+v", a, c.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBranchMissingID(t *testing.T) {
+	_, err := DecodeBranch(map[string]any{"status": "running"})
+	var schemaErr *ResponseSchemaError
+	if err == nil || !strings.Contains(err.Error(), "branch_id") {
+		t.Fatalf("err = %v", err)
+	}
+	if !errors.As(err, &schemaErr) || schemaErr.Tool != "get_branch" {
+		t.Errorf("err = %#v, want a get_branch ResponseSchemaError", err)
+	}
+}
+
+// TestDecodeExploreResultShapes covers the parallel_explore replies seen in
+// production: a top-level branch id, a nested branch object and a
+// structuredContent wrapper, besides the usual branches list.
+func TestDecodeExploreResultShapes(t *testing.T) {
+	cases := []struct {
+		name  string
+		reply map[string]any
+		ids   []string
+	}{
+		{"top-level id", map[string]any{"branch_id": "b-1", "status": "pending"}, []string{"b-1"}},
+		{"nested branch", map[string]any{"branch": map[string]any{"id": "b-1", "status": "pending"}}, []string{"b-1"}},
+		{"structured content", map[string]any{"structuredContent": map[string]any{"branches": []any{map[string]any{"branch_id": "b-1"}, map[string]any{"id": "b-2"}}}}, []string{"b-1", "b-2"}},
+		{"branches list", map[string]any{"branches": []any{map[string]any{"branch": map[string]any{"id": "b-1"}}}}, []string{"b-1"}},
+		{"parallel_explore key", map[string]any{"parallel_explore": map[string]any{"branches": []any{map[string]any{"branch_id": "b-1"}}}}, []string{"b-1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res, err := DecodeExploreResult(c.reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, b := range res.Branches {
+				ids = append(ids, b.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+				t.Errorf("branch ids = %v, want %v", ids, c.ids)
+			}
+			if res.Raw == nil || res.Branches[0].Raw == nil {
+				t.Error("the raw reply was not kept")
+			}
+		})
+	}
+}
+
+func TestResponseSchemaErrors(t *testing.T) {
+	long := strings.Repeat("x", 2*maxSchemaDumpBytes)
+	cases := []struct {
+		name        string
+		decode      func(map[string]any) error
+		reply       map[string]any
+		tool, field string
+		problem     string
+	}{
+		{"explore without branches", exploreErr, map[string]any{"result": "ok", "padding": long}, "parallel_explore", "branches", "missing"},
+		{"explore branch without id", exploreErr, map[string]any{"branches": []any{map[string]any{"branch_id": "b-1"}, map[string]any{"status": "pending"}}}, "parallel_explore", "branches[1].branch_id", "missing"},
+		{"explore mistyped branches", exploreErr, map[string]any{"branches": "b-1"}, "parallel_explore", "branches", "has type string"},
+		{"explore mistyped nested id", exploreErr, map[string]any{"parallel_explore": map[string]any{"branch_id": 7}}, "parallel_explore", "parallel_explore.branch_id", "has type number"},
+		{"branch without id", branchErr, map[string]any{"status": "running"}, "get_branch", "branch_id", "missing"},
+		{"branch mistyped id", branchErr, map[string]any{"structuredContent": map[string]any{"id": true}}, "get_branch", "id", "has type bool"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var schemaErr *ResponseSchemaError
+			if err := c.decode(c.reply); !errors.As(err, &schemaErr) {
+				t.Fatalf("err = %v, want a ResponseSchemaError", err)
+			}
+			if schemaErr.Tool != c.tool || schemaErr.Field != c.field || !strings.Contains(schemaErr.Problem, c.problem) {
+				t.Errorf("err = %s %s %s, want %s %s ...%s...", schemaErr.Tool, schemaErr.Field, schemaErr.Problem, c.tool, c.field, c.problem)
+			}
+			if schemaErr.Raw == "" || len(schemaErr.Raw) > maxSchemaDumpBytes+100 {
+				t.Errorf("raw dump is %d bytes, want a truncated dump", len(schemaErr.Raw))
+			}
+		})
+	}
+}
+
+func exploreErr(reply map[string]any) error {
+	_, err := DecodeExploreResult(reply)
+	return err
+}
+
+func branchErr(reply map[string]any) error {
+	_, err := DecodeBranch(reply)
+	return err
+}
+
+// TestExecuteAgentInvalidResponse checks that a malformed parallel_explore
+// reply reaches the model as invalid_response naming the field.
+func TestExecuteAgentInvalidResponse(t *testing.T) {
+	h, srv := newTestHandler(t)
+	captureLogs(t)
+	srv.Respond("parallel_explore", map[string]any{"branches": []any{map[string]any{"state": "pending"}}})
+
+	code, details := mustFail(t, callTool(h, "execute_agent", map[string]any{"agent": "claude_code", "prompt": "Implement it", "parent_branch_id": testParent}))
+	if code != CodeInvalidResponse {
+		t.Errorf("code = %q, want %q", code, CodeInvalidResponse)
+	}
+	if details["tool"] != "parallel_explore" || details["field"] != "branches[0].branch_id" || !strings.Contains(fmt.Sprint(details["raw_response"]), `"state":"pending"`) {
+		t.Errorf("details = %v", details)
+	}
+}
+
+func TestCheckStatusFollowsNestedStatus(t *testing.T) {
+	h, srv := newTestHandler(t)
+	h.SetPollPolicy(PollPolicy{Initial: time.Millisecond, Max: 2 * time.Millisecond})
+	var mu sync.Mutex
+	polls := 0
+	replies := []map[string]any{
+		{"branch": map[string]any{"id": "b-1", "status": "running"}},
+		{"id": "b-1", "status": map[string]any{"state": "running"}},
+		{"branch": map[string]any{"id": "b-1", "status": "succeed"}},
+	}
+	srv.Handle("get_branch", func(map[string]any) (map[string]any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		r := replies[min(polls, len(replies)-1)]
+		polls++
+		return r, nil
+	})
+	data := mustSucceed(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1"}))
+	if data["terminal_status"] != TerminalSucceeded || polls != 3 {
+		t.Errorf("after %d polls: %v", polls, data)
+	}
+}
+
+func TestCheckStatusWarnsOnUnknownShape(t *testing.T) {
+	logs := captureLogs(t)
+	h, srv := newTestHandler(t)
+	h.SetPollPolicy(PollPolicy{Initial: time.Millisecond, Max: 2 * time.Millisecond})
+	srv.Respond("get_branch", map[string]any{"id": "b-1", "state_code": 7})
+	code, _ := mustFail(t, callTool(h, "check_status", map[string]any{"branch_id": "b-1", "timeout_seconds": 1}))
+	if code != CodeTimeout {
+		t.Errorf("code = %s, want %s", code, CodeTimeout)
+	}
+	if !strings.Contains(logs.String(), `no recognizable status field (attempt 1); raw shape: {"id":"b-1","state_code":7}`) {
+		t.Errorf("no warning with the raw shape:\n%s", logs)
+	}
+}
@@ -0,0 +1,74 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CodeUnknownTool marks a call to a tool name that is not registered.
+const CodeUnknownTool = "unknown_tool"
+
+// unknownToolError lists the registered tools and, when one is close enough
+// by edit distance, how to call it. defs are the handler's ToolDefinitions,
+// so the list never drifts from what the model was offered.
+func unknownToolError(name string, defs []map[string]any) ToolExecutionError {
+	supported := make([]any, 0, len(defs))
+	var (
+		best     map[string]any
+		bestName string
+		bestDist int
+	)
+	for _, def := range defs {
+		fn, _ := def["function"].(map[string]any)
+		candidate, _ := fn["name"].(string)
+		if candidate == "" {
+			continue
+		}
+		supported = append(supported, candidate)
+		dist := editDistance(strings.ToLower(name), candidate)
+		if best == nil || dist < bestDist {
+			best, bestName, bestDist = fn, candidate, dist
+		}
+	}
+
+	msg := fmt.Sprintf("Unsupported tool: %s. Supported tools: %s.", name, joinAny(supported))
+	details := map[string]any{"supported_tools": supported}
+	if best != nil && bestDist <= max(len(name), len(bestName))/2 {
+		usage := toolUsage(best)
+		msg += fmt.Sprintf(" Did you mean %s? %s", bestName, usage)
+		details["did_you_mean"] = map[string]any{"name": bestName, "usage": usage}
+	}
+	return ToolExecutionError{Msg: msg, Code: CodeUnknownTool, Details: details}
+}
+
+// toolUsage is a one-line hint: the description's first sentence plus the
+// required fields.
+func toolUsage(fn map[string]any) string {
+	desc, _ := fn["description"].(string)
+	for i := 0; ; {
+		j := strings.Index(desc[i:], ". ")
+		if j < 0 {
+			break
+		}
+		i += j + 1
+		// "e.g." and "i.e." do not end a sentence.
+		if !strings.HasSuffix(desc[:i], "e.g.") && !strings.HasSuffix(desc[:i], "i.e.") {
+			desc = desc[:i]
+			break
+		}
+	}
+	params, _ := fn["parameters"].(map[string]any)
+	required, _ := params["required"].([]any)
+	if len(required) == 0 {
+		return desc
+	}
+	return fmt.Sprintf("%s Required arguments: %s.", desc, joinAny(required))
+}
+
+func joinAny(items []any) string {
+	parts := make([]string, len(items))
+	for i, v := range items {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ", ")
+}
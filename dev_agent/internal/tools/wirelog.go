@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"dev_agent/internal/logx"
+)
+
+// wireEntry is one MCP exchange in the wire log.
+type wireEntry struct {
+	Time       time.Time      `json:"ts"`
+	Method     string         `json:"method"`
+	RequestID  any            `json:"id,omitempty"`
+	Params     any            `json:"params,omitempty"`
+	Headers    map[string]any `json:"headers,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	Body       string         `json:"body,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	DurationMS int64          `json:"duration_ms"`
+}
+
+const (
+	// wireLogQueue is how many entries may wait for the writer before new
+	// ones are dropped.
+	wireLogQueue = 256
+	// maxWireBodyBytes bounds the response body kept per entry.
+	maxWireBodyBytes = 64 * 1024
+	// DefaultWireLogMaxBytes is the size at which the wire log rotates.
+	DefaultWireLogMaxBytes = 50 * 1024 * 1024
+)
+
+// WireLog appends MCP requests and responses to a JSONL file. Writes happen
+// on a background goroutine and entries are dropped rather than blocking a
+// request when the writer falls behind. Registered secrets are redacted.
+// When the file exceeds maxBytes it is renamed to <path>.1 (replacing any
+// previous one) and a new file is started. A nil *WireLog records nothing.
+type WireLog struct {
+	path     string
+	maxBytes int64
+	ch       chan []byte
+	done     chan struct{}
+	once     sync.Once
+
+	f    *os.File
+	size int64
+}
+
+func NewWireLog(path string, maxBytes int64) (*WireLog, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultWireLogMaxBytes
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := &WireLog{path: path, maxBytes: maxBytes, ch: make(chan []byte, wireLogQueue), done: make(chan struct{}), f: f, size: st.Size()}
+	go w.run()
+	return w, nil
+}
+
+func (w *WireLog) record(e wireEntry) {
+	if w == nil {
+		return
+	}
+	if len(e.Body) > maxWireBodyBytes {
+		e.Body = logx.Truncate(e.Body, maxWireBodyBytes)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append([]byte(logx.Redact(string(line))), '\n')
+	select {
+	case w.ch <- line:
+	default:
+		logx.Debugf("MCP wire log queue full; dropping %s entry", e.Method)
+	}
+}
+
+func (w *WireLog) run() {
+	defer close(w.done)
+	for line := range w.ch {
+		if w.size+int64(len(line)) > w.maxBytes && w.size > 0 {
+			w.rotate()
+		}
+		if w.f == nil {
+			continue
+		}
+		n, err := w.f.Write(line)
+		w.size += int64(n)
+		if err != nil {
+			logx.Warningf("MCP wire log write failed: %v", err)
+		}
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+}
+
+func (w *WireLog) rotate() {
+	w.f.Close()
+	w.f = nil
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		logx.Warningf("MCP wire log rotation failed: %v", err)
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		logx.Warningf("MCP wire log reopen failed: %v", err)
+		return
+	}
+	w.f, w.size = f, 0
+}
+
+// Close flushes queued entries and closes the file.
+func (w *WireLog) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.once.Do(func() { close(w.ch) })
+	<-w.done
+	return nil
+}
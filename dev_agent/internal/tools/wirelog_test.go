@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dev_agent/internal/logx"
+	"dev_agent/internal/tools/mcptest"
+)
+
+// readJSONL decodes every line of path, failing on a torn one.
+func readJSONL(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []map[string]any
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var m map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("%s: line %q is not JSON: %v", path, sc.Text(), err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestWireLogRedaction(t *testing.T) {
+	const githubToken = "ghp_wirelogtestsecret0123456789"
+	const apiToken = "mcp-wirelog-test-api-token"
+	logx.RegisterSecret(githubToken)
+	logx.RegisterSecret(apiToken)
+
+	srv := mcptest.NewFakeServer()
+	t.Cleanup(srv.Close)
+	srv.Handle("echo", func(args map[string]any) (map[string]any, error) { return args, nil })
+	path := filepath.Join(t.TempDir(), "wire.jsonl")
+	wire, err := NewWireLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewMCPClientWithOptions(srv.URL, MCPClientOptions{MaxRetries: 1, APIToken: apiToken, WireLog: wire})
+	if _, err := client.CallTool(context.Background(), "echo", map[string]any{"prompt": "push with " + githubToken}); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	raw, _ := os.ReadFile(path)
+	for _, secret := range []string{githubToken, apiToken} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("wire log leaks %q:\n%s", secret, raw)
+		}
+	}
+	var call map[string]any
+	for _, e := range readJSONL(t, path) {
+		if e["method"] == "tools/call" {
+			call = e
+		}
+	}
+	if call == nil {
+		t.Fatalf("no tools/call entry in:\n%s", raw)
+	}
+	headers, _ := call["headers"].(map[string]any)
+	if headers["Authorization"] != "Bearer [REDACTED]" {
+		t.Errorf("Authorization header = %v", headers["Authorization"])
+	}
+	if !strings.Contains(call["body"].(string), "push with [REDACTED]") || !strings.Contains(toJSON(call["params"]), "push with [REDACTED]") {
+		t.Errorf("entry does not keep the redacted request and reply: %v", call)
+	}
+}
+
+func TestWireLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wire.jsonl")
+	const maxBytes = 2048
+	wire, err := NewWireLog(path, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const entries = 40
+	for i := 0; i < entries; i++ {
+		wire.record(wireEntry{Method: "tools/call", RequestID: float64(i), Body: strings.Repeat("x", 200)})
+	}
+	wire.Close()
+
+	current, previous := readJSONL(t, path), readJSONL(t, path+".1")
+	if len(current) == 0 || len(previous) == 0 {
+		t.Fatalf("%d entries in the log and %d in the rotated one, want both non-empty", len(current), len(previous))
+	}
+	for _, p := range []string{path, path + ".1"} {
+		if st, _ := os.Stat(p); st.Size() > maxBytes {
+			t.Errorf("%s is %d bytes, over the %d cap", p, st.Size(), maxBytes)
+		}
+	}
+	// The newest entries survive, in order, across the two files.
+	kept := append(previous, current...)
+	last := kept[len(kept)-1]["id"].(float64)
+	if last != entries-1 {
+		t.Errorf("last entry id = %v, want %d", last, entries-1)
+	}
+	for i := 1; i < len(kept); i++ {
+		if kept[i]["id"].(float64) != kept[i-1]["id"].(float64)+1 {
+			t.Fatalf("entries out of order around %v", kept[i]["id"])
+		}
+	}
+
+	// Reopening resumes from the existing file's size, so the cap holds.
+	wire, err = NewWireLog(path, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := entries; i < entries+5; i++ {
+		wire.record(wireEntry{Method: "tools/call", RequestID: float64(i), Body: strings.Repeat("x", 200)})
+	}
+	wire.Close()
+	if st, _ := os.Stat(path); st.Size() > maxBytes {
+		t.Errorf("after reopening the log is %d bytes, over the %d cap", st.Size(), maxBytes)
+	}
+	if got := readJSONL(t, path); got[len(got)-1]["id"].(float64) != entries+4 {
+		t.Errorf("last entry after reopening = %v", got[len(got)-1])
+	}
+}